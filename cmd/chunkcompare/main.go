@@ -0,0 +1,174 @@
+// Command chunkcompare compares the chunking strategies on a dataset.
+//
+// For each strategy it reports the chunk size distribution (mean, standard
+// deviation, coefficient of variation, chunks cut at the maximum size) and
+// edit resilience: how many new chunks a single random update, insert or
+// delete creates on average.
+//
+// The dataset is a file of key/value lines, either tab-separated
+// ("key<TAB>value") or JSON lines ({"key": "...", "value": "..."}) when the
+// file name ends in .jsonl. Without -input a synthetic dataset is used.
+//
+// Run with: go run ./cmd/chunkcompare -input data.tsv
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+)
+
+func main() {
+	input := flag.String("input", "", "dataset file (.tsv or .jsonl); synthetic data if empty")
+	target := flag.Uint("target", 4096, "target chunk size in bytes")
+	minSize := flag.Uint("min", 512, "minimum chunk size in bytes")
+	maxSize := flag.Uint("max", 16384, "maximum chunk size in bytes")
+	edits := flag.Int("edits", 200, "number of random edits for the resilience test")
+	seed := flag.Int64("seed", 1, "random seed for synthetic data and edits")
+	flag.Parse()
+
+	rng := rand.New(rand.NewSource(*seed))
+
+	var pairs []types.KVPair
+	var err error
+	if *input == "" {
+		pairs = syntheticPairs(rng, 50000)
+	} else {
+		pairs, err = loadPairs(*input)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(pairs) == 0 {
+		log.Fatal("dataset is empty")
+	}
+
+	randomEdits := generateEdits(rng, pairs, *edits)
+	fmt.Printf("%d pairs, %d edits, sizes %d/%d/%d (target/min/max)\n\n",
+		len(pairs), len(randomEdits), *target, *minSize, *maxSize)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "algorithm\tchunks\tmean\tstddev\tcv\tmin\tmax\tat max\tchunks/edit\tbytes/edit\t")
+	for _, name := range chunker.Algorithms {
+		c, err := chunker.New(name, uint32(*target), uint32(*minSize), uint32(*maxSize))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sizes := chunker.MeasureSizes(c.Chunk(pairs), int(*maxSize))
+		resilience := chunker.MeasureEdits(c, pairs, randomEdits)
+		fmt.Fprintf(w, "%s\t%d\t%.0f\t%.0f\t%.3f\t%d\t%d\t%d\t%.2f\t%.0f\t\n",
+			name, sizes.Chunks, sizes.Mean, sizes.StdDev, sizes.CoefficientOfVariation(),
+			sizes.Min, sizes.Max, sizes.AtMax, resilience.ChunksPerEdit, resilience.BytesPerEdit)
+	}
+	w.Flush()
+}
+
+// loadPairs reads a dataset file and returns its pairs sorted by key.
+// Later lines win for repeated keys.
+func loadPairs(path string) ([]types.KVPair, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string][]byte)
+	jsonLines := strings.HasSuffix(path, ".jsonl")
+	reader := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			key, value, parseErr := parseLine(bytes.TrimRight(line, "\r\n"), jsonLines)
+			if parseErr != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNo, parseErr)
+			}
+			values[key] = value
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pairs := make([]types.KVPair, 0, len(values))
+	for k, v := range values {
+		pairs = append(pairs, types.KVPair{Key: []byte(k), Value: v})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0
+	})
+	return pairs, nil
+}
+
+// parseLine parses one dataset line
+func parseLine(line []byte, jsonLines bool) (string, []byte, error) {
+	if jsonLines {
+		var record struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return "", nil, err
+		}
+		if record.Key == "" {
+			return "", nil, fmt.Errorf("missing key")
+		}
+		return record.Key, []byte(record.Value), nil
+	}
+
+	key, value, ok := bytes.Cut(line, []byte("\t"))
+	if !ok || len(key) == 0 {
+		return "", nil, fmt.Errorf("expected key<TAB>value")
+	}
+	return string(key), append([]byte(nil), value...), nil
+}
+
+// syntheticPairs returns n pairs with record-like keys and values of varied length
+func syntheticPairs(rng *rand.Rand, n int) []types.KVPair {
+	pairs := make([]types.KVPair, n)
+	for i := range pairs {
+		value := make([]byte, 20+rng.Intn(200))
+		for j := range value {
+			value[j] = 'a' + byte(rng.Intn(26))
+		}
+		pairs[i] = types.KVPair{Key: []byte(fmt.Sprintf("user:%08d", i)), Value: value}
+	}
+	return pairs
+}
+
+// generateEdits returns n random edits: a third each of value updates,
+// inserts of new keys and deletes
+func generateEdits(rng *rand.Rand, pairs []types.KVPair, n int) []chunker.Edit {
+	edits := make([]chunker.Edit, n)
+	for i := range edits {
+		existing := pairs[rng.Intn(len(pairs))]
+		value := make([]byte, 20+rng.Intn(200))
+		rng.Read(value)
+
+		switch i % 3 {
+		case 0:
+			edits[i] = chunker.Edit{Key: existing.Key, Value: value}
+		case 1:
+			key := append(append([]byte(nil), existing.Key...), fmt.Sprintf("~%d", i)...)
+			edits[i] = chunker.Edit{Key: key, Value: value}
+		default:
+			edits[i] = chunker.Edit{Key: existing.Key, Delete: true}
+		}
+	}
+	return edits
+}
@@ -2,4 +2,4 @@ module microprolly
 
 go 1.24.5
 
-require pgregory.net/rapid v1.2.0 // indirect
+require pgregory.net/rapid v1.2.0
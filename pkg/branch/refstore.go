@@ -0,0 +1,316 @@
+package branch
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"microprolly/pkg/types"
+)
+
+// RefStore persists branch and tag references and the HEAD state.
+// BranchManager, TagManager and HeadManager provide the file-backed
+// implementation; MemoryRefStore keeps everything in memory.
+type RefStore interface {
+	// CreateBranch creates a new branch pointing to the given commit
+	CreateBranch(name string, commitHash types.Hash) error
+	// GetBranch returns the commit hash a branch points to
+	GetBranch(name string) (types.Hash, error)
+	// BranchExists checks if a branch exists
+	BranchExists(name string) bool
+	// UpdateBranch updates an existing branch to point to a new commit
+	UpdateBranch(name string, commitHash types.Hash) error
+	// DeleteBranch removes a branch reference
+	DeleteBranch(name string) error
+	// ListBranches returns all branch names
+	ListBranches() ([]string, error)
+
+	// CreateTag creates a new tag pointing to the given hash
+	CreateTag(name string, hash types.Hash) error
+	// GetTag returns the hash a tag points to
+	GetTag(name string) (types.Hash, error)
+	// TagExists checks if a tag exists
+	TagExists(name string) bool
+	// UpdateTag points an existing tag at a new hash
+	UpdateTag(name string, hash types.Hash) error
+	// DeleteTag removes a tag reference
+	DeleteTag(name string) error
+	// ListTags returns all tag names
+	ListTags() ([]string, error)
+
+	// GetHead returns the current HEAD state
+	GetHead() (*HeadState, error)
+	// SetHeadToBranch sets HEAD to point to a branch (attached state)
+	SetHeadToBranch(name string) error
+	// SetHeadToCommit sets HEAD to point directly to a commit (detached state)
+	SetHeadToCommit(commitHash types.Hash) error
+	// InitializeHead points HEAD at defaultBranch if HEAD has never been set
+	InitializeHead(defaultBranch string) error
+}
+
+// FileRefStore is the file-backed RefStore, storing branches under
+// refs/heads/, tags under refs/tags/ and HEAD in the data directory
+type FileRefStore struct {
+	*BranchManager
+	*TagManager
+	*HeadManager
+}
+
+// NewFileRefStore creates a file-backed RefStore in dataDir
+func NewFileRefStore(dataDir string) (*FileRefStore, error) {
+	branchMgr, err := NewBranchManager(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	tagMgr, err := NewTagManager(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &FileRefStore{
+		BranchManager: branchMgr,
+		TagManager:    tagMgr,
+		HeadManager:   NewHeadManager(dataDir, branchMgr),
+	}, nil
+}
+
+// MemoryRefStore implements RefStore in memory.
+// It follows the same validation and conflict rules as the file-backed store.
+type MemoryRefStore struct {
+	mu       sync.RWMutex
+	branches map[string]types.Hash
+	tags     map[string]types.Hash
+	head     *HeadState // nil until HEAD is first set
+}
+
+// NewMemoryRefStore creates an empty in-memory RefStore
+func NewMemoryRefStore() *MemoryRefStore {
+	return &MemoryRefStore{
+		branches: make(map[string]types.Hash),
+		tags:     make(map[string]types.Hash),
+	}
+}
+
+// CreateBranch creates a new branch pointing to the given commit
+func (m *MemoryRefStore) CreateBranch(name string, commitHash types.Hash) error {
+	if err := ValidateBranchName(name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.branches[name]; exists {
+		return ErrBranchExists
+	}
+	if pathConflict(m.branches, name) {
+		return ErrBranchPathConflict
+	}
+
+	m.branches[name] = commitHash
+	return nil
+}
+
+// pathConflict reports whether name and an existing ref would be a file
+// and a directory in the file layout: "foo" and "foo/bar" cannot coexist
+func pathConflict(refs map[string]types.Hash, name string) bool {
+	for existing := range refs {
+		if strings.HasPrefix(name, existing+"/") || strings.HasPrefix(existing, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBranch returns the commit hash a branch points to
+func (m *MemoryRefStore) GetBranch(name string) (types.Hash, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	commitHash, exists := m.branches[name]
+	if !exists {
+		return types.Hash{}, ErrBranchNotFound
+	}
+	return commitHash, nil
+}
+
+// BranchExists checks if a branch exists
+func (m *MemoryRefStore) BranchExists(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, exists := m.branches[name]
+	return exists
+}
+
+// UpdateBranch updates a branch to point to a new commit
+func (m *MemoryRefStore) UpdateBranch(name string, commitHash types.Hash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.branches[name]; !exists {
+		return ErrBranchNotFound
+	}
+	m.branches[name] = commitHash
+	return nil
+}
+
+// DeleteBranch removes a branch reference
+func (m *MemoryRefStore) DeleteBranch(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.branches[name]; !exists {
+		return ErrBranchNotFound
+	}
+	delete(m.branches, name)
+	return nil
+}
+
+// ListBranches returns all branch names in sorted order
+func (m *MemoryRefStore) ListBranches() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	branches := make([]string, 0, len(m.branches))
+	for name := range m.branches {
+		branches = append(branches, name)
+	}
+	sort.Strings(branches)
+	return branches, nil
+}
+
+// CreateTag creates a new tag pointing to the given hash
+func (m *MemoryRefStore) CreateTag(name string, hash types.Hash) error {
+	if err := ValidateBranchName(name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.tags[name]; exists {
+		return ErrTagExists
+	}
+	if pathConflict(m.tags, name) {
+		return ErrTagPathConflict
+	}
+
+	m.tags[name] = hash
+	return nil
+}
+
+// GetTag returns the hash a tag points to
+func (m *MemoryRefStore) GetTag(name string) (types.Hash, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hash, exists := m.tags[name]
+	if !exists {
+		return types.Hash{}, ErrTagNotFound
+	}
+	return hash, nil
+}
+
+// TagExists checks if a tag exists
+func (m *MemoryRefStore) TagExists(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, exists := m.tags[name]
+	return exists
+}
+
+// UpdateTag points an existing tag at a new hash
+func (m *MemoryRefStore) UpdateTag(name string, hash types.Hash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.tags[name]; !exists {
+		return ErrTagNotFound
+	}
+	m.tags[name] = hash
+	return nil
+}
+
+// DeleteTag removes a tag reference
+func (m *MemoryRefStore) DeleteTag(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.tags[name]; !exists {
+		return ErrTagNotFound
+	}
+	delete(m.tags, name)
+	return nil
+}
+
+// ListTags returns all tag names in sorted order
+func (m *MemoryRefStore) ListTags() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tags := make([]string, 0, len(m.tags))
+	for name := range m.tags {
+		tags = append(tags, name)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// GetHead returns the current HEAD state.
+// Like the file-backed store, an unset HEAD defaults to the main branch.
+func (m *MemoryRefStore) GetHead() (*HeadState, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.head == nil {
+		return &HeadState{
+			IsDetached: false,
+			Branch:     "main",
+			CommitHash: m.branches["main"],
+		}, nil
+	}
+
+	state := *m.head
+	if !state.IsDetached {
+		// Resolve the branch on every read, as the HEAD file does
+		state.CommitHash = m.branches[state.Branch]
+	}
+	return &state, nil
+}
+
+// SetHeadToBranch sets HEAD to point to a branch (attached state)
+func (m *MemoryRefStore) SetHeadToBranch(name string) error {
+	if err := ValidateBranchName(name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.branches[name]; !exists {
+		return ErrBranchNotFound
+	}
+	m.head = &HeadState{IsDetached: false, Branch: name}
+	return nil
+}
+
+// SetHeadToCommit sets HEAD to point directly to a commit (detached state)
+func (m *MemoryRefStore) SetHeadToCommit(commitHash types.Hash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.head = &HeadState{IsDetached: true, CommitHash: commitHash}
+	return nil
+}
+
+// InitializeHead points HEAD at defaultBranch if HEAD has never been set
+func (m *MemoryRefStore) InitializeHead(defaultBranch string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.head == nil {
+		m.head = &HeadState{IsDetached: false, Branch: defaultBranch}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package branch
+
+import (
+	"os"
+	"testing"
+
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// refStoreImpls returns constructors for every RefStore implementation
+func refStoreImpls(t *testing.T) map[string]func() (RefStore, func()) {
+	return map[string]func() (RefStore, func()){
+		"file": func() (RefStore, func()) {
+			tmpDir, err := os.MkdirTemp("", "refstore-test-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs, err := NewFileRefStore(tmpDir)
+			if err != nil {
+				os.RemoveAll(tmpDir)
+				t.Fatal(err)
+			}
+			return refs, func() { os.RemoveAll(tmpDir) }
+		},
+		"memory": func() (RefStore, func()) {
+			return NewMemoryRefStore(), func() {}
+		},
+	}
+}
+
+// TestRefStore_BranchLifecycle tests that both implementations agree on
+// create, update, list, delete and conflict behaviour
+func TestRefStore_BranchLifecycle(t *testing.T) {
+	for name, newRefs := range refStoreImpls(t) {
+		t.Run(name, func(t *testing.T) {
+			refs, cleanup := newRefs()
+			defer cleanup()
+
+			h1 := types.HashFromBytes([]byte("one"))
+			h2 := types.HashFromBytes([]byte("two"))
+
+			if err := refs.CreateBranch("main", h1); err != nil {
+				t.Fatalf("CreateBranch failed: %v", err)
+			}
+			if err := refs.CreateBranch("main", h1); err != ErrBranchExists {
+				t.Fatalf("Expected ErrBranchExists, got %v", err)
+			}
+			if err := refs.CreateBranch("feature/x", h2); err != nil {
+				t.Fatalf("CreateBranch nested failed: %v", err)
+			}
+			// The file store reports the directory as existing, so only require rejection
+			if err := refs.CreateBranch("feature", h2); err == nil {
+				t.Fatal("Expected conflict creating parent of an existing branch")
+			}
+			if err := refs.CreateBranch("main/sub", h2); err != ErrBranchPathConflict {
+				t.Fatalf("Expected ErrBranchPathConflict, got %v", err)
+			}
+			if err := refs.CreateBranch("bad name", h1); err != ErrInvalidBranchName {
+				t.Fatalf("Expected ErrInvalidBranchName, got %v", err)
+			}
+
+			if err := refs.UpdateBranch("main", h2); err != nil {
+				t.Fatalf("UpdateBranch failed: %v", err)
+			}
+			if got, _ := refs.GetBranch("main"); got != h2 {
+				t.Fatal("UpdateBranch did not take effect")
+			}
+			if err := refs.UpdateBranch("missing", h2); err != ErrBranchNotFound {
+				t.Fatalf("Expected ErrBranchNotFound, got %v", err)
+			}
+
+			branches, err := refs.ListBranches()
+			if err != nil || len(branches) != 2 || branches[0] != "feature/x" || branches[1] != "main" {
+				t.Fatalf("ListBranches returned %v, %v", branches, err)
+			}
+
+			if err := refs.DeleteBranch("feature/x"); err != nil {
+				t.Fatalf("DeleteBranch failed: %v", err)
+			}
+			if refs.BranchExists("feature/x") {
+				t.Fatal("Branch still exists after delete")
+			}
+			if err := refs.CreateBranch("feature", h1); err != nil {
+				t.Fatalf("CreateBranch after conflict removed failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestRefStore_TagLifecycle tests that both implementations agree on tag
+// create, update, list, delete and conflict behaviour, and keep tags apart
+// from branches
+func TestRefStore_TagLifecycle(t *testing.T) {
+	for name, newRefs := range refStoreImpls(t) {
+		t.Run(name, func(t *testing.T) {
+			refs, cleanup := newRefs()
+			defer cleanup()
+
+			h1 := types.HashFromBytes([]byte("one"))
+			h2 := types.HashFromBytes([]byte("two"))
+
+			if err := refs.CreateBranch("v1", h1); err != nil {
+				t.Fatalf("CreateBranch failed: %v", err)
+			}
+			if err := refs.CreateTag("v1", h2); err != nil {
+				t.Fatalf("CreateTag with a branch's name failed: %v", err)
+			}
+			if got, err := refs.GetTag("v1"); err != nil || got != h2 {
+				t.Fatalf("GetTag returned %s, %v", got, err)
+			}
+			if got, _ := refs.GetBranch("v1"); got != h1 {
+				t.Fatal("CreateTag changed the branch of the same name")
+			}
+
+			if err := refs.CreateTag("v1", h1); err != ErrTagExists {
+				t.Fatalf("Expected ErrTagExists, got %v", err)
+			}
+			if err := refs.CreateTag("release/2.0", h1); err != nil {
+				t.Fatalf("CreateTag nested failed: %v", err)
+			}
+			if err := refs.CreateTag("v1/rc", h1); err != ErrTagPathConflict {
+				t.Fatalf("Expected ErrTagPathConflict, got %v", err)
+			}
+			if err := refs.CreateTag("bad name", h1); err != ErrInvalidBranchName {
+				t.Fatalf("Expected ErrInvalidBranchName, got %v", err)
+			}
+			if _, err := refs.GetTag("missing"); err != ErrTagNotFound {
+				t.Fatalf("Expected ErrTagNotFound, got %v", err)
+			}
+
+			if err := refs.UpdateTag("v1", h1); err != nil {
+				t.Fatalf("UpdateTag failed: %v", err)
+			}
+			if got, _ := refs.GetTag("v1"); got != h1 {
+				t.Fatal("UpdateTag did not take effect")
+			}
+			if err := refs.UpdateTag("missing", h1); err != ErrTagNotFound {
+				t.Fatalf("Expected ErrTagNotFound, got %v", err)
+			}
+
+			tags, err := refs.ListTags()
+			if err != nil || len(tags) != 2 || tags[0] != "release/2.0" || tags[1] != "v1" {
+				t.Fatalf("ListTags returned %v, %v", tags, err)
+			}
+
+			if err := refs.DeleteTag("release/2.0"); err != nil {
+				t.Fatalf("DeleteTag failed: %v", err)
+			}
+			if refs.TagExists("release/2.0") {
+				t.Fatal("Tag still exists after delete")
+			}
+			if err := refs.DeleteTag("release/2.0"); err != ErrTagNotFound {
+				t.Fatalf("Expected ErrTagNotFound, got %v", err)
+			}
+			if !refs.BranchExists("v1") {
+				t.Fatal("Tag operations removed a branch")
+			}
+		})
+	}
+}
+
+// TestProperty_RefStoreHeadTracking tests that HEAD resolves through the
+// branch it is attached to and stays fixed when detached, for both implementations
+func TestProperty_RefStoreHeadTracking(t *testing.T) {
+	for name, newRefs := range refStoreImpls(t) {
+		t.Run(name, func(t *testing.T) {
+			rapid.Check(t, func(rt *rapid.T) {
+				refs, cleanup := newRefs()
+				defer cleanup()
+
+				initial := genCommitHash().Draw(rt, "initial")
+				updated := genCommitHash().Draw(rt, "updated")
+				detached := genCommitHash().Draw(rt, "detached")
+
+				if err := refs.CreateBranch("main", initial); err != nil {
+					rt.Fatal(err)
+				}
+				if err := refs.InitializeHead("main"); err != nil {
+					rt.Fatal(err)
+				}
+
+				state, err := refs.GetHead()
+				if err != nil || state.IsDetached || state.Branch != "main" || state.CommitHash != initial {
+					rt.Fatalf("Unexpected initial HEAD %+v, %v", state, err)
+				}
+
+				// Attached HEAD follows branch updates
+				refs.UpdateBranch("main", updated)
+				state, _ = refs.GetHead()
+				if state.CommitHash != updated {
+					rt.Fatal("Attached HEAD did not follow branch update")
+				}
+
+				if err := refs.SetHeadToCommit(detached); err != nil {
+					rt.Fatal(err)
+				}
+				refs.UpdateBranch("main", initial)
+				state, _ = refs.GetHead()
+				if !state.IsDetached || state.Branch != "" || state.CommitHash != detached {
+					rt.Fatalf("Unexpected detached HEAD %+v", state)
+				}
+
+				// InitializeHead must not override an existing HEAD
+				refs.InitializeHead("main")
+				state, _ = refs.GetHead()
+				if !state.IsDetached {
+					rt.Fatal("InitializeHead overwrote existing HEAD")
+				}
+
+				if err := refs.SetHeadToBranch("missing"); err != ErrBranchNotFound {
+					rt.Fatalf("Expected ErrBranchNotFound, got %v", err)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package branch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"microprolly/pkg/types"
+)
+
+var (
+	// ErrTagExists is returned when attempting to create a tag that already exists
+	ErrTagExists = errors.New("tag already exists")
+	// ErrTagNotFound is returned when a tag does not exist
+	ErrTagNotFound = errors.New("tag not found")
+	// ErrTagPathConflict is returned when a tag name conflicts with an existing path
+	ErrTagPathConflict = errors.New("tag name conflicts with existing tag path")
+)
+
+// TagManager handles tag references. Tags are stored under refs/tags/ in
+// the same format as branches, and their names follow the branch name rules.
+type TagManager struct {
+	refs *BranchManager // Branch operations on the refs/tags/ directory
+}
+
+// NewTagManager creates a new TagManager
+func NewTagManager(dataDir string) (*TagManager, error) {
+	refsDir := filepath.Join(dataDir, "refs", "tags")
+	if err := os.MkdirAll(refsDir, 0755); err != nil {
+		return nil, err
+	}
+	return &TagManager{refs: &BranchManager{refsDir: refsDir}}, nil
+}
+
+// CreateTag creates a new tag pointing to the given hash
+func (tm *TagManager) CreateTag(name string, hash types.Hash) error {
+	return tagError(tm.refs.CreateBranch(name, hash))
+}
+
+// GetTag returns the hash a tag points to
+func (tm *TagManager) GetTag(name string) (types.Hash, error) {
+	hash, err := tm.refs.GetBranch(name)
+	return hash, tagError(err)
+}
+
+// TagExists checks if a tag exists
+func (tm *TagManager) TagExists(name string) bool {
+	return tm.refs.BranchExists(name)
+}
+
+// UpdateTag points an existing tag at a new hash
+func (tm *TagManager) UpdateTag(name string, hash types.Hash) error {
+	return tagError(tm.refs.UpdateBranch(name, hash))
+}
+
+// DeleteTag removes a tag reference
+func (tm *TagManager) DeleteTag(name string) error {
+	return tagError(tm.refs.DeleteBranch(name))
+}
+
+// ListTags returns all tag names
+func (tm *TagManager) ListTags() ([]string, error) {
+	return tm.refs.ListBranches()
+}
+
+// tagError translates the branch errors of the refs/tags/ directory
+func tagError(err error) error {
+	switch err {
+	case ErrBranchExists:
+		return ErrTagExists
+	case ErrBranchNotFound:
+		return ErrTagNotFound
+	case ErrBranchPathConflict:
+		return ErrTagPathConflict
+	}
+	return err
+}
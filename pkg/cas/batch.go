@@ -0,0 +1,112 @@
+package cas
+
+import (
+	"context"
+
+	"microprolly/pkg/types"
+)
+
+// BatchCAS extends CAS with context-aware and multi-object operations.
+// Backends that can pipeline or group work (remote stores, packs, memory)
+// implement it directly; any other CAS can be adapted with AsBatch.
+type BatchCAS interface {
+	CAS
+
+	// WriteContext stores data and returns its SHA-256 hash
+	WriteContext(ctx context.Context, data []byte) (types.Hash, error)
+	// ReadContext retrieves data by its hash
+	ReadContext(ctx context.Context, hash types.Hash) ([]byte, error)
+	// ExistsContext checks if a hash exists in storage
+	ExistsContext(ctx context.Context, hash types.Hash) (bool, error)
+
+	// WriteMany stores every object and returns their hashes in input order
+	WriteMany(ctx context.Context, data [][]byte) ([]types.Hash, error)
+	// ReadMany retrieves every object in input order.
+	// It fails with ErrHashNotFound if any hash is missing.
+	ReadMany(ctx context.Context, hashes []types.Hash) ([][]byte, error)
+	// HasMany reports, in input order, which hashes exist in storage
+	HasMany(ctx context.Context, hashes []types.Hash) ([]bool, error)
+}
+
+// AsBatch returns c as a BatchCAS. If c does not implement BatchCAS itself,
+// it is wrapped in an adapter that issues single-object calls in sequence
+// and checks for cancellation between them.
+func AsBatch(c CAS) BatchCAS {
+	if b, ok := c.(BatchCAS); ok {
+		return b
+	}
+	return batchAdapter{CAS: c}
+}
+
+// batchAdapter implements BatchCAS on top of a plain CAS
+type batchAdapter struct {
+	CAS
+}
+
+// WriteContext stores data unless ctx is already done
+func (a batchAdapter) WriteContext(ctx context.Context, data []byte) (types.Hash, error) {
+	if err := ctx.Err(); err != nil {
+		return types.Hash{}, err
+	}
+	return a.Write(data)
+}
+
+// ReadContext reads data unless ctx is already done
+func (a batchAdapter) ReadContext(ctx context.Context, hash types.Hash) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Read(hash)
+}
+
+// ExistsContext checks existence unless ctx is already done
+func (a batchAdapter) ExistsContext(ctx context.Context, hash types.Hash) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return a.Exists(hash), nil
+}
+
+// WriteMany writes each object in turn
+func (a batchAdapter) WriteMany(ctx context.Context, data [][]byte) ([]types.Hash, error) {
+	hashes := make([]types.Hash, len(data))
+	for i, d := range data {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		h, err := a.Write(d)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = h
+	}
+	return hashes, nil
+}
+
+// ReadMany reads each object in turn
+func (a batchAdapter) ReadMany(ctx context.Context, hashes []types.Hash) ([][]byte, error) {
+	result := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := a.Read(h)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = data
+	}
+	return result, nil
+}
+
+// HasMany checks each hash in turn
+func (a batchAdapter) HasMany(ctx context.Context, hashes []types.Hash) ([]bool, error) {
+	result := make([]bool, len(hashes))
+	for i, h := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result[i] = a.Exists(h)
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+package cas
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"microprolly/pkg/types"
+)
+
+// TestAsBatch_AdapterAndNative tests that plain and native batch backends
+// behave the same through the BatchCAS interface
+func TestAsBatch_AdapterAndNative(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "batch-cas-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileCAS, err := NewFileCAS(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := map[string]BatchCAS{
+		"file-adapter": AsBatch(fileCAS),
+		"memory":       AsBatch(NewMemoryCAS()),
+	}
+	if _, ok := backends["file-adapter"].(batchAdapter); !ok {
+		t.Fatal("FileCAS should be wrapped in the adapter")
+	}
+	if _, ok := backends["memory"].(*MemoryCAS); !ok {
+		t.Fatal("MemoryCAS should be used directly")
+	}
+
+	ctx := context.Background()
+	data := [][]byte{[]byte("a"), []byte("b"), []byte("a")}
+
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			hashes, err := b.WriteMany(ctx, data)
+			if err != nil {
+				t.Fatalf("WriteMany failed: %v", err)
+			}
+			if hashes[0] != hashes[2] || hashes[0] != types.HashFromBytes([]byte("a")) {
+				t.Fatal("WriteMany returned unexpected hashes")
+			}
+
+			read, err := b.ReadMany(ctx, hashes)
+			if err != nil {
+				t.Fatalf("ReadMany failed: %v", err)
+			}
+			for i := range data {
+				if string(read[i]) != string(data[i]) {
+					t.Fatalf("ReadMany[%d] = %q, want %q", i, read[i], data[i])
+				}
+			}
+
+			missing := types.HashFromBytes([]byte("missing"))
+			has, err := b.HasMany(ctx, []types.Hash{hashes[1], missing})
+			if err != nil || !has[0] || has[1] {
+				t.Fatalf("HasMany returned %v, %v", has, err)
+			}
+			if _, err := b.ReadMany(ctx, []types.Hash{hashes[0], missing}); err != ErrHashNotFound {
+				t.Fatalf("Expected ErrHashNotFound, got %v", err)
+			}
+
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			if _, err := b.ReadMany(cancelled, hashes); err != context.Canceled {
+				t.Fatalf("Expected context.Canceled from ReadMany, got %v", err)
+			}
+			if _, err := b.WriteContext(cancelled, []byte("c")); err != context.Canceled {
+				t.Fatalf("Expected context.Canceled from WriteContext, got %v", err)
+			}
+		})
+	}
+}
@@ -2,10 +2,12 @@ package cas
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"microprolly/pkg/types"
 )
@@ -15,6 +17,15 @@ var (
 	ErrHashNotFound = errors.New("hash not found in storage")
 )
 
+// AddressedWriter is implemented by backends that can store data under a
+// hash the caller computed. Wrappers that transform content before storing
+// it, such as EncryptedCAS, use it to keep objects addressed by the hash of
+// their original content. The backend does not check data against hash.
+type AddressedWriter interface {
+	// WriteAddressed stores data under hash unless the hash already exists
+	WriteAddressed(hash types.Hash, data []byte) error
+}
+
 // CAS provides content-addressed storage operations
 type CAS interface {
 	// Write stores data and returns its SHA-256 hash
@@ -56,10 +67,17 @@ func (c *FileCAS) objectPath(hash types.Hash) string {
 // If the data already exists (same hash), it skips writing and returns the existing hash
 func (c *FileCAS) Write(data []byte) (types.Hash, error) {
 	hash := sha256.Sum256(data)
+	if err := c.WriteAddressed(hash, data); err != nil {
+		return types.Hash{}, err
+	}
+	return hash, nil
+}
 
+// WriteAddressed stores data under hash unless the hash already exists
+func (c *FileCAS) WriteAddressed(hash types.Hash, data []byte) error {
 	// Check if already exists (deduplication)
 	if c.Exists(hash) {
-		return hash, nil
+		return nil
 	}
 
 	objPath := c.objectPath(hash)
@@ -67,13 +85,13 @@ func (c *FileCAS) Write(data []byte) (types.Hash, error) {
 	// Create subdirectory if needed
 	dir := filepath.Dir(objPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return types.Hash{}, err
+		return err
 	}
 
 	// Atomic write: write to temp file, sync, then rename
 	tmpFile, err := os.CreateTemp(dir, ".tmp-*")
 	if err != nil {
-		return types.Hash{}, err
+		return err
 	}
 	tmpPath := tmpFile.Name()
 
@@ -82,29 +100,29 @@ func (c *FileCAS) Write(data []byte) (types.Hash, error) {
 	if err != nil {
 		tmpFile.Close()
 		os.Remove(tmpPath)
-		return types.Hash{}, err
+		return err
 	}
 
 	// Sync to ensure data is written to disk before rename - this blocks until is written makes it sync
 	if err := tmpFile.Sync(); err != nil {
 		tmpFile.Close()
 		os.Remove(tmpPath)
-		return types.Hash{}, err
+		return err
 	}
 
 	// Close before rename
 	if err := tmpFile.Close(); err != nil {
 		os.Remove(tmpPath)
-		return types.Hash{}, err
+		return err
 	}
 
 	// Atomic rename
 	if err := os.Rename(tmpPath, objPath); err != nil {
 		os.Remove(tmpPath)
-		return types.Hash{}, err
+		return err
 	}
 
-	return hash, nil
+	return nil
 }
 
 // Read retrieves data by its hash
@@ -134,3 +152,56 @@ func (c *FileCAS) Exists(hash types.Hash) bool {
 func (c *FileCAS) Close() error {
 	return nil
 }
+
+// ForEach calls fn with the hash of every loose object in storage.
+// Iteration stops at the first error returned by fn.
+func (c *FileCAS) ForEach(fn func(types.Hash) error) error {
+	objectsDir := filepath.Join(c.baseDir, "objects")
+
+	subdirs, err := os.ReadDir(objectsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subdirs {
+		if !sub.IsDir() || len(sub.Name()) != 2 {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(objectsDir, sub.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			// Skip temp files and anything that is not a hash
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			hashBytes, err := hex.DecodeString(sub.Name() + f.Name())
+			if err != nil || len(hashBytes) != 32 {
+				continue
+			}
+
+			var hash types.Hash
+			copy(hash[:], hashBytes)
+			if err := fn(hash); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove deletes a loose object from storage
+func (c *FileCAS) Remove(hash types.Hash) error {
+	err := os.Remove(c.objectPath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Clean up the subdirectory if it is now empty
+	os.Remove(filepath.Dir(c.objectPath(hash)))
+	return nil
+}
@@ -0,0 +1,252 @@
+package cas
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"microprolly/pkg/types"
+)
+
+// EncryptionMode selects how EncryptedCAS chooses nonces
+type EncryptionMode string
+
+const (
+	// ConvergentEncryption derives each nonce from the object's hash, so the
+	// same object always encrypts to the same bytes under a key. Copies of
+	// a store stay byte-identical, at the cost of revealing equal objects.
+	ConvergentEncryption EncryptionMode = "convergent"
+	// RandomNonceEncryption draws a fresh random nonce for every write
+	RandomNonceEncryption EncryptionMode = "random"
+)
+
+// EncryptionKeySize is the size of the keys a KeyProvider must return (AES-256)
+const EncryptionKeySize = 32
+
+const (
+	// sealedHeaderSize is the size of a sealed object header: mode byte + nonce
+	sealedHeaderSize = 1 + 12
+	// sealedConvergent and sealedRandom are the mode bytes of sealed objects
+	sealedConvergent = 1
+	sealedRandom     = 2
+)
+
+var (
+	// ErrInvalidEncryptionKey is returned when a key provider returns a key
+	// of the wrong size
+	ErrInvalidEncryptionKey = errors.New("encryption key must be 32 bytes")
+	// ErrDecryptionFailed is returned when an object cannot be decrypted:
+	// the key is wrong or the stored bytes were modified
+	ErrDecryptionFailed = errors.New("object decryption failed")
+	// ErrAddressedWriteUnsupported is returned when EncryptedCAS wraps a
+	// backend that cannot store objects under a given hash
+	ErrAddressedWriteUnsupported = errors.New("object store cannot write under a given hash")
+)
+
+// KeyProvider supplies the key objects are encrypted with, for example
+// from a key management service or a file outside the data directory
+type KeyProvider interface {
+	// Key returns the EncryptionKeySize-byte master key
+	Key() ([]byte, error)
+}
+
+// StaticKey is a KeyProvider holding the key itself
+type StaticKey []byte
+
+// Key returns the key
+func (k StaticKey) Key() ([]byte, error) {
+	return k, nil
+}
+
+// KeyProviderFunc adapts a function to a KeyProvider
+type KeyProviderFunc func() ([]byte, error)
+
+// Key calls f
+func (f KeyProviderFunc) Key() ([]byte, error) {
+	return f()
+}
+
+// EncryptedCAS encrypts object contents with AES-GCM before storing them in
+// another CAS. Objects keep the SHA-256 hash of their plaintext as their
+// address, so tree links are unchanged; the hash is also authenticated with
+// the ciphertext, so an object cannot be swapped for another. Addresses are
+// not secret: anyone with the store can test whether it holds a known object.
+//
+// Sealed objects are stored as [1 mode][12 nonce][ciphertext + tag].
+type EncryptedCAS struct {
+	inner    CAS
+	writer   AddressedWriter
+	aead     cipher.AEAD
+	nonceKey []byte
+	keyCheck string
+	mode     EncryptionMode
+}
+
+// NewEncryptedCAS wraps inner, encrypting with the key from keys.
+// inner must implement AddressedWriter.
+func NewEncryptedCAS(inner CAS, keys KeyProvider, mode EncryptionMode) (*EncryptedCAS, error) {
+	writer, ok := inner.(AddressedWriter)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrAddressedWriteUnsupported, inner)
+	}
+	if mode != ConvergentEncryption && mode != RandomNonceEncryption {
+		return nil, fmt.Errorf("unknown encryption mode %q", mode)
+	}
+
+	key, err := providedKey(keys)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(deriveKey(key, "object encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedCAS{
+		inner:    inner,
+		writer:   writer,
+		aead:     aead,
+		nonceKey: deriveKey(key, "convergent nonce"),
+		keyCheck: keyCheck(key),
+		mode:     mode,
+	}, nil
+}
+
+// KeyCheck returns a short value identifying the key in use. It is safe
+// to store next to the data and lets a wrong key be detected on open.
+func (e *EncryptedCAS) KeyCheck() string {
+	return e.keyCheck
+}
+
+// KeyCheckFor returns the KeyCheck of the key from keys without opening a store
+func KeyCheckFor(keys KeyProvider) (string, error) {
+	key, err := providedKey(keys)
+	if err != nil {
+		return "", err
+	}
+	return keyCheck(key), nil
+}
+
+// Write encrypts data and stores it under the hash of the plaintext
+func (e *EncryptedCAS) Write(data []byte) (types.Hash, error) {
+	hash := sha256.Sum256(data)
+	if e.inner.Exists(hash) {
+		return hash, nil
+	}
+
+	sealed, err := e.seal(hash, data)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	if err := e.writer.WriteAddressed(hash, sealed); err != nil {
+		return types.Hash{}, err
+	}
+	return hash, nil
+}
+
+// Read retrieves and decrypts the object stored under hash
+func (e *EncryptedCAS) Read(hash types.Hash) ([]byte, error) {
+	sealed, err := e.inner.Read(hash)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(hash, sealed)
+}
+
+// Exists checks if a hash exists in storage
+func (e *EncryptedCAS) Exists(hash types.Hash) bool {
+	return e.inner.Exists(hash)
+}
+
+// Sync flushes the wrapped CAS if it buffers durability
+func (e *EncryptedCAS) Sync() error {
+	if syncer, ok := e.inner.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Repack moves the loose objects of a wrapped PackCAS into packs. Objects
+// are moved sealed, after checking that each one opens under its hash.
+func (e *EncryptedCAS) Repack() (int, error) {
+	packs, ok := e.inner.(*PackCAS)
+	if !ok {
+		return 0, ErrRepackUnsupported
+	}
+	return packs.repack(func(hash types.Hash, sealed []byte) error {
+		_, err := e.open(hash, sealed)
+		return err
+	})
+}
+
+// Close closes the wrapped CAS
+func (e *EncryptedCAS) Close() error {
+	return e.inner.Close()
+}
+
+// seal encrypts data, authenticating its hash with it
+func (e *EncryptedCAS) seal(hash types.Hash, data []byte) ([]byte, error) {
+	sealed := make([]byte, sealedHeaderSize, sealedHeaderSize+len(data)+e.aead.Overhead())
+	nonce := sealed[1:sealedHeaderSize]
+
+	if e.mode == ConvergentEncryption {
+		sealed[0] = sealedConvergent
+		mac := hmac.New(sha256.New, e.nonceKey)
+		mac.Write(hash[:])
+		copy(nonce, mac.Sum(nil))
+	} else {
+		sealed[0] = sealedRandom
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.aead.Seal(sealed, nonce, data, hash[:]), nil
+}
+
+// open decrypts a sealed object. Objects written in either mode can be read.
+func (e *EncryptedCAS) open(hash types.Hash, sealed []byte) ([]byte, error) {
+	if len(sealed) < sealedHeaderSize+e.aead.Overhead() ||
+		(sealed[0] != sealedConvergent && sealed[0] != sealedRandom) {
+		return nil, fmt.Errorf("%w: object %s is not a sealed object", ErrDecryptionFailed, hash.String())
+	}
+
+	data, err := e.aead.Open(nil, sealed[1:sealedHeaderSize], sealed[sealedHeaderSize:], hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: object %s", ErrDecryptionFailed, hash.String())
+	}
+	return data, nil
+}
+
+// providedKey fetches and checks the key from a provider
+func providedKey(keys KeyProvider) ([]byte, error) {
+	key, err := keys.Key()
+	if err != nil {
+		return nil, fmt.Errorf("fetching encryption key: %w", err)
+	}
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("%w: got %d bytes", ErrInvalidEncryptionKey, len(key))
+	}
+	return key, nil
+}
+
+// deriveKey derives an independent subkey for one purpose from the master key
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("microprolly " + purpose))
+	return mac.Sum(nil)
+}
+
+// keyCheck returns the hex-encoded first 8 bytes of the key's check subkey
+func keyCheck(key []byte) string {
+	return hex.EncodeToString(deriveKey(key, "key check")[:8])
+}
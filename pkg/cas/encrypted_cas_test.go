@@ -0,0 +1,178 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"pgregory.net/rapid"
+)
+
+// testKey returns a deterministic 32-byte key
+func testKey(seed byte) StaticKey {
+	return StaticKey(bytes.Repeat([]byte{seed}, EncryptionKeySize))
+}
+
+// TestProperty_EncryptedCASRoundTrip tests that objects read back unchanged
+// in both modes, addressed by their plaintext hash
+func TestProperty_EncryptedCASRoundTrip(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		mode := rapid.SampledFrom([]EncryptionMode{ConvergentEncryption, RandomNonceEncryption}).Draw(t, "mode")
+		data := rapid.SliceOfN(rapid.Byte(), 0, 1000).Draw(t, "data")
+
+		enc, err := NewEncryptedCAS(NewMemoryCAS(), testKey(1), mode)
+		if err != nil {
+			t.Fatalf("NewEncryptedCAS failed: %v", err)
+		}
+		hash, err := enc.Write(data)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if hash != sha256.Sum256(data) {
+			t.Fatal("address is not the plaintext hash")
+		}
+		got, err := enc.Read(hash)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("Read returned different data")
+		}
+	})
+}
+
+// TestEncryptedCAS_StoresCiphertext tests that the wrapped store never holds
+// the plaintext and that each mode's nonces behave as documented
+func TestEncryptedCAS_StoresCiphertext(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("patient record "), 20)
+
+	sealedBy := func(mode EncryptionMode) []byte {
+		inner := NewMemoryCAS()
+		enc, err := NewEncryptedCAS(inner, testKey(1), mode)
+		if err != nil {
+			t.Fatalf("NewEncryptedCAS failed: %v", err)
+		}
+		hash, err := enc.Write(plaintext)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		sealed, err := inner.Read(hash)
+		if err != nil {
+			t.Fatalf("inner Read failed: %v", err)
+		}
+		if bytes.Contains(sealed, []byte("patient")) {
+			t.Fatalf("%s: stored object contains the plaintext", mode)
+		}
+		return sealed
+	}
+
+	if !bytes.Equal(sealedBy(ConvergentEncryption), sealedBy(ConvergentEncryption)) {
+		t.Error("convergent encryption produced different ciphertexts for the same object")
+	}
+	if bytes.Equal(sealedBy(RandomNonceEncryption), sealedBy(RandomNonceEncryption)) {
+		t.Error("random-nonce encryption produced the same ciphertext twice")
+	}
+}
+
+// TestEncryptedCAS_RejectsWrongKeyAndTampering tests that objects only
+// decrypt with the right key, unmodified and under their own address
+func TestEncryptedCAS_RejectsWrongKeyAndTampering(t *testing.T) {
+	inner := NewMemoryCAS()
+	enc, err := NewEncryptedCAS(inner, testKey(1), ConvergentEncryption)
+	if err != nil {
+		t.Fatalf("NewEncryptedCAS failed: %v", err)
+	}
+	hashA, _ := enc.Write([]byte("object a"))
+	hashB, _ := enc.Write([]byte("object b"))
+
+	wrong, err := NewEncryptedCAS(inner, testKey(2), ConvergentEncryption)
+	if err != nil {
+		t.Fatalf("NewEncryptedCAS failed: %v", err)
+	}
+	if wrong.KeyCheck() == enc.KeyCheck() {
+		t.Error("different keys have the same key check")
+	}
+	if _, err := wrong.Read(hashA); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Read with the wrong key returned %v", err)
+	}
+
+	// The sealed bytes of one object stored under another's address
+	sealedA, _ := inner.Read(hashA)
+	swapped := NewMemoryCAS()
+	swapped.WriteAddressed(hashB, sealedA)
+	swappedEnc, _ := NewEncryptedCAS(swapped, testKey(1), ConvergentEncryption)
+	if _, err := swappedEnc.Read(hashB); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Read of a swapped object returned %v", err)
+	}
+
+	tampered := append([]byte(nil), sealedA...)
+	tampered[len(tampered)-1] ^= 1
+	corrupt := NewMemoryCAS()
+	corrupt.WriteAddressed(hashA, tampered)
+	corruptEnc, _ := NewEncryptedCAS(corrupt, testKey(1), ConvergentEncryption)
+	if _, err := corruptEnc.Read(hashA); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Read of a modified object returned %v", err)
+	}
+}
+
+// TestNewEncryptedCAS_Errors tests the constructor's checks
+func TestNewEncryptedCAS_Errors(t *testing.T) {
+	if _, err := NewEncryptedCAS(NewMemoryCAS(), StaticKey("short"), ConvergentEncryption); !errors.Is(err, ErrInvalidEncryptionKey) {
+		t.Errorf("short key returned %v, expected ErrInvalidEncryptionKey", err)
+	}
+	if _, err := NewEncryptedCAS(NewTrackingCAS(NewMemoryCAS()), testKey(1), ConvergentEncryption); !errors.Is(err, ErrAddressedWriteUnsupported) {
+		t.Errorf("plain CAS returned %v, expected ErrAddressedWriteUnsupported", err)
+	}
+	if _, err := NewEncryptedCAS(NewMemoryCAS(), testKey(1), "rot13"); err == nil {
+		t.Error("expected an unknown mode to be rejected")
+	}
+
+	failing := KeyProviderFunc(func() ([]byte, error) { return nil, errors.New("vault sealed") })
+	if _, err := NewEncryptedCAS(NewMemoryCAS(), failing, ConvergentEncryption); err == nil {
+		t.Error("expected a key provider error to be returned")
+	}
+}
+
+// TestEncryptedCAS_Repack tests that Repack moves the wrapped store's loose
+// objects into packs still sealed, and fails over a store without packs
+func TestEncryptedCAS_Repack(t *testing.T) {
+	dir := t.TempDir()
+	loose, err := NewFileCAS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := NewEncryptedCAS(loose, testKey(1), ConvergentEncryption)
+	if err != nil {
+		t.Fatalf("NewEncryptedCAS failed: %v", err)
+	}
+	hash, err := enc.Write([]byte("loose record"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := enc.Repack(); !errors.Is(err, ErrRepackUnsupported) {
+		t.Errorf("Repack over a FileCAS returned %v, expected ErrRepackUnsupported", err)
+	}
+	enc.Close()
+
+	packs, err := NewPackCAS(dir, DefaultPackOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err = NewEncryptedCAS(packs, testKey(1), ConvergentEncryption)
+	if err != nil {
+		t.Fatalf("NewEncryptedCAS failed: %v", err)
+	}
+	defer enc.Close()
+
+	moved, err := enc.Repack()
+	if err != nil || moved != 1 {
+		t.Fatalf("Repack = %d, %v; expected 1 object moved", moved, err)
+	}
+	if _, packed := packs.index[hash]; !packed {
+		t.Error("expected the loose object to be packed")
+	}
+	if data, err := enc.Read(hash); err != nil || string(data) != "loose record" {
+		t.Errorf("Read after Repack returned %q, %v", data, err)
+	}
+}
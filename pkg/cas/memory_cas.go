@@ -0,0 +1,160 @@
+package cas
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	"microprolly/pkg/types"
+)
+
+// MemoryCAS implements CAS in memory.
+// It is safe for concurrent use and is intended for tests and ephemeral stores.
+type MemoryCAS struct {
+	mu      sync.RWMutex
+	objects map[types.Hash][]byte
+}
+
+// NewMemoryCAS creates a new empty in-memory CAS
+func NewMemoryCAS() *MemoryCAS {
+	return &MemoryCAS{objects: make(map[types.Hash][]byte)}
+}
+
+// Write stores a copy of data and returns its SHA-256 hash
+func (m *MemoryCAS) Write(data []byte) (types.Hash, error) {
+	hash := sha256.Sum256(data)
+	return hash, m.WriteAddressed(hash, data)
+}
+
+// WriteAddressed stores a copy of data under hash unless the hash already exists
+func (m *MemoryCAS) WriteAddressed(hash types.Hash, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.objects[hash]; !exists {
+		stored := make([]byte, len(data))
+		copy(stored, data)
+		m.objects[hash] = stored
+	}
+	return nil
+}
+
+// Read retrieves a copy of the data stored under hash
+func (m *MemoryCAS) Read(hash types.Hash) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, exists := m.objects[hash]
+	if !exists {
+		return nil, ErrHashNotFound
+	}
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result, nil
+}
+
+// Exists checks if a hash exists in storage
+func (m *MemoryCAS) Exists(hash types.Hash) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, exists := m.objects[hash]
+	return exists
+}
+
+// Len returns the number of stored objects
+func (m *MemoryCAS) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.objects)
+}
+
+// Close releases resources (no-op for in-memory CAS)
+func (m *MemoryCAS) Close() error {
+	return nil
+}
+
+// WriteContext stores data unless ctx is already done
+func (m *MemoryCAS) WriteContext(ctx context.Context, data []byte) (types.Hash, error) {
+	if err := ctx.Err(); err != nil {
+		return types.Hash{}, err
+	}
+	return m.Write(data)
+}
+
+// ReadContext reads data unless ctx is already done
+func (m *MemoryCAS) ReadContext(ctx context.Context, hash types.Hash) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.Read(hash)
+}
+
+// ExistsContext checks existence unless ctx is already done
+func (m *MemoryCAS) ExistsContext(ctx context.Context, hash types.Hash) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return m.Exists(hash), nil
+}
+
+// WriteMany stores every object under a single lock acquisition
+func (m *MemoryCAS) WriteMany(ctx context.Context, data [][]byte) ([]types.Hash, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	hashes := make([]types.Hash, len(data))
+	for i, d := range data {
+		hashes[i] = sha256.Sum256(d)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, d := range data {
+		if _, exists := m.objects[hashes[i]]; !exists {
+			stored := make([]byte, len(d))
+			copy(stored, d)
+			m.objects[hashes[i]] = stored
+		}
+	}
+	return hashes, nil
+}
+
+// ReadMany retrieves every object under a single lock acquisition
+func (m *MemoryCAS) ReadMany(ctx context.Context, hashes []types.Hash) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		data, exists := m.objects[h]
+		if !exists {
+			return nil, ErrHashNotFound
+		}
+		result[i] = make([]byte, len(data))
+		copy(result[i], data)
+	}
+	return result, nil
+}
+
+// HasMany reports which hashes exist under a single lock acquisition
+func (m *MemoryCAS) HasMany(ctx context.Context, hashes []types.Hash) ([]bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]bool, len(hashes))
+	for i, h := range hashes {
+		_, result[i] = m.objects[h]
+	}
+	return result, nil
+}
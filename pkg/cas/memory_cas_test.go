@@ -0,0 +1,56 @@
+package cas
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"microprolly/pkg/types"
+)
+
+// TestMemoryCAS_ConcurrentWriteRead tests that MemoryCAS is safe for
+// concurrent use and isolates stored data from callers
+func TestMemoryCAS_ConcurrentWriteRead(t *testing.T) {
+	m := NewMemoryCAS()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				data := []byte(fmt.Sprintf("object-%d", i))
+				h, err := m.Write(data)
+				if err != nil {
+					t.Errorf("Write failed: %v", err)
+					return
+				}
+				got, err := m.Read(h)
+				if err != nil || string(got) != string(data) {
+					t.Errorf("Read returned %q, %v", got, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if m.Len() != 200 {
+		t.Fatalf("Expected 200 unique objects, got %d", m.Len())
+	}
+
+	// Mutating written or read slices must not affect stored data
+	data := []byte("immutable")
+	h, _ := m.Write(data)
+	data[0] = 'X'
+	got, _ := m.Read(h)
+	got[1] = 'Y'
+	again, _ := m.Read(h)
+	if string(again) != "immutable" {
+		t.Fatalf("Stored data was mutated: %q", again)
+	}
+
+	if _, err := m.Read(types.Hash{}); err != ErrHashNotFound {
+		t.Fatalf("Expected ErrHashNotFound, got %v", err)
+	}
+}
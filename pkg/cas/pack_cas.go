@@ -0,0 +1,763 @@
+package cas
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"microprolly/pkg/types"
+)
+
+const (
+	// packRecordHeaderSize is the size of a record header: hash + data length
+	packRecordHeaderSize = 32 + 4
+	// packIndexEntrySize is the size of an index entry: hash + offset + length
+	packIndexEntrySize = 32 + 8 + 4
+	// packIndexMagic identifies a pack index file
+	packIndexMagic = "MPIDX001"
+	// packCompressedFlag is set in a record's length field when its data is
+	// DEFLATE-compressed. Records without it are stored as written, so packs
+	// written with and without compression can be read by either setting.
+	packCompressedFlag = 1 << 31
+)
+
+var (
+	// ErrCorruptedPack is returned when a pack or index file cannot be parsed
+	ErrCorruptedPack = errors.New("corrupted pack file")
+	// ErrReadOnly is returned when writing to a CAS opened read-only
+	ErrReadOnly = errors.New("object store is read-only")
+	// ErrRepackUnsupported is returned by wrappers whose wrapped CAS cannot
+	// hold packs
+	ErrRepackUnsupported = errors.New("object store does not support packs")
+)
+
+// Syncer is implemented by CAS backends that buffer durability.
+// Sync blocks until every previously written object is on stable storage.
+type Syncer interface {
+	Sync() error
+}
+
+// Repacker is implemented by CAS backends that can migrate loose objects into packs
+type Repacker interface {
+	// Repack moves loose objects into packs and returns how many were moved
+	Repack() (int, error)
+}
+
+// PackOptions configures a PackCAS
+type PackOptions struct {
+	// MaxSegmentSize is the size in bytes after which a segment is sealed
+	// and a new one is started
+	MaxSegmentSize int64
+	// SyncEvery fsyncs the active segment after this many appended objects.
+	// Zero defers fsync to explicit Sync calls, segment rollover, Repack and
+	// Close.
+	SyncEvery int
+	// Compress stores objects DEFLATE-compressed when that makes them
+	// smaller. Hashes are always of the uncompressed data.
+	Compress bool
+	// ReadOnly opens existing packs without modifying them: writes fail
+	// with ErrReadOnly and a partially written segment is left as it is
+	ReadOnly bool
+}
+
+// DefaultPackOptions returns pack options with sensible defaults
+func DefaultPackOptions() PackOptions {
+	return PackOptions{
+		MaxSegmentSize: 64 << 20,
+		SyncEvery:      0,
+	}
+}
+
+// packEntry locates an object inside a segment
+type packEntry struct {
+	segment    int
+	offset     int64
+	length     uint32 // stored length, after compression
+	compressed bool
+}
+
+// storedLength returns the length field written for the entry
+func (e packEntry) storedLength() uint32 {
+	if e.compressed {
+		return e.length | packCompressedFlag
+	}
+	return e.length
+}
+
+// newPackEntry decodes a length field written by storedLength
+func newPackEntry(segment int, offset int64, field uint32) packEntry {
+	return packEntry{
+		segment:    segment,
+		offset:     offset,
+		length:     field &^ packCompressedFlag,
+		compressed: field&packCompressedFlag != 0,
+	}
+}
+
+// packSegment is an open segment file
+type packSegment struct {
+	id   int
+	file *os.File
+	size int64
+}
+
+// PackCAS implements CAS by appending objects to segment files.
+//
+// Segment format (pack-NNNNNN.pack), a sequence of records:
+//
+//	[32 bytes: SHA-256][4 bytes: data length (big-endian)][N bytes: data]
+//
+// The top bit of the length marks data stored DEFLATE-compressed.
+//
+// When a segment is sealed a sorted index (pack-NNNNNN.idx) is written next
+// to it so reopening does not require scanning. A segment is sealed when it
+// reaches MaxSegmentSize or by Repack. Until then it has no index: Close
+// leaves it unsealed, and the next open rescans it, drops any partially
+// written record and keeps appending to it, so reopening a store often does
+// not leave a trail of small segments.
+//
+// Objects not found in packs are read from the loose FileCAS layout in the
+// same directory, so loose and packed objects can be used together.
+type PackCAS struct {
+	mu       sync.RWMutex
+	packDir  string
+	opts     PackOptions
+	loose    *FileCAS
+	index    map[types.Hash]packEntry
+	segments map[int]*packSegment
+	active   *packSegment
+	nextID   int
+	pending  int
+}
+
+// NewPackCAS opens or creates a pack-based CAS at the given directory
+func NewPackCAS(baseDir string, opts PackOptions) (*PackCAS, error) {
+	packDir := filepath.Join(baseDir, "packs")
+
+	var loose *FileCAS
+	if opts.ReadOnly {
+		// Nothing is created; missing directories just hold no objects
+		loose = &FileCAS{baseDir: baseDir}
+	} else {
+		var err error
+		if loose, err = NewFileCAS(baseDir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(packDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = DefaultPackOptions().MaxSegmentSize
+	}
+
+	p := &PackCAS{
+		packDir:  packDir,
+		opts:     opts,
+		loose:    loose,
+		index:    make(map[types.Hash]packEntry),
+		segments: make(map[int]*packSegment),
+		nextID:   1,
+	}
+
+	if err := p.loadSegments(); err != nil {
+		p.closeSegments()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// segmentPath returns the path of a segment file
+func (p *PackCAS) segmentPath(id int) string {
+	return filepath.Join(p.packDir, fmt.Sprintf("pack-%06d.pack", id))
+}
+
+// indexPath returns the path of a segment's index file
+func (p *PackCAS) indexPath(id int) string {
+	return filepath.Join(p.packDir, fmt.Sprintf("pack-%06d.idx", id))
+}
+
+// loadSegments opens every segment and rebuilds the in-memory index
+func (p *PackCAS) loadSegments() error {
+	entries, err := os.ReadDir(p.packDir)
+	if err != nil {
+		if p.opts.ReadOnly && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var ids []int
+	for _, e := range entries {
+		var id int
+		if _, err := fmt.Sscanf(e.Name(), "pack-%06d.pack", &id); err == nil && strings.HasSuffix(e.Name(), ".pack") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		flag := os.O_RDWR
+		if p.opts.ReadOnly {
+			flag = os.O_RDONLY
+		}
+		file, err := os.OpenFile(p.segmentPath(id), flag, 0644)
+		if err != nil {
+			return err
+		}
+		seg := &packSegment{id: id, file: file}
+		p.segments[id] = seg
+
+		if id >= p.nextID {
+			p.nextID = id + 1
+		}
+
+		if err := p.loadIndex(seg); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		// Unsealed segment: scan records and continue appending to it
+		if err := p.scanSegment(seg); err != nil {
+			return err
+		}
+		if !p.opts.ReadOnly {
+			p.active = seg
+		}
+	}
+
+	return nil
+}
+
+// loadIndex reads a sealed segment's index file
+func (p *PackCAS) loadIndex(seg *packSegment) error {
+	data, err := os.ReadFile(p.indexPath(seg.id))
+	if err != nil {
+		return err
+	}
+
+	if len(data) < len(packIndexMagic)+4 || string(data[:len(packIndexMagic)]) != packIndexMagic {
+		return fmt.Errorf("%w: bad index header in segment %d", ErrCorruptedPack, seg.id)
+	}
+	pos := len(packIndexMagic)
+	count := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+	pos += 4
+
+	if len(data) != pos+count*packIndexEntrySize {
+		return fmt.Errorf("%w: bad index length in segment %d", ErrCorruptedPack, seg.id)
+	}
+
+	for i := 0; i < count; i++ {
+		var h types.Hash
+		copy(h[:], data[pos:pos+32])
+		offset := int64(binary.BigEndian.Uint64(data[pos+32 : pos+40]))
+		length := binary.BigEndian.Uint32(data[pos+40 : pos+44])
+		pos += packIndexEntrySize
+
+		p.index[h] = newPackEntry(seg.id, offset, length)
+	}
+
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	seg.size = info.Size()
+	return nil
+}
+
+// scanSegment rebuilds index entries by reading every record of a segment.
+// A trailing partial record (from a crash mid-append) is truncated away,
+// unless the CAS is read-only.
+func (p *PackCAS) scanSegment(seg *packSegment) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	var header [packRecordHeaderSize]byte
+	var offset int64
+	for offset+packRecordHeaderSize <= fileSize {
+		if _, err := seg.file.ReadAt(header[:], offset); err != nil {
+			return err
+		}
+		entry := newPackEntry(seg.id, offset+packRecordHeaderSize, binary.BigEndian.Uint32(header[32:]))
+		end := entry.offset + int64(entry.length)
+		if end > fileSize {
+			break
+		}
+
+		var h types.Hash
+		copy(h[:], header[:32])
+		p.index[h] = entry
+		offset = end
+	}
+
+	if offset != fileSize && !p.opts.ReadOnly {
+		if err := seg.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	seg.size = offset
+	return nil
+}
+
+// Write appends data to the active segment and returns its SHA-256 hash.
+// Objects already present in a pack or as loose files are not written again.
+func (p *PackCAS) Write(data []byte) (types.Hash, error) {
+	hash := sha256.Sum256(data)
+	if err := p.WriteAddressed(hash, data); err != nil {
+		return types.Hash{}, err
+	}
+	return hash, nil
+}
+
+// WriteAddressed appends data under hash unless the hash is already stored
+func (p *PackCAS) WriteAddressed(hash types.Hash, data []byte) error {
+	if p.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.index[hash]; ok {
+		return nil
+	}
+	if p.loose.Exists(hash) {
+		return nil
+	}
+	return p.append(hash, data)
+}
+
+// append writes a record to the active segment, rolling over when it is full.
+// Caller must hold the write lock.
+func (p *PackCAS) append(hash types.Hash, data []byte) error {
+	if p.active == nil || p.active.size >= p.opts.MaxSegmentSize {
+		if err := p.rollover(); err != nil {
+			return err
+		}
+	}
+
+	seg := p.active
+	entry := packEntry{segment: seg.id, offset: seg.size + packRecordHeaderSize}
+	if p.opts.Compress {
+		if compressed, ok := compressObject(data); ok {
+			data = compressed
+			entry.compressed = true
+		}
+	}
+	entry.length = uint32(len(data))
+
+	record := make([]byte, packRecordHeaderSize+len(data))
+	copy(record, hash[:])
+	binary.BigEndian.PutUint32(record[32:], entry.storedLength())
+	copy(record[packRecordHeaderSize:], data)
+
+	if _, err := seg.file.WriteAt(record, seg.size); err != nil {
+		// Drop whatever part of the record made it to the file
+		seg.file.Truncate(seg.size)
+		return err
+	}
+
+	p.index[hash] = entry
+	seg.size += int64(len(record))
+
+	p.pending++
+	if p.opts.SyncEvery > 0 && p.pending >= p.opts.SyncEvery {
+		return p.syncLocked()
+	}
+	return nil
+}
+
+// rollover seals the active segment (if any) and opens a new one.
+// Caller must hold the write lock.
+func (p *PackCAS) rollover() error {
+	if p.active != nil {
+		if err := p.seal(p.active); err != nil {
+			return err
+		}
+		p.active = nil
+	}
+
+	id := p.nextID
+	file, err := os.OpenFile(p.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	p.nextID++
+
+	seg := &packSegment{id: id, file: file}
+	p.segments[id] = seg
+	p.active = seg
+	return nil
+}
+
+// seal fsyncs a segment and writes its sorted index atomically
+func (p *PackCAS) seal(seg *packSegment) error {
+	if err := seg.file.Sync(); err != nil {
+		return err
+	}
+	if seg == p.active {
+		p.pending = 0
+	}
+
+	// Collect and sort this segment's entries by hash
+	hashes := make([]types.Hash, 0)
+	for h, e := range p.index {
+		if e.segment == seg.id {
+			hashes = append(hashes, h)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+
+	buf := make([]byte, 0, len(packIndexMagic)+4+len(hashes)*packIndexEntrySize)
+	buf = append(buf, packIndexMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(hashes)))
+	for _, h := range hashes {
+		e := p.index[h]
+		buf = append(buf, h[:]...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.offset))
+		buf = binary.BigEndian.AppendUint32(buf, e.storedLength())
+	}
+
+	return writeFileAtomic(p.indexPath(seg.id), buf)
+}
+
+// Read retrieves data by its hash, checking packs before loose objects
+func (p *PackCAS) Read(hash types.Hash) ([]byte, error) {
+	p.mu.RLock()
+	entry, ok := p.index[hash]
+	var seg *packSegment
+	if ok {
+		seg = p.segments[entry.segment]
+	}
+	p.mu.RUnlock()
+
+	if !ok {
+		return p.loose.Read(hash)
+	}
+	return readPackObject(seg, entry, hash)
+}
+
+// readPackObject reads and, if needed, decompresses one packed object
+func readPackObject(seg *packSegment, entry packEntry, hash types.Hash) ([]byte, error) {
+	data := make([]byte, entry.length)
+	if _, err := seg.file.ReadAt(data, entry.offset); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: object %s truncated", ErrCorruptedPack, hash.String())
+		}
+		return nil, err
+	}
+	if !entry.compressed {
+		return data, nil
+	}
+
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: object %s: %v", ErrCorruptedPack, hash.String(), err)
+	}
+	return data, nil
+}
+
+// compressObject DEFLATE-compresses data, reporting false if that would
+// not make it smaller
+func compressObject(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// ReadContext reads data unless ctx is already done
+func (p *PackCAS) ReadContext(ctx context.Context, hash types.Hash) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.Read(hash)
+}
+
+// WriteContext stores data unless ctx is already done
+func (p *PackCAS) WriteContext(ctx context.Context, data []byte) (types.Hash, error) {
+	if err := ctx.Err(); err != nil {
+		return types.Hash{}, err
+	}
+	return p.Write(data)
+}
+
+// ExistsContext checks existence unless ctx is already done
+func (p *PackCAS) ExistsContext(ctx context.Context, hash types.Hash) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return p.Exists(hash), nil
+}
+
+// WriteMany appends every new object while holding the write lock once
+func (p *PackCAS) WriteMany(ctx context.Context, data [][]byte) ([]types.Hash, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if p.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hashes := make([]types.Hash, len(data))
+	for i, d := range data {
+		hash := sha256.Sum256(d)
+		hashes[i] = hash
+
+		if _, ok := p.index[hash]; ok || p.loose.Exists(hash) {
+			continue
+		}
+		if err := p.append(hash, d); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// ReadMany resolves every hash against the index in one pass and then reads
+// the objects, falling back to loose files for hashes not in a pack
+func (p *PackCAS) ReadMany(ctx context.Context, hashes []types.Hash) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]packEntry, len(hashes))
+	found := make([]bool, len(hashes))
+	segs := make([]*packSegment, len(hashes))
+	p.mu.RLock()
+	for i, h := range hashes {
+		entries[i], found[i] = p.index[h]
+		if found[i] {
+			segs[i] = p.segments[entries[i].segment]
+		}
+	}
+	p.mu.RUnlock()
+
+	result := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !found[i] {
+			data, err := p.loose.Read(h)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = data
+			continue
+		}
+
+		data, err := readPackObject(segs[i], entries[i], h)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = data
+	}
+	return result, nil
+}
+
+// HasMany reports which hashes exist in packs or as loose objects
+func (p *PackCAS) HasMany(ctx context.Context, hashes []types.Hash) ([]bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]bool, len(hashes))
+	p.mu.RLock()
+	for i, h := range hashes {
+		_, result[i] = p.index[h]
+	}
+	p.mu.RUnlock()
+
+	for i, h := range hashes {
+		if !result[i] {
+			result[i] = p.loose.Exists(h)
+		}
+	}
+	return result, nil
+}
+
+// Exists checks if a hash exists in a pack or as a loose object
+func (p *PackCAS) Exists(hash types.Hash) bool {
+	p.mu.RLock()
+	_, ok := p.index[hash]
+	p.mu.RUnlock()
+
+	return ok || p.loose.Exists(hash)
+}
+
+// Sync flushes the active segment to stable storage
+func (p *PackCAS) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.syncLocked()
+}
+
+// syncLocked fsyncs the active segment. Caller must hold the write lock.
+func (p *PackCAS) syncLocked() error {
+	if p.active == nil || p.pending == 0 {
+		return nil
+	}
+	if err := p.active.file.Sync(); err != nil {
+		return err
+	}
+	p.pending = 0
+	return nil
+}
+
+// Repack moves all loose objects into the active pack and seals it.
+// Loose files are only removed after the pack has been synced.
+func (p *PackCAS) Repack() (int, error) {
+	return p.repack(func(hash types.Hash, data []byte) error {
+		if types.HashFromBytes(data) != hash {
+			return fmt.Errorf("%w: loose object %s", ErrCorruptedPack, hash.String())
+		}
+		return nil
+	})
+}
+
+// repack moves all loose objects into the active pack, checking each with
+// verify first. Objects written with WriteAddressed are not stored under
+// their own hash, so their writer supplies the check.
+func (p *PackCAS) repack(verify func(hash types.Hash, data []byte) error) (int, error) {
+	if p.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var moved []types.Hash
+	err := p.loose.ForEach(func(hash types.Hash) error {
+		if _, ok := p.index[hash]; ok {
+			moved = append(moved, hash)
+			return nil
+		}
+
+		data, err := p.loose.Read(hash)
+		if err != nil {
+			return err
+		}
+		if err := verify(hash, data); err != nil {
+			return err
+		}
+		if err := p.append(hash, data); err != nil {
+			return err
+		}
+		moved = append(moved, hash)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.syncLocked(); err != nil {
+		return 0, err
+	}
+	if p.active != nil {
+		if err := p.seal(p.active); err != nil {
+			return 0, err
+		}
+		p.active = nil
+	}
+
+	for _, hash := range moved {
+		if err := p.loose.Remove(hash); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(moved), nil
+}
+
+// Close fsyncs the active segment and closes all segment files. The active
+// segment stays unsealed so the next open continues appending to it.
+func (p *PackCAS) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	firstErr := p.syncLocked()
+	p.active = nil
+	if err := p.closeSegments(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// closeSegments closes every open segment file
+func (p *PackCAS) closeSegments() error {
+	var firstErr error
+	for id, seg := range p.segments {
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(p.segments, id)
+	}
+	return firstErr
+}
+
+// writeFileAtomic writes a file via temp file, fsync and rename
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	tmpFile, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
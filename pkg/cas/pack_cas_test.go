@@ -0,0 +1,416 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// createTestPackCAS creates a PackCAS in a temporary directory
+func createTestPackCAS(t *testing.T, opts PackOptions) (*PackCAS, string, func()) {
+	tmpDir, err := os.MkdirTemp("", "pack-cas-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPackCAS(tmpDir, opts)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatal(err)
+	}
+
+	cleanup := func() {
+		p.Close()
+		os.RemoveAll(tmpDir)
+	}
+	return p, tmpDir, cleanup
+}
+
+// TestProperty_PackCASWriteReadRoundTrip tests that PackCAS satisfies the
+// same write-read round-trip and idempotence property as FileCAS
+func TestProperty_PackCASWriteReadRoundTrip(t *testing.T) {
+	p, _, cleanup := createTestPackCAS(t, PackOptions{MaxSegmentSize: 4096})
+	defer cleanup()
+
+	rapid.Check(t, func(rt *rapid.T) {
+		data := rapid.SliceOf(rapid.Byte()).Draw(rt, "data")
+
+		hash1, err := p.Write(data)
+		if err != nil {
+			rt.Fatalf("Write failed: %v", err)
+		}
+		if hash1 != types.HashFromBytes(data) {
+			rt.Fatal("Write returned wrong hash")
+		}
+
+		readData, err := p.Read(hash1)
+		if err != nil {
+			rt.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(data, readData) {
+			rt.Fatal("Round-trip failed: data mismatch")
+		}
+
+		hash2, err := p.Write(data)
+		if err != nil {
+			rt.Fatalf("Second Write failed: %v", err)
+		}
+		if hash1 != hash2 {
+			rt.Fatal("Idempotence failed")
+		}
+		if !p.Exists(hash1) {
+			rt.Fatal("Exists returned false for written hash")
+		}
+	})
+}
+
+// TestPackCAS_ReopenAndRollover tests that objects survive reopening across
+// several sealed segments and one unsealed segment
+func TestPackCAS_ReopenAndRollover(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pack-cas-reopen-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p, err := NewPackCAS(tmpDir, PackOptions{MaxSegmentSize: 1024, SyncEvery: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []types.Hash
+	for i := 0; i < 200; i++ {
+		h, err := p.Write([]byte(fmt.Sprintf("object-%d-%s", i, bytes.Repeat([]byte("x"), i))))
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		hashes = append(hashes, h)
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// Simulate a crash: close files without sealing the active segment
+	p.mu.Lock()
+	p.closeSegments()
+	p.active = nil
+	p.mu.Unlock()
+
+	segments, _ := filepath.Glob(filepath.Join(tmpDir, "packs", "*.pack"))
+	if len(segments) < 2 {
+		t.Fatalf("Expected multiple segments, got %d", len(segments))
+	}
+
+	p, err = NewPackCAS(tmpDir, PackOptions{MaxSegmentSize: 1024})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer p.Close()
+
+	for i, h := range hashes {
+		data, err := p.Read(h)
+		if err != nil {
+			t.Fatalf("Read %d after reopen failed: %v", i, err)
+		}
+		if types.HashFromBytes(data) != h {
+			t.Fatalf("Object %d corrupted after reopen", i)
+		}
+	}
+}
+
+// TestPackCAS_ReopenKeepsAppending tests that Close leaves the active segment
+// unsealed so reopening continues it, and that Repack seals it
+func TestPackCAS_ReopenKeepsAppending(t *testing.T) {
+	tmpDir := t.TempDir()
+	segments := func() []string {
+		paths, _ := filepath.Glob(filepath.Join(tmpDir, "packs", "*.pack"))
+		return paths
+	}
+
+	var hashes []types.Hash
+	for i := 0; i < 5; i++ {
+		p, err := NewPackCAS(tmpDir, DefaultPackOptions())
+		if err != nil {
+			t.Fatalf("Open %d failed: %v", i, err)
+		}
+		h, err := p.Write([]byte(fmt.Sprintf("session-%d", i)))
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		hashes = append(hashes, h)
+		if err := p.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+	if got := segments(); len(got) != 1 {
+		t.Fatalf("expected 1 segment after 5 sessions, got %d", len(got))
+	}
+	if idx, _ := filepath.Glob(filepath.Join(tmpDir, "packs", "*.idx")); len(idx) != 0 {
+		t.Fatalf("expected the segment to stay unsealed, found %d indexes", len(idx))
+	}
+
+	p, err := NewPackCAS(tmpDir, DefaultPackOptions())
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer p.Close()
+	for i, h := range hashes {
+		if data, err := p.Read(h); err != nil || string(data) != fmt.Sprintf("session-%d", i) {
+			t.Fatalf("Read %d returned %q, %v", i, data, err)
+		}
+	}
+
+	if _, err := p.Repack(); err != nil {
+		t.Fatalf("Repack failed: %v", err)
+	}
+	if idx, _ := filepath.Glob(filepath.Join(tmpDir, "packs", "*.idx")); len(idx) != 1 {
+		t.Fatalf("expected Repack to seal the segment, found %d indexes", len(idx))
+	}
+	if _, err := p.Write([]byte("after repack")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := segments(); len(got) != 2 {
+		t.Errorf("expected a new segment after Repack, got %d segments", len(got))
+	}
+}
+
+// TestPackCAS_TruncatedTailRecovered tests that a partially written record
+// at the end of the active segment is dropped on open
+func TestPackCAS_TruncatedTailRecovered(t *testing.T) {
+	p, tmpDir, cleanup := createTestPackCAS(t, DefaultPackOptions())
+	defer cleanup()
+
+	good, err := p.Write([]byte("complete object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Sync()
+	segPath := p.segmentPath(p.active.id)
+
+	p.mu.Lock()
+	p.closeSegments()
+	p.active = nil
+	p.mu.Unlock()
+
+	// Append a header that promises more data than is present
+	f, err := os.OpenFile(segPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 32))
+	f.Write([]byte{0, 0, 1, 0, 'p', 'a', 'r'})
+	f.Close()
+
+	p2, err := NewPackCAS(tmpDir, DefaultPackOptions())
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer p2.Close()
+
+	data, err := p2.Read(good)
+	if err != nil || string(data) != "complete object" {
+		t.Fatalf("Read returned %q, %v", data, err)
+	}
+
+	// New writes must land after the good record
+	h, err := p2.Write([]byte("after recovery"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := p2.Read(h); err != nil || string(data) != "after recovery" {
+		t.Fatalf("Read after recovery returned %q, %v", data, err)
+	}
+}
+
+// TestPackCAS_RepackLooseObjects tests that loose and packed objects are
+// readable together and that Repack moves loose objects into packs
+func TestPackCAS_RepackLooseObjects(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pack-cas-repack-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	loose, err := NewFileCAS(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var looseHashes []types.Hash
+	for i := 0; i < 50; i++ {
+		h, err := loose.Write([]byte(fmt.Sprintf("loose-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		looseHashes = append(looseHashes, h)
+	}
+
+	p, err := NewPackCAS(tmpDir, DefaultPackOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	packed, err := p.Write([]byte("packed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing an existing loose object must not duplicate it
+	if _, err := p.Write([]byte("loose-0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.index[looseHashes[0]]; ok {
+		t.Fatal("Loose object was duplicated into a pack")
+	}
+
+	for _, h := range append(looseHashes, packed) {
+		if _, err := p.Read(h); err != nil {
+			t.Fatalf("Read before repack failed: %v", err)
+		}
+	}
+
+	moved, err := p.Repack()
+	if err != nil {
+		t.Fatalf("Repack failed: %v", err)
+	}
+	if moved != len(looseHashes) {
+		t.Fatalf("Expected %d objects moved, got %d", len(looseHashes), moved)
+	}
+
+	for _, h := range looseHashes {
+		if loose.Exists(h) {
+			t.Fatalf("Loose object %s still present after repack", h)
+		}
+		data, err := p.Read(h)
+		if err != nil || types.HashFromBytes(data) != h {
+			t.Fatalf("Read after repack failed: %v", err)
+		}
+	}
+}
+
+// TestPackCAS_Compression tests that compressed objects round-trip through a
+// reopen, and that packs with mixed compression settings stay readable
+func TestPackCAS_Compression(t *testing.T) {
+	p, dir, cleanup := createTestPackCAS(t, PackOptions{Compress: true})
+	defer cleanup()
+
+	compressible := bytes.Repeat([]byte("compress me "), 1000)
+	incompressible := []byte("x")
+	hashA, err := p.Write(compressible)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	hashB, err := p.Write(incompressible)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if entry := p.index[hashA]; !entry.compressed || int(entry.length) >= len(compressible) {
+		t.Errorf("expected a compressed entry, got %+v", entry)
+	}
+	if p.index[hashB].compressed {
+		t.Error("expected data that does not shrink to be stored as written")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Reopen without compression: old records still decompress, new ones are raw
+	p2, err := NewPackCAS(dir, PackOptions{})
+	if err != nil {
+		t.Fatalf("NewPackCAS failed: %v", err)
+	}
+	defer p2.Close()
+
+	data, err := p2.Read(hashA)
+	if err != nil || !bytes.Equal(data, compressible) {
+		t.Fatalf("Read after reopen returned %d bytes, %v", len(data), err)
+	}
+	hashC, err := p2.Write(bytes.Repeat([]byte("raw "), 1000))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if p2.index[hashC].compressed {
+		t.Error("expected no compression when disabled")
+	}
+	many, err := p2.ReadMany(context.Background(), []types.Hash{hashA, hashB, hashC})
+	if err != nil {
+		t.Fatalf("ReadMany failed: %v", err)
+	}
+	if !bytes.Equal(many[0], compressible) || !bytes.Equal(many[1], incompressible) {
+		t.Error("ReadMany returned different data")
+	}
+}
+
+// TestPackCAS_ReadOnly tests that a read-only PackCAS serves existing
+// objects, rejects writes and leaves an unsealed segment untouched
+func TestPackCAS_ReadOnly(t *testing.T) {
+	p, dir, cleanup := createTestPackCAS(t, PackOptions{})
+	defer cleanup()
+
+	hash, err := p.Write([]byte("existing"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// Leave a partial record at the end of the unsealed segment
+	segPath := p.segmentPath(p.active.id)
+	f, err := os.OpenFile(segPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+	before, _ := os.Stat(segPath)
+
+	ro, err := NewPackCAS(dir, PackOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("NewPackCAS failed: %v", err)
+	}
+	data, err := ro.Read(hash)
+	if err != nil || string(data) != "existing" {
+		t.Errorf("Read returned %q, %v", data, err)
+	}
+	if _, err := ro.Write([]byte("new")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Write returned %v, expected ErrReadOnly", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	after, _ := os.Stat(segPath)
+	if after.Size() != before.Size() {
+		t.Errorf("segment changed size from %d to %d", before.Size(), after.Size())
+	}
+	if _, err := os.Stat(p.indexPath(p.active.id)); !os.IsNotExist(err) {
+		t.Error("read-only Close should not seal the segment")
+	}
+}
+
+// TestPackCAS_ReadOnlyMissingDir tests that a read-only PackCAS does not
+// create directories
+func TestPackCAS_ReadOnlyMissingDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	ro, err := NewPackCAS(dir, PackOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("NewPackCAS failed: %v", err)
+	}
+	defer ro.Close()
+
+	if ro.Exists(types.HashFromBytes([]byte("x"))) {
+		t.Error("expected an empty store")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("read-only open created the directory")
+	}
+}
@@ -1,15 +1,58 @@
 package chunker
 
 import (
+	"errors"
+	"fmt"
+
 	"microprolly/pkg/types"
 )
 
+// Chunking algorithms selectable by name
+const (
+	// AlgorithmBuzhash rolls a Buzhash over serialized keys and values
+	AlgorithmBuzhash = "buzhash"
+	// AlgorithmKeyHash decides boundaries from keys alone
+	AlgorithmKeyHash = "keyhash"
+	// AlgorithmGear is FastCDC-style normalized chunking with a Gear hash
+	AlgorithmGear = "gear"
+	// AlgorithmWeighted ends chunks with a probability that grows with their size
+	AlgorithmWeighted = "weighted"
+)
+
+// Algorithms lists every algorithm New accepts
+var Algorithms = []string{AlgorithmBuzhash, AlgorithmKeyHash, AlgorithmGear, AlgorithmWeighted}
+
+var (
+	// ErrUnknownAlgorithm is returned by New for an unrecognised algorithm name
+	ErrUnknownAlgorithm = errors.New("unknown chunking algorithm")
+)
+
 // Chunker splits sorted KV pairs into content-defined chunks using rolling hash
 type Chunker interface {
 	// Chunk takes sorted KV pairs and returns chunk boundaries
 	Chunk(pairs []types.KVPair) [][]types.KVPair
 }
 
+// Splitter is a Chunker whose boundary search restarts after every boundary,
+// so a sequence can be rechunked from any boundary onward. Every chunker in
+// this package is a Splitter.
+type Splitter interface {
+	Chunker
+	// Split returns the chunks Chunk would, except that a result of only
+	// single-pair chunks is not merged into one
+	Split(pairs []types.KVPair) [][]types.KVPair
+}
+
+// ensureProgress merges chunks into a single chunk when there are as many
+// of them as pairs. Chunking then always reduces the count, so callers can
+// chunk recursively without looping forever.
+func ensureProgress(pairs []types.KVPair, chunks [][]types.KVPair) [][]types.KVPair {
+	if len(chunks) >= len(pairs) && len(pairs) > 0 {
+		return [][]types.KVPair{pairs}
+	}
+	return chunks
+}
+
 // BuzhashChunker implements content-defined chunking using Buzhash rolling hash
 type BuzhashChunker struct {
 	// TargetSize is the average chunk size (boundary when hash % targetSize == 0)
@@ -29,6 +72,23 @@ func DefaultChunker() *BuzhashChunker {
 	}
 }
 
+// New creates a chunker for the named algorithm with the given parameters.
+// An empty name selects AlgorithmBuzhash.
+func New(algorithm string, targetSize, minSize, maxSize uint32) (Chunker, error) {
+	switch algorithm {
+	case "", AlgorithmBuzhash:
+		return NewBuzhashChunker(targetSize, minSize, maxSize), nil
+	case AlgorithmKeyHash:
+		return NewKeyHashChunker(targetSize, minSize, maxSize), nil
+	case AlgorithmGear:
+		return NewGearChunker(targetSize, minSize, maxSize), nil
+	case AlgorithmWeighted:
+		return NewWeightedChunker(targetSize, minSize, maxSize), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algorithm)
+	}
+}
+
 // NewBuzhashChunker creates a new BuzhashChunker with the given parameters
 func NewBuzhashChunker(targetSize, minSize, maxSize uint32) *BuzhashChunker {
 	return &BuzhashChunker{
@@ -42,6 +102,11 @@ func NewBuzhashChunker(targetSize, minSize, maxSize uint32) *BuzhashChunker {
 // The chunking is deterministic: the same input always produces the same chunks.
 // Chunk boundaries are determined by the rolling hash of serialized KV pairs.
 func (c *BuzhashChunker) Chunk(pairs []types.KVPair) [][]types.KVPair {
+	return ensureProgress(pairs, c.Split(pairs))
+}
+
+// Split returns the chunk boundaries of Chunk without its progress guarantee
+func (c *BuzhashChunker) Split(pairs []types.KVPair) [][]types.KVPair {
 	if len(pairs) == 0 {
 		return nil
 	}
@@ -77,12 +142,33 @@ func (c *BuzhashChunker) Chunk(pairs []types.KVPair) [][]types.KVPair {
 		chunks = append(chunks, currentChunk)
 	}
 
-	// Safety check: chunking must always make progress (reduce count)
-	// If we produced as many chunks as input items, merge everything into one
-	// This guarantees callers can use this in recursive algorithms without infinite loops
-	if len(chunks) >= len(pairs) {
-		return [][]types.KVPair{pairs}
+	return chunks
+}
+
+// SplitBytes splits a byte slice into content-defined chunks using the same
+// Buzhash boundary rule as Chunk, applied to raw bytes. Identical runs of
+// data produce identical chunks wherever they occur, so large values that
+// share content share storage. The returned chunks alias data.
+func SplitBytes(data []byte, targetSize, minSize, maxSize uint32) [][]byte {
+	if len(data) == 0 {
+		return nil
 	}
 
+	hasher := NewBuzhash(targetSize, minSize, maxSize)
+
+	var chunks [][]byte
+	start := 0
+	for i, b := range data {
+		hasher.Roll(b)
+		if hasher.IsBoundary() {
+			chunks = append(chunks, data[start:i+1])
+			start = i + 1
+			hasher.Reset()
+		}
+	}
+
+	if start < len(data) {
+		chunks = append(chunks, data[start:])
+	}
 	return chunks
 }
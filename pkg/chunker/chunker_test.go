@@ -210,3 +210,64 @@ func TestChunker_BasicFunctionality(t *testing.T) {
 		}
 	})
 }
+
+// TestProperty_SplitBytesReassembles tests that byte chunks respect the size
+// limits and concatenate back to the input
+func TestProperty_SplitBytesReassembles(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		data := rapid.SliceOfN(rapid.Byte(), 0, 20000).Draw(t, "data")
+		chunks := SplitBytes(data, 256, 64, 1024)
+
+		var joined []byte
+		for i, chunk := range chunks {
+			if len(chunk) > 1024 {
+				t.Fatalf("Chunk %d has %d bytes, above max", i, len(chunk))
+			}
+			if i < len(chunks)-1 && len(chunk) < 64 {
+				t.Fatalf("Chunk %d has %d bytes, below min", i, len(chunk))
+			}
+			joined = append(joined, chunk...)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Fatal("Chunks do not reassemble to the input")
+		}
+	})
+}
+
+// TestProperty_SplitRestartsAtBoundaries checks the Splitter contract for
+// every algorithm: the chunks after any boundary are the chunks of the
+// pairs after it on their own
+func TestProperty_SplitRestartsAtBoundaries(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			c, err := New(algorithm, 256, 64, 1024)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			splitter := c.(Splitter)
+
+			rapid.Check(t, func(t *rapid.T) {
+				pairs := genSortedKVPairs().Draw(t, "pairs")
+				chunks := splitter.Split(pairs)
+
+				offset := 0
+				for i, chunk := range chunks {
+					offset += len(chunk)
+					rest := splitter.Split(pairs[offset:])
+					if len(rest) != len(chunks)-i-1 {
+						t.Fatalf("after chunk %d: %d chunks, expected %d", i, len(rest), len(chunks)-i-1)
+					}
+					for j := range rest {
+						if !chunksEqual(rest[j], chunks[i+1+j]) {
+							t.Fatalf("after chunk %d: chunk %d differs", i, j)
+						}
+					}
+				}
+
+				if merged := splitter.Chunk(pairs); len(chunks) < len(pairs) && len(merged) != len(chunks) {
+					t.Fatalf("Chunk returned %d chunks, Split %d", len(merged), len(chunks))
+				}
+			})
+		})
+	}
+}
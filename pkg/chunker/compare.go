@@ -0,0 +1,134 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math"
+	"sort"
+
+	"microprolly/pkg/types"
+)
+
+// SizeStats summarises the sizes of a chunking, in serialized bytes
+type SizeStats struct {
+	Chunks int
+	Mean   float64
+	StdDev float64
+	Min    int
+	Max    int
+	// AtMax counts chunks that reached the maximum size, i.e. were most
+	// likely cut by force rather than by content
+	AtMax int
+}
+
+// CoefficientOfVariation returns StdDev / Mean, a scale-free measure of
+// how spread out the chunk sizes are
+func (s SizeStats) CoefficientOfVariation() float64 {
+	if s.Mean == 0 {
+		return 0
+	}
+	return s.StdDev / s.Mean
+}
+
+// MeasureSizes computes size statistics for chunks. Chunks of maxSize
+// bytes or more are counted in AtMax.
+func MeasureSizes(chunks [][]types.KVPair, maxSize int) SizeStats {
+	stats := SizeStats{Chunks: len(chunks)}
+	if len(chunks) == 0 {
+		return stats
+	}
+
+	sizes := make([]int, len(chunks))
+	total := 0
+	for i, chunk := range chunks {
+		for _, pair := range chunk {
+			sizes[i] += 8 + len(pair.Key) + len(pair.Value)
+		}
+		total += sizes[i]
+	}
+
+	stats.Mean = float64(total) / float64(len(sizes))
+	stats.Min, stats.Max = sizes[0], sizes[0]
+	var variance float64
+	for _, size := range sizes {
+		stats.Min = min(stats.Min, size)
+		stats.Max = max(stats.Max, size)
+		if size >= maxSize {
+			stats.AtMax++
+		}
+		d := float64(size) - stats.Mean
+		variance += d * d
+	}
+	stats.StdDev = math.Sqrt(variance / float64(len(sizes)))
+	return stats
+}
+
+// Edit is one change to a sorted set of pairs: Value is written to Key,
+// or Key is removed if Delete is set
+type Edit struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// ApplyEdit returns a copy of sorted pairs with the edit applied
+func ApplyEdit(pairs []types.KVPair, e Edit) []types.KVPair {
+	i := sort.Search(len(pairs), func(i int) bool {
+		return bytes.Compare(pairs[i].Key, e.Key) >= 0
+	})
+	found := i < len(pairs) && bytes.Equal(pairs[i].Key, e.Key)
+
+	result := make([]types.KVPair, 0, len(pairs)+1)
+	result = append(result, pairs[:i]...)
+	switch {
+	case e.Delete && found:
+		return append(result, pairs[i+1:]...)
+	case e.Delete:
+		return append(result, pairs[i:]...)
+	case found:
+		result = append(result, types.KVPair{Key: e.Key, Value: e.Value})
+		return append(result, pairs[i+1:]...)
+	default:
+		result = append(result, types.KVPair{Key: e.Key, Value: e.Value})
+		return append(result, pairs[i:]...)
+	}
+}
+
+// EditStats reports how much of a chunking each edit rewrote
+type EditStats struct {
+	Edits int
+	// ChunksPerEdit is the average number of chunks an edit created that
+	// did not exist before it. One is the minimum for any real change.
+	ChunksPerEdit float64
+	// BytesPerEdit is the average size of those new chunks
+	BytesPerEdit float64
+}
+
+// MeasureEdits applies each edit on its own to pairs and measures how many
+// new chunks c produces compared with chunking the original pairs
+func MeasureEdits(c Chunker, pairs []types.KVPair, edits []Edit) EditStats {
+	stats := EditStats{Edits: len(edits)}
+	if len(edits) == 0 {
+		return stats
+	}
+
+	existing := make(map[[sha256.Size]byte]bool)
+	for _, chunk := range c.Chunk(pairs) {
+		existing[sha256.Sum256(SerializeKVPairs(chunk))] = true
+	}
+
+	var chunks, newBytes int
+	for _, e := range edits {
+		for _, chunk := range c.Chunk(ApplyEdit(pairs, e)) {
+			data := SerializeKVPairs(chunk)
+			if !existing[sha256.Sum256(data)] {
+				chunks++
+				newBytes += len(data)
+			}
+		}
+	}
+
+	stats.ChunksPerEdit = float64(chunks) / float64(len(edits))
+	stats.BytesPerEdit = float64(newBytes) / float64(len(edits))
+	return stats
+}
@@ -0,0 +1,95 @@
+package chunker
+
+import (
+	"math"
+	"testing"
+
+	"microprolly/pkg/types"
+)
+
+// TestApplyEdit tests updates, inserts and deletes on sorted pairs
+func TestApplyEdit(t *testing.T) {
+	pairs := []types.KVPair{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("c"), Value: []byte("3")},
+	}
+
+	tests := []struct {
+		name string
+		edit Edit
+		want []types.KVPair
+	}{
+		{"update", Edit{Key: []byte("a"), Value: []byte("9")}, []types.KVPair{
+			{Key: []byte("a"), Value: []byte("9")}, {Key: []byte("c"), Value: []byte("3")},
+		}},
+		{"insert", Edit{Key: []byte("b"), Value: []byte("2")}, []types.KVPair{
+			{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}, {Key: []byte("c"), Value: []byte("3")},
+		}},
+		{"append", Edit{Key: []byte("d"), Value: []byte("4")}, []types.KVPair{
+			{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("c"), Value: []byte("3")}, {Key: []byte("d"), Value: []byte("4")},
+		}},
+		{"delete", Edit{Key: []byte("c"), Delete: true}, []types.KVPair{
+			{Key: []byte("a"), Value: []byte("1")},
+		}},
+		{"delete missing", Edit{Key: []byte("b"), Delete: true}, pairs},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ApplyEdit(pairs, tt.edit); !chunksEqual(got, tt.want) {
+				t.Errorf("ApplyEdit returned %v, expected %v", got, tt.want)
+			}
+		})
+	}
+	if string(pairs[0].Value) != "1" || len(pairs) != 2 {
+		t.Error("ApplyEdit modified its input")
+	}
+}
+
+// TestMeasureSizes tests the size statistics of a known chunking
+func TestMeasureSizes(t *testing.T) {
+	// Serialized sizes 10 and 30 bytes
+	chunks := [][]types.KVPair{
+		{{Key: []byte("a"), Value: []byte("b")}},
+		{{Key: []byte("cc"), Value: []byte("dd")}, {Key: []byte("eeeeee"), Value: []byte("ffff")}},
+	}
+
+	stats := MeasureSizes(chunks, 30)
+	if stats.Chunks != 2 || stats.Min != 10 || stats.Max != 30 || stats.AtMax != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.Mean != 20 || stats.StdDev != 10 {
+		t.Errorf("mean %f stddev %f, expected 20 and 10", stats.Mean, stats.StdDev)
+	}
+	if cv := stats.CoefficientOfVariation(); math.Abs(cv-0.5) > 1e-9 {
+		t.Errorf("CoefficientOfVariation() = %f, expected 0.5", cv)
+	}
+}
+
+// TestMeasureEdits tests that every real edit creates at least one new chunk
+// and that no-op edits create none
+func TestMeasureEdits(t *testing.T) {
+	pairs := recordPairs(2000, 50)
+	for _, name := range Algorithms {
+		c, err := New(name, 1024, 128, 4096)
+		if err != nil {
+			t.Fatalf("New(%q) failed: %v", name, err)
+		}
+
+		changed := MeasureEdits(c, pairs, []Edit{
+			{Key: pairs[500].Key, Value: []byte("changed")},
+			{Key: []byte("key00001000a"), Value: []byte("inserted")},
+			{Key: pairs[1500].Key, Delete: true},
+		})
+		if changed.Edits != 3 || changed.ChunksPerEdit < 1 || changed.BytesPerEdit <= 0 {
+			t.Errorf("%s: unexpected stats for real edits %+v", name, changed)
+		}
+
+		unchanged := MeasureEdits(c, pairs, []Edit{
+			{Key: pairs[10].Key, Value: pairs[10].Value},
+			{Key: []byte("missing"), Delete: true},
+		})
+		if unchanged.ChunksPerEdit != 0 {
+			t.Errorf("%s: no-op edits created %.1f chunks each", name, unchanged.ChunksPerEdit)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package chunker
+
+import (
+	"math/bits"
+
+	"microprolly/pkg/types"
+)
+
+// gearNormalization is the FastCDC normalization level: the mask used
+// below TargetSize has this many more bits than log2(TargetSize), and the
+// mask used above it this many fewer, which pulls chunk sizes toward the target
+const gearNormalization = 2
+
+// gearTable maps each byte to a random 64-bit value. It is generated from a
+// fixed seed so every platform and release chunks identically.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6d6963726f70726f) // "micropro"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// GearChunker implements FastCDC-style content-defined chunking with a Gear
+// rolling hash over serialized KV pairs.
+//
+// The Gear hash is fp = (fp << 1) + table[b], so its top bits depend on the
+// last 64 bytes. A boundary is found when the masked top bits are all zero.
+// Normalized chunking uses a harder mask until the chunk reaches TargetSize
+// and an easier one after, which narrows the size distribution and makes
+// forced cuts at MaxSize rare.
+type GearChunker struct {
+	// TargetSize is the normal chunk size in bytes
+	TargetSize uint32
+	// MinSize prevents tiny chunks; no boundary is checked below it
+	MinSize uint32
+	// MaxSize prevents huge chunks
+	MaxSize uint32
+}
+
+// NewGearChunker creates a new GearChunker with the given parameters
+func NewGearChunker(targetSize, minSize, maxSize uint32) *GearChunker {
+	return &GearChunker{
+		TargetSize: targetSize,
+		MinSize:    minSize,
+		MaxSize:    maxSize,
+	}
+}
+
+// gearMasks returns the masks used below and above the target size
+func (c *GearChunker) gearMasks() (small, large uint64) {
+	n := bits.Len32(c.TargetSize) - 1 // log2 of the target
+	return topBits(n + gearNormalization), topBits(n - gearNormalization)
+}
+
+// topBits returns a mask of the n most significant bits
+func topBits(n int) uint64 {
+	n = max(1, min(n, 63))
+	return ^uint64(0) << (64 - n)
+}
+
+// Chunk splits sorted KV pairs into content-defined chunks. Boundaries fall
+// after the pair in which the Gear hash matched, respecting MinSize and MaxSize.
+func (c *GearChunker) Chunk(pairs []types.KVPair) [][]types.KVPair {
+	return ensureProgress(pairs, c.Split(pairs))
+}
+
+// Split returns the chunk boundaries of Chunk without its progress guarantee
+func (c *GearChunker) Split(pairs []types.KVPair) [][]types.KVPair {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	maskSmall, maskLarge := c.gearMasks()
+
+	var chunks [][]types.KVPair
+	start := 0
+	var fp uint64
+	size := 0
+	for i, pair := range pairs {
+		hit := false
+		for _, b := range SerializeKVPair(pair) {
+			fp = (fp << 1) + gearTable[b]
+			size++
+
+			if size < int(c.MinSize) || hit {
+				continue
+			}
+			mask := maskLarge
+			if size < int(c.TargetSize) {
+				mask = maskSmall
+			}
+			hit = fp&mask == 0
+		}
+
+		if hit || size >= int(c.MaxSize) {
+			chunks = append(chunks, pairs[start:i+1])
+			start = i + 1
+			fp = 0
+			size = 0
+		}
+	}
+
+	if start < len(pairs) {
+		chunks = append(chunks, pairs[start:])
+	}
+
+	return chunks
+}
@@ -0,0 +1,92 @@
+package chunker
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"microprolly/pkg/types"
+)
+
+// keyHashEntryOverhead is the size counted for each entry besides its key:
+// the two length prefixes of a serialized pair
+const keyHashEntryOverhead = 8
+
+// KeyHashChunker places chunk boundaries using only keys. Each key is hashed
+// on its own, and a boundary follows the key when its hash falls under a
+// threshold that grows with the key's size, once the chunk holds MinSize
+// bytes. MaxSize forces a boundary. Sizes count keys and length prefixes
+// but never values, so updating a value cannot move any boundary and
+// rewrites exactly one node per tree level.
+type KeyHashChunker struct {
+	// TargetSize is the average chunk size in key bytes
+	TargetSize uint32
+	// MinSize prevents tiny chunks
+	MinSize uint32
+	// MaxSize prevents huge chunks
+	MaxSize uint32
+}
+
+// NewKeyHashChunker creates a new KeyHashChunker with the given parameters
+func NewKeyHashChunker(targetSize, minSize, maxSize uint32) *KeyHashChunker {
+	return &KeyHashChunker{
+		TargetSize: targetSize,
+		MinSize:    minSize,
+		MaxSize:    maxSize,
+	}
+}
+
+// Chunk splits sorted KV pairs into chunks whose boundaries depend only on keys
+func (c *KeyHashChunker) Chunk(pairs []types.KVPair) [][]types.KVPair {
+	return ensureProgress(pairs, c.Split(pairs))
+}
+
+// Split returns the chunk boundaries of Chunk without its progress guarantee
+func (c *KeyHashChunker) Split(pairs []types.KVPair) [][]types.KVPair {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	// After MinSize, a key of size d ends the chunk with probability
+	// d / span, so chunks average MinSize + span = TargetSize bytes
+	var span uint64
+	if c.TargetSize > c.MinSize {
+		span = uint64(c.TargetSize - c.MinSize)
+	}
+
+	var chunks [][]types.KVPair
+	start := 0
+	var size uint64
+	for i, pair := range pairs {
+		d := uint64(len(pair.Key) + keyHashEntryOverhead)
+		size += d
+
+		if size >= uint64(c.MaxSize) ||
+			(size >= uint64(c.MinSize) && (span == 0 || keyHash(pair.Key)%span < d)) {
+			chunks = append(chunks, pairs[start:i+1])
+			start = i + 1
+			size = 0
+		}
+	}
+
+	if start < len(pairs) {
+		chunks = append(chunks, pairs[start:])
+	}
+
+	return chunks
+}
+
+// keyHash returns a well-mixed 64-bit hash of a key
+func keyHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	var sum [8]byte
+	x := binary.BigEndian.Uint64(h.Sum(sum[:0]))
+
+	// splitmix64 finalizer: FNV's low bits are weak for short keys
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
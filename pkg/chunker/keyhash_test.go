@@ -0,0 +1,122 @@
+package chunker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// chunkLengths returns the number of pairs in each chunk
+func chunkLengths(chunks [][]types.KVPair) []int {
+	lengths := make([]int, len(chunks))
+	for i, chunk := range chunks {
+		lengths[i] = len(chunk)
+	}
+	return lengths
+}
+
+// TestProperty_KeyHashBoundariesIgnoreValues tests that replacing every value
+// leaves the chunk boundaries unchanged
+func TestProperty_KeyHashBoundariesIgnoreValues(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		pairs := genSortedKVPairs().Draw(t, "pairs")
+		chunker := NewKeyHashChunker(64, 16, 256)
+
+		updated := make([]types.KVPair, len(pairs))
+		for i, pair := range pairs {
+			updated[i] = types.KVPair{
+				Key:   pair.Key,
+				Value: rapid.SliceOfN(rapid.Byte(), 0, 500).Draw(t, "new_value"),
+			}
+		}
+
+		before := chunkLengths(chunker.Chunk(pairs))
+		after := chunkLengths(chunker.Chunk(updated))
+		if len(before) != len(after) {
+			t.Fatalf("Chunk count changed from %d to %d", len(before), len(after))
+		}
+		for i := range before {
+			if before[i] != after[i] {
+				t.Fatalf("Chunk %d changed from %d to %d pairs", i, before[i], after[i])
+			}
+		}
+	})
+}
+
+// TestProperty_KeyHashChunksCoverInput tests that key-hash chunks keep every
+// pair in order and respect the maximum size
+func TestProperty_KeyHashChunksCoverInput(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		pairs := genSortedKVPairs().Draw(t, "pairs")
+		const maxSize = 256
+		chunks := NewKeyHashChunker(64, 16, maxSize).Chunk(pairs)
+
+		var joined []types.KVPair
+		for _, chunk := range chunks {
+			if len(chunks) > 1 {
+				size := 0
+				for _, pair := range chunk[:len(chunk)-1] {
+					size += len(pair.Key) + keyHashEntryOverhead
+				}
+				if size >= maxSize {
+					t.Fatalf("Chunk reached %d key bytes before its last pair", size)
+				}
+			}
+			joined = append(joined, chunk...)
+		}
+		if !chunksEqual(joined, pairs) {
+			t.Fatal("Chunks do not reassemble to the input")
+		}
+	})
+}
+
+// TestKeyHashChunker_AverageSize tests that chunks average near the target size
+func TestKeyHashChunker_AverageSize(t *testing.T) {
+	pairs := make([]types.KVPair, 20000)
+	for i := range pairs {
+		pairs[i] = types.KVPair{Key: []byte{byte(i >> 16), byte(i >> 8), byte(i), 'k'}, Value: []byte("v")}
+	}
+
+	const target = 512
+	chunks := NewKeyHashChunker(target, 128, 4096).Chunk(pairs)
+	avg := len(pairs) * (4 + keyHashEntryOverhead) / len(chunks)
+	if avg < target/2 || avg > target*2 {
+		t.Errorf("Average chunk size %d bytes, expected near %d", avg, target)
+	}
+}
+
+// TestNew_SelectsAlgorithm tests chunker construction by name
+func TestNew_SelectsAlgorithm(t *testing.T) {
+	for _, name := range []string{"", AlgorithmBuzhash} {
+		c, err := New(name, 4096, 512, 16384)
+		if err != nil {
+			t.Fatalf("New(%q) failed: %v", name, err)
+		}
+		if _, ok := c.(*BuzhashChunker); !ok {
+			t.Errorf("New(%q) returned %T, expected *BuzhashChunker", name, c)
+		}
+	}
+
+	expected := map[string]Chunker{
+		AlgorithmKeyHash:  &KeyHashChunker{},
+		AlgorithmGear:     &GearChunker{},
+		AlgorithmWeighted: &WeightedChunker{},
+	}
+	for name, want := range expected {
+		c, err := New(name, 4096, 512, 16384)
+		if err != nil {
+			t.Fatalf("New(%q) failed: %v", name, err)
+		}
+		if fmt.Sprintf("%T", c) != fmt.Sprintf("%T", want) {
+			t.Errorf("New(%q) returned %T, expected %T", name, c, want)
+		}
+	}
+
+	if _, err := New("nope", 4096, 512, 16384); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("New with unknown name returned %v, expected ErrUnknownAlgorithm", err)
+	}
+}
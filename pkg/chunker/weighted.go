@@ -0,0 +1,94 @@
+package chunker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"microprolly/pkg/types"
+)
+
+// weightedShape is the Weibull shape parameter of the chunk size
+// distribution. Higher values concentrate sizes more tightly around the
+// target; 4 is the value Dolt uses.
+const weightedShape = 4
+
+// WeightedChunker places a boundary after each pair with a probability that
+// grows with the size of the chunk so far, so chunk sizes follow a Weibull
+// distribution around TargetSize instead of the long geometric tail of a
+// fixed-probability rule.
+//
+// Each pair is hashed on its own (key and value), and the hash is compared
+// with the probability that a chunk which survived to its start size ends
+// before its end size. Decisions depend only on the pair and the chunk
+// size, so an edit only affects boundaries until the next unchanged one.
+type WeightedChunker struct {
+	// TargetSize is the average chunk size in bytes
+	TargetSize uint32
+	// MinSize prevents tiny chunks
+	MinSize uint32
+	// MaxSize prevents huge chunks
+	MaxSize uint32
+}
+
+// NewWeightedChunker creates a new WeightedChunker with the given parameters
+func NewWeightedChunker(targetSize, minSize, maxSize uint32) *WeightedChunker {
+	return &WeightedChunker{
+		TargetSize: targetSize,
+		MinSize:    minSize,
+		MaxSize:    maxSize,
+	}
+}
+
+// Chunk splits sorted KV pairs into chunks with size-weighted boundaries
+func (c *WeightedChunker) Chunk(pairs []types.KVPair) [][]types.KVPair {
+	return ensureProgress(pairs, c.Split(pairs))
+}
+
+// Split returns the chunk boundaries of Chunk without its progress guarantee
+func (c *WeightedChunker) Split(pairs []types.KVPair) [][]types.KVPair {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	// Scale so the mean of the Weibull distribution is the target:
+	// mean = scale * Gamma(1 + 1/shape)
+	scale := float64(c.TargetSize) / math.Gamma(1+1.0/weightedShape)
+
+	var chunks [][]types.KVPair
+	start := 0
+	size := 0
+	for i, pair := range pairs {
+		serialized := SerializeKVPair(pair)
+		prev := size
+		size += len(serialized)
+
+		if size >= int(c.MaxSize) ||
+			(size >= int(c.MinSize) && pairHashFraction(serialized) < weightedBoundaryProbability(prev, size, scale)) {
+			chunks = append(chunks, pairs[start:i+1])
+			start = i + 1
+			size = 0
+		}
+	}
+
+	if start < len(pairs) {
+		chunks = append(chunks, pairs[start:])
+	}
+
+	return chunks
+}
+
+// weightedBoundaryProbability returns the probability that a chunk of at
+// least from bytes ends by to bytes: (F(to) - F(from)) / (1 - F(from)) for
+// the Weibull CDF F(x) = 1 - exp(-(x/scale)^shape)
+func weightedBoundaryProbability(from, to int, scale float64) float64 {
+	a := math.Pow(float64(from)/scale, weightedShape)
+	b := math.Pow(float64(to)/scale, weightedShape)
+	return -math.Expm1(a - b)
+}
+
+// pairHashFraction maps the hash of a serialized pair to [0, 1)
+func pairHashFraction(serialized []byte) float64 {
+	sum := sha256.Sum256(serialized)
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
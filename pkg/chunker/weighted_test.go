@@ -0,0 +1,68 @@
+package chunker
+
+import (
+	"testing"
+
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// TestProperty_WeightedChunksCoverInput tests that weighted chunks keep every
+// pair in order and respect the maximum size
+func TestProperty_WeightedChunksCoverInput(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		pairs := genSortedKVPairs().Draw(t, "pairs")
+		const maxSize = 1024
+		chunks := NewWeightedChunker(256, 64, maxSize).Chunk(pairs)
+
+		var joined []types.KVPair
+		for _, chunk := range chunks {
+			if len(chunks) > 1 {
+				size := len(SerializeKVPairs(chunk[:len(chunk)-1]))
+				if size >= maxSize {
+					t.Fatalf("Chunk reached %d bytes before its last pair", size)
+				}
+			}
+			joined = append(joined, chunk...)
+		}
+		if !chunksEqual(joined, pairs) {
+			t.Fatal("Chunks do not reassemble to the input")
+		}
+	})
+}
+
+// TestWeightedChunker_AverageSize tests that chunks average near the target
+// with few cut at the maximum size
+func TestWeightedChunker_AverageSize(t *testing.T) {
+	pairs := recordPairs(20000, 100)
+	const target, minSize, maxSize = 4096, 512, 16384
+
+	stats := MeasureSizes(NewWeightedChunker(target, minSize, maxSize).Chunk(pairs), maxSize)
+	if stats.Mean < target/2 || stats.Mean > target*2 {
+		t.Errorf("Average chunk size %.0f bytes, expected near %d", stats.Mean, target)
+	}
+	if stats.AtMax > stats.Chunks/20 {
+		t.Errorf("%d of %d chunks were cut at the maximum size", stats.AtMax, stats.Chunks)
+	}
+}
+
+// TestWeightedBoundaryProbability tests that the boundary probability of a
+// fixed-size step is a probability and grows with the chunk size
+func TestWeightedBoundaryProbability(t *testing.T) {
+	const scale, step = 4096.0, 100
+	prev := -1.0
+	for size := 0; size < 4*scale; size += step {
+		p := weightedBoundaryProbability(size, size+step, scale)
+		if p < 0 || p > 1 {
+			t.Fatalf("Probability %f at size %d is out of range", p, size)
+		}
+		if p < prev {
+			t.Fatalf("Probability fell from %f to %f at size %d", prev, p, size)
+		}
+		prev = p
+	}
+	if prev < 0.99 {
+		t.Errorf("Probability far past the target is %f, expected near 1", prev)
+	}
+}
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"microprolly/pkg/tree"
+)
+
+// ErrCompareFailed is returned when a batch condition or compare-and-swap
+// does not match the working state
+var ErrCompareFailed = errors.New("compare failed: working state does not match")
+
+// batchOpKind identifies a batch operation
+type batchOpKind int
+
+const (
+	opPut batchOpKind = iota
+	opDelete
+	opDeleteRange
+	opExpect
+	opExpectAbsent
+)
+
+// batchOp is one operation of a Batch
+type batchOp struct {
+	kind  batchOpKind
+	key   []byte
+	value []byte
+	// end is the exclusive end of a range delete; nil is unbounded
+	end []byte
+	// inTable marks an op on the named table rather than the default
+	// keyspace
+	inTable bool
+	table   string
+}
+
+// Batch collects changes that Store.Apply makes together: either all of
+// them or none. The zero value is an empty batch.
+//
+// Conditions added with Expect and ExpectAbsent are checked against the
+// working state before any change is made. Changes are then applied in the
+// order they were added. Changes and conditions on named tables are added
+// through Table, so one batch can span several keyspaces.
+type Batch struct {
+	ops []batchOp
+}
+
+// Put sets key to value
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{kind: opPut, key: cloneBytes(key), value: append([]byte{}, value...)})
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{kind: opDelete, key: cloneBytes(key)})
+}
+
+// DeleteRange removes every key with start <= key < end. A nil end is
+// unbounded; a range with start >= end removes nothing.
+func (b *Batch) DeleteRange(start, end []byte) {
+	b.ops = append(b.ops, batchOp{kind: opDeleteRange, key: cloneBytes(start), end: cloneBytes(end)})
+}
+
+// Expect makes the batch fail unless key currently holds value
+func (b *Batch) Expect(key, value []byte) {
+	b.ops = append(b.ops, batchOp{kind: opExpect, key: cloneBytes(key), value: cloneBytes(value)})
+}
+
+// ExpectAbsent makes the batch fail unless key currently does not exist
+func (b *Batch) ExpectAbsent(key []byte) {
+	b.ops = append(b.ops, batchOp{kind: opExpectAbsent, key: cloneBytes(key)})
+}
+
+// BatchTable adds changes and conditions on one named table to a Batch
+type BatchTable struct {
+	b    *Batch
+	name string
+}
+
+// Table returns a handle that adds changes and conditions on the named
+// table to the batch
+func (b *Batch) Table(name string) *BatchTable {
+	return &BatchTable{b: b, name: name}
+}
+
+// Put sets key to value in the table
+func (t *BatchTable) Put(key, value []byte) {
+	t.b.Put(key, value)
+	t.b.markTable(t.name)
+}
+
+// Delete removes key from the table. Deleting a missing key is not an
+// error, unlike Table.Delete.
+func (t *BatchTable) Delete(key []byte) {
+	t.b.Delete(key)
+	t.b.markTable(t.name)
+}
+
+// DeleteRange removes every key of the table with start <= key < end
+func (t *BatchTable) DeleteRange(start, end []byte) {
+	t.b.DeleteRange(start, end)
+	t.b.markTable(t.name)
+}
+
+// Expect makes the batch fail unless key currently holds value in the table
+func (t *BatchTable) Expect(key, value []byte) {
+	t.b.Expect(key, value)
+	t.b.markTable(t.name)
+}
+
+// ExpectAbsent makes the batch fail unless key currently does not exist in
+// the table
+func (t *BatchTable) ExpectAbsent(key []byte) {
+	t.b.ExpectAbsent(key)
+	t.b.markTable(t.name)
+}
+
+// markTable moves the last op added to the named table
+func (b *Batch) markTable(name string) {
+	op := &b.ops[len(b.ops)-1]
+	op.inTable, op.table = true, name
+}
+
+// Len returns the number of operations in the batch, conditions included
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Apply makes every change in the batch under one lock, or none of them.
+// All keys are validated and all conditions checked before anything is
+// modified: an empty key fails with ErrInvalidKey, an empty table name
+// with ErrInvalidTableName, and an unmet condition with an error wrapping
+// ErrCompareFailed that names the key. With a write-ahead log the batch is
+// logged as a single record, table changes included, so it is also
+// replayed whole or not at all.
+func (s *Store) Apply(b *Batch) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	for _, op := range b.ops {
+		if op.inTable && op.table == "" {
+			return ErrInvalidTableName
+		}
+		if op.kind != opDeleteRange && len(op.key) == 0 {
+			return ErrInvalidKey
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := make([]*workingSet, len(b.ops))
+	for i, op := range b.ops {
+		w, err := s.batchTarget(op)
+		if err != nil {
+			return err
+		}
+		if err := checkCondition(s.traverser, w, op); err != nil {
+			if op.inTable {
+				return fmt.Errorf("table %s: %w", op.table, err)
+			}
+			return err
+		}
+		targets[i] = w
+	}
+
+	if err := s.logBatch(b.ops); err != nil {
+		return err
+	}
+	for i, op := range b.ops {
+		targets[i].apply(op)
+	}
+	return nil
+}
+
+// batchTarget returns the working set a batch op reads or changes: the
+// default keyspace or its table
+func (s *Store) batchTarget(op batchOp) (*workingSet, error) {
+	if !op.inTable {
+		return s.working, nil
+	}
+	return s.tableWorkingSet(op.table)
+}
+
+// CompareAndSwap sets key to newValue only if it currently holds expected.
+// Otherwise nothing changes and an error wrapping ErrCompareFailed is
+// returned. Use PutIfAbsent to require that the key does not exist.
+func (s *Store) CompareAndSwap(key, expected, newValue []byte) error {
+	var b Batch
+	b.Expect(key, expected)
+	b.Put(key, newValue)
+	return s.Apply(&b)
+}
+
+// PutIfAbsent sets key to value only if it does not exist. Otherwise
+// nothing changes and an error wrapping ErrCompareFailed is returned.
+func (s *Store) PutIfAbsent(key, value []byte) error {
+	var b Batch
+	b.ExpectAbsent(key)
+	b.Put(key, value)
+	return s.Apply(&b)
+}
+
+// CompareAndSwap sets key to newValue in the table only if it currently
+// holds expected, like Store.CompareAndSwap
+func (t *Table) CompareAndSwap(key, expected, newValue []byte) error {
+	var b Batch
+	b.Table(t.name).Expect(key, expected)
+	b.Table(t.name).Put(key, newValue)
+	return t.s.Apply(&b)
+}
+
+// PutIfAbsent sets key to value in the table only if it does not exist,
+// like Store.PutIfAbsent
+func (t *Table) PutIfAbsent(key, value []byte) error {
+	var b Batch
+	b.Table(t.name).ExpectAbsent(key)
+	b.Table(t.name).Put(key, value)
+	return t.s.Apply(&b)
+}
+
+// checkCondition verifies a condition op against the working set w;
+// other ops always pass
+func checkCondition(traverser *tree.TreeTraverser, w *workingSet, op batchOp) error {
+	switch op.kind {
+	case opExpect:
+		current, err := w.value(traverser, op.key)
+		if errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("%w: key %q not found", ErrCompareFailed, op.key)
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, op.value) {
+			return fmt.Errorf("%w: key %q has a different value", ErrCompareFailed, op.key)
+		}
+	case opExpectAbsent:
+		if w.has(op.key) {
+			return fmt.Errorf("%w: key %q already exists", ErrCompareFailed, op.key)
+		}
+	}
+	return nil
+}
+
+// cloneBytes returns a copy of b that keeps nil distinct from empty
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"pgregory.net/rapid"
+)
+
+// TestApply_AllOrNothing tests that an invalid key or failed condition
+// anywhere in a batch leaves the working state untouched
+func TestApply_AllOrNothing(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	fillAndCommit(t, s, "k", 5)
+
+	var b Batch
+	b.Put([]byte("new"), []byte("1"))
+	b.Delete([]byte("k-0000"))
+	b.Put(nil, []byte("bad"))
+	if err := s.Apply(&b); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("Apply returned %v, expected ErrInvalidKey", err)
+	}
+	expectMissing(t, s, "new")
+	expectValue(t, s, "k-0000", "value-k-0")
+
+	b.Reset()
+	b.Put([]byte("new"), []byte("1"))
+	b.DeleteRange([]byte("k-0001"), []byte("k-0003"))
+	b.Expect([]byte("k-0004"), []byte("stale"))
+	if err := s.Apply(&b); !errors.Is(err, ErrCompareFailed) {
+		t.Fatalf("Apply returned %v, expected ErrCompareFailed", err)
+	}
+	expectMissing(t, s, "new")
+	expectValue(t, s, "k-0001", "value-k-1")
+
+	b.Reset()
+	b.Expect([]byte("k-0004"), []byte("value-k-4"))
+	b.ExpectAbsent([]byte("new"))
+	b.Put([]byte("new"), []byte("1"))
+	b.DeleteRange([]byte("k-0001"), []byte("k-0003"))
+	b.Delete([]byte("missing"))
+	if err := s.Apply(&b); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	expectValue(t, s, "new", "1")
+	expectMissing(t, s, "k-0001")
+	expectMissing(t, s, "k-0002")
+	expectValue(t, s, "k-0003", "value-k-3")
+}
+
+// TestCompareAndSwap tests swaps against present, changed and absent keys
+func TestCompareAndSwap(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+
+	if err := s.CompareAndSwap([]byte("counter"), []byte("0"), []byte("1")); !errors.Is(err, ErrCompareFailed) {
+		t.Errorf("swap of a missing key returned %v, expected ErrCompareFailed", err)
+	}
+	if err := s.PutIfAbsent([]byte("counter"), []byte("0")); err != nil {
+		t.Fatalf("PutIfAbsent failed: %v", err)
+	}
+	if err := s.PutIfAbsent([]byte("counter"), []byte("9")); !errors.Is(err, ErrCompareFailed) {
+		t.Errorf("PutIfAbsent of an existing key returned %v, expected ErrCompareFailed", err)
+	}
+	if err := s.CompareAndSwap([]byte("counter"), []byte("0"), []byte("1")); err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	if err := s.CompareAndSwap([]byte("counter"), []byte("0"), []byte("2")); !errors.Is(err, ErrCompareFailed) {
+		t.Errorf("stale swap returned %v, expected ErrCompareFailed", err)
+	}
+	expectValue(t, s, "counter", "1")
+
+	if err := s.CompareAndSwap(nil, nil, []byte("x")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("swap of an empty key returned %v, expected ErrInvalidKey", err)
+	}
+}
+
+// TestApply_ReplayedFromWAL tests that a logged batch, range deletes
+// included, is restored after a crash
+func TestApply_ReplayedFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fillAndCommit(t, s, "k", 10)
+
+	var b Batch
+	b.Put([]byte("added"), []byte("1"))
+	b.DeleteRange([]byte("k-0002"), []byte("k-0005"))
+	b.DeleteRange([]byte("k-0008"), nil)
+	if err := s.Apply(&b); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	crash(s)
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	expectValue(t, s, "added", "1")
+	expectValue(t, s, "k-0001", "value-k-1")
+	for _, key := range []string{"k-0002", "k-0004", "k-0008", "k-0009"} {
+		expectMissing(t, s, key)
+	}
+	expectValue(t, s, "k-0005", "value-k-5")
+}
+
+// TestApply_Tables tests that one batch changes the default keyspace and
+// named tables together, all or nothing, and is replayed whole
+func TestApply_Tables(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fillAndCommit(t, s, "k", 5)
+	fillTable(t, s.Table("samples"), "s", 5)
+	if _, err := s.Commit("load"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	var b Batch
+	b.Put([]byte("new"), []byte("1"))
+	b.Table("samples").Put([]byte("s-new"), []byte("1"))
+	b.Table("").Put([]byte("x"), []byte("1"))
+	if err := s.Apply(&b); !errors.Is(err, ErrInvalidTableName) {
+		t.Fatalf("Apply returned %v, expected ErrInvalidTableName", err)
+	}
+
+	// A failed condition on a table leaves every keyspace untouched
+	b.Reset()
+	b.Put([]byte("new"), []byte("1"))
+	b.Table("variants").Put([]byte("v-new"), []byte("1"))
+	b.Table("samples").Expect([]byte("s-0000"), []byte("stale"))
+	if err := s.Apply(&b); !errors.Is(err, ErrCompareFailed) {
+		t.Fatalf("Apply returned %v, expected ErrCompareFailed", err)
+	}
+	expectMissing(t, s, "new")
+	if _, err := s.Table("variants").Get([]byte("v-new")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(v-new) returned %v, expected ErrKeyNotFound", err)
+	}
+	if changed, err := s.hasUncommittedChanges(); err != nil || changed {
+		t.Errorf("hasUncommittedChanges() = %v, %v after a failed batch", changed, err)
+	}
+
+	// The same key in different keyspaces is checked in its own keyspace
+	b.Reset()
+	b.ExpectAbsent([]byte("s-0000"))
+	b.Table("samples").Expect([]byte("s-0000"), []byte("samples/value-s-0"))
+	b.Table("samples").Put([]byte("s-0000"), []byte("changed"))
+	b.Table("samples").DeleteRange([]byte("s-0002"), []byte("s-0004"))
+	b.Table("samples").Delete([]byte("missing"))
+	b.Table("variants").Put([]byte("v-new"), []byte("1"))
+	b.Put([]byte("new"), []byte("1"))
+	if err := s.Apply(&b); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	crash(s)
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	expectValue(t, s, "new", "1")
+	expectMissing(t, s, "s-0000")
+	expectTableValue(t, s.Table("samples"), "s-0000", "changed")
+	expectTableValue(t, s.Table("samples"), "s-0001", "samples/value-s-1")
+	for _, key := range []string{"s-0002", "s-0003"} {
+		if _, err := s.Table("samples").Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get(%s) returned %v, expected ErrKeyNotFound", key, err)
+		}
+	}
+	expectTableValue(t, s.Table("variants"), "v-new", "1")
+}
+
+// TestTable_CompareAndSwap tests swaps and absent puts on a table
+func TestTable_CompareAndSwap(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	table := s.Table("counters")
+
+	if err := table.PutIfAbsent([]byte("n"), []byte("0")); err != nil {
+		t.Fatalf("PutIfAbsent failed: %v", err)
+	}
+	if err := table.PutIfAbsent([]byte("n"), []byte("0")); !errors.Is(err, ErrCompareFailed) {
+		t.Errorf("second PutIfAbsent returned %v, expected ErrCompareFailed", err)
+	}
+	if err := table.CompareAndSwap([]byte("n"), []byte("0"), []byte("1")); err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	if err := table.CompareAndSwap([]byte("n"), []byte("0"), []byte("2")); !errors.Is(err, ErrCompareFailed) {
+		t.Errorf("stale CompareAndSwap returned %v, expected ErrCompareFailed", err)
+	}
+	expectTableValue(t, table, "n", "1")
+	expectMissing(t, s, "n")
+}
+
+// TestProperty_ApplyMatchesModel checks random batches against a map model:
+// a batch either fails and changes nothing, or applies every change in order
+func TestProperty_ApplyMatchesModel(t *testing.T) {
+	rapid.Check(t, func(rt *rapid.T) {
+		s := NewInMemory()
+		model := make(map[string]string)
+		key := func(label string) string {
+			return fmt.Sprintf("key%02d", rapid.IntRange(0, 20).Draw(rt, label))
+		}
+
+		for round := 0; round < 5; round++ {
+			var b Batch
+			next := make(map[string]string, len(model))
+			for k, v := range model {
+				next[k] = v
+			}
+			ok := true
+
+			for i, n := 0, rapid.IntRange(0, 8).Draw(rt, "ops"); i < n; i++ {
+				switch rapid.IntRange(0, 4).Draw(rt, "op") {
+				case 0:
+					k, v := key("key"), rapid.StringN(0, 4, -1).Draw(rt, "value")
+					b.Put([]byte(k), []byte(v))
+					next[k] = v
+				case 1:
+					k := key("key")
+					b.Delete([]byte(k))
+					delete(next, k)
+				case 2:
+					start, end := key("start"), key("end")
+					b.DeleteRange([]byte(start), []byte(end))
+					for k := range next {
+						if k >= start && k < end {
+							delete(next, k)
+						}
+					}
+				case 3:
+					k := key("key")
+					current, exists := model[k]
+					if rapid.Bool().Draw(rt, "match") && exists {
+						b.Expect([]byte(k), []byte(current))
+					} else {
+						b.Expect([]byte(k), []byte("never"))
+						ok = ok && exists && current == "never"
+					}
+				case 4:
+					k := key("key")
+					b.ExpectAbsent([]byte(k))
+					_, exists := model[k]
+					ok = ok && !exists
+				}
+			}
+
+			err := s.Apply(&b)
+			if ok != (err == nil) {
+				rt.Fatalf("Apply returned %v, expected success %v", err, ok)
+			}
+			if ok {
+				model = next
+			}
+
+			var keys []string
+			for k := range model {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for i := 0; i <= 20; i++ {
+				k := fmt.Sprintf("key%02d", i)
+				got, err := s.Get([]byte(k))
+				want, exists := model[k]
+				if exists != (err == nil) || (exists && string(got) != want) {
+					rt.Fatalf("Get(%q) = %q, %v; model has %q, %v (keys %v)", k, got, err, want, exists, keys)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,648 @@
+package store
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"microprolly/pkg/branch"
+	"microprolly/pkg/tree"
+	"microprolly/pkg/types"
+)
+
+const (
+	// bundleMagic identifies a MicroProlly bundle file
+	bundleMagic = "MPBUNDLE"
+	// bundleVersion is the bundle format version written when a bundle has
+	// no tags; bundleTagsVersion adds a kind byte to each ref so tags can be
+	// told from branches
+	bundleVersion     = 1
+	bundleTagsVersion = 2
+	// tagRefPrefix marks a tag in the ref names given to CreateBundle;
+	// branchRefPrefix may be used to name a branch explicitly
+	tagRefPrefix    = "refs/tags/"
+	branchRefPrefix = "refs/heads/"
+	// maxBundleNameLen bounds ref names read from a bundle header
+	maxBundleNameLen = 4096
+	// maxBundleObjectSize bounds object lengths read from a bundle. Nodes
+	// and blob chunks are at most a few hundred KiB; the bound leaves room
+	// for the index of a value of about 100 GiB and for the large inline
+	// values of format 1 leaves.
+	maxBundleObjectSize = 64 << 20
+)
+
+var (
+	// ErrInvalidBundle is returned when a bundle is malformed or truncated
+	ErrInvalidBundle = errors.New("invalid bundle")
+	// ErrBundleChecksum is returned when a bundled object does not match its hash
+	ErrBundleChecksum = errors.New("bundle object hash mismatch")
+	// ErrBundlePrerequisite is returned when a bundle's basis commits are missing
+	ErrBundlePrerequisite = errors.New("bundle prerequisite commit not found")
+	// ErrBundleNotFastForward is returned when a bundle would move a branch
+	// to a commit that does not descend from its current one
+	ErrBundleNotFastForward = errors.New("bundle ref is not a fast-forward of the local branch")
+)
+
+// ImportOptions controls how ImportBundle moves existing branches
+type ImportOptions struct {
+	// Force moves branches to the bundle's commits even when they do not
+	// descend from the branches' current commits
+	Force bool
+}
+
+// ImportOption sets a field of ImportOptions
+type ImportOption func(*ImportOptions)
+
+// WithForcedImport lets ImportBundle rewind or replace branch history
+func WithForcedImport() ImportOption {
+	return func(o *ImportOptions) { o.Force = true }
+}
+
+// BundleRef is a branch or tag recorded in a bundle header
+type BundleRef struct {
+	Name       string
+	CommitHash types.Hash
+	// Tag is the tag object of a tag, whose CommitHash is the tagged
+	// commit. It is zero for branches.
+	Tag types.Hash
+}
+
+// IsTag reports whether the ref is a tag
+func (r BundleRef) IsTag() bool {
+	return r.Tag != ZeroHash
+}
+
+// CreateBundle writes a self-describing bundle containing the given branches
+// and tags and every object needed to reconstruct them. Refs are branch
+// names; a name starting with "refs/tags/" names a tag, and one starting
+// with "refs/heads/" a branch whose name would otherwise look like a tag.
+//
+// Bundle format:
+//
+//	[8 bytes: magic "MPBUNDLE"]
+//	[4 bytes: format version]
+//	[4 bytes: ref count]
+//	For each ref:
+//	  [1 byte: 0 for a branch, 1 for a tag; version 2 only]
+//	  [4 bytes: name length][N bytes: name]
+//	  [32 bytes: commit hash, or tag object hash for a tag]
+//	[4 bytes: prerequisite count]
+//	For each prerequisite:
+//	  [32 bytes: commit hash]
+//	[4 bytes: object count]
+//	For each object:
+//	  [32 bytes: SHA-256][4 bytes: length][M bytes: data]
+//
+// Commits in exclude are prerequisites: the receiver must already have them,
+// so their history and the tree nodes of their roots are left out. This makes
+// incremental bundles relative to a known commit contain only new objects.
+func (s *Store) CreateBundle(w io.Writer, refs []string, exclude []types.Hash) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bundleRefs := make([]BundleRef, 0, len(refs))
+	tips := make([]types.Hash, 0, len(refs))
+	version := uint32(bundleVersion)
+	for _, name := range refs {
+		ref, err := s.bundleRef(name)
+		if err != nil {
+			return err
+		}
+		bundleRefs = append(bundleRefs, ref)
+		if ref.IsTag() {
+			version = bundleTagsVersion
+		}
+		if ref.CommitHash != ZeroHash {
+			tips = append(tips, ref.CommitHash)
+		}
+	}
+
+	// Everything reachable from the basis commits is assumed present on the receiver
+	known, err := s.collectBasisObjects(exclude)
+	if err != nil {
+		return err
+	}
+
+	var objects []types.Hash
+	for _, ref := range bundleRefs {
+		if ref.IsTag() && !known[ref.Tag] {
+			known[ref.Tag] = true
+			objects = append(objects, ref.Tag)
+		}
+	}
+	history, err := s.collectBundleObjects(tips, known)
+	if err != nil {
+		return err
+	}
+	objects = append(objects, history...)
+
+	bw := bufio.NewWriter(w)
+
+	// Header
+	bw.WriteString(bundleMagic)
+	writeUint32(bw, version)
+	writeUint32(bw, uint32(len(bundleRefs)))
+	for _, ref := range bundleRefs {
+		hash := ref.CommitHash
+		if version == bundleTagsVersion {
+			kind := byte(0)
+			if ref.IsTag() {
+				kind, hash = 1, ref.Tag
+			}
+			bw.WriteByte(kind)
+		}
+		writeUint32(bw, uint32(len(ref.Name)))
+		bw.WriteString(ref.Name)
+		bw.Write(hash[:])
+	}
+	writeUint32(bw, uint32(len(exclude)))
+	for _, h := range exclude {
+		bw.Write(h[:])
+	}
+
+	// Objects
+	writeUint32(bw, uint32(len(objects)))
+	for _, h := range objects {
+		data, err := s.cas.Read(h)
+		if err != nil {
+			return fmt.Errorf("failed to read object %s: %w", h.String(), err)
+		}
+		bw.Write(h[:])
+		writeUint32(bw, uint32(len(data)))
+		if _, err := bw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ImportBundle reads a bundle, verifies and stores its objects, and then
+// creates or updates the branches and tags listed in its header.
+// Every object's SHA-256 is checked before it is written to the CAS.
+//
+// An existing branch is only moved to a commit that descends from its
+// current one; otherwise the import fails with ErrBundleNotFastForward,
+// unless WithForcedImport is given. Likewise an existing tag is only
+// replaced by a different tag object when forced; otherwise the import
+// fails with branch.ErrTagExists. If the currently checked-out branch is
+// moved, HEAD and the working state follow it, so the import fails with
+// ErrUncommittedChanges while the working state differs from HEAD. No
+// branch is changed when the import fails.
+func (s *Store) ImportBundle(r io.Reader, opts ...ImportOption) ([]BundleRef, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	var importOpts ImportOptions
+	for _, opt := range opts {
+		opt(&importOpts)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	br := bufio.NewReader(r)
+
+	// Header
+	magic := make([]byte, len(bundleMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != bundleMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidBundle)
+	}
+	version, err := readUint32(br)
+	if err != nil {
+		return nil, err
+	}
+	if version != bundleVersion && version != bundleTagsVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBundle, version)
+	}
+
+	refCount, err := readUint32(br)
+	if err != nil {
+		return nil, err
+	}
+	var refs []BundleRef
+	for i := uint32(0); i < refCount; i++ {
+		isTag := false
+		if version == bundleTagsVersion {
+			kind, err := br.ReadByte()
+			if err != nil || kind > 1 {
+				return nil, fmt.Errorf("%w: bad ref kind", ErrInvalidBundle)
+			}
+			isTag = kind == 1
+		}
+		nameLen, err := readUint32(br)
+		if err != nil {
+			return nil, err
+		}
+		if nameLen > maxBundleNameLen {
+			return nil, fmt.Errorf("%w: ref name too long", ErrInvalidBundle)
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, fmt.Errorf("%w: truncated ref name", ErrInvalidBundle)
+		}
+		if err := branch.ValidateBranchName(string(name)); err != nil {
+			return nil, err
+		}
+		hash, err := readHash(br)
+		if err != nil {
+			return nil, err
+		}
+		if isTag {
+			// The tagged commit is read from the tag object once it is stored
+			refs = append(refs, BundleRef{Name: string(name), Tag: hash})
+		} else {
+			refs = append(refs, BundleRef{Name: string(name), CommitHash: hash})
+		}
+	}
+
+	prereqCount, err := readUint32(br)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < prereqCount; i++ {
+		h, err := readHash(br)
+		if err != nil {
+			return nil, err
+		}
+		if !s.cas.Exists(h) {
+			return nil, fmt.Errorf("%w: %s", ErrBundlePrerequisite, h.String())
+		}
+	}
+
+	// Objects
+	objectCount, err := readUint32(br)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < objectCount; i++ {
+		expected, err := readHash(br)
+		if err != nil {
+			return nil, err
+		}
+		length, err := readUint32(br)
+		if err != nil {
+			return nil, err
+		}
+		if length > maxBundleObjectSize {
+			return nil, fmt.Errorf("%w: object %s is %d bytes", ErrInvalidBundle, expected.String(), length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("%w: truncated object", ErrInvalidBundle)
+		}
+
+		// Verify before anything touches the object store
+		if sha256.Sum256(data) != expected {
+			return nil, fmt.Errorf("%w: %s", ErrBundleChecksum, expected.String())
+		}
+		if s.cas.Exists(expected) {
+			continue
+		}
+		if _, err := s.cas.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.syncObjects(); err != nil {
+		return nil, err
+	}
+
+	headState, err := s.refs.GetHead()
+	if err != nil {
+		return nil, err
+	}
+
+	// All referenced commits and their trees must now be complete, and
+	// every branch move allowed, before any branch points at them
+	seen := make(map[types.Hash]bool)
+	for i, ref := range refs {
+		if ref.IsTag() {
+			tag, err := s.readTag(ref.Tag)
+			if err != nil || tag.Name != ref.Name {
+				return nil, fmt.Errorf("%w: missing or mismatched tag object for %s", ErrInvalidBundle, ref.Name)
+			}
+			ref.CommitHash = tag.Commit
+			refs[i] = ref
+		}
+		if err := s.checkBundleRef(ref, headState, importOpts); err != nil {
+			return nil, err
+		}
+		if ref.CommitHash == ZeroHash {
+			continue
+		}
+		commit, err := s.commitMgr.GetCommit(ref.CommitHash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: missing commit %s for %s", ErrInvalidBundle, ref.CommitHash.String(), ref.Name)
+		}
+		missing := ZeroHash
+		err = s.walkCommitTrees(commit, seen, func(h types.Hash) {
+			if missing == ZeroHash && !s.cas.Exists(h) {
+				missing = h
+			}
+		})
+		if err == nil && missing != ZeroHash {
+			err = fmt.Errorf("object %s not found", missing.String())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: incomplete trees for %s: %v", ErrInvalidBundle, ref.Name, err)
+		}
+		if err := s.checkBranchUpdate(ref.Name, ref.CommitHash); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ref := range refs {
+		if ref.IsTag() {
+			if s.refs.TagExists(ref.Name) {
+				err = s.refs.UpdateTag(ref.Name, ref.Tag)
+			} else {
+				err = s.refs.CreateTag(ref.Name, ref.Tag)
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if s.refs.BranchExists(ref.Name) {
+			err = s.refs.UpdateBranch(ref.Name, ref.CommitHash)
+		} else {
+			err = s.refs.CreateBranch(ref.Name, ref.CommitHash)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !headState.IsDetached && headState.Branch == ref.Name && ref.CommitHash != s.head {
+			s.head = ref.CommitHash
+			if err := s.resetWorkingStateToHead(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// bundleRef resolves a ref name given to CreateBundle
+func (s *Store) bundleRef(name string) (BundleRef, error) {
+	if tagName, ok := strings.CutPrefix(name, tagRefPrefix); ok {
+		tagHash, err := s.refs.GetTag(tagName)
+		if err != nil {
+			return BundleRef{}, err
+		}
+		tag, err := s.readTag(tagHash)
+		if err != nil {
+			return BundleRef{}, err
+		}
+		return BundleRef{Name: tagName, CommitHash: tag.Commit, Tag: tagHash}, nil
+	}
+
+	name = strings.TrimPrefix(name, branchRefPrefix)
+	commitHash, err := s.refs.GetBranch(name)
+	if err != nil {
+		return BundleRef{}, err
+	}
+	return BundleRef{Name: name, CommitHash: commitHash}, nil
+}
+
+// checkBundleRef checks that importing ref may move its branch: only
+// forward unless forced, and only with a clean working state if the branch
+// is checked out. A tag may only be replaced when forced.
+func (s *Store) checkBundleRef(ref BundleRef, headState *branch.HeadState, opts ImportOptions) error {
+	if ref.IsTag() {
+		current, err := s.refs.GetTag(ref.Name)
+		if err == branch.ErrTagNotFound || (err == nil && (current == ref.Tag || opts.Force)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s points at a different tag object", branch.ErrTagExists, ref.Name)
+	}
+	if !s.refs.BranchExists(ref.Name) {
+		return nil
+	}
+	current, err := s.refs.GetBranch(ref.Name)
+	if err != nil {
+		return err
+	}
+	if current == ref.CommitHash {
+		return nil
+	}
+
+	if !opts.Force {
+		forward, err := s.descendsFrom(ref.CommitHash, current)
+		if err != nil {
+			return err
+		}
+		if !forward {
+			return fmt.Errorf("%w: %s at %s, bundle has %s", ErrBundleNotFastForward,
+				ref.Name, current.String(), ref.CommitHash.String())
+		}
+	}
+
+	if !headState.IsDetached && headState.Branch == ref.Name {
+		changed, err := s.hasUncommittedChanges()
+		if err != nil {
+			return err
+		}
+		if changed {
+			return fmt.Errorf("%w: importing would move the checked-out branch %s", ErrUncommittedChanges, ref.Name)
+		}
+	}
+	return nil
+}
+
+// descendsFrom reports whether ancestor is commitHash or one of its
+// ancestors. Every commit descends from ZeroHash, the empty branch.
+func (s *Store) descendsFrom(commitHash, ancestor types.Hash) (bool, error) {
+	for current := commitHash; current != ZeroHash; {
+		if current == ancestor {
+			return true, nil
+		}
+		commit, err := s.commitMgr.GetCommit(current)
+		if err != nil {
+			return false, err
+		}
+		current = commit.Parent
+	}
+	return ancestor == ZeroHash, nil
+}
+
+// resetWorkingStateToHead replaces the working state with the HEAD commit's
+// data, discarding logged changes
+func (s *Store) resetWorkingStateToHead() error {
+	if s.head == ZeroHash {
+		s.clearWorkingState()
+	} else if err := s.loadWorkingStateFromHead(); err != nil {
+		return err
+	}
+	return s.resetWAL()
+}
+
+// collectBasisObjects returns the set of objects a bundle receiver is assumed
+// to have: the basis commits, their ancestors, and the trees of the basis commits
+func (s *Store) collectBasisObjects(basis []types.Hash) (map[types.Hash]bool, error) {
+	known := make(map[types.Hash]bool)
+
+	for _, h := range basis {
+		commit, err := s.commitMgr.GetCommit(h)
+		if err != nil {
+			return nil, ErrCommitNotFound
+		}
+		if err := s.walkCommitTrees(commit, known, func(types.Hash) {}); err != nil {
+			return nil, err
+		}
+
+		for current := h; current != ZeroHash && !known[current]; {
+			known[current] = true
+			c, err := s.commitMgr.GetCommit(current)
+			if err != nil {
+				return nil, err
+			}
+			current = c.Parent
+		}
+	}
+
+	return known, nil
+}
+
+// collectBundleObjects walks history and trees from the given tips and returns
+// every object hash not already in known, in a deterministic order
+func (s *Store) collectBundleObjects(tips []types.Hash, known map[types.Hash]bool) ([]types.Hash, error) {
+	var objects []types.Hash
+	add := func(h types.Hash) { objects = append(objects, h) }
+
+	for _, tip := range tips {
+		for current := tip; current != ZeroHash && !known[current]; {
+			known[current] = true
+			commit, err := s.commitMgr.GetCommit(current)
+			if err != nil {
+				return nil, err
+			}
+			add(current)
+
+			if err := s.walkCommitTrees(commit, known, add); err != nil {
+				return nil, err
+			}
+			current = commit.Parent
+		}
+	}
+
+	return objects, nil
+}
+
+// walkCommitTrees walks the trees of a commit: its root tree, its table map
+// and the tree of every table. Tables already in seen are skipped.
+func (s *Store) walkCommitTrees(commit *types.Commit, seen map[types.Hash]bool, visit func(types.Hash)) error {
+	if err := s.walkTree(commit.RootHash, seen, visit); err != nil {
+		return err
+	}
+	if commit.Tables == ZeroHash || seen[commit.Tables] {
+		return nil
+	}
+	roots, err := s.loadTableRoots(commit.Tables)
+	if err != nil {
+		return err
+	}
+	if err := s.walkTree(commit.Tables, seen, visit); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(roots)) {
+		if err := s.walkTree(roots[name], seen, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTree visits every node reachable from root that is not already in seen,
+// along with the blob objects of values stored out of line.
+// Subtrees whose root is in seen are skipped entirely.
+func (s *Store) walkTree(root types.Hash, seen map[types.Hash]bool, visit func(types.Hash)) error {
+	if seen[root] {
+		return nil
+	}
+	seen[root] = true
+
+	data, err := s.cas.Read(root)
+	if err != nil {
+		return fmt.Errorf("failed to read node %s: %w", root.String(), err)
+	}
+	visit(root)
+
+	node, err := tree.DeserializeNode(data)
+	if err != nil {
+		return err
+	}
+	if node.IsLeaf() {
+		return s.walkLeafBlobs(node.(*types.LeafNode), seen, visit)
+	}
+
+	for _, child := range node.(*types.InternalNode).Children {
+		if err := s.walkTree(child.Hash, seen, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeUint32 writes a big-endian uint32
+func writeUint32(w io.Writer, v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	w.Write(buf[:])
+}
+
+// readUint32 reads a big-endian uint32
+func readUint32(r io.Reader) (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, fmt.Errorf("%w: truncated data", ErrInvalidBundle)
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+// readHash reads a raw 32-byte hash
+func readHash(r io.Reader) (types.Hash, error) {
+	var h types.Hash
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return types.Hash{}, fmt.Errorf("%w: truncated hash", ErrInvalidBundle)
+	}
+	return h, nil
+}
+
+// walkLeafBlobs visits the blob index and chunks of every out-of-line value
+// in a leaf that are not already in seen
+func (s *Store) walkLeafBlobs(leaf *types.LeafNode, seen map[types.Hash]bool, visit func(types.Hash)) error {
+	for _, pair := range leaf.Pairs {
+		if !pair.ValueRef {
+			continue
+		}
+		ref, err := tree.DecodeBlobRef(pair.Value)
+		if err != nil {
+			return err
+		}
+		if seen[ref.Index] {
+			continue
+		}
+
+		objects, err := tree.BlobObjects(s.cas, ref)
+		if err != nil {
+			return fmt.Errorf("failed to read blob %s: %w", ref.Index.String(), err)
+		}
+		for _, h := range objects {
+			if !seen[h] {
+				seen[h] = true
+				visit(h)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"microprolly/pkg/types"
+)
+
+// fillAndCommit puts count keys with the given prefix and commits them
+func fillAndCommit(t *testing.T, s *Store, prefix string, count int) types.Hash {
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("%s-%04d", prefix, i))
+		if err := s.Put(key, []byte(fmt.Sprintf("value-%s-%d", prefix, i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	h, err := s.Commit("commit " + prefix)
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	return h
+}
+
+// TestBundle_RoundTrip tests that a full bundle reconstructs branches in an empty store
+func TestBundle_RoundTrip(t *testing.T) {
+	src, _, cleanupSrc := createTestStoreWithDir(t)
+	defer cleanupSrc()
+
+	fillAndCommit(t, src, "a", 200)
+	head := fillAndCommit(t, src, "b", 200)
+	if err := src.CreateBranch("feature"); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.CreateBundle(&buf, []string{"main", "feature"}, nil); err != nil {
+		t.Fatalf("CreateBundle failed: %v", err)
+	}
+
+	dst, _, cleanupDst := createTestStoreWithDir(t)
+	defer cleanupDst()
+
+	refs, err := dst.ImportBundle(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ImportBundle failed: %v", err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("Expected 2 refs, got %d", len(refs))
+	}
+
+	// main is checked out in dst, so HEAD and working state follow the import
+	if dst.Head() != head {
+		t.Fatalf("HEAD mismatch: got %s, want %s", dst.Head(), head)
+	}
+	value, err := dst.Get([]byte("b-0199"))
+	if err != nil || string(value) != "value-b-199" {
+		t.Fatalf("Get after import returned %q, %v", value, err)
+	}
+
+	log, err := dst.Log()
+	if err != nil {
+		t.Fatalf("Log failed: %v", err)
+	}
+	if len(log) != 2 {
+		t.Fatalf("Expected 2 commits in log, got %d", len(log))
+	}
+
+	branches, err := dst.ListBranches()
+	if err != nil {
+		t.Fatalf("ListBranches failed: %v", err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("Expected 2 branches, got %v", branches)
+	}
+}
+
+// TestBundle_LargeValues tests that bundles carry the blobs of values stored out of line
+func TestBundle_LargeValues(t *testing.T) {
+	src, _, cleanupSrc := createTestStoreWithDir(t)
+	defer cleanupSrc()
+
+	large := bytes.Repeat([]byte("large value "), 20000)
+	if err := src.Put([]byte("big"), large); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := src.Commit("large"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.CreateBundle(&buf, []string{"main"}, nil); err != nil {
+		t.Fatalf("CreateBundle failed: %v", err)
+	}
+
+	dst, _, cleanupDst := createTestStoreWithDir(t)
+	defer cleanupDst()
+
+	if _, err := dst.ImportBundle(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ImportBundle failed: %v", err)
+	}
+	value, err := dst.Get([]byte("big"))
+	if err != nil || !bytes.Equal(value, large) {
+		t.Fatalf("Get after import returned %d bytes, %v", len(value), err)
+	}
+}
+
+// TestBundle_Incremental tests that an incremental bundle only carries new objects
+// and requires its basis commit on import
+func TestBundle_Incremental(t *testing.T) {
+	src, _, cleanupSrc := createTestStoreWithDir(t)
+	defer cleanupSrc()
+
+	base := fillAndCommit(t, src, "a", 500)
+
+	var full bytes.Buffer
+	if err := src.CreateBundle(&full, []string{"main"}, nil); err != nil {
+		t.Fatalf("CreateBundle failed: %v", err)
+	}
+
+	// A single-key change on top of base
+	if err := src.Put([]byte("a-0250"), []byte("changed")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	head, err := src.Commit("change one key")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	var incr bytes.Buffer
+	if err := src.CreateBundle(&incr, []string{"main"}, []types.Hash{base}); err != nil {
+		t.Fatalf("CreateBundle failed: %v", err)
+	}
+	if incr.Len() >= full.Len()/2 {
+		t.Fatalf("Incremental bundle too large: %d bytes vs full %d bytes", incr.Len(), full.Len())
+	}
+
+	dst, _, cleanupDst := createTestStoreWithDir(t)
+	defer cleanupDst()
+
+	// Without the basis commit the import must fail
+	if _, err := dst.ImportBundle(bytes.NewReader(incr.Bytes())); !errors.Is(err, ErrBundlePrerequisite) {
+		t.Fatalf("Expected ErrBundlePrerequisite, got %v", err)
+	}
+
+	if _, err := dst.ImportBundle(bytes.NewReader(full.Bytes())); err != nil {
+		t.Fatalf("Full import failed: %v", err)
+	}
+	if _, err := dst.ImportBundle(bytes.NewReader(incr.Bytes())); err != nil {
+		t.Fatalf("Incremental import failed: %v", err)
+	}
+
+	if dst.Head() != head {
+		t.Fatalf("HEAD mismatch after incremental import")
+	}
+	value, err := dst.GetAt([]byte("a-0250"), head)
+	if err != nil || string(value) != "changed" {
+		t.Fatalf("GetAt returned %q, %v", value, err)
+	}
+}
+
+// TestBundle_CorruptObjectRejected tests that a tampered object fails verification
+func TestBundle_CorruptObjectRejected(t *testing.T) {
+	src, _, cleanupSrc := createTestStoreWithDir(t)
+	defer cleanupSrc()
+
+	fillAndCommit(t, src, "a", 10)
+
+	var buf bytes.Buffer
+	if err := src.CreateBundle(&buf, []string{"main"}, nil); err != nil {
+		t.Fatalf("CreateBundle failed: %v", err)
+	}
+
+	// Flip the last byte, which belongs to the final object's data
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	dst, _, cleanupDst := createTestStoreWithDir(t)
+	defer cleanupDst()
+
+	if _, err := dst.ImportBundle(bytes.NewReader(data)); !errors.Is(err, ErrBundleChecksum) {
+		t.Fatalf("Expected ErrBundleChecksum, got %v", err)
+	}
+
+	// Refs must not have been touched
+	if dst.Head() != ZeroHash {
+		t.Fatal("HEAD changed after failed import")
+	}
+}
+
+// writeTestBundle writes a bundle of one ref with the given objects, read
+// from s, and no prerequisites
+func writeTestBundle(t *testing.T, s *Store, ref BundleRef, objects []types.Hash) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString(bundleMagic)
+	writeUint32(&buf, bundleVersion)
+	writeUint32(&buf, 1)
+	writeUint32(&buf, uint32(len(ref.Name)))
+	buf.WriteString(ref.Name)
+	buf.Write(ref.CommitHash[:])
+	writeUint32(&buf, 0)
+	writeUint32(&buf, uint32(len(objects)))
+	for _, h := range objects {
+		data, err := s.cas.Read(h)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		buf.Write(h[:])
+		writeUint32(&buf, uint32(len(data)))
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// TestBundle_IncompleteTreeRejected tests that a bundle whose commit is
+// present but whose tree misses a node or blob chunk moves no branch
+func TestBundle_IncompleteTreeRejected(t *testing.T) {
+	src := NewInMemory()
+	defer src.Close()
+	if err := src.Put([]byte("big"), bytes.Repeat([]byte("large value "), 1000)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	head := fillAndCommit(t, src, "a", 500)
+	objects, err := src.collectBundleObjects([]types.Hash{head}, make(map[types.Hash]bool))
+	if err != nil {
+		t.Fatalf("collectBundleObjects failed: %v", err)
+	}
+
+	// objects[0] is the commit; drop each kind of tree object in turn
+	for _, dropped := range []int{1, len(objects) / 2, len(objects) - 1} {
+		kept := append(append([]types.Hash{}, objects[:dropped]...), objects[dropped+1:]...)
+		bundle := writeTestBundle(t, src, BundleRef{Name: "imported", CommitHash: head}, kept)
+
+		dst := NewInMemory()
+		if _, err := dst.ImportBundle(bytes.NewReader(bundle)); !errors.Is(err, ErrInvalidBundle) {
+			t.Errorf("dropping object %d: ImportBundle returned %v, expected ErrInvalidBundle", dropped, err)
+		}
+		if dst.refs.BranchExists("imported") {
+			t.Errorf("dropping object %d: the branch was created", dropped)
+		}
+		dst.Close()
+	}
+}
+
+// TestBundle_OversizedObjectRejected tests that an object length above the
+// bound fails before the object is allocated
+func TestBundle_OversizedObjectRejected(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(bundleMagic)
+	writeUint32(&buf, bundleVersion)
+	writeUint32(&buf, 0)
+	writeUint32(&buf, 0)
+	writeUint32(&buf, 1)
+	buf.Write(make([]byte, 32))
+	writeUint32(&buf, 0xffffffff)
+
+	s := NewInMemory()
+	defer s.Close()
+	if _, err := s.ImportBundle(&buf); !errors.Is(err, ErrInvalidBundle) {
+		t.Errorf("ImportBundle returned %v, expected ErrInvalidBundle", err)
+	}
+}
+
+// bundleOf returns a full bundle of the given branches of s
+func bundleOf(t *testing.T, s *Store, refs ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := s.CreateBundle(&buf, refs, nil); err != nil {
+		t.Fatalf("CreateBundle failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestBundle_UncommittedChangesKept tests that an import moving the
+// checked-out branch fails instead of discarding uncommitted changes
+func TestBundle_UncommittedChangesKept(t *testing.T) {
+	src := NewInMemory()
+	defer src.Close()
+	base := fillAndCommit(t, src, "a", 10)
+	first := bundleOf(t, src, "main")
+	head := fillAndCommit(t, src, "b", 10)
+	if err := src.CreateBranch("feature"); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+
+	dst := NewInMemory()
+	defer dst.Close()
+	if _, err := dst.ImportBundle(bytes.NewReader(first)); err != nil {
+		t.Fatalf("ImportBundle failed: %v", err)
+	}
+
+	for name, change := range map[string]func() error{
+		"Put":       func() error { return dst.Put([]byte("local"), []byte("x")) },
+		"Table.Put": func() error { return dst.Table("t").Put([]byte("local"), []byte("x")) },
+	} {
+		if err := change(); err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		if _, err := dst.ImportBundle(bytes.NewReader(bundleOf(t, src, "main"))); !errors.Is(err, ErrUncommittedChanges) {
+			t.Errorf("after %s: ImportBundle returned %v, expected ErrUncommittedChanges", name, err)
+		}
+		if dst.Head() != base {
+			t.Fatalf("after %s: HEAD moved to %s", name, dst.Head())
+		}
+		if err := dst.Reset(); err != nil {
+			t.Fatalf("Reset failed: %v", err)
+		}
+	}
+
+	// Branches that are not checked out can still be imported
+	if err := dst.Put([]byte("local"), []byte("x")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := dst.ImportBundle(bytes.NewReader(bundleOf(t, src, "feature"))); err != nil {
+		t.Fatalf("ImportBundle of another branch failed: %v", err)
+	}
+	expectValue(t, dst, "local", "x")
+
+	if err := dst.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if _, err := dst.ImportBundle(bytes.NewReader(bundleOf(t, src, "main"))); err != nil {
+		t.Fatalf("ImportBundle failed: %v", err)
+	}
+	if dst.Head() != head {
+		t.Errorf("HEAD = %s, expected %s", dst.Head(), head)
+	}
+}
+
+// TestBundle_NonFastForwardRejected tests that an import only moves a
+// branch forward unless forced
+func TestBundle_NonFastForwardRejected(t *testing.T) {
+	src := NewInMemory()
+	defer src.Close()
+	fillAndCommit(t, src, "a", 10)
+	first := bundleOf(t, src, "main")
+
+	dst := NewInMemory()
+	defer dst.Close()
+	if _, err := dst.ImportBundle(bytes.NewReader(first)); err != nil {
+		t.Fatalf("ImportBundle failed: %v", err)
+	}
+	local := fillAndCommit(t, dst, "local", 5)
+
+	// Importing the older commit again would rewind main
+	if _, err := dst.ImportBundle(bytes.NewReader(first)); !errors.Is(err, ErrBundleNotFastForward) {
+		t.Errorf("rewind: ImportBundle returned %v, expected ErrBundleNotFastForward", err)
+	}
+
+	// A bundle of diverged history would replace the local commit
+	diverged := fillAndCommit(t, src, "remote", 5)
+	bundle := bundleOf(t, src, "main")
+	if _, err := dst.ImportBundle(bytes.NewReader(bundle)); !errors.Is(err, ErrBundleNotFastForward) {
+		t.Errorf("diverged: ImportBundle returned %v, expected ErrBundleNotFastForward", err)
+	}
+	if dst.Head() != local {
+		t.Fatalf("HEAD moved to %s after a rejected import", dst.Head())
+	}
+
+	if _, err := dst.ImportBundle(bytes.NewReader(bundle), WithForcedImport()); err != nil {
+		t.Fatalf("forced ImportBundle failed: %v", err)
+	}
+	if dst.Head() != diverged {
+		t.Errorf("HEAD = %s, expected the forced import's %s", dst.Head(), diverged)
+	}
+	expectMissing(t, dst, "local-0000")
+}
@@ -1,10 +1,14 @@
 package store
 
 import (
+	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"time"
+	"unicode/utf8"
 
 	"microprolly/pkg/cas"
 	"microprolly/pkg/types"
@@ -13,13 +17,42 @@ import (
 // ZeroHash represents an empty/null hash (used for initial commit with no parent)
 var ZeroHash = types.Hash{}
 
+var (
+	// ErrInvalidCommitOptions is returned for commit metadata that cannot be
+	// encoded exactly
+	ErrInvalidCommitOptions = errors.New("invalid commit options")
+)
+
 // commitJSON is the JSON representation of a Commit
-// Hash fields are encoded as hex strings for readability
+// Hash fields are encoded as hex strings for readability.
+// The encoding is canonical: fields have a fixed order, metadata keys are
+// sorted and empty optional fields are omitted, so commits written before
+// signatures existed keep their bytes and hashes.
 type commitJSON struct {
-	RootHash  string `json:"root_hash"`
-	Message   string `json:"message"`
-	Parent    string `json:"parent"`
-	Timestamp int64  `json:"timestamp"`
+	RootHash  string            `json:"root_hash"`
+	Message   string            `json:"message"`
+	Parent    string            `json:"parent"`
+	Timestamp int64             `json:"timestamp"`
+	Author    *signatureJSON    `json:"author,omitempty"`
+	Committer *signatureJSON    `json:"committer,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Tables    string            `json:"tables,omitempty"`
+	Sig       *commitSigJSON    `json:"sig,omitempty"`
+}
+
+// commitSigJSON is the JSON representation of a CommitSignature
+type commitSigJSON struct {
+	KeyID string `json:"key_id"`
+	Value string `json:"value"`
+}
+
+// signatureJSON is the JSON representation of a Signature. The time is
+// stored as Unix nanoseconds plus a zone offset in seconds east of UTC.
+type signatureJSON struct {
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Time     *int64 `json:"time_ns,omitempty"`
+	TZOffset int    `json:"tz_offset,omitempty"`
 }
 
 // MarshalCommit serializes a Commit to JSON bytes
@@ -29,10 +62,51 @@ func MarshalCommit(c *types.Commit) ([]byte, error) {
 		Message:   c.Message,
 		Parent:    hex.EncodeToString(c.Parent[:]),
 		Timestamp: c.Timestamp,
+		Author:    marshalSignature(c.Author),
+		Committer: marshalSignature(c.Committer),
+	}
+	if len(c.Metadata) > 0 {
+		cj.Metadata = c.Metadata
+	}
+	if c.Tables != ZeroHash {
+		cj.Tables = hex.EncodeToString(c.Tables[:])
+	}
+	if c.Sig != nil {
+		cj.Sig = &commitSigJSON{KeyID: c.Sig.KeyID, Value: hex.EncodeToString(c.Sig.Value)}
 	}
 	return json.Marshal(cj)
 }
 
+// marshalSignature converts a Signature to its JSON form, nil if empty
+func marshalSignature(sig types.Signature) *signatureJSON {
+	if sig.IsZero() {
+		return nil
+	}
+	sj := &signatureJSON{Name: sig.Name, Email: sig.Email}
+	if !sig.When.IsZero() {
+		ns := sig.When.UnixNano()
+		_, sj.TZOffset = sig.When.Zone()
+		sj.Time = &ns
+	}
+	return sj
+}
+
+// unmarshalSignature converts the JSON form back to a Signature
+func unmarshalSignature(sj *signatureJSON) types.Signature {
+	if sj == nil {
+		return types.Signature{}
+	}
+	sig := types.Signature{Name: sj.Name, Email: sj.Email}
+	if sj.Time != nil {
+		zone := time.UTC
+		if sj.TZOffset != 0 {
+			zone = time.FixedZone("", sj.TZOffset)
+		}
+		sig.When = time.Unix(0, *sj.Time).In(zone)
+	}
+	return sig
+}
+
 // UnmarshalCommit deserializes JSON bytes to a Commit
 func UnmarshalCommit(data []byte) (*types.Commit, error) {
 	var cj commitJSON
@@ -56,6 +130,27 @@ func UnmarshalCommit(data []byte) (*types.Commit, error) {
 		return nil, fmt.Errorf("parent must be 32 bytes, got %d", len(parentBytes))
 	}
 
+	var sig *types.CommitSignature
+	if cj.Sig != nil {
+		value, err := hex.DecodeString(cj.Sig.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature hex: %w", err)
+		}
+		sig = &types.CommitSignature{KeyID: cj.Sig.KeyID, Value: value}
+	}
+
+	var tables types.Hash
+	if cj.Tables != "" {
+		tablesBytes, err := hex.DecodeString(cj.Tables)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tables hex: %w", err)
+		}
+		if len(tablesBytes) != 32 {
+			return nil, fmt.Errorf("tables must be 32 bytes, got %d", len(tablesBytes))
+		}
+		copy(tables[:], tablesBytes)
+	}
+
 	var rootHash, parent types.Hash
 	copy(rootHash[:], rootHashBytes)
 	copy(parent[:], parentBytes)
@@ -65,9 +160,76 @@ func UnmarshalCommit(data []byte) (*types.Commit, error) {
 		Message:   cj.Message,
 		Parent:    parent,
 		Timestamp: cj.Timestamp,
+		Author:    unmarshalSignature(cj.Author),
+		Committer: unmarshalSignature(cj.Committer),
+		Metadata:  cj.Metadata,
+		Tables:    tables,
+		Sig:       sig,
 	}, nil
 }
 
+// CommitOptions sets the identities and metadata of a new commit
+type CommitOptions struct {
+	// Author defaults to the committer's name and email, and to the commit time
+	Author types.Signature
+	// Committer.When defaults to the current time
+	Committer types.Signature
+	// Metadata holds annotations such as a pipeline run or sample ID
+	Metadata map[string]string
+	// SigningKey, if set, signs the commit
+	SigningKey ed25519.PrivateKey
+
+	// tables is the root of the commit's table map, set by Store.Commit
+	tables types.Hash
+}
+
+// CommitOption sets a field of CommitOptions
+type CommitOption func(*CommitOptions)
+
+// WithAuthor sets the commit author
+func WithAuthor(author types.Signature) CommitOption {
+	return func(o *CommitOptions) { o.Author = author }
+}
+
+// WithCommitter sets the committer. A non-zero When fixes the commit time,
+// which makes commit hashes reproducible.
+func WithCommitter(committer types.Signature) CommitOption {
+	return func(o *CommitOptions) { o.Committer = committer }
+}
+
+// WithMetadata adds a metadata entry
+func WithMetadata(key, value string) CommitOption {
+	return func(o *CommitOptions) {
+		if o.Metadata == nil {
+			o.Metadata = make(map[string]string)
+		}
+		o.Metadata[key] = value
+	}
+}
+
+// WithSigningKey signs the commit with an ed25519 key
+func WithSigningKey(key ed25519.PrivateKey) CommitOption {
+	return func(o *CommitOptions) { o.SigningKey = key }
+}
+
+// validate checks that every string survives the JSON encoding unchanged
+func (o CommitOptions) validate() error {
+	for _, sig := range []types.Signature{o.Author, o.Committer} {
+		if !utf8.ValidString(sig.Name) || !utf8.ValidString(sig.Email) {
+			return fmt.Errorf("%w: identity is not valid UTF-8", ErrInvalidCommitOptions)
+		}
+	}
+	for key, value := range o.Metadata {
+		if key == "" {
+			return fmt.Errorf("%w: empty metadata key", ErrInvalidCommitOptions)
+		}
+		if !utf8.ValidString(key) || !utf8.ValidString(value) {
+			return fmt.Errorf("%w: metadata %q is not valid UTF-8", ErrInvalidCommitOptions, key)
+		}
+	}
+	return nil
+}
+
 // CommitManager handles commit operations
 type CommitManager struct {
 	cas cas.CAS
@@ -81,26 +243,64 @@ func NewCommitManager(c cas.CAS) *CommitManager {
 // CreateCommit creates a new commit with the given root hash, message, and parent
 // Returns the commit object and its hash
 func (cm *CommitManager) CreateCommit(rootHash types.Hash, message string, parent types.Hash) (*types.Commit, types.Hash, error) {
+	return cm.CreateCommitWithOptions(rootHash, message, parent, CommitOptions{})
+}
+
+// CreateCommitWithOptions creates a new commit with the identities and
+// metadata from opts, filling in their defaults
+func (cm *CommitManager) CreateCommitWithOptions(rootHash types.Hash, message string, parent types.Hash, opts CommitOptions) (*types.Commit, types.Hash, error) {
+	if err := opts.validate(); err != nil {
+		return nil, types.Hash{}, err
+	}
+
+	committer := opts.Committer
+	if committer.When.IsZero() {
+		committer.When = time.Now()
+	}
+	author := opts.Author
+	if author.Name == "" && author.Email == "" {
+		author.Name, author.Email = committer.Name, committer.Email
+	}
+	if author.When.IsZero() {
+		author.When = committer.When
+	}
+
 	commit := &types.Commit{
 		RootHash:  rootHash,
 		Message:   message,
 		Parent:    parent,
-		Timestamp: time.Now().Unix(),
+		Timestamp: committer.When.Unix(),
+		Author:    author,
+		Committer: committer,
+		Metadata:  maps.Clone(opts.Metadata),
+		Tables:    opts.tables,
+	}
+	if opts.SigningKey != nil {
+		if err := signCommit(commit, opts.SigningKey); err != nil {
+			return nil, types.Hash{}, err
+		}
+	}
+
+	hash, err := cm.WriteCommit(commit)
+	if err != nil {
+		return nil, types.Hash{}, err
 	}
+	return commit, hash, nil
+}
 
-	// Serialize commit to JSON
+// WriteCommit stores a commit as it is, keeping its timestamp, and
+// returns its hash
+func (cm *CommitManager) WriteCommit(commit *types.Commit) (types.Hash, error) {
 	data, err := MarshalCommit(commit)
 	if err != nil {
-		return nil, types.Hash{}, fmt.Errorf("failed to marshal commit: %w", err)
+		return types.Hash{}, fmt.Errorf("failed to marshal commit: %w", err)
 	}
 
-	// Store in CAS
 	hash, err := cm.cas.Write(data)
 	if err != nil {
-		return nil, types.Hash{}, fmt.Errorf("failed to write commit to CAS: %w", err)
+		return types.Hash{}, fmt.Errorf("failed to write commit to CAS: %w", err)
 	}
-
-	return commit, hash, nil
+	return hash, nil
 }
 
 // GetCommit retrieves a commit by its hash
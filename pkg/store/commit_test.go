@@ -1,6 +1,7 @@
 package store
 
 import (
+	"errors"
 	"os"
 	"testing"
 	"time"
@@ -236,3 +237,170 @@ func TestProperty_CommitHistoryChainIntegrity(t *testing.T) {
 		}
 	})
 }
+
+// genSignature generates a random, possibly empty, Signature
+func genSignature(t *rapid.T, name string) types.Signature {
+	sig := types.Signature{
+		Name:  rapid.SampledFrom([]string{"", "Ada", "Grace Hopper"}).Draw(t, name+"_name"),
+		Email: rapid.SampledFrom([]string{"", "ada@example.com"}).Draw(t, name+"_email"),
+	}
+	if rapid.Bool().Draw(t, name+"_has_time") {
+		offset := rapid.IntRange(-12, 14).Draw(t, name+"_offset_hours") * 3600
+		ns := rapid.Int64Range(0, 1<<62).Draw(t, name+"_ns")
+		sig.When = time.Unix(0, ns).In(time.FixedZone("zone", offset))
+	}
+	return sig
+}
+
+// TestProperty_CommitEncodingIsCanonical tests that commits with signatures
+// and metadata round-trip and that decoding and re-encoding yields the same
+// bytes, so commit hashes are deterministic
+func TestProperty_CommitEncodingIsCanonical(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		commit := &types.Commit{
+			RootHash:  genHash(t, "root_hash"),
+			Message:   rapid.String().Draw(t, "message"),
+			Parent:    genHash(t, "parent"),
+			Timestamp: rapid.Int64().Draw(t, "timestamp"),
+			Author:    genSignature(t, "author"),
+			Committer: genSignature(t, "committer"),
+			Metadata:  rapid.MapOf(rapid.StringN(1, 10, -1), rapid.String()).Draw(t, "metadata"),
+		}
+		if rapid.Bool().Draw(t, "signed") {
+			commit.Sig = &types.CommitSignature{
+				KeyID: rapid.StringMatching(`[0-9a-f]{16}`).Draw(t, "key_id"),
+				Value: rapid.SliceOfN(rapid.Byte(), 64, 64).Draw(t, "sig"),
+			}
+		}
+
+		data, err := MarshalCommit(commit)
+		if err != nil {
+			t.Fatalf("MarshalCommit failed: %v", err)
+		}
+		restored, err := UnmarshalCommit(data)
+		if err != nil {
+			t.Fatalf("UnmarshalCommit failed: %v", err)
+		}
+
+		for _, pair := range [][2]types.Signature{{commit.Author, restored.Author}, {commit.Committer, restored.Committer}} {
+			want, got := pair[0], pair[1]
+			_, wantOffset := want.When.Zone()
+			_, gotOffset := got.When.Zone()
+			if got.Name != want.Name || got.Email != want.Email || !got.When.Equal(want.When) || gotOffset != wantOffset {
+				t.Fatalf("Signature mismatch: got %+v, want %+v", got, want)
+			}
+		}
+		if len(restored.Metadata) != len(commit.Metadata) {
+			t.Fatalf("Metadata has %d entries, want %d", len(restored.Metadata), len(commit.Metadata))
+		}
+		for key, value := range commit.Metadata {
+			if restored.Metadata[key] != value {
+				t.Fatalf("Metadata %q = %q, want %q", key, restored.Metadata[key], value)
+			}
+		}
+
+		if (commit.Sig == nil) != (restored.Sig == nil) ||
+			commit.Sig != nil && (commit.Sig.KeyID != restored.Sig.KeyID || string(commit.Sig.Value) != string(restored.Sig.Value)) {
+			t.Fatalf("Signature mismatch: got %+v, want %+v", restored.Sig, commit.Sig)
+		}
+
+		again, err := MarshalCommit(restored)
+		if err != nil {
+			t.Fatalf("MarshalCommit failed: %v", err)
+		}
+		if string(again) != string(data) {
+			t.Fatalf("Re-encoding changed the bytes:\n%s\n%s", data, again)
+		}
+	})
+}
+
+// TestUnmarshalCommit_WithoutSignatures tests that commits written before
+// signatures existed decode and keep their exact bytes
+func TestUnmarshalCommit_WithoutSignatures(t *testing.T) {
+	legacy := `{"root_hash":"` + ZeroHash.String() + `","message":"old","parent":"` + ZeroHash.String() + `","timestamp":1700000000}`
+
+	commit, err := UnmarshalCommit([]byte(legacy))
+	if err != nil {
+		t.Fatalf("UnmarshalCommit failed: %v", err)
+	}
+	if !commit.Author.IsZero() || !commit.Committer.IsZero() || commit.Metadata != nil {
+		t.Errorf("unexpected signatures or metadata in %+v", commit)
+	}
+	if !commit.Time().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Time() = %v, expected the Unix timestamp", commit.Time())
+	}
+
+	data, err := MarshalCommit(commit)
+	if err != nil {
+		t.Fatalf("MarshalCommit failed: %v", err)
+	}
+	if string(data) != legacy {
+		t.Errorf("re-encoded legacy commit differs:\n%s\n%s", legacy, data)
+	}
+}
+
+// TestStore_CommitOptions tests that Store.Commit records identities,
+// metadata and nanosecond times
+func TestStore_CommitOptions(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+
+	when := time.Date(2024, 3, 1, 9, 30, 0, 123456789, time.FixedZone("CET", 3600))
+	author := types.Signature{Name: "Ada", Email: "ada@example.com"}
+	committer := types.Signature{Name: "pipeline", Email: "ci@example.com", When: when}
+
+	if err := s.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	hash, err := s.Commit("annotated",
+		WithAuthor(author),
+		WithCommitter(committer),
+		WithMetadata("run_id", "42"),
+		WithMetadata("sample", "S-7"),
+	)
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	commit, err := s.commitMgr.GetCommit(hash)
+	if err != nil {
+		t.Fatalf("GetCommit failed: %v", err)
+	}
+	if commit.Author.Name != "Ada" || commit.Committer.Email != "ci@example.com" {
+		t.Errorf("unexpected identities %+v / %+v", commit.Author, commit.Committer)
+	}
+	if !commit.Time().Equal(when) || !commit.Author.When.Equal(when) || commit.Timestamp != when.Unix() {
+		t.Errorf("commit time %v (timestamp %d), expected %v", commit.Time(), commit.Timestamp, when)
+	}
+	if _, offset := commit.Time().Zone(); offset != 3600 {
+		t.Errorf("zone offset %d, expected 3600", offset)
+	}
+	if commit.Metadata["run_id"] != "42" || commit.Metadata["sample"] != "S-7" {
+		t.Errorf("unexpected metadata %v", commit.Metadata)
+	}
+
+	// Two commits within the same second are ordered by their nanosecond times
+	second, err := s.Commit("plain")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	third, err := s.Commit("plain again")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	c2, _ := s.commitMgr.GetCommit(second)
+	c3, _ := s.commitMgr.GetCommit(third)
+	if !c3.Time().After(c2.Time()) {
+		t.Errorf("commit times %v and %v are not ordered", c2.Time(), c3.Time())
+	}
+	if c2.Author.Name != c2.Committer.Name || !c2.Author.When.Equal(c2.Committer.When) {
+		t.Errorf("author %+v should default to the committer %+v", c2.Author, c2.Committer)
+	}
+
+	if _, err := s.Commit("bad", WithMetadata("", "x")); !errors.Is(err, ErrInvalidCommitOptions) {
+		t.Errorf("Commit with an empty metadata key returned %v, expected ErrInvalidCommitOptions", err)
+	}
+	if _, err := s.Commit("bad", WithMetadata("k", "\xff")); !errors.Is(err, ErrInvalidCommitOptions) {
+		t.Errorf("Commit with invalid UTF-8 returned %v, expected ErrInvalidCommitOptions", err)
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"testing"
+)
+
+// TestNewInMemory_Branching tests that an in-memory store supports branches,
+// HEAD tracking and detached commits without a data directory
+func TestNewInMemory_Branching(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+
+	branchName, detached, err := s.CurrentBranch()
+	if err != nil || branchName != "main" || detached {
+		t.Fatalf("CurrentBranch returned %q, %v, %v", branchName, detached, err)
+	}
+
+	base := fillAndCommit(t, s, "a", 20)
+	if err := s.CreateBranch("feature"); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+	if err := s.SwitchBranch("feature"); err != nil {
+		t.Fatalf("SwitchBranch failed: %v", err)
+	}
+	featureHead := fillAndCommit(t, s, "f", 5)
+
+	if err := s.SwitchBranch("main"); err != nil {
+		t.Fatalf("SwitchBranch failed: %v", err)
+	}
+	if s.Head() != base {
+		t.Fatal("main should still point at the base commit")
+	}
+	if _, err := s.Get([]byte("f-0000")); err != ErrKeyNotFound {
+		t.Fatalf("feature key visible on main: %v", err)
+	}
+
+	if err := s.DeleteBranch("main"); err != ErrCannotDeleteCurrentBranch {
+		t.Fatalf("Expected ErrCannotDeleteCurrentBranch, got %v", err)
+	}
+
+	if err := s.DetachHead(featureHead); err != nil {
+		t.Fatalf("DetachHead failed: %v", err)
+	}
+	if _, detached, _ := s.CurrentBranch(); !detached {
+		t.Fatal("Expected detached HEAD")
+	}
+	if _, err := s.Get([]byte("f-0004")); err != nil {
+		t.Fatalf("Get on detached HEAD failed: %v", err)
+	}
+
+	branches, err := s.ListBranches()
+	if err != nil || len(branches) != 2 {
+		t.Fatalf("ListBranches returned %v, %v", branches, err)
+	}
+}
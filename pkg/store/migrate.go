@@ -0,0 +1,371 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"microprolly/pkg/tree"
+	"microprolly/pkg/types"
+)
+
+// MigrationProgress reports the state of a running migration step
+type MigrationProgress struct {
+	// From and To are the format versions of the step
+	From, To    int
+	Description string
+	// Done of Total commits have been rewritten
+	Done, Total int
+}
+
+// ErrMigrationDropsSignatures is returned when a migration would rewrite a
+// signed commit or tag without WithResigningKey or WithDroppedSignatures
+var ErrMigrationDropsSignatures = errors.New("migration would drop commit signatures")
+
+// MigrateOptions controls what happens to the signatures of rewritten commits
+type MigrateOptions struct {
+	// ResigningKey, if set, signs every rewritten commit or tag that was
+	// signed
+	ResigningKey ed25519.PrivateKey
+	// DropSignatures lets rewritten commits and tags lose their signatures
+	DropSignatures bool
+}
+
+// MigrateOption sets a field of MigrateOptions
+type MigrateOption func(*MigrateOptions)
+
+// WithResigningKey signs rewritten commits and tags that were signed with key
+func WithResigningKey(key ed25519.PrivateKey) MigrateOption {
+	return func(o *MigrateOptions) { o.ResigningKey = key }
+}
+
+// WithDroppedSignatures lets Migrate rewrite signed commits and tags unsigned
+func WithDroppedSignatures() MigrateOption {
+	return func(o *MigrateOptions) { o.DropSignatures = true }
+}
+
+// migration upgrades a repository by one format version
+type migration struct {
+	description string
+	run         func(s *Store, report func(done, total int), opts MigrateOptions) error
+}
+
+// migrations[i] upgrades format version i+1 to i+2
+var migrations = []migration{
+	{description: "store large values out of line", run: migrateBlobValues},
+	{description: "record subtree key counts", run: migrateSubtreeCounts},
+}
+
+// FormatVersion returns the repository format version the store reads and
+// writes. It is below the package FormatVersion until Migrate is run.
+func (s *Store) FormatVersion() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.formatVersion
+}
+
+// Migrate upgrades the repository to the current FormatVersion, one format
+// version at a time, calling progress (if non-nil) as commits are rewritten.
+//
+// Each step writes every reachable commit and tree again in the new format
+// and then moves branches and HEAD to the rewritten commits, so commit
+// hashes change and signed commits need new signatures: they are signed
+// with the key from WithResigningKey, or left unsigned with
+// WithDroppedSignatures. Without either, a step that would rewrite a signed
+// commit fails with ErrMigrationDropsSignatures before any ref is moved, as
+// does a step whose commits do not satisfy a signature policy.
+// Objects in the old format are not deleted: they stay
+// readable by their old hashes until garbage collected. A migration that
+// is interrupted can be run again. The working state is kept.
+func (s *Store) Migrate(progress func(MigrationProgress), opts ...MigrateOption) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	var migrateOpts MigrateOptions
+	for _, opt := range opts {
+		opt(&migrateOpts)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.formatVersion < FormatVersion {
+		from := s.formatVersion
+		step := migrations[from-1]
+		report := func(done, total int) {
+			if progress != nil {
+				progress(MigrationProgress{From: from, To: from + 1, Description: step.description, Done: done, Total: total})
+			}
+		}
+
+		if err := step.run(s, report, migrateOpts); err != nil {
+			return fmt.Errorf("migrating format %d to %d: %w", from, from+1, err)
+		}
+		if err := s.setFormatVersion(from + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFormatVersion records a completed migration step in the config
+func (s *Store) setFormatVersion(version int) error {
+	if s.dataDir != "" {
+		cfg, err := readConfig(s.dataDir)
+		if err != nil {
+			return err
+		}
+		cfg.Version = version
+		if err := writeConfig(s.dataDir, cfg); err != nil {
+			return err
+		}
+	}
+
+	s.formatVersion = version
+	if version >= formatBlobValues {
+		s.builder.SetBlobThreshold(tree.DefaultBlobThreshold)
+	}
+	if version >= formatSubtreeCounts {
+		s.builder.SetSubtreeCounts(true)
+	}
+	return nil
+}
+
+// migrateBlobValues rebuilds every reachable tree so that values above the
+// blob threshold are stored out of line
+func migrateBlobValues(s *Store, report func(done, total int), opts MigrateOptions) error {
+	builder := tree.NewTreeBuilderWithCache(s.cas, s.builder.Chunker(), s.nodeCache)
+	builder.SetSubtreeCounts(false)
+	return s.rewriteTrees(report, builder, opts)
+}
+
+// migrateSubtreeCounts rebuilds every reachable tree so that internal nodes
+// record how many keys are under each child
+func migrateSubtreeCounts(s *Store, report func(done, total int), opts MigrateOptions) error {
+	builder := tree.NewTreeBuilderWithCache(s.cas, s.builder.Chunker(), s.nodeCache)
+	return s.rewriteTrees(report, builder, opts)
+}
+
+// rewriteTrees rewrites every reachable commit with its trees rebuilt by
+// builder: the root tree, and the table map with the tree of every table
+func (s *Store) rewriteTrees(report func(done, total int), builder *tree.TreeBuilder, opts MigrateOptions) error {
+	return s.rewriteCommits(report, builder, opts, func(root types.Hash) (types.Hash, error) {
+		pairs, err := s.traverser.GetAllRaw(root)
+		if err != nil {
+			return types.Hash{}, err
+		}
+		return builder.Build(pairs)
+	})
+}
+
+// resignCommit replaces the signature of a changed commit as opts say
+func resignCommit(commit *types.Commit, opts MigrateOptions) error {
+	if commit.Sig == nil {
+		return nil
+	}
+	commit.Sig = nil
+	switch {
+	case opts.ResigningKey != nil:
+		return signCommit(commit, opts.ResigningKey)
+	case opts.DropSignatures:
+		return nil
+	}
+	return ErrMigrationDropsSignatures
+}
+
+// resignTag replaces the signature of a changed tag as opts say
+func resignTag(tag *types.Tag, opts MigrateOptions) error {
+	if tag.Sig == nil {
+		return nil
+	}
+	tag.Sig = nil
+	switch {
+	case opts.ResigningKey != nil:
+		return signTag(tag, opts.ResigningKey)
+	case opts.DropSignatures:
+		return nil
+	}
+	return ErrMigrationDropsSignatures
+}
+
+// rewriteTables returns the table map with the tree of every table replaced
+// by rewriteTree, rebuilt by builder
+func (s *Store) rewriteTables(tablesHash types.Hash, builder *tree.TreeBuilder, rewriteTree func(types.Hash) (types.Hash, error)) (types.Hash, error) {
+	if tablesHash == ZeroHash {
+		return ZeroHash, nil
+	}
+	roots, err := s.loadTableRoots(tablesHash)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	for name, root := range roots {
+		if roots[name], err = rewriteTree(root); err != nil {
+			return types.Hash{}, fmt.Errorf("table %s: %w", name, err)
+		}
+	}
+	return s.buildTableMap(builder, roots)
+}
+
+// rewriteCommits writes a copy of every commit reachable from a branch, tag or
+// HEAD with its trees replaced by rewriteTree and its table map rebuilt by
+// builder, then points the refs at the copies. Commit messages and
+// timestamps are kept, and so are the signatures of commits that did not
+// change; changed signed commits and tags are handled as opts say.
+func (s *Store) rewriteCommits(report func(done, total int), builder *tree.TreeBuilder, opts MigrateOptions, rewriteTree func(types.Hash) (types.Hash, error)) error {
+	branches, err := s.refs.ListBranches()
+	if err != nil {
+		return err
+	}
+	tips := make(map[string]types.Hash, len(branches))
+	for _, name := range branches {
+		hash, err := s.refs.GetBranch(name)
+		if err != nil {
+			return err
+		}
+		tips[name] = hash
+	}
+	tagNames, err := s.refs.ListTags()
+	if err != nil {
+		return err
+	}
+	tags := make(map[string]*types.Tag, len(tagNames))
+	for _, name := range tagNames {
+		tagHash, err := s.refs.GetTag(name)
+		if err != nil {
+			return err
+		}
+		if tags[name], err = s.readTag(tagHash); err != nil {
+			return err
+		}
+	}
+	headState, err := s.refs.GetHead()
+	if err != nil {
+		return err
+	}
+
+	// Order the commits so that parents come before their children
+	var order []types.Hash
+	commits := make(map[types.Hash]*types.Commit)
+	collect := func(tip types.Hash) error {
+		var chain []types.Hash
+		for hash := tip; hash != ZeroHash && commits[hash] == nil; {
+			commit, err := s.commitMgr.GetCommit(hash)
+			if err != nil {
+				return err
+			}
+			commits[hash] = commit
+			chain = append(chain, hash)
+			hash = commit.Parent
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			order = append(order, chain[i])
+		}
+		return nil
+	}
+	for _, name := range branches {
+		if err := collect(tips[name]); err != nil {
+			return err
+		}
+	}
+	for _, name := range tagNames {
+		if err := collect(tags[name].Commit); err != nil {
+			return err
+		}
+	}
+	if err := collect(headState.CommitHash); err != nil {
+		return err
+	}
+
+	rewritten := map[types.Hash]types.Hash{ZeroHash: ZeroHash}
+	report(0, len(order))
+	for i, hash := range order {
+		commit := *commits[hash]
+		root, err := rewriteTree(commit.RootHash)
+		if err != nil {
+			return fmt.Errorf("commit %s: %w", hash, err)
+		}
+		tables, err := s.rewriteTables(commit.Tables, builder, rewriteTree)
+		if err != nil {
+			return fmt.Errorf("commit %s: %w", hash, err)
+		}
+		if root != commit.RootHash || tables != commit.Tables || rewritten[commit.Parent] != commit.Parent {
+			commit.RootHash = root
+			commit.Tables = tables
+			commit.Parent = rewritten[commit.Parent]
+			if err := resignCommit(&commit, opts); err != nil {
+				return fmt.Errorf("commit %s: %w", hash, err)
+			}
+		}
+
+		newHash, err := s.commitMgr.WriteCommit(&commit)
+		if err != nil {
+			return err
+		}
+		rewritten[hash] = newHash
+		report(i+1, len(order))
+	}
+
+	// Tags whose commit changed get a new tag object naming the new commit
+	newTags := make(map[string]types.Hash)
+	for _, name := range tagNames {
+		tag := *tags[name]
+		if rewritten[tag.Commit] == tag.Commit {
+			continue
+		}
+		tag.Commit = rewritten[tag.Commit]
+		if err := resignTag(&tag, opts); err != nil {
+			return fmt.Errorf("tag %s: %w", name, err)
+		}
+		tagHash, err := s.writeTag(&tag)
+		if err != nil {
+			return err
+		}
+		newTags[name] = tagHash
+	}
+
+	// Make the new objects durable before any ref points at them
+	if err := s.syncObjects(); err != nil {
+		return err
+	}
+
+	for _, name := range branches {
+		if err := s.checkBranchUpdate(name, rewritten[tips[name]]); err != nil {
+			return err
+		}
+	}
+	for _, name := range branches {
+		if err := s.refs.UpdateBranch(name, rewritten[tips[name]]); err != nil {
+			return err
+		}
+	}
+	for _, name := range tagNames {
+		if tagHash, ok := newTags[name]; ok {
+			if err := s.refs.UpdateTag(name, tagHash); err != nil {
+				return err
+			}
+		}
+	}
+	if headState.IsDetached {
+		if err := s.refs.SetHeadToCommit(rewritten[headState.CommitHash]); err != nil {
+			return err
+		}
+	}
+	s.head = rewritten[s.head]
+
+	// Tables unchanged since HEAD are committed by root, so their roots
+	// must name the rewritten trees
+	if s.head != ZeroHash {
+		commit, err := s.commitMgr.GetCommit(s.head)
+		if err != nil {
+			return err
+		}
+		if s.tableRoots, err = s.loadTableRoots(commit.Tables); err != nil {
+			return err
+		}
+	}
+	// The trees the working sets were loaded from are in the old format
+	s.working.forgetBase()
+	for _, w := range s.tables {
+		w.forgetBase()
+	}
+	return s.rebaseWAL()
+}
@@ -0,0 +1,425 @@
+package store
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"microprolly/pkg/types"
+)
+
+// openInlineFormatStore creates a repository without a config, as versions
+// before the config file did, and opens it in the original inline-value
+// format
+func openInlineFormatStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	legacy, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	legacy.Close()
+	if err := os.Remove(filepath.Join(dir, configFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if s.FormatVersion() != formatInlineValues {
+		t.Fatalf("FormatVersion() = %d, expected %d", s.FormatVersion(), formatInlineValues)
+	}
+	return s
+}
+
+// hasValueRefs reports whether any value of a commit is stored out of line
+func hasValueRefs(t *testing.T, s *Store, commitHash types.Hash) bool {
+	t.Helper()
+	commit, err := s.commitMgr.GetCommit(commitHash)
+	if err != nil {
+		t.Fatalf("GetCommit failed: %v", err)
+	}
+	pairs, err := s.traverser.GetAllRaw(commit.RootHash)
+	if err != nil {
+		t.Fatalf("GetAllRaw failed: %v", err)
+	}
+	for _, pair := range pairs {
+		if pair.ValueRef {
+			return true
+		}
+	}
+	return false
+}
+
+// TestMigrate_InlineToBlobValues tests that migration rewrites every commit
+// and ref, keeps history and the old objects, and records the new version
+func TestMigrate_InlineToBlobValues(t *testing.T) {
+	dir := t.TempDir()
+	s := openInlineFormatStore(t, dir)
+	defer s.Close()
+
+	large := bytes.Repeat([]byte("large value "), 1000)
+	if err := s.Put([]byte("big"), large); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	first := fillAndCommit(t, s, "a", 50)
+	if hasValueRefs(t, s, first) {
+		t.Fatal("the inline format stored a value out of line")
+	}
+	if err := s.CreateBranch("feature"); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+	fillAndCommit(t, s, "b", 50)
+	if err := s.SwitchBranch("feature"); err != nil {
+		t.Fatalf("SwitchBranch failed: %v", err)
+	}
+	fillAndCommit(t, s, "c", 50)
+	if err := s.Put([]byte("uncommitted"), []byte("kept")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	logBefore, err := s.Log()
+	if err != nil {
+		t.Fatalf("Log failed: %v", err)
+	}
+
+	var reports []MigrationProgress
+	if err := s.Migrate(func(p MigrationProgress) { reports = append(reports, p) }); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	// Every step rewrites three distinct commits: the shared first one and
+	// one per branch
+	final := make(map[int]MigrationProgress)
+	for _, p := range reports {
+		final[p.From] = p
+	}
+	for from := formatInlineValues; from < FormatVersion; from++ {
+		if p := final[from]; p.To != from+1 || p.Done != 3 || p.Total != 3 {
+			t.Errorf("unexpected final progress for format %d: %+v", from, p)
+		}
+	}
+	if s.FormatVersion() != FormatVersion {
+		t.Errorf("FormatVersion() = %d, expected %d", s.FormatVersion(), FormatVersion)
+	}
+	cfg, err := readConfig(dir)
+	if err != nil || cfg.Version != FormatVersion {
+		t.Errorf("config version %d, %v; expected %d", cfg.Version, err, FormatVersion)
+	}
+
+	logAfter, err := s.Log()
+	if err != nil {
+		t.Fatalf("Log failed: %v", err)
+	}
+	if len(logAfter) != len(logBefore) {
+		t.Fatalf("history has %d commits, expected %d", len(logAfter), len(logBefore))
+	}
+	for i := range logAfter {
+		if logAfter[i].Message != logBefore[i].Message || logAfter[i].Timestamp != logBefore[i].Timestamp {
+			t.Errorf("commit %d changed from %+v to %+v", i, logBefore[i], logAfter[i])
+		}
+	}
+	if !hasValueRefs(t, s, s.Head()) {
+		t.Error("the migrated tree still holds the large value inline")
+	}
+
+	mainHead, err := s.refs.GetBranch("main")
+	if err != nil {
+		t.Fatalf("GetBranch failed: %v", err)
+	}
+	for key, expected := range map[string][]byte{"big": large, "b-0049": []byte("value-b-49")} {
+		value, err := s.GetAt([]byte(key), mainHead)
+		if err != nil || !bytes.Equal(value, expected) {
+			t.Errorf("GetAt(%q) on main returned %d bytes, %v", key, len(value), err)
+		}
+	}
+	if value, err := s.Get([]byte("uncommitted")); err != nil || string(value) != "kept" {
+		t.Errorf("working state lost: %q, %v", value, err)
+	}
+
+	// Old objects stay readable by their old hashes
+	if value, err := s.GetAt([]byte("a-0000"), first); err != nil || string(value) != "value-a-0" {
+		t.Errorf("GetAt on the old commit returned %q, %v", value, err)
+	}
+
+	// Running it again is a no-op
+	reports = nil
+	if err := s.Migrate(func(p MigrationProgress) { reports = append(reports, p) }); err != nil || len(reports) != 0 {
+		t.Errorf("second Migrate reported %d steps, %v", len(reports), err)
+	}
+}
+
+// TestMigrate_DetachedHead tests that a detached HEAD is moved to the
+// rewritten commit
+func TestMigrate_DetachedHead(t *testing.T) {
+	s := openInlineFormatStore(t, t.TempDir())
+	defer s.Close()
+
+	if err := s.Put([]byte("big"), bytes.Repeat([]byte("x"), 10000)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	first := fillAndCommit(t, s, "a", 10)
+	fillAndCommit(t, s, "b", 10)
+	if err := s.DetachHead(first); err != nil {
+		t.Fatalf("DetachHead failed: %v", err)
+	}
+
+	if err := s.Migrate(nil); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	_, detached, err := s.CurrentBranch()
+	if err != nil || !detached {
+		t.Fatalf("CurrentBranch() detached = %v, %v; expected detached", detached, err)
+	}
+	if s.Head() == first {
+		t.Error("HEAD still points at the old commit")
+	}
+	logAfter, err := s.Log()
+	if err != nil || len(logAfter) != 1 || logAfter[0].Message != "commit a" {
+		t.Errorf("unexpected history at HEAD: %v, %v", logAfter, err)
+	}
+}
+
+// TestMigrate_Tags tests that tags are moved to the rewritten commits and
+// keep their message and tagger
+func TestMigrate_Tags(t *testing.T) {
+	s := openInlineFormatStore(t, t.TempDir())
+	defer s.Close()
+
+	if err := s.Put([]byte("big"), bytes.Repeat([]byte("x"), 10000)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	first := fillAndCommit(t, s, "a", 10)
+	fillAndCommit(t, s, "b", 10)
+	tagger := types.Signature{Name: "Ada", Email: "ada@example.com", When: time.Unix(1700000000, 0)}
+	oldTag, err := s.CreateTag("v1", first, "release", WithTagger(tagger))
+	if err != nil {
+		t.Fatalf("CreateTag failed: %v", err)
+	}
+
+	if err := s.Migrate(nil); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	tagHash, err := s.refs.GetTag("v1")
+	if err != nil || tagHash == oldTag {
+		t.Fatalf("tag ref = %s, %v; expected a new tag object", tagHash, err)
+	}
+	tag, err := s.GetTag("v1")
+	if err != nil {
+		t.Fatalf("GetTag failed: %v", err)
+	}
+	if tag.Commit == first || tag.Message != "release" || !tag.Tagger.When.Equal(tagger.When) {
+		t.Errorf("unexpected tag after migration %+v", tag)
+	}
+	if !hasValueRefs(t, s, tag.Commit) {
+		t.Error("tagged commit was not rewritten")
+	}
+	commit, err := s.commitMgr.GetCommit(tag.Commit)
+	if err != nil || commit.Message != "commit a" {
+		t.Errorf("tag names %+v, %v; expected the rewritten first commit", commit, err)
+	}
+}
+
+// TestMigrate_SubtreeCounts tests that migrating a blob-values repository
+// rewrites internal nodes with subtree counts
+func TestMigrate_SubtreeCounts(t *testing.T) {
+	dir := t.TempDir()
+	config := `{"version": 2, "chunker": {"target_size": 4096, "min_size": 512, "max_size": 16384}}`
+	if err := os.WriteFile(filepath.Join(dir, configFileName), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	rootType := func() byte {
+		commit, err := s.commitMgr.GetCommit(s.Head())
+		if err != nil {
+			t.Fatalf("GetCommit failed: %v", err)
+		}
+		data, err := s.cas.Read(commit.RootHash)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		return data[0]
+	}
+
+	fillAndCommit(t, s, "a", 2000)
+	if got := rootType(); got != 0x02 {
+		t.Fatalf("format 2 root has node type %#x, expected an uncounted internal node", got)
+	}
+
+	if err := s.Migrate(nil); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if got := rootType(); got != 0x05 {
+		t.Errorf("migrated root has node type %#x, expected a counted internal node", got)
+	}
+
+	commit, err := s.commitMgr.GetCommit(s.Head())
+	if err != nil {
+		t.Fatalf("GetCommit failed: %v", err)
+	}
+	if count, err := s.traverser.Count(commit.RootHash); err != nil || count != 2000 {
+		t.Errorf("Count() = %d, %v; expected 2000", count, err)
+	}
+}
+
+// TestMigrate_SignedCommits tests that Migrate refuses to drop signatures
+// unless told to, and re-signs rewritten commits with a given key
+func TestMigrate_SignedCommits(t *testing.T) {
+	key := testSigningKey(1)
+	keyring := NewKeyring(key.Public().(ed25519.PublicKey))
+	openSigned := func(t *testing.T) *Store {
+		t.Helper()
+		dir := t.TempDir()
+		config := `{"version": 2, "chunker": {"target_size": 4096, "min_size": 512, "max_size": 16384}}`
+		if err := os.WriteFile(filepath.Join(dir, configFileName), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := Open(dir)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			for j := 0; j < 1000; j++ {
+				if err := s.Put([]byte(fmt.Sprintf("k-%d-%04d", i, j)), []byte("value")); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+			if _, err := s.Commit("signed", WithSigningKey(key)); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+		}
+		return s
+	}
+
+	s := openSigned(t)
+	defer s.Close()
+	head := s.Head()
+	if err := s.Migrate(nil); !errors.Is(err, ErrMigrationDropsSignatures) {
+		t.Fatalf("Migrate returned %v, expected ErrMigrationDropsSignatures", err)
+	}
+	if s.Head() != head || s.FormatVersion() != formatBlobValues {
+		t.Fatal("a refused migration moved HEAD or changed the format")
+	}
+
+	if err := s.Migrate(nil, WithResigningKey(key)); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if s.Head() == head {
+		t.Fatal("expected the migration to rewrite HEAD")
+	}
+	if log, err := s.VerifiedLog(keyring); err != nil || len(log) != 2 {
+		t.Errorf("VerifiedLog after re-signing = %d commits, %v", len(log), err)
+	}
+
+	dropped := openSigned(t)
+	defer dropped.Close()
+	if err := dropped.Migrate(nil, WithDroppedSignatures()); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if err := dropped.VerifyCommit(dropped.Head(), keyring); !errors.Is(err, ErrUnsignedCommit) {
+		t.Errorf("VerifyCommit after dropping signatures returned %v, expected ErrUnsignedCommit", err)
+	}
+}
+
+// TestMigrate_SignedTags tests that a signed tag whose commit is rewritten
+// is re-signed or left unsigned as told, like a signed commit
+func TestMigrate_SignedTags(t *testing.T) {
+	key := testSigningKey(1)
+	keyring := NewKeyring(key.Public().(ed25519.PublicKey))
+	openTagged := func(t *testing.T) *Store {
+		t.Helper()
+		s := openInlineFormatStore(t, t.TempDir())
+		if err := s.Put([]byte("big"), bytes.Repeat([]byte("x"), 10000)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if _, err := s.CreateTag("v1", fillAndCommit(t, s, "a", 10), "release", WithTagSigningKey(key)); err != nil {
+			t.Fatalf("CreateTag failed: %v", err)
+		}
+		return s
+	}
+
+	s := openTagged(t)
+	defer s.Close()
+	if err := s.Migrate(nil); !errors.Is(err, ErrMigrationDropsSignatures) {
+		t.Fatalf("Migrate returned %v, expected ErrMigrationDropsSignatures", err)
+	}
+	if err := s.Migrate(nil, WithResigningKey(key)); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if err := s.VerifyTag("v1", keyring); err != nil {
+		t.Errorf("VerifyTag after re-signing failed: %v", err)
+	}
+
+	dropped := openTagged(t)
+	defer dropped.Close()
+	if err := dropped.Migrate(nil, WithDroppedSignatures()); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if err := dropped.VerifyTag("v1", keyring); !errors.Is(err, ErrUnsignedTag) {
+		t.Errorf("VerifyTag after dropping signatures returned %v, expected ErrUnsignedTag", err)
+	}
+}
+
+// TestOpen_RejectsUnsupportedFormat tests that newer versions and unknown
+// feature flags are refused
+func TestOpen_RejectsUnsupportedFormat(t *testing.T) {
+	configs := map[string]string{
+		"newer version":   `{"version": 99, "chunker": {"target_size": 4096, "min_size": 512, "max_size": 16384}}`,
+		"unknown feature": `{"version": 2, "features": ["time-travel"], "chunker": {"target_size": 4096, "min_size": 512, "max_size": 16384}}`,
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, configFileName), []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Open(dir); !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("Open returned %v, expected ErrUnsupportedFormat", err)
+			}
+		})
+	}
+}
+
+// TestOpen_RecordsFeatures tests that a new repository starts at the current
+// format and that compression is recorded as a feature
+func TestOpen_RecordsFeatures(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	s.Close()
+
+	cfg, err := readConfig(dir)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if cfg.Version != FormatVersion || len(cfg.Features) != 0 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	s, err = Open(dir, WithCompression(true))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	s.Close()
+
+	cfg, err = readConfig(dir)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if !cfg.hasFeature(FeatureCompression) {
+		t.Errorf("expected the compression feature, got %v", cfg.Features)
+	}
+}
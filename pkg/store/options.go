@@ -0,0 +1,562 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"microprolly/pkg/branch"
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/tree"
+)
+
+const (
+	// configFileName is the repository config file in the data directory
+	configFileName = "config"
+	// DefaultBranch is the branch created in a new repository
+	DefaultBranch = "main"
+)
+
+// Repository format versions. The version in the config describes how
+// nodes, commits and refs are encoded; Store.Migrate upgrades older ones.
+const (
+	// formatInlineValues is the original format: every value is stored
+	// inline in its leaf. Repositories without a config use it.
+	formatInlineValues = 1
+	// formatBlobValues stores values above the blob threshold out of line
+	formatBlobValues = 2
+	// formatSubtreeCounts records the number of keys under each child of
+	// an internal node
+	formatSubtreeCounts = 3
+
+	// FormatVersion is the format new repositories are created with
+	FormatVersion = formatSubtreeCounts
+)
+
+// Feature flags name optional format extensions a repository uses.
+// Opening a repository with a feature this version does not know fails.
+const (
+	// FeatureCompression marks repositories holding DEFLATE-compressed objects
+	FeatureCompression = "compression"
+	// FeatureEncryption marks repositories whose objects are encrypted
+	FeatureEncryption = "encryption"
+	// FeatureTables marks repositories whose commits have named tables
+	FeatureTables = "tables"
+)
+
+// Storage layouts name how a repository's objects are kept on disk
+const (
+	// layoutLoose stores one file per object, as NewStore writes them
+	layoutLoose = "loose"
+	// layoutPacks appends objects to pack files, as Open and NewPackedStore
+	// write them. Loose objects are still read alongside the packs.
+	layoutPacks = "packs"
+)
+
+// knownFeatures lists the feature flags this version can read
+var knownFeatures = []string{FeatureCompression, FeatureEncryption, FeatureTables}
+
+var (
+	// ErrReadOnly is returned by operations that modify a store opened
+	// read-only. It is the object store's error, so writes refused by the
+	// CAS match it too.
+	ErrReadOnly = cas.ErrReadOnly
+	// ErrConfigMismatch is returned when Open is given chunker parameters that
+	// differ from the ones the repository was created with
+	ErrConfigMismatch = errors.New("options do not match repository config")
+	// ErrInvalidConfig is returned when the repository config cannot be parsed
+	ErrInvalidConfig = errors.New("invalid repository config")
+	// ErrUnsupportedFormat is returned when a repository uses a format
+	// version or feature this version cannot read
+	ErrUnsupportedFormat = errors.New("unsupported repository format")
+	// ErrRepositoryNotFound is returned when opening a missing repository read-only
+	ErrRepositoryNotFound = errors.New("repository not found")
+	// ErrEncryptionKeyRequired is returned when opening an encrypted
+	// repository without WithEncryption
+	ErrEncryptionKeyRequired = errors.New("repository is encrypted: a key is required")
+	// ErrWrongEncryptionKey is returned when the key does not match the one
+	// the repository was created with
+	ErrWrongEncryptionKey = errors.New("wrong encryption key for repository")
+)
+
+// SyncPolicy controls when written objects are fsynced
+type SyncPolicy int
+
+const (
+	// SyncOnCommit fsyncs new objects once per commit, before refs are updated
+	SyncOnCommit SyncPolicy = iota
+	// SyncAlways fsyncs after every object write
+	SyncAlways
+	// SyncNever leaves flushing to the operating system. A crash can lose
+	// recent commits, or leave refs pointing at objects that were never written.
+	SyncNever
+)
+
+// ChunkerParams are the content-defined chunking parameters of a repository
+type ChunkerParams struct {
+	// Algorithm names the chunker, one of chunker.Algorithms. Configs
+	// written before it existed used Buzhash.
+	Algorithm  string `json:"algorithm,omitempty"`
+	TargetSize uint32 `json:"target_size"`
+	MinSize    uint32 `json:"min_size"`
+	MaxSize    uint32 `json:"max_size"`
+}
+
+// DefaultChunkerParams returns the parameters of chunker.DefaultChunker
+func DefaultChunkerParams() ChunkerParams {
+	c := chunker.DefaultChunker()
+	return ChunkerParams{
+		Algorithm:  chunker.AlgorithmBuzhash,
+		TargetSize: c.TargetSize,
+		MinSize:    c.MinSize,
+		MaxSize:    c.MaxSize,
+	}
+}
+
+// validate checks that the parameters can chunk data
+func (p ChunkerParams) validate() error {
+	if p.TargetSize == 0 || p.MinSize > p.TargetSize || p.TargetSize > p.MaxSize {
+		return fmt.Errorf("invalid chunker parameters: need 0 < target and min <= target <= max, got %d/%d/%d",
+			p.TargetSize, p.MinSize, p.MaxSize)
+	}
+	_, err := p.newChunker()
+	return err
+}
+
+// newChunker creates the chunker the parameters describe
+func (p ChunkerParams) newChunker() (chunker.Chunker, error) {
+	return chunker.New(p.Algorithm, p.TargetSize, p.MinSize, p.MaxSize)
+}
+
+// sameSizes reports whether two parameter sets have the same sizes
+func (p ChunkerParams) sameSizes(other ChunkerParams) bool {
+	return p.TargetSize == other.TargetSize && p.MinSize == other.MinSize && p.MaxSize == other.MaxSize
+}
+
+// Options configures a Store opened with Open
+type Options struct {
+	// Chunker sets the chunk sizes of a new repository, and
+	// ChunkerAlgorithm its chunking algorithm. For an existing repository
+	// the stored parameters are used, and setting different ones is an error.
+	Chunker          *ChunkerParams
+	ChunkerAlgorithm string
+	// SyncPolicy controls when objects are fsynced
+	SyncPolicy SyncPolicy
+	// NodeCacheSize is the byte budget of the decoded-node cache
+	NodeCacheSize int64
+	// Compression stores objects DEFLATE-compressed
+	Compression bool
+	// DefaultBranch is the branch created in a new repository
+	DefaultBranch string
+	// ReadOnly opens an existing repository without modifying it
+	ReadOnly bool
+	// RequiredSigners, if set, only lets branches move to commits signed
+	// by one of its keys
+	RequiredSigners *Keyring
+	// Encryption encrypts the objects of a new repository and supplies the
+	// key of an encrypted one
+	Encryption *EncryptionOptions
+	// WAL, if set, logs uncommitted changes so they survive a crash
+	WAL *WALOptions
+}
+
+// EncryptionOptions configures encryption at rest
+type EncryptionOptions struct {
+	Keys cas.KeyProvider
+	// Mode is used when creating a repository; empty selects
+	// cas.ConvergentEncryption. An existing repository keeps its mode.
+	Mode cas.EncryptionMode
+}
+
+// Option sets a field of Options
+type Option func(*Options)
+
+// WithChunker sets the chunking parameters
+func WithChunker(targetSize, minSize, maxSize uint32) Option {
+	return func(o *Options) {
+		o.Chunker = &ChunkerParams{TargetSize: targetSize, MinSize: minSize, MaxSize: maxSize}
+	}
+}
+
+// WithChunkerAlgorithm selects the chunking algorithm by name, such as
+// chunker.AlgorithmKeyHash to keep value updates from moving boundaries
+func WithChunkerAlgorithm(algorithm string) Option {
+	return func(o *Options) { o.ChunkerAlgorithm = algorithm }
+}
+
+// WithSyncPolicy sets when objects are fsynced
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(o *Options) { o.SyncPolicy = policy }
+}
+
+// WithNodeCacheSize sets the decoded-node cache budget in bytes
+func WithNodeCacheSize(bytes int64) Option {
+	return func(o *Options) { o.NodeCacheSize = bytes }
+}
+
+// WithCompression enables or disables object compression
+func WithCompression(enabled bool) Option {
+	return func(o *Options) { o.Compression = enabled }
+}
+
+// WithDefaultBranch sets the branch created in a new repository
+func WithDefaultBranch(name string) Option {
+	return func(o *Options) { o.DefaultBranch = name }
+}
+
+// WithReadOnly opens the repository read-only
+func WithReadOnly() Option {
+	return func(o *Options) { o.ReadOnly = true }
+}
+
+// WithRequiredSigners rejects branch updates to commits that are not signed
+// by a key in the keyring
+func WithRequiredSigners(keyring *Keyring) Option {
+	return func(o *Options) { o.RequiredSigners = keyring }
+}
+
+// WithEncryption encrypts objects with AES-GCM using the key from keys.
+// A new repository is created encrypted with the given mode (empty for
+// convergent); an encrypted repository cannot be opened without it.
+func WithEncryption(keys cas.KeyProvider, mode cas.EncryptionMode) Option {
+	return func(o *Options) { o.Encryption = &EncryptionOptions{Keys: keys, Mode: mode} }
+}
+
+// DefaultOptions returns the options used when none are given
+func DefaultOptions() Options {
+	return Options{
+		SyncPolicy:    SyncOnCommit,
+		NodeCacheSize: tree.DefaultNodeCacheSize,
+		DefaultBranch: DefaultBranch,
+	}
+}
+
+// repoConfig is the persisted repository config
+type repoConfig struct {
+	// Version is the repository format version
+	Version    int               `json:"version"`
+	Features   []string          `json:"features,omitempty"`
+	Chunker    ChunkerParams     `json:"chunker"`
+	Encryption *encryptionConfig `json:"encryption,omitempty"`
+	// Layout is the storage layout, layoutLoose or layoutPacks. Configs
+	// written before it existed leave it empty; see storageLayout.
+	Layout string `json:"layout,omitempty"`
+}
+
+// encryptionConfig records how an encrypted repository's objects are sealed
+type encryptionConfig struct {
+	Mode cas.EncryptionMode `json:"mode"`
+	// KeyCheck identifies the key without revealing it
+	KeyCheck string `json:"key_check"`
+}
+
+// hasFeature reports whether the config lists a feature flag
+func (c repoConfig) hasFeature(feature string) bool {
+	return slices.Contains(c.Features, feature)
+}
+
+// Open opens the repository in dir, creating it unless read-only.
+// Objects are stored in pack files.
+//
+// The chunking parameters are saved in the repository config on creation
+// and checked on every open: trees built with different parameters would
+// not share structure with existing ones. Repositories in an older format
+// are opened as they are and keep being written in that format until
+// Store.Migrate upgrades them; newer formats fail with ErrUnsupportedFormat.
+func Open(dir string, opts ...Option) (*Store, error) {
+	o := DefaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := branch.ValidateBranchName(o.DefaultBranch); err != nil {
+		return nil, err
+	}
+
+	exists := fileExists(filepath.Join(dir, "HEAD"))
+	if o.ReadOnly && !exists {
+		return nil, fmt.Errorf("%w: %s", ErrRepositoryNotFound, dir)
+	}
+
+	cfg, err := resolveConfig(dir, exists, o, layoutPacks)
+	if err != nil {
+		return nil, err
+	}
+
+	packs, err := cas.NewPackCAS(dir, cas.PackOptions{
+		SyncEvery: syncEvery(o.SyncPolicy),
+		Compress:  o.Compression,
+		ReadOnly:  o.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var casStore cas.CAS = packs
+	if cfg.Encryption != nil {
+		casStore, err = cas.NewEncryptedCAS(packs, o.Encryption.Keys, cfg.Encryption.Mode)
+		if err != nil {
+			packs.Close()
+			return nil, err
+		}
+	}
+
+	refs, err := branch.NewFileRefStore(dir)
+	if err != nil {
+		casStore.Close()
+		return nil, err
+	}
+
+	chunkr, err := cfg.Chunker.newChunker()
+	if err != nil {
+		casStore.Close()
+		return nil, err
+	}
+
+	store, err := newStore(casStore, refs, storeSettings{
+		chunker:         chunkr,
+		nodeCacheSize:   o.NodeCacheSize,
+		defaultBranch:   o.DefaultBranch,
+		syncPolicy:      o.SyncPolicy,
+		readOnly:        o.ReadOnly,
+		formatVersion:   cfg.Version,
+		requiredSigners: o.RequiredSigners,
+	})
+	if err != nil {
+		casStore.Close()
+		return nil, err
+	}
+	store.dataDir = dir
+	if err := store.attachWAL(o.WAL); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// resolveConfig returns the config to open dir with, writing the config
+// of a new (or pre-config) repository and recording newly used features.
+// layout is the storage layout the caller writes objects in; empty keeps
+// the repository's own.
+func resolveConfig(dir string, exists bool, o Options, layout string) (repoConfig, error) {
+	cfg, err := readConfig(dir)
+	switch {
+	case err == nil:
+		if err := checkChunkerOptions(o, cfg.Chunker); err != nil {
+			return repoConfig{}, err
+		}
+		if err := checkEncryptionOptions(o, cfg); err != nil {
+			return repoConfig{}, err
+		}
+	case !os.IsNotExist(err):
+		return repoConfig{}, err
+	case exists:
+		// Repositories created before the config file existed used the
+		// default chunker and the original format
+		cfg = repoConfig{Version: formatInlineValues, Chunker: DefaultChunkerParams()}
+		if err := checkChunkerOptions(o, cfg.Chunker); err != nil {
+			return repoConfig{}, err
+		}
+		if err := checkEncryptionOptions(o, cfg); err != nil {
+			return repoConfig{}, err
+		}
+	default:
+		cfg = repoConfig{Version: FormatVersion, Chunker: DefaultChunkerParams()}
+		if o.Chunker != nil {
+			cfg.Chunker.TargetSize, cfg.Chunker.MinSize, cfg.Chunker.MaxSize = o.Chunker.TargetSize, o.Chunker.MinSize, o.Chunker.MaxSize
+		}
+		if o.ChunkerAlgorithm != "" {
+			cfg.Chunker.Algorithm = o.ChunkerAlgorithm
+		}
+		if err := cfg.Chunker.validate(); err != nil {
+			return repoConfig{}, err
+		}
+		if o.Encryption != nil {
+			enc, err := newEncryptionConfig(*o.Encryption)
+			if err != nil {
+				return repoConfig{}, err
+			}
+			cfg.Encryption = enc
+			cfg.Features = append(cfg.Features, FeatureEncryption)
+		}
+	}
+
+	if o.ReadOnly {
+		return cfg, nil
+	}
+	changed := err != nil // the config file does not exist yet
+	if o.Compression && !cfg.hasFeature(FeatureCompression) {
+		cfg.Features = append(cfg.Features, FeatureCompression)
+		changed = true
+	}
+	if layout == "" {
+		layout = storageLayout(dir, cfg)
+	}
+	if cfg.Layout != layout {
+		cfg.Layout = layout
+		changed = true
+	}
+	if changed {
+		if err := writeConfig(dir, cfg); err != nil {
+			return repoConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// storageLayout returns the storage layout of the repository in dir. Configs
+// written before the layout was recorded leave it to the directory: Open and
+// NewPackedStore always created the packs directory.
+func storageLayout(dir string, cfg repoConfig) string {
+	if cfg.Layout != "" {
+		return cfg.Layout
+	}
+	if fileExists(filepath.Join(dir, "packs")) {
+		return layoutPacks
+	}
+	return layoutLoose
+}
+
+// checkChunkerOptions returns ErrConfigMismatch if the options set chunker
+// sizes or an algorithm different from a repository's parameters
+func checkChunkerOptions(o Options, params ChunkerParams) error {
+	if o.Chunker != nil && !o.Chunker.sameSizes(params) {
+		return fmt.Errorf("%w: chunker sizes %d/%d/%d, repository uses %d/%d/%d", ErrConfigMismatch,
+			o.Chunker.TargetSize, o.Chunker.MinSize, o.Chunker.MaxSize,
+			params.TargetSize, params.MinSize, params.MaxSize)
+	}
+	if o.ChunkerAlgorithm != "" && o.ChunkerAlgorithm != params.Algorithm {
+		return fmt.Errorf("%w: chunker algorithm %q, repository uses %q", ErrConfigMismatch, o.ChunkerAlgorithm, params.Algorithm)
+	}
+	return nil
+}
+
+// newEncryptionConfig returns the encryption config of a new repository
+func newEncryptionConfig(opts EncryptionOptions) (*encryptionConfig, error) {
+	mode := opts.Mode
+	if mode == "" {
+		mode = cas.ConvergentEncryption
+	}
+	if mode != cas.ConvergentEncryption && mode != cas.RandomNonceEncryption {
+		return nil, fmt.Errorf("unknown encryption mode %q", mode)
+	}
+	check, err := cas.KeyCheckFor(opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionConfig{Mode: mode, KeyCheck: check}, nil
+}
+
+// checkEncryptionOptions checks the encryption options against an existing
+// repository: an encrypted one needs its key, an unencrypted one stays so
+func checkEncryptionOptions(o Options, cfg repoConfig) error {
+	switch {
+	case cfg.Encryption == nil && o.Encryption == nil:
+		return nil
+	case cfg.Encryption == nil:
+		return fmt.Errorf("%w: repository is not encrypted", ErrConfigMismatch)
+	case o.Encryption == nil:
+		return ErrEncryptionKeyRequired
+	}
+
+	if o.Encryption.Mode != "" && o.Encryption.Mode != cfg.Encryption.Mode {
+		return fmt.Errorf("%w: encryption mode %q, repository uses %q", ErrConfigMismatch, o.Encryption.Mode, cfg.Encryption.Mode)
+	}
+	check, err := cas.KeyCheckFor(o.Encryption.Keys)
+	if err != nil {
+		return err
+	}
+	if check != cfg.Encryption.KeyCheck {
+		return ErrWrongEncryptionKey
+	}
+	return nil
+}
+
+// readConfig loads the repository config from dir
+func readConfig(dir string) (repoConfig, error) {
+	data, err := os.ReadFile(filepath.Join(dir, configFileName))
+	if err != nil {
+		return repoConfig{}, err
+	}
+
+	var cfg repoConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return repoConfig{}, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if cfg.Version < formatInlineValues || cfg.Version > FormatVersion {
+		return repoConfig{}, fmt.Errorf("%w: version %d, this version reads %d to %d",
+			ErrUnsupportedFormat, cfg.Version, formatInlineValues, FormatVersion)
+	}
+	for _, feature := range cfg.Features {
+		if !slices.Contains(knownFeatures, feature) {
+			return repoConfig{}, fmt.Errorf("%w: unknown feature %q", ErrUnsupportedFormat, feature)
+		}
+	}
+	if cfg.hasFeature(FeatureEncryption) != (cfg.Encryption != nil) {
+		return repoConfig{}, fmt.Errorf("%w: encryption feature and settings disagree", ErrInvalidConfig)
+	}
+	if cfg.Layout != "" && cfg.Layout != layoutLoose && cfg.Layout != layoutPacks {
+		return repoConfig{}, fmt.Errorf("%w: unknown storage layout %q", ErrUnsupportedFormat, cfg.Layout)
+	}
+	if cfg.Chunker.Algorithm == "" {
+		cfg.Chunker.Algorithm = chunker.AlgorithmBuzhash
+	}
+	if err := cfg.Chunker.validate(); err != nil {
+		return repoConfig{}, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return cfg, nil
+}
+
+// writeConfig saves the repository config to dir atomically
+func writeConfig(dir string, cfg repoConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Atomic write: temp file, fsync, rename
+	tmpFile, err := os.CreateTemp(dir, ".config-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := tmpFile.Write(append(data, '\n')); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, configFileName)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// syncEvery maps a SyncPolicy to the pack fsync interval
+func syncEvery(policy SyncPolicy) int {
+	if policy == SyncAlways {
+		return 1
+	}
+	return 0
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,445 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+)
+
+// TestOpen_PersistsChunkerConfig tests that chunking parameters are saved on
+// creation, reused on reopen and checked against explicit options
+func TestOpen_PersistsChunkerConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir, WithChunker(1024, 128, 4096))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := s.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := s.Commit("first"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	s.Close()
+
+	cfg, err := readConfig(dir)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if cfg.Chunker != (ChunkerParams{Algorithm: "buzhash", TargetSize: 1024, MinSize: 128, MaxSize: 4096}) {
+		t.Errorf("unexpected stored chunker %+v", cfg.Chunker)
+	}
+
+	// Reopening without chunker options uses the stored parameters
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	value, err := s.Get([]byte("k"))
+	if err != nil || string(value) != "v" {
+		t.Errorf("Get returned %q, %v", value, err)
+	}
+	s.Close()
+
+	if _, err := Open(dir, WithChunker(4096, 512, 16384)); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("Open with different chunker returned %v, expected ErrConfigMismatch", err)
+	}
+}
+
+// TestOpen_ExistingRepositoryWithoutConfig tests that a repository created
+// by NewStore is opened with the default chunking parameters
+func TestOpen_ExistingRepositoryWithoutConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	legacy, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if err := legacy.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := legacy.Commit("legacy"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	legacy.Close()
+	// Versions before the config file left none behind
+	if err := os.Remove(filepath.Join(dir, configFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir, WithChunker(1024, 128, 4096)); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("Open with non-default chunker returned %v, expected ErrConfigMismatch", err)
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	value, err := s.Get([]byte("k"))
+	if err != nil || string(value) != "v" {
+		t.Errorf("Get returned %q, %v", value, err)
+	}
+	cfg, err := readConfig(dir)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if cfg.Chunker != DefaultChunkerParams() {
+		t.Errorf("expected default chunker in config, got %+v", cfg.Chunker)
+	}
+}
+
+// TestNewStore_HonoursConfig tests that NewStore and NewPackedStore refuse
+// the formats Open refuses and keep a repository's format and chunker
+func TestNewStore_HonoursConfig(t *testing.T) {
+	writeRepoConfig := func(t *testing.T, dir, config string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, configFileName), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	writeRepoConfig(t, dir, `{"version": 99, "chunker": {"target_size": 4096, "min_size": 512, "max_size": 16384}}`)
+	if _, err := NewStore(dir); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("NewStore returned %v, expected ErrUnsupportedFormat", err)
+	}
+	if _, err := NewPackedStore(dir, cas.PackOptions{}); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("NewPackedStore returned %v, expected ErrUnsupportedFormat", err)
+	}
+
+	dir = t.TempDir()
+	writeRepoConfig(t, dir, `{"version": 1, "chunker": {"algorithm": "keyhash", "target_size": 4096, "min_size": 512, "max_size": 16384}}`)
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if s.FormatVersion() != formatInlineValues {
+		t.Errorf("FormatVersion() = %d, expected %d", s.FormatVersion(), formatInlineValues)
+	}
+	if _, ok := s.builder.Chunker().(*chunker.KeyHashChunker); !ok {
+		t.Errorf("expected the configured key-hash chunker, got %T", s.builder.Chunker())
+	}
+	if err := s.Put([]byte("big"), bytes.Repeat([]byte("large value "), 1000)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	head := fillAndCommit(t, s, "k", 2000)
+	if hasValueRefs(t, s, head) {
+		t.Error("NewStore stored a value out of line in a version 1 repository")
+	}
+	commit, err := s.commitMgr.GetCommit(head)
+	if err != nil {
+		t.Fatalf("GetCommit failed: %v", err)
+	}
+	root, err := s.cas.Read(commit.RootHash)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if root[0] != 0x02 {
+		t.Errorf("version 1 root has node type %#x, expected an uncounted internal node", root[0])
+	}
+	s.Close()
+
+	cfg, err := readConfig(dir)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if cfg.Version != formatInlineValues {
+		t.Errorf("config version = %d, expected %d", cfg.Version, formatInlineValues)
+	}
+
+	dir = t.TempDir()
+	s, err = NewPackedStore(dir, cas.PackOptions{})
+	if err != nil {
+		t.Fatalf("NewPackedStore failed: %v", err)
+	}
+	s.Close()
+	if cfg, err := readConfig(dir); err != nil || cfg.Version != FormatVersion {
+		t.Errorf("new repository config = %+v, %v; expected version %d", cfg, err, FormatVersion)
+	}
+}
+
+// TestNewStore_OpensPackedRepository tests that NewStore reads a repository
+// Open wrote to packs, and that the config records each layout
+func TestNewStore_OpensPackedRepository(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	head := fillAndCommit(t, s, "k", 100)
+	s.Close()
+	cfg, err := readConfig(dir)
+	if err != nil || cfg.Layout != layoutPacks {
+		t.Fatalf("config = %+v, %v; expected the packs layout", cfg, err)
+	}
+
+	// Configs written before the layout was recorded are read by the
+	// packs directory Open created
+	cfg.Layout = ""
+	if err := writeConfig(dir, cfg); err != nil {
+		t.Fatalf("writeConfig failed: %v", err)
+	}
+
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if s.Head() != head {
+		t.Fatalf("HEAD = %s, expected %s", s.Head(), head)
+	}
+	expectValue(t, s, "k-0042", "value-k-42")
+	if err := s.Put([]byte("added"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := s.Commit("from NewStore"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	s.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+	expectValue(t, s, "added", "1")
+
+	// A repository NewStore created keeps one file per object
+	dir = t.TempDir()
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	s.Close()
+	if cfg, err := readConfig(dir); err != nil || cfg.Layout != layoutLoose {
+		t.Errorf("config = %+v, %v; expected the loose layout", cfg, err)
+	}
+}
+
+// TestOpen_ReadOnly tests that a read-only store serves data, rejects every
+// write and leaves the repository unchanged
+func TestOpen_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := s.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	commitHash, err := s.Commit("first")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	s.Close()
+
+	headBefore, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := Open(dir, WithReadOnly())
+	if err != nil {
+		t.Fatalf("Open read-only failed: %v", err)
+	}
+	defer ro.Close()
+
+	value, err := ro.Get([]byte("k"))
+	if err != nil || string(value) != "v" {
+		t.Errorf("Get returned %q, %v", value, err)
+	}
+	if ro.Head() != commitHash {
+		t.Errorf("Head() = %s, expected %s", ro.Head(), commitHash)
+	}
+
+	writes := map[string]error{
+		"Put":          ro.Put([]byte("k"), []byte("w")),
+		"Delete":       ro.Delete([]byte("k")),
+		"CreateBranch": ro.CreateBranch("feature"),
+		"Checkout":     ro.Checkout(commitHash),
+	}
+	_, writes["Commit"] = ro.Commit("nope")
+	_, writes["CAS Write"] = ro.cas.Write([]byte("object"))
+	for name, err := range writes {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s returned %v, expected ErrReadOnly", name, err)
+		}
+	}
+
+	headAfter, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(headAfter) != string(headBefore) {
+		t.Error("read-only store changed HEAD")
+	}
+
+	if _, err := Open(filepath.Join(dir, "missing"), WithReadOnly()); !errors.Is(err, ErrRepositoryNotFound) {
+		t.Errorf("Open of missing repository returned %v, expected ErrRepositoryNotFound", err)
+	}
+}
+
+// TestOpen_Options tests the default branch, compression and sync options
+func TestOpen_Options(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir,
+		WithDefaultBranch("trunk"),
+		WithCompression(true),
+		WithSyncPolicy(SyncAlways),
+		WithNodeCacheSize(1<<20),
+	)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	name, detached, err := s.CurrentBranch()
+	if err != nil || detached || name != "trunk" {
+		t.Errorf("CurrentBranch() = %q, %v, %v; expected trunk", name, detached, err)
+	}
+
+	fillAndCommit(t, s, "c", 500)
+	s.Close()
+
+	// Compressed objects are readable without the option
+	s, err = Open(dir, WithSyncPolicy(SyncNever))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	value, err := s.Get([]byte("c-0499"))
+	if err != nil || string(value) != "value-c-499" {
+		t.Errorf("Get returned %q, %v", value, err)
+	}
+
+	if _, err := Open(t.TempDir(), WithDefaultBranch("bad name")); err == nil {
+		t.Error("expected an invalid default branch name to be rejected")
+	}
+}
+
+// TestOpen_ChunkerAlgorithm tests that the chunking algorithm is selected
+// per repository and checked on reopen
+func TestOpen_ChunkerAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir, WithChunkerAlgorithm(chunker.AlgorithmKeyHash))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, ok := s.builder.Chunker().(*chunker.KeyHashChunker); !ok {
+		t.Errorf("expected a key-hash chunker, got %T", s.builder.Chunker())
+	}
+	fillAndCommit(t, s, "k", 100)
+	s.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, ok := s.builder.Chunker().(*chunker.KeyHashChunker); !ok {
+		t.Errorf("expected the stored key-hash chunker on reopen, got %T", s.builder.Chunker())
+	}
+	s.Close()
+
+	if _, err := Open(dir, WithChunkerAlgorithm(chunker.AlgorithmBuzhash)); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("Open with a different algorithm returned %v, expected ErrConfigMismatch", err)
+	}
+	if _, err := Open(t.TempDir(), WithChunkerAlgorithm("nope")); !errors.Is(err, chunker.ErrUnknownAlgorithm) {
+		t.Errorf("Open with an unknown algorithm returned %v, expected ErrUnknownAlgorithm", err)
+	}
+}
+
+// TestOpen_Encryption tests that an encrypted repository keeps no plaintext
+// on disk and cannot be opened without its key
+func TestOpen_Encryption(t *testing.T) {
+	dir := t.TempDir()
+	key := cas.StaticKey(bytes.Repeat([]byte{7}, cas.EncryptionKeySize))
+
+	s, err := Open(dir, WithEncryption(key, ""))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	secret := []byte("diagnosis: confidential")
+	if err := s.Put([]byte("patient-1"), secret); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := s.Commit("encrypted"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, err := s.Repack(); err != nil {
+		t.Errorf("Repack of an encrypted store failed: %v", err)
+	}
+	s.Close()
+
+	packs, err := filepath.Glob(filepath.Join(dir, "packs", "*"))
+	if err != nil || len(packs) == 0 {
+		t.Fatalf("no pack files written: %v", err)
+	}
+	for _, pack := range packs {
+		data, err := os.ReadFile(pack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("confidential")) {
+			t.Errorf("%s contains plaintext", pack)
+		}
+	}
+
+	cfg, err := readConfig(dir)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if cfg.Encryption == nil || cfg.Encryption.Mode != cas.ConvergentEncryption || !cfg.hasFeature(FeatureEncryption) {
+		t.Errorf("config does not record encryption: %+v", cfg)
+	}
+
+	if _, err := Open(dir); !errors.Is(err, ErrEncryptionKeyRequired) {
+		t.Errorf("Open without a key returned %v, expected ErrEncryptionKeyRequired", err)
+	}
+	if _, err := NewStore(dir); !errors.Is(err, ErrEncryptionKeyRequired) {
+		t.Errorf("NewStore returned %v, expected ErrEncryptionKeyRequired", err)
+	}
+	if _, err := NewPackedStore(dir, cas.PackOptions{}); !errors.Is(err, ErrEncryptionKeyRequired) {
+		t.Errorf("NewPackedStore returned %v, expected ErrEncryptionKeyRequired", err)
+	}
+	wrongKey := cas.StaticKey(bytes.Repeat([]byte{8}, cas.EncryptionKeySize))
+	if _, err := Open(dir, WithEncryption(wrongKey, "")); !errors.Is(err, ErrWrongEncryptionKey) {
+		t.Errorf("Open with the wrong key returned %v, expected ErrWrongEncryptionKey", err)
+	}
+	if _, err := Open(dir, WithEncryption(key, cas.RandomNonceEncryption)); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("Open with another mode returned %v, expected ErrConfigMismatch", err)
+	}
+
+	s, err = Open(dir, WithEncryption(key, ""), WithReadOnly())
+	if err != nil {
+		t.Fatalf("Open with the key failed: %v", err)
+	}
+	value, err := s.Get([]byte("patient-1"))
+	if err != nil || !bytes.Equal(value, secret) {
+		t.Errorf("Get returned %q, %v", value, err)
+	}
+	s.Close()
+
+	if _, err := Open(t.TempDir(), WithEncryption(cas.StaticKey("short"), "")); !errors.Is(err, cas.ErrInvalidEncryptionKey) {
+		t.Errorf("Open with a short key returned %v, expected ErrInvalidEncryptionKey", err)
+	}
+
+	plain := t.TempDir()
+	s, err = Open(plain)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	s.Close()
+	if _, err := Open(plain, WithEncryption(key, "")); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("encrypting an existing repository returned %v, expected ErrConfigMismatch", err)
+	}
+}
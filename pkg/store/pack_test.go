@@ -0,0 +1,61 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"microprolly/pkg/cas"
+)
+
+// TestStore_RepackAndReopen tests that a store migrated to packs keeps its
+// history readable across restarts
+func TestStore_RepackAndReopen(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "store-pack-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Start with a loose-object store
+	loose, err := NewStore(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := fillAndCommit(t, loose, "a", 300)
+	if _, err := loose.Repack(); err != ErrRepackUnsupported {
+		t.Fatalf("Expected ErrRepackUnsupported for FileCAS store, got %v", err)
+	}
+	loose.Close()
+
+	packed, err := NewPackedStore(tmpDir, cas.DefaultPackOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := fillAndCommit(t, packed, "b", 300)
+
+	moved, err := packed.Repack()
+	if err != nil {
+		t.Fatalf("Repack failed: %v", err)
+	}
+	if moved == 0 {
+		t.Fatal("Expected loose objects to be moved")
+	}
+	packed.Close()
+
+	reopened, err := NewPackedStore(tmpDir, cas.DefaultPackOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if reopened.Head() != second {
+		t.Fatal("HEAD mismatch after reopen")
+	}
+	value, err := reopened.GetAt([]byte("a-0100"), first)
+	if err != nil || string(value) != "value-a-100" {
+		t.Fatalf("GetAt on repacked history returned %q, %v", value, err)
+	}
+	if _, err := reopened.Get([]byte("b-0299")); err != nil {
+		t.Fatalf("Get after reopen failed: %v", err)
+	}
+}
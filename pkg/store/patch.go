@@ -0,0 +1,117 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"microprolly/pkg/tree"
+	"microprolly/pkg/types"
+)
+
+// ErrPatchConflict is returned when the working state does not match a
+// patch's expected old values
+var ErrPatchConflict = errors.New("patch does not match working state")
+
+// ApplyPatchOptions controls how ApplyPatch treats the current working state
+type ApplyPatchOptions struct {
+	// Force skips old-value verification: added and modified keys are
+	// written and deleted keys are removed whatever their current values
+	Force bool
+}
+
+// CreatePatch returns the changes between two commits as a serializable patch.
+// The patch's Base and Target are the commit hashes.
+func (s *Store) CreatePatch(hashA, hashB types.Hash) (*tree.Patch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	commitA, err := s.commitMgr.GetCommit(hashA)
+	if err != nil {
+		return nil, ErrCommitNotFound
+	}
+	commitB, err := s.commitMgr.GetCommit(hashB)
+	if err != nil {
+		return nil, ErrCommitNotFound
+	}
+
+	patch, err := s.differ.CreatePatch(commitA.RootHash, commitB.RootHash)
+	if err != nil {
+		return nil, err
+	}
+	patch.Base = hashA
+	patch.Target = hashB
+	return patch, nil
+}
+
+// ApplyPatch applies a patch to the working state.
+//
+// Unless opts.Force is set, every entry is verified first: added keys must
+// not exist, and modified or deleted keys must currently hold the patch's
+// old value. If any entry fails, nothing is applied and an error wrapping
+// ErrPatchConflict names the first conflicting key. Like a Batch, the patch
+// is logged as a single write-ahead log record, so it is replayed whole or
+// not at all.
+func (s *Store) ApplyPatch(patch *tree.Patch, opts ApplyPatchOptions) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	for _, e := range patch.Entries {
+		if len(e.Key) == 0 {
+			return ErrInvalidKey
+		}
+		if e.Kind != tree.DiffAdded && e.Kind != tree.DiffModified && e.Kind != tree.DiffDeleted {
+			return fmt.Errorf("%w: unknown change kind %d", tree.ErrInvalidPatch, e.Kind)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !opts.Force {
+		for _, e := range patch.Entries {
+			if err := s.checkPatchEntry(e); err != nil {
+				return err
+			}
+		}
+	}
+
+	ops := make([]batchOp, len(patch.Entries))
+	for i, e := range patch.Entries {
+		if e.Kind == tree.DiffDeleted {
+			ops[i] = batchOp{kind: opDelete, key: cloneBytes(e.Key)}
+			continue
+		}
+		ops[i] = batchOp{kind: opPut, key: cloneBytes(e.Key), value: append([]byte{}, e.NewValue...)}
+	}
+
+	if err := s.logBatch(ops); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		s.working.apply(op)
+	}
+	return nil
+}
+
+// checkPatchEntry verifies one patch entry against the working state
+func (s *Store) checkPatchEntry(e tree.DiffEntry) error {
+	switch e.Kind {
+	case tree.DiffAdded:
+		if s.working.has(e.Key) {
+			return fmt.Errorf("%w: key %q already exists", ErrPatchConflict, e.Key)
+		}
+	case tree.DiffModified, tree.DiffDeleted:
+		current, err := s.working.value(s.traverser, e.Key)
+		if errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("%w: key %q not found", ErrPatchConflict, e.Key)
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, e.OldValue) {
+			return fmt.Errorf("%w: key %q has a different value", ErrPatchConflict, e.Key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"microprolly/pkg/tree"
+)
+
+// TestStore_PatchReplication tests shipping a patch to a store that shares
+// no objects with the source and applying it there
+func TestStore_PatchReplication(t *testing.T) {
+	source := NewInMemory()
+	defer source.Close()
+	replica := NewInMemory()
+	defer replica.Close()
+
+	for _, s := range []*Store{source, replica} {
+		s.Put([]byte("keep"), []byte("same"))
+		s.Put([]byte("change"), []byte("old"))
+		s.Put([]byte("remove"), []byte("gone"))
+	}
+	base, err := source.Commit("base")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	source.Put([]byte("change"), []byte("new"))
+	source.Put([]byte("add"), []byte("fresh"))
+	source.Delete([]byte("remove"))
+	target, err := source.Commit("changes")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	patch, err := source.CreatePatch(base, target)
+	if err != nil {
+		t.Fatalf("CreatePatch failed: %v", err)
+	}
+	if patch.Base != base || patch.Target != target || len(patch.Entries) != 3 {
+		t.Fatalf("Unexpected patch: base=%x target=%x entries=%d", patch.Base, patch.Target, len(patch.Entries))
+	}
+
+	// Ship it as JSON
+	data, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var received tree.Patch
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if err := replica.ApplyPatch(&received, ApplyPatchOptions{}); err != nil {
+		t.Fatalf("ApplyPatch failed: %v", err)
+	}
+
+	expected := map[string]string{"keep": "same", "change": "new", "add": "fresh"}
+	for key, value := range expected {
+		got, err := replica.Get([]byte(key))
+		if err != nil || string(got) != value {
+			t.Fatalf("Get(%q) = %q, %v; want %q", key, got, err, value)
+		}
+	}
+	if _, err := replica.Get([]byte("remove")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected deleted key to be gone, got %v", err)
+	}
+}
+
+// TestStore_ApplyPatchConflict tests that a mismatched old value rejects the
+// whole patch unless forced
+func TestStore_ApplyPatchConflict(t *testing.T) {
+	store := NewInMemory()
+	defer store.Close()
+
+	store.Put([]byte("a"), []byte("1"))
+	store.Put([]byte("b"), []byte("local edit"))
+
+	patch := &tree.Patch{Entries: []tree.DiffEntry{
+		{Kind: tree.DiffModified, Key: []byte("a"), OldValue: []byte("1"), NewValue: []byte("2")},
+		{Kind: tree.DiffModified, Key: []byte("b"), OldValue: []byte("original"), NewValue: []byte("3")},
+	}}
+
+	if err := store.ApplyPatch(patch, ApplyPatchOptions{}); !errors.Is(err, ErrPatchConflict) {
+		t.Fatalf("Expected ErrPatchConflict, got %v", err)
+	}
+	if got, _ := store.Get([]byte("a")); string(got) != "1" {
+		t.Fatalf("Conflicting patch was partially applied: a=%q", got)
+	}
+
+	if err := store.ApplyPatch(patch, ApplyPatchOptions{Force: true}); err != nil {
+		t.Fatalf("Forced ApplyPatch failed: %v", err)
+	}
+	if got, _ := store.Get([]byte("b")); string(got) != "3" {
+		t.Fatalf("Forced patch not applied: b=%q", got)
+	}
+}
+
+// TestStore_ApplyPatchWALFailure tests that a patch whose log write fails or
+// is torn by a crash leaves no entry applied, before or after replay
+func TestStore_ApplyPatchWALFailure(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fillAndCommit(t, s, "k", 4)
+
+	patch := &tree.Patch{Entries: []tree.DiffEntry{
+		{Kind: tree.DiffAdded, Key: []byte("added"), NewValue: []byte("1")},
+		{Kind: tree.DiffModified, Key: []byte("k-0001"), OldValue: []byte("value-k-1"), NewValue: []byte("2")},
+		{Kind: tree.DiffDeleted, Key: []byte("k-0002"), OldValue: []byte("value-k-2")},
+	}}
+
+	// A failed log write applies nothing
+	file := s.wal.file
+	readOnly, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	s.wal.file = readOnly
+	if err := s.ApplyPatch(patch, ApplyPatchOptions{}); err == nil {
+		t.Fatal("expected ApplyPatch to fail when the log cannot be written")
+	}
+	readOnly.Close()
+	s.wal.file = file
+	expectMissing(t, s, "added")
+	expectValue(t, s, "k-0001", "value-k-1")
+	expectValue(t, s, "k-0002", "value-k-2")
+
+	// The patch is one record: tearing its last bytes loses all of it
+	if err := s.ApplyPatch(patch, ApplyPatchOptions{}); err != nil {
+		t.Fatalf("ApplyPatch failed: %v", err)
+	}
+	if records := walRecords(t, dir); len(records) != 2 || records[1].kind != walBatch {
+		t.Fatalf("expected the base record and one batch record, got %d records", len(records))
+	}
+	size := s.wal.size
+	crash(s)
+	if err := os.Truncate(filepath.Join(dir, walFileName), size-1); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+	expectMissing(t, s, "added")
+	expectValue(t, s, "k-0001", "value-k-1")
+	expectValue(t, s, "k-0002", "value-k-2")
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"microprolly/pkg/tree"
+	"microprolly/pkg/types"
+)
+
+// DeleteRange removes every key with start <= key < end from the working
+// state. A nil end is unbounded; a range with start >= end removes nothing.
+// The write-ahead log records the range, not the keys it removed, and the
+// next commit removes it from the HEAD tree with TreeBuilder.DeleteRange
+// instead of rebuilding the tree.
+func (s *Store) DeleteRange(start, end []byte) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	start, end = cloneBytes(start), cloneBytes(end)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.logDeleteRange(start, end); err != nil {
+		return err
+	}
+	s.working.deleteRange(start, end)
+	return nil
+}
+
+// DeletePrefix removes every key that starts with prefix. An empty prefix
+// removes every key.
+func (s *Store) DeletePrefix(prefix []byte) error {
+	return s.DeleteRange(prefix, tree.PrefixEnd(prefix))
+}
+
+// CopyPrefix replaces the keys under dst with a copy of the keys under src,
+// with the src prefix swapped for dst. Keys under dst that have no
+// counterpart under src are removed, so dst ends up mirroring src. Values
+// stored out of line are copied by reference without being read. Moving a
+// prefix is CopyPrefix followed by DeletePrefix of src. As with
+// DeleteRange, the next commit edits the HEAD tree in place.
+//
+// dst must not be empty, since a key equal to src would become empty.
+func (s *Store) CopyPrefix(src, dst []byte) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if len(dst) == 0 {
+		return ErrInvalidKey
+	}
+	src, dst = cloneBytes(src), cloneBytes(dst)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.logCopyPrefix(src, dst); err != nil {
+		return err
+	}
+	s.working.copyPrefix(src, dst)
+	return nil
+}
+
+// Scan calls fn for each key with start <= key < end in the working state,
+// in key order. A nil end is unbounded. The matching keys are gathered
+// first and fn runs without the store lock held, so it may use the store;
+// changes it makes are not seen by the running scan. Scanning stops at the
+// first error fn returns, which Scan returns.
+func (s *Store) Scan(start, end []byte, fn func(key, value []byte) error) error {
+	s.mu.RLock()
+	pairs := s.working.rangePairs(start, end)
+	s.mu.RUnlock()
+
+	return s.scanPairs(pairs, fn)
+}
+
+// ScanPrefix is Scan over the keys that start with prefix
+func (s *Store) ScanPrefix(prefix []byte, fn func(key, value []byte) error) error {
+	return s.Scan(prefix, tree.PrefixEnd(prefix), fn)
+}
+
+// scanPairs calls fn for each pair, reading values stored out of line from
+// their blobs
+func (s *Store) scanPairs(pairs []types.KVPair, fn func(key, value []byte) error) error {
+	for _, pair := range pairs {
+		value := cloneBytes(pair.Value)
+		if pair.ValueRef {
+			ref, err := tree.DecodeBlobRef(pair.Value)
+			if err != nil {
+				return err
+			}
+			if value, err = s.traverser.ReadBlob(ref); err != nil {
+				return err
+			}
+		}
+		if err := fn(pair.Key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
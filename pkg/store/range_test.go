@@ -0,0 +1,304 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/tree"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// rootOf returns the tree root of a commit
+func rootOf(t *testing.T, s *Store, commitHash types.Hash) types.Hash {
+	t.Helper()
+	commit, err := s.commitMgr.GetCommit(commitHash)
+	if err != nil {
+		t.Fatalf("GetCommit failed: %v", err)
+	}
+	return commit.RootHash
+}
+
+// TestDeletePrefix_MatchesTreeEdit tests that deleting a prefix removes
+// exactly its keys, and that the commit holds the tree the builder's
+// in-place DeleteRange produces from the previous one
+func TestDeletePrefix_MatchesTreeEdit(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	fillAndCommit(t, s, "patient:122", 100)
+	fillAndCommit(t, s, "patient:123", 500)
+	base := fillAndCommit(t, s, "patient:124", 100)
+
+	if err := s.DeletePrefix([]byte("patient:123")); err != nil {
+		t.Fatalf("DeletePrefix failed: %v", err)
+	}
+	expectMissing(t, s, "patient:123-0000")
+	expectMissing(t, s, "patient:123-0499")
+	expectValue(t, s, "patient:122-0099", "value-patient:122-99")
+	expectValue(t, s, "patient:124-0000", "value-patient:124-0")
+
+	head, err := s.Commit("drop patient 123")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	edited, err := s.builder.DeleteRange(rootOf(t, s, base), []byte("patient:123"), []byte("patient:124"))
+	if err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	if rootOf(t, s, head) != edited {
+		t.Error("committed root differs from the tree edited in place")
+	}
+}
+
+// TestDeletePrefix_CommitEditsInPlace tests that a commit after a range
+// edit writes only the edges of the range instead of the whole tree
+func TestDeletePrefix_CommitEditsInPlace(t *testing.T) {
+	tracking := cas.NewTrackingCAS(cas.NewMemoryCAS())
+	s := NewStoreWithCAS(tracking)
+	defer s.Close()
+	fillAndCommit(t, s, "a", 2000)
+	fillAndCommit(t, s, "b", 2000)
+	fillAndCommit(t, s, "c", 2000)
+	tracking.ResetStats()
+
+	if err := s.DeletePrefix([]byte("b")); err != nil {
+		t.Fatalf("DeletePrefix failed: %v", err)
+	}
+	if err := s.Put([]byte("c-0000"), []byte("changed")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := s.Commit("drop b"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	// A rebuild would write every leaf of the 4000 remaining keys again
+	if writes := tracking.Stats().TotalWrites; writes > 40 {
+		t.Errorf("commit wrote %d objects, expected only the edges of the range", writes)
+	}
+
+	if _, err := s.Commit("no change"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	expectMissing(t, s, "b-0000")
+	expectValue(t, s, "c-0000", "changed")
+	expectValue(t, s, "c-0001", "value-c-1")
+}
+
+// TestDeleteRange_Bounds tests inclusive start, exclusive end, unbounded
+// end and empty ranges
+func TestDeleteRange_Bounds(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	fillAndCommit(t, s, "k", 10)
+
+	if err := s.DeleteRange([]byte("k-0005"), []byte("k-0002")); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	expectValue(t, s, "k-0003", "value-k-3")
+
+	if err := s.DeleteRange([]byte("k-0002"), []byte("k-0004")); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	expectValue(t, s, "k-0001", "value-k-1")
+	expectMissing(t, s, "k-0002")
+	expectMissing(t, s, "k-0003")
+	expectValue(t, s, "k-0004", "value-k-4")
+
+	if err := s.DeleteRange([]byte("k-0008"), nil); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	expectValue(t, s, "k-0007", "value-k-7")
+	expectMissing(t, s, "k-0009")
+}
+
+// TestCopyPrefix_ReplacesDestination tests that dst mirrors src afterwards,
+// that src is untouched, and that out-of-line values are shared
+func TestCopyPrefix_ReplacesDestination(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	fillAndCommit(t, s, "src", 20)
+	fillAndCommit(t, s, "dst", 30)
+	big := bytes.Repeat([]byte("x"), 10000)
+	if err := s.Put([]byte("src-big"), big); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := s.Commit("big value"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	if err := s.CopyPrefix([]byte("src"), []byte("dst")); err != nil {
+		t.Fatalf("CopyPrefix failed: %v", err)
+	}
+	expectValue(t, s, "dst-0019", "value-src-19")
+	expectMissing(t, s, "dst-0025")
+	expectValue(t, s, "src-0019", "value-src-19")
+	if s.working.blobs["dst-big"] != s.working.blobs["src-big"] {
+		t.Error("expected the copied value to keep its blob reference")
+	}
+
+	if err := s.CopyPrefix([]byte("src"), nil); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("copy to an empty prefix returned %v, expected ErrInvalidKey", err)
+	}
+
+	// Overlapping prefixes copy the keys as they were before the copy
+	if err := s.CopyPrefix([]byte("src-"), []byte("src-0")); err != nil {
+		t.Fatalf("CopyPrefix failed: %v", err)
+	}
+	expectValue(t, s, "src-00019", "value-src-19")
+	expectValue(t, s, "src-0big", string(big))
+	expectMissing(t, s, "src-0019")
+	expectValue(t, s, "src-big", string(big))
+}
+
+// TestRangeEdits_ReplayedFromWAL tests that range deletes and prefix copies
+// are logged as single records and restored after a crash
+func TestRangeEdits_ReplayedFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fillAndCommit(t, s, "a", 50)
+	fillAndCommit(t, s, "b", 50)
+
+	if err := s.CopyPrefix([]byte("a"), []byte("c")); err != nil {
+		t.Fatalf("CopyPrefix failed: %v", err)
+	}
+	if err := s.DeletePrefix([]byte("a")); err != nil {
+		t.Fatalf("DeletePrefix failed: %v", err)
+	}
+	if records := walRecords(t, dir); len(records) != 3 {
+		t.Errorf("expected 3 records, got %d", len(records))
+	}
+	crash(s)
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	expectMissing(t, s, "a-0000")
+	expectValue(t, s, "b-0049", "value-b-49")
+	expectValue(t, s, "c-0049", "value-a-49")
+}
+
+// TestScan_WorkingState tests that Scan sees uncommitted changes, reads
+// values stored out of line, and that DiffStream honours its key range
+func TestScan_WorkingState(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	base := fillAndCommit(t, s, "k", 100)
+
+	big := bytes.Repeat([]byte("x"), 10000)
+	if err := s.Put([]byte("k-0050"), big); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Delete([]byte("k-0051")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := s.Put([]byte("l-0000"), []byte("outside")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	var keys []string
+	err := s.Scan([]byte("k-0049"), []byte("k-0053"), func(key, value []byte) error {
+		if string(key) == "k-0050" && !bytes.Equal(value, big) {
+			t.Error("Scan returned the wrong value for k-0050")
+		}
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(keys) != 3 || keys[0] != "k-0049" || keys[1] != "k-0050" || keys[2] != "k-0052" {
+		t.Errorf("Scan returned %v", keys)
+	}
+
+	n := 0
+	if err := s.ScanPrefix([]byte("k-"), func(key, value []byte) error { n++; return nil }); err != nil || n != 99 {
+		t.Errorf("ScanPrefix visited %d keys, %v; expected 99", n, err)
+	}
+
+	head, err := s.Commit("edits")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	var changes []string
+	err = s.DiffStream(base, head, tree.DiffOptions{Prefix: []byte("k-")}, func(e tree.DiffEntry) error {
+		changes = append(changes, e.Kind.String()+" "+string(e.Key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DiffStream failed: %v", err)
+	}
+	if len(changes) != 2 || changes[0] != "modified k-0050" || changes[1] != "deleted k-0051" {
+		t.Errorf("DiffStream returned %v", changes)
+	}
+}
+
+// TestProperty_RangeEditCommitsMatchBuild checks that commits after random
+// puts, deletes and range edits hold the tree a fresh build of the working
+// state gives
+func TestProperty_RangeEditCommitsMatchBuild(t *testing.T) {
+	rapid.Check(t, func(rt *rapid.T) {
+		s := NewInMemory()
+		defer s.Close()
+		prefixes := []string{"a", "b", "ba", "c"}
+		key := func(label string) []byte {
+			prefix := rapid.SampledFrom(prefixes).Draw(rt, label+"-prefix")
+			return []byte(fmt.Sprintf("%s%04d", prefix, rapid.IntRange(0, 300).Draw(rt, label)))
+		}
+		for _, prefix := range prefixes {
+			for i, n := 0, rapid.IntRange(0, 300).Draw(rt, "n-"+prefix); i < n; i++ {
+				k := []byte(fmt.Sprintf("%s%04d", prefix, i))
+				if err := s.Put(k, k); err != nil {
+					rt.Fatalf("Put failed: %v", err)
+				}
+			}
+		}
+
+		for round := 0; round < 3; round++ {
+			for i, n := 0, rapid.IntRange(0, 6).Draw(rt, "ops"); i < n; i++ {
+				var err error
+				switch rapid.IntRange(0, 3).Draw(rt, "op") {
+				case 0:
+					err = s.Put(key("put"), []byte("new"))
+				case 1:
+					if err = s.Delete(key("delete")); errors.Is(err, ErrKeyNotFound) {
+						err = nil
+					}
+				case 2:
+					err = s.DeleteRange(key("start"), key("end"))
+				case 3:
+					src := rapid.SampledFrom(prefixes).Draw(rt, "src")
+					dst := rapid.SampledFrom(prefixes).Draw(rt, "dst")
+					err = s.CopyPrefix([]byte(src), []byte(dst))
+				}
+				if err != nil {
+					rt.Fatalf("edit failed: %v", err)
+				}
+			}
+
+			want, err := s.builder.Build(s.working.sortedPairs())
+			if err != nil {
+				rt.Fatalf("Build failed: %v", err)
+			}
+			head, err := s.Commit("round")
+			if err != nil {
+				rt.Fatalf("Commit failed: %v", err)
+			}
+			commit, err := s.commitMgr.GetCommit(head)
+			if err != nil {
+				rt.Fatalf("GetCommit failed: %v", err)
+			}
+			if commit.RootHash != want {
+				rt.Fatalf("round %d: committed root differs from a fresh build of the working state", round)
+			}
+		}
+	})
+}
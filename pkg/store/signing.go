@@ -0,0 +1,212 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"microprolly/pkg/types"
+)
+
+var (
+	// ErrUnsignedCommit is returned when a commit that must be signed is not
+	ErrUnsignedCommit = errors.New("commit is not signed")
+	// ErrUnknownSigningKey is returned when a commit is signed by a key that
+	// is not in the keyring
+	ErrUnknownSigningKey = errors.New("commit signed by unknown key")
+	// ErrInvalidSignature is returned when a commit signature does not verify
+	ErrInvalidSignature = errors.New("invalid commit signature")
+	// ErrUnsignedTag is returned when a tag that must be signed is not
+	ErrUnsignedTag = errors.New("tag is not signed")
+	// ErrInvalidTagSignature is returned when a tag signature does not verify
+	ErrInvalidTagSignature = errors.New("invalid tag signature")
+)
+
+// Keyring holds the public keys trusted to sign commits, by key ID
+type Keyring struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewKeyring creates a keyring trusting the given keys
+func NewKeyring(keys ...ed25519.PublicKey) *Keyring {
+	k := &Keyring{keys: make(map[string]ed25519.PublicKey)}
+	for _, key := range keys {
+		k.Add(key)
+	}
+	return k
+}
+
+// Add trusts a key and returns its ID
+func (k *Keyring) Add(key ed25519.PublicKey) string {
+	id := KeyID(key)
+	k.keys[id] = key
+	return id
+}
+
+// Key returns the key with the given ID
+func (k *Keyring) Key(id string) (ed25519.PublicKey, bool) {
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// KeyID returns the ID of a public key: the hex-encoded first 8 bytes of
+// its SHA-256 hash
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signedCommitBytes returns the bytes a commit signature covers: the
+// canonical encoding of the commit without its signature
+func signedCommitBytes(commit *types.Commit) ([]byte, error) {
+	unsigned := *commit
+	unsigned.Sig = nil
+	return MarshalCommit(&unsigned)
+}
+
+// signCommit signs a commit with key, setting its Sig
+func signCommit(commit *types.Commit, key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%w: signing key has %d bytes", ErrInvalidCommitOptions, len(key))
+	}
+	data, err := signedCommitBytes(commit)
+	if err != nil {
+		return err
+	}
+	commit.Sig = &types.CommitSignature{
+		KeyID: KeyID(key.Public().(ed25519.PublicKey)),
+		Value: ed25519.Sign(key, data),
+	}
+	return nil
+}
+
+// verifyCommitSignature checks a commit's signature against the keyring
+func verifyCommitSignature(commit *types.Commit, keyring *Keyring) error {
+	if commit.Sig == nil {
+		return ErrUnsignedCommit
+	}
+	key, ok := keyring.Key(commit.Sig.KeyID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSigningKey, commit.Sig.KeyID)
+	}
+	data, err := signedCommitBytes(commit)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, commit.Sig.Value) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyCommit checks that a commit is signed by a key in the keyring
+func (s *Store) VerifyCommit(commitHash types.Hash, keyring *Keyring) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	commit, err := s.commitMgr.GetCommit(commitHash)
+	if err != nil {
+		return err
+	}
+	return verifyCommitSignature(commit, keyring)
+}
+
+// VerifiedLog returns the commit history from HEAD like Log, verifying
+// every commit's signature. It fails at the first commit that does not
+// verify, naming it in the error.
+func (s *Store) VerifiedLog(keyring *Keyring) ([]*types.Commit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var commits []*types.Commit
+	for hash := s.head; hash != ZeroHash; {
+		commit, err := s.commitMgr.GetCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyCommitSignature(commit, keyring); err != nil {
+			return nil, fmt.Errorf("commit %s: %w", hash, err)
+		}
+		commits = append(commits, commit)
+		hash = commit.Parent
+	}
+	return commits, nil
+}
+
+// signedTagBytes returns the bytes a tag signature covers: the canonical
+// encoding of the tag without its signature
+func signedTagBytes(tag *types.Tag) ([]byte, error) {
+	unsigned := *tag
+	unsigned.Sig = nil
+	return MarshalTag(&unsigned)
+}
+
+// signTag signs a tag with key, setting its Sig
+func signTag(tag *types.Tag, key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%w: signing key has %d bytes", ErrInvalidTagOptions, len(key))
+	}
+	data, err := signedTagBytes(tag)
+	if err != nil {
+		return err
+	}
+	tag.Sig = &types.CommitSignature{
+		KeyID: KeyID(key.Public().(ed25519.PublicKey)),
+		Value: ed25519.Sign(key, data),
+	}
+	return nil
+}
+
+// verifyTagSignature checks a tag's signature against the keyring
+func verifyTagSignature(tag *types.Tag, keyring *Keyring) error {
+	if tag.Sig == nil {
+		return ErrUnsignedTag
+	}
+	key, ok := keyring.Key(tag.Sig.KeyID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSigningKey, tag.Sig.KeyID)
+	}
+	data, err := signedTagBytes(tag)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, tag.Sig.Value) {
+		return ErrInvalidTagSignature
+	}
+	return nil
+}
+
+// VerifyTag checks that a tag is signed by a key in the keyring. It does
+// not verify the tagged commit; use VerifyCommit for that.
+func (s *Store) VerifyTag(name string, keyring *Keyring) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tagHash, err := s.refs.GetTag(name)
+	if err != nil {
+		return err
+	}
+	tag, err := s.readTag(tagHash)
+	if err != nil {
+		return err
+	}
+	return verifyTagSignature(tag, keyring)
+}
+
+// checkBranchUpdate enforces the signature policy: with a keyring set, a
+// branch may only be moved to a commit signed by one of its keys
+func (s *Store) checkBranchUpdate(name string, commitHash types.Hash) error {
+	if s.requiredSigners == nil || commitHash == ZeroHash {
+		return nil
+	}
+	commit, err := s.commitMgr.GetCommit(commitHash)
+	if err != nil {
+		return err
+	}
+	if err := verifyCommitSignature(commit, s.requiredSigners); err != nil {
+		return fmt.Errorf("branch %s: commit %s: %w", name, commitHash, err)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testSigningKey returns a deterministic ed25519 key
+func testSigningKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// TestSigning_VerifyCommit tests signing and every verification failure
+func TestSigning_VerifyCommit(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+
+	key := testSigningKey(1)
+	keyring := NewKeyring(key.Public().(ed25519.PublicKey))
+
+	if err := s.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	signed, err := s.Commit("signed", WithSigningKey(key), WithMetadata("sample", "S-1"))
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := s.VerifyCommit(signed, keyring); err != nil {
+		t.Errorf("VerifyCommit failed: %v", err)
+	}
+
+	commit, err := s.commitMgr.GetCommit(signed)
+	if err != nil {
+		t.Fatalf("GetCommit failed: %v", err)
+	}
+	if commit.Sig == nil || commit.Sig.KeyID != KeyID(key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("unexpected signature %+v", commit.Sig)
+	}
+
+	unsigned, err := s.Commit("unsigned")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := s.VerifyCommit(unsigned, keyring); !errors.Is(err, ErrUnsignedCommit) {
+		t.Errorf("VerifyCommit of an unsigned commit returned %v", err)
+	}
+
+	other := NewKeyring(testSigningKey(2).Public().(ed25519.PublicKey))
+	if err := s.VerifyCommit(signed, other); !errors.Is(err, ErrUnknownSigningKey) {
+		t.Errorf("VerifyCommit with another keyring returned %v", err)
+	}
+
+	// A commit whose content changed after signing does not verify
+	tampered := *commit
+	tampered.Metadata = map[string]string{"sample": "S-2"}
+	tamperedHash, err := s.commitMgr.WriteCommit(&tampered)
+	if err != nil {
+		t.Fatalf("WriteCommit failed: %v", err)
+	}
+	if err := s.VerifyCommit(tamperedHash, keyring); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("VerifyCommit of a tampered commit returned %v", err)
+	}
+}
+
+// TestSigning_VerifiedLog tests that the verified log walk stops at the first
+// commit that does not verify
+func TestSigning_VerifiedLog(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+
+	key := testSigningKey(1)
+	keyring := NewKeyring(key.Public().(ed25519.PublicKey))
+
+	for _, message := range []string{"one", "two"} {
+		if err := s.Put([]byte(message), []byte(message)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if _, err := s.Commit(message, WithSigningKey(key)); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+	commits, err := s.VerifiedLog(keyring)
+	if err != nil || len(commits) != 2 || commits[0].Message != "two" {
+		t.Fatalf("VerifiedLog returned %d commits, %v", len(commits), err)
+	}
+
+	unsigned, err := s.Commit("three")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	_, err = s.VerifiedLog(keyring)
+	if !errors.Is(err, ErrUnsignedCommit) || !strings.Contains(err.Error(), unsigned.String()) {
+		t.Errorf("VerifiedLog returned %v, expected ErrUnsignedCommit naming %s", err, unsigned)
+	}
+}
+
+// TestSigning_RequiredSigners tests that the signature policy rejects branch
+// updates to unsigned commits and accepts signed ones
+func TestSigning_RequiredSigners(t *testing.T) {
+	dir := t.TempDir()
+	key := testSigningKey(1)
+	keyring := NewKeyring(key.Public().(ed25519.PublicKey))
+
+	// An unsigned commit made without the policy
+	plain, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	unsigned := fillAndCommit(t, plain, "a", 5)
+	plain.Close()
+
+	s, err := Open(dir, WithRequiredSigners(keyring))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := s.Commit("unsigned"); !errors.Is(err, ErrUnsignedCommit) {
+		t.Errorf("unsigned Commit returned %v, expected ErrUnsignedCommit", err)
+	}
+	if s.Head() != unsigned {
+		t.Error("a rejected commit moved HEAD")
+	}
+	if _, err := s.Commit("wrong key", WithSigningKey(testSigningKey(2))); !errors.Is(err, ErrUnknownSigningKey) {
+		t.Errorf("Commit signed by an untrusted key returned %v, expected ErrUnknownSigningKey", err)
+	}
+
+	signed, err := s.Commit("signed", WithSigningKey(key))
+	if err != nil {
+		t.Fatalf("signed Commit failed: %v", err)
+	}
+	if s.Head() != signed {
+		t.Error("signed commit did not move HEAD")
+	}
+
+	if err := s.CreateBranchAt("old", unsigned); !errors.Is(err, ErrUnsignedCommit) {
+		t.Errorf("CreateBranchAt an unsigned commit returned %v, expected ErrUnsignedCommit", err)
+	}
+	if err := s.CreateBranch("release"); err != nil {
+		t.Errorf("CreateBranch at a signed commit failed: %v", err)
+	}
+}
+
+// TestSigning_VerifyTag tests signing tags and every verification failure,
+// including for tags carried by a bundle
+func TestSigning_VerifyTag(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+
+	key := testSigningKey(1)
+	keyring := NewKeyring(key.Public().(ed25519.PublicKey))
+	head := fillAndCommit(t, s, "a", 5)
+
+	signedHash, err := s.CreateTag("signed", head, "release", WithTagSigningKey(key))
+	if err != nil {
+		t.Fatalf("CreateTag failed: %v", err)
+	}
+	if err := s.VerifyTag("signed", keyring); err != nil {
+		t.Errorf("VerifyTag failed: %v", err)
+	}
+	tag, err := s.GetTag("signed")
+	if err != nil {
+		t.Fatalf("GetTag failed: %v", err)
+	}
+	if tag.Sig == nil || tag.Sig.KeyID != KeyID(key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("unexpected signature %+v", tag.Sig)
+	}
+
+	if _, err := s.CreateTag("unsigned", head, "release"); err != nil {
+		t.Fatalf("CreateTag failed: %v", err)
+	}
+	if err := s.VerifyTag("unsigned", keyring); !errors.Is(err, ErrUnsignedTag) {
+		t.Errorf("VerifyTag of an unsigned tag returned %v, expected ErrUnsignedTag", err)
+	}
+	if err := s.VerifyTag("signed", NewKeyring(testSigningKey(2).Public().(ed25519.PublicKey))); !errors.Is(err, ErrUnknownSigningKey) {
+		t.Errorf("VerifyTag with another keyring returned %v, expected ErrUnknownSigningKey", err)
+	}
+	if _, err := s.CreateTag("short-key", head, "", WithTagSigningKey(key[:10])); !errors.Is(err, ErrInvalidTagOptions) {
+		t.Errorf("CreateTag with a short key returned %v, expected ErrInvalidTagOptions", err)
+	}
+
+	// A tag whose message was altered no longer verifies
+	forged := *tag
+	forged.Message = "forged"
+	forgedHash, err := s.writeTag(&forged)
+	if err != nil {
+		t.Fatalf("writeTag failed: %v", err)
+	}
+	if err := s.refs.CreateTag("forged", forgedHash); err != nil {
+		t.Fatalf("CreateTag ref failed: %v", err)
+	}
+	if err := s.VerifyTag("forged", keyring); !errors.Is(err, ErrInvalidTagSignature) {
+		t.Errorf("VerifyTag of an altered tag returned %v, expected ErrInvalidTagSignature", err)
+	}
+
+	// The signature travels with the tag object in a bundle
+	dst := NewInMemory()
+	defer dst.Close()
+	if _, err := dst.ImportBundle(bytes.NewReader(bundleOf(t, s, "refs/tags/signed"))); err != nil {
+		t.Fatalf("ImportBundle failed: %v", err)
+	}
+	if got, err := dst.refs.GetTag("signed"); err != nil || got != signedHash {
+		t.Errorf("imported tag = %s, %v; expected %s", got, err, signedHash)
+	}
+	if err := dst.VerifyTag("signed", keyring); err != nil {
+		t.Errorf("VerifyTag after import failed: %v", err)
+	}
+}
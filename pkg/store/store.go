@@ -1,9 +1,9 @@
 package store
 
 import (
-	"bytes"
+	"context"
 	"errors"
-	"sort"
+	"path/filepath"
 	"sync"
 
 	"microprolly/pkg/branch"
@@ -22,6 +22,11 @@ var (
 	ErrInvalidKey = errors.New("invalid key: empty keys not allowed")
 	// ErrCannotDeleteCurrentBranch is returned when trying to delete the current branch
 	ErrCannotDeleteCurrentBranch = errors.New("cannot delete the current branch")
+	// ErrUncommittedChanges is returned by operations that would discard
+	// changes not yet committed
+	ErrUncommittedChanges = errors.New("working state has uncommitted changes")
+	// ErrRepackUnsupported is returned when the store's CAS cannot hold packs
+	ErrRepackUnsupported = cas.ErrRepackUnsupported
 )
 
 // Store is the main user-facing interface for the versioned key-value store
@@ -31,7 +36,8 @@ type Store struct {
 	// Storage layer
 	cas cas.CAS
 
-	// Tree layer
+	// Tree layer - all components share one decoded-node cache
+	nodeCache *tree.NodeCache
 	builder   *tree.TreeBuilder
 	traverser *tree.TreeTraverser
 	differ    *tree.DiffEngine
@@ -39,63 +45,223 @@ type Store struct {
 	// Version layer
 	commitMgr *CommitManager
 
-	// Branch layer
-	branchMgr *branch.BranchManager
-	headMgr   *branch.HeadManager
+	// Branch layer - branch references and HEAD state
+	refs branch.RefStore
 
-	// Working state - in-memory map of current uncommitted changes
-	workingState map[string][]byte
+	// Working state - the uncommitted contents of the default keyspace
+	working *workingSet
 
-	// HEAD commit reference (cached from HeadManager)
+	// Named tables: the table roots of HEAD, and the working sets of the
+	// tables changed since, each loaded on its first change
+	tableRoots map[string]types.Hash
+	tables     map[string]*workingSet
+	// tablesRecorded is set once the config lists FeatureTables
+	tablesRecorded bool
+
+	// wal logs working-state changes until they are committed; nil when
+	// disabled. walRequested is false for a log kept only because one was
+	// found on disk.
+	wal          *writeAheadLog
+	walRequested bool
+
+	// HEAD commit reference (cached from the RefStore)
 	head types.Hash
 
 	// Data directory for HEAD file persistence
 	dataDir string
+
+	// Settings from Open
+	syncPolicy      SyncPolicy
+	readOnly        bool
+	formatVersion   int
+	requiredSigners *Keyring
+}
+
+// storeSettings are the tunables newStore wires a Store with
+type storeSettings struct {
+	chunker         chunker.Chunker
+	nodeCacheSize   int64
+	defaultBranch   string
+	syncPolicy      SyncPolicy
+	readOnly        bool
+	formatVersion   int
+	requiredSigners *Keyring
 }
 
-// NewStore creates a new Store with the given CAS directory
+// NewStore creates a new Store with the given CAS directory. Objects are
+// written one file per object, unless the repository already keeps them in
+// pack files, in which case it is opened as NewPackedStore would.
 // Requirements: 9.1, 9.2, 6.1, 6.2
 func NewStore(dataDir string) (*Store, error) {
+	cfg, err := legacyConfig(dataDir, DefaultOptions(), "")
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize CAS
-	casStore, err := cas.NewFileCAS(dataDir)
+	var casStore cas.CAS
+	if cfg.Layout == layoutPacks {
+		casStore, err = cas.NewPackCAS(dataDir, cas.DefaultPackOptions())
+	} else {
+		casStore, err = cas.NewFileCAS(dataDir)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	store := NewStoreWithCAS(casStore)
-	store.dataDir = dataDir
+	store, err := newStoreAt(dataDir, casStore, cfg)
+	if err != nil {
+		casStore.Close()
+		return nil, err
+	}
+	return store, nil
+}
 
-	// Initialize BranchManager (creates refs/heads/ directory)
-	branchMgr, err := branch.NewBranchManager(dataDir)
+// NewPackedStore creates a new Store whose objects are appended to pack files
+// instead of being written one file per object
+func NewPackedStore(dataDir string, opts cas.PackOptions) (*Store, error) {
+	o := DefaultOptions()
+	o.Compression = opts.Compress
+	cfg, err := legacyConfig(dataDir, o, layoutPacks)
 	if err != nil {
 		return nil, err
 	}
-	store.branchMgr = branchMgr
 
-	// Initialize HeadManager
-	store.headMgr = branch.NewHeadManager(dataDir, branchMgr)
+	casStore, err := cas.NewPackCAS(dataDir, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	// Check if this is a fresh store (no branches exist)
-	branches, err := branchMgr.ListBranches()
+	store, err := newStoreAt(dataDir, casStore, cfg)
 	if err != nil {
+		casStore.Close()
 		return nil, err
 	}
+	return store, nil
+}
 
-	if len(branches) == 0 {
-		// Create default "main" branch pointing to ZeroHash
-		// This will be updated when the first commit is made
-		if err := branchMgr.CreateBranch("main", ZeroHash); err != nil {
-			return nil, err
-		}
+// legacyConfig resolves the repository config for NewStore and
+// NewPackedStore, which take no options: they refuse formats and features
+// Open would refuse, and keep writing a repository in its own format
+func legacyConfig(dataDir string, o Options, layout string) (repoConfig, error) {
+	return resolveConfig(dataDir, fileExists(filepath.Join(dataDir, "HEAD")), o, layout)
+}
+
+// newStoreAt wires a Store on top of an opened CAS and the refs in dataDir,
+// with the chunker and format version of the repository config
+func newStoreAt(dataDir string, casStore cas.CAS, cfg repoConfig) (*Store, error) {
+	// Initialize file-backed refs (creates refs/heads/ directory)
+	refs, err := branch.NewFileRefStore(dataDir)
+	if err != nil {
+		return nil, err
 	}
 
-	// Initialize HEAD to point to main branch if it doesn't exist
-	if err := store.headMgr.InitializeHead("main"); err != nil {
+	chunkr, err := cfg.Chunker.newChunker()
+	if err != nil {
 		return nil, err
 	}
 
-	// Load HEAD state from HeadManager
-	headState, err := store.headMgr.GetHead()
+	store, err := newStore(casStore, refs, storeSettings{
+		chunker:       chunkr,
+		nodeCacheSize: tree.DefaultNodeCacheSize,
+		defaultBranch: DefaultBranch,
+		syncPolicy:    SyncOnCommit,
+		formatVersion: cfg.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.dataDir = dataDir
+	if err := store.attachWAL(nil); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewInMemory creates a Store whose objects, branches and HEAD live entirely
+// in memory. Nothing touches disk; all data is lost on Close.
+func NewInMemory() *Store {
+	return NewStoreWithCAS(cas.NewMemoryCAS())
+}
+
+// NewStoreWithCAS creates a new Store with an existing CAS instance.
+// Branches and HEAD are kept in memory; use NewStoreWithRefs to persist them.
+func NewStoreWithCAS(casStore cas.CAS) *Store {
+	// Initializing a fresh in-memory RefStore cannot fail
+	store, err := NewStoreWithRefs(casStore, branch.NewMemoryRefStore())
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+// NewStoreWithRefs creates a new Store with an existing CAS and RefStore.
+// A default "main" branch and HEAD are created if the RefStore is empty,
+// and the working state is loaded from HEAD.
+func NewStoreWithRefs(casStore cas.CAS, refs branch.RefStore) (*Store, error) {
+	return newStore(casStore, refs, storeSettings{
+		chunker:       chunker.DefaultChunker(),
+		nodeCacheSize: tree.DefaultNodeCacheSize,
+		defaultBranch: DefaultBranch,
+		syncPolicy:    SyncOnCommit,
+		formatVersion: FormatVersion,
+	})
+}
+
+// newStore creates a Store with the given settings, initializing the
+// default branch and HEAD of an empty RefStore
+func newStore(casStore cas.CAS, refs branch.RefStore, settings storeSettings) (*Store, error) {
+	nodeCache := tree.NewNodeCache(settings.nodeCacheSize)
+
+	store := &Store{
+		cas:             casStore,
+		nodeCache:       nodeCache,
+		builder:         tree.NewTreeBuilderWithCache(casStore, settings.chunker, nodeCache),
+		traverser:       tree.NewTreeTraverserWithCache(casStore, nodeCache),
+		differ:          tree.NewDiffEngineWithCache(casStore, nodeCache),
+		commitMgr:       NewCommitManager(casStore),
+		refs:            refs,
+		working:         newWorkingSet(),
+		tableRoots:      make(map[string]types.Hash),
+		tables:          make(map[string]*workingSet),
+		head:            ZeroHash,
+		syncPolicy:      settings.syncPolicy,
+		readOnly:        settings.readOnly,
+		formatVersion:   settings.formatVersion,
+		requiredSigners: settings.requiredSigners,
+	}
+
+	// Older formats keep every value inline until migrated
+	if settings.formatVersion < formatBlobValues {
+		store.builder.SetBlobThreshold(0)
+	}
+	if settings.formatVersion < formatSubtreeCounts {
+		store.builder.SetSubtreeCounts(false)
+	}
+
+	if !settings.readOnly {
+		// Check if this is a fresh store (no branches exist)
+		branches, err := refs.ListBranches()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(branches) == 0 {
+			// Create the default branch pointing to ZeroHash
+			// This will be updated when the first commit is made
+			if err := refs.CreateBranch(settings.defaultBranch, ZeroHash); err != nil {
+				return nil, err
+			}
+		}
+
+		// Initialize HEAD to point to the default branch if it doesn't exist
+		if err := refs.InitializeHead(settings.defaultBranch); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load HEAD state from the RefStore
+	headState, err := refs.GetHead()
 	if err != nil {
 		return nil, err
 	}
@@ -111,24 +277,12 @@ func NewStore(dataDir string) (*Store, error) {
 	return store, nil
 }
 
-// NewStoreWithCAS creates a new Store with an existing CAS instance
-func NewStoreWithCAS(casStore cas.CAS) *Store {
-	chunkr := chunker.DefaultChunker()
-
-	return &Store{
-		cas:          casStore,
-		builder:      tree.NewTreeBuilder(casStore, chunkr),
-		traverser:    tree.NewTreeTraverser(casStore),
-		differ:       tree.NewDiffEngine(casStore),
-		commitMgr:    NewCommitManager(casStore),
-		workingState: make(map[string][]byte),
-		head:         ZeroHash,
-	}
-}
-
 // Put stores a key-value pair in the working state
 // Requirements: 1.1
 func (s *Store) Put(key, value []byte) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	if len(key) == 0 {
 		return ErrInvalidKey
 	}
@@ -136,13 +290,17 @@ func (s *Store) Put(key, value []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.logPut(key, value); err != nil {
+		return err
+	}
+
 	// Store in working state (make copies to avoid external mutation)
 	keyCopy := make([]byte, len(key))
 	copy(keyCopy, key)
 	valueCopy := make([]byte, len(value))
 	copy(valueCopy, value)
 
-	s.workingState[string(keyCopy)] = valueCopy
+	s.working.put(keyCopy, valueCopy)
 	return nil
 }
 
@@ -156,20 +314,29 @@ func (s *Store) Get(key []byte) ([]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	value, exists := s.workingState[string(key)]
-	if !exists {
-		return nil, ErrKeyNotFound
+	return s.working.value(s.traverser, key)
+}
+
+// GetReader returns a streaming reader over a value in the working state.
+// Values stored out of line are read one chunk at a time, so large values
+// never have to be held in memory whole.
+func (s *Store) GetReader(key []byte) (*tree.ValueReader, error) {
+	if len(key) == 0 {
+		return nil, ErrInvalidKey
 	}
 
-	// Return a copy to avoid external mutation
-	result := make([]byte, len(value))
-	copy(result, value)
-	return result, nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.working.reader(s.traverser, key)
 }
 
 // Delete removes a key from the working state
 // Requirements: 1.4, 1.5
 func (s *Store) Delete(key []byte) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	if len(key) == 0 {
 		return ErrInvalidKey
 	}
@@ -177,14 +344,22 @@ func (s *Store) Delete(key []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.workingState[string(key)]; !exists {
+	if !s.working.has(key) {
 		return ErrKeyNotFound
 	}
 
-	delete(s.workingState, string(key))
+	if err := s.logDelete(key); err != nil {
+		return err
+	}
+	s.working.delete(key)
 	return nil
 }
 
+// CacheStats returns hit, miss and size statistics for the decoded-node cache
+func (s *Store) CacheStats() tree.CacheStats {
+	return s.nodeCache.Stats()
+}
+
 // Head returns the current HEAD commit hash
 func (s *Store) Head() types.Hash {
 	s.mu.RLock()
@@ -192,27 +367,13 @@ func (s *Store) Head() types.Hash {
 	return s.head
 }
 
-// workingStateToSortedPairs converts the working state map to sorted KV pairs
-func (s *Store) workingStateToSortedPairs() []types.KVPair {
-	pairs := make([]types.KVPair, 0, len(s.workingState))
-	for k, v := range s.workingState {
-		pairs = append(pairs, types.KVPair{
-			Key:   []byte(k),
-			Value: v,
-		})
-	}
-
-	// Sort by key for deterministic tree construction
-	sort.Slice(pairs, func(i, j int) bool {
-		return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0
-	})
-
-	return pairs
-}
-
-// Close releases resources
+// Close releases resources, flushing the write-ahead log if there is one
 func (s *Store) Close() error {
-	return s.cas.Close()
+	var walErr error
+	if s.wal != nil {
+		walErr = s.wal.close()
+	}
+	return errors.Join(walErr, s.cas.Close())
 }
 
 // loadWorkingStateFromHead loads the working state from the current HEAD commit
@@ -227,74 +388,147 @@ func (s *Store) loadWorkingStateFromHead() error {
 		return err
 	}
 
-	// Load all KV pairs from the commit's tree
-	pairs, err := s.traverser.GetAll(commit.RootHash)
+	return s.loadWorkingState(commit)
+}
+
+// loadWorkingState replaces the working state with the contents of a
+// commit. Only the table roots are read; tables are loaded when changed.
+func (s *Store) loadWorkingState(commit *types.Commit) error {
+	working, err := loadWorkingSet(s.traverser, commit.RootHash)
 	if err != nil {
 		return err
 	}
-
-	// Populate working state with commit's data
-	s.workingState = make(map[string][]byte)
-	for _, pair := range pairs {
-		keyCopy := make([]byte, len(pair.Key))
-		copy(keyCopy, pair.Key)
-		valueCopy := make([]byte, len(pair.Value))
-		copy(valueCopy, pair.Value)
-		s.workingState[string(keyCopy)] = valueCopy
+	tableRoots, err := s.loadTableRoots(commit.Tables)
+	if err != nil {
+		return err
 	}
-
+	s.working = working
+	s.tableRoots = tableRoots
+	s.tables = make(map[string]*workingSet)
 	return nil
 }
 
-// Commit creates a new commit with the current working state
+// clearWorkingState empties the working state
+func (s *Store) clearWorkingState() {
+	s.working = newWorkingSet()
+	s.tableRoots = make(map[string]types.Hash)
+	s.tables = make(map[string]*workingSet)
+}
+
+// hasUncommittedChanges reports whether the working state or a table may
+// differ from HEAD
+func (s *Store) hasUncommittedChanges() (bool, error) {
+	root := ZeroHash
+	if s.head != ZeroHash {
+		commit, err := s.commitMgr.GetCommit(s.head)
+		if err != nil {
+			return false, err
+		}
+		root = commit.RootHash
+	}
+	if changed, err := s.working.changedFrom(s.traverser, root); err != nil || changed {
+		return changed, err
+	}
+	for name, w := range s.tables {
+		if changed, err := w.changedFrom(s.traverser, s.tableRoots[name]); err != nil || changed {
+			return changed, err
+		}
+	}
+	return false, nil
+}
+
+// Commit creates a new commit with the current working state.
+// Options set the author, committer and metadata.
 // Requirements: 5.1, 5.2, 5.3, 9.2
-func (s *Store) Commit(message string) (types.Hash, error) {
+func (s *Store) Commit(message string, opts ...CommitOption) (types.Hash, error) {
+	if err := s.checkWritable(); err != nil {
+		return types.Hash{}, err
+	}
+	var commitOpts CommitOptions
+	for _, opt := range opts {
+		opt(&commitOpts)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Convert working state to sorted KV pairs
-	pairs := s.workingStateToSortedPairs()
-
 	// Build Prolly Tree from working state
-	rootHash, err := s.builder.Build(pairs)
+	rootHash, err := s.working.build(s.builder)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	tablesHash, tableRoots, err := s.buildTables()
 	if err != nil {
 		return types.Hash{}, err
 	}
+	if tablesHash != ZeroHash {
+		if err := s.recordTablesFeature(); err != nil {
+			return types.Hash{}, err
+		}
+	}
+	commitOpts.tables = tablesHash
 
 	// Create commit with tree root hash
-	_, commitHash, err := s.commitMgr.CreateCommit(rootHash, message, s.head)
+	_, commitHash, err := s.commitMgr.CreateCommitWithOptions(rootHash, message, s.head, commitOpts)
 	if err != nil {
 		return types.Hash{}, err
 	}
 
-	// Update HEAD reference
-	s.head = commitHash
+	// Make the new objects durable before any ref points at them
+	if err := s.syncObjects(); err != nil {
+		return types.Hash{}, err
+	}
 
-	// If HeadManager is available, update branch pointer or HEAD
-	if s.headMgr != nil {
-		headState, err := s.headMgr.GetHead()
-		if err != nil {
+	// Update branch pointer or HEAD
+	headState, err := s.refs.GetHead()
+	if err != nil {
+		return types.Hash{}, err
+	}
+	if !headState.IsDetached {
+		if err := s.checkBranchUpdate(headState.Branch, commitHash); err != nil {
 			return types.Hash{}, err
 		}
+	}
 
-		if headState.IsDetached {
-			// Detached HEAD: only update HEAD to point to new commit
-			// Requirements: 5.2
-			if err := s.headMgr.SetHeadToCommit(commitHash); err != nil {
-				return types.Hash{}, err
-			}
-		} else {
-			// Attached HEAD: update branch to point to new commit
-			// Requirements: 5.1, 5.3
-			if err := s.branchMgr.UpdateBranch(headState.Branch, commitHash); err != nil {
-				return types.Hash{}, err
-			}
+	// Update HEAD reference
+	s.head = commitHash
+	s.working.committed(rootHash)
+	s.tableRoots = tableRoots
+	s.tables = make(map[string]*workingSet)
+
+	if headState.IsDetached {
+		// Detached HEAD: only update HEAD to point to new commit
+		// Requirements: 5.2
+		if err := s.refs.SetHeadToCommit(commitHash); err != nil {
+			return types.Hash{}, err
 		}
+	} else {
+		// Attached HEAD: update branch to point to new commit
+		// Requirements: 5.1, 5.3
+		if err := s.refs.UpdateBranch(headState.Branch, commitHash); err != nil {
+			return types.Hash{}, err
+		}
+	}
+
+	// The logged changes are now part of HEAD
+	if err := s.resetWAL(); err != nil {
+		return types.Hash{}, err
 	}
 
 	return commitHash, nil
 }
 
+// Reset discards all uncommitted changes, restoring the working state of
+// the HEAD commit and emptying the write-ahead log
+func (s *Store) Reset() error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.resetWorkingStateToHead()
+}
+
 // GetAt retrieves a value as it existed at a specific commit
 // Requirements: 6.1, 6.2, 6.3
 func (s *Store) GetAt(key []byte, commitHash types.Hash) ([]byte, error) {
@@ -327,6 +561,9 @@ func (s *Store) GetAt(key []byte, commitHash types.Hash) ([]byte, error) {
 // This puts HEAD in detached state pointing to the commit
 // Requirements: 6.4, 9.2
 func (s *Store) Checkout(commitHash types.Hash) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -336,34 +573,20 @@ func (s *Store) Checkout(commitHash types.Hash) error {
 		return ErrCommitNotFound
 	}
 
-	// Load all KV pairs from the commit's tree
-	pairs, err := s.traverser.GetAll(commit.RootHash)
-	if err != nil {
+	// Replace the working state with the commit's data
+	if err := s.loadWorkingState(commit); err != nil {
 		return err
 	}
 
-	// Clear current working state and populate with commit's data
-	s.workingState = make(map[string][]byte)
-	for _, pair := range pairs {
-		// Make copies to avoid external mutation
-		keyCopy := make([]byte, len(pair.Key))
-		copy(keyCopy, pair.Key)
-		valueCopy := make([]byte, len(pair.Value))
-		copy(valueCopy, pair.Value)
-		s.workingState[string(keyCopy)] = valueCopy
-	}
-
 	// Update HEAD reference
 	s.head = commitHash
 
-	// Persist HEAD to disk using HeadManager if available
-	if s.headMgr != nil {
-		if err := s.headMgr.SetHeadToCommit(commitHash); err != nil {
-			return err
-		}
+	// Persist HEAD
+	if err := s.refs.SetHeadToCommit(commitHash); err != nil {
+		return err
 	}
 
-	return nil
+	return s.resetWAL()
 }
 
 // Diff compares two commits and returns the differences
@@ -387,6 +610,62 @@ func (s *Store) Diff(hashA, hashB types.Hash) (tree.DiffResult, error) {
 	return s.differ.Diff(commitA.RootHash, commitB.RootHash)
 }
 
+// DiffStream calls fn for each change between two commits in ascending key
+// order, restricted to the key range of opts. Subtrees outside the range
+// are never loaded. If fn returns an error the diff stops and that error
+// is returned.
+func (s *Store) DiffStream(hashA, hashB types.Hash, opts tree.DiffOptions, fn func(tree.DiffEntry) error) error {
+	s.mu.RLock()
+	commitA, errA := s.commitMgr.GetCommit(hashA)
+	commitB, errB := s.commitMgr.GetCommit(hashB)
+	s.mu.RUnlock()
+	if errA != nil || errB != nil {
+		return ErrCommitNotFound
+	}
+
+	// Committed trees never change, so the diff runs without the lock
+	return s.differ.DiffStreamContext(context.Background(), commitA.RootHash, commitB.RootHash, opts, fn)
+}
+
+// DiffStatsBranches counts the changes between the latest commits of two
+// branches without materializing the diff. A branch with no commits is
+// treated as empty.
+func (s *Store) DiffStatsBranches(branchA, branchB string) (tree.DiffStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rootA, err := s.branchRoot(branchA)
+	if err != nil {
+		return tree.DiffStats{}, err
+	}
+	rootB, err := s.branchRoot(branchB)
+	if err != nil {
+		return tree.DiffStats{}, err
+	}
+
+	return s.differ.DiffStats(rootA, rootB)
+}
+
+// branchRoot returns the tree root of a branch's latest commit, or
+// ZeroHash, which the tree package reads as the empty tree, if the branch
+// has no commits
+func (s *Store) branchRoot(name string) (types.Hash, error) {
+	commitHash, err := s.refs.GetBranch(name)
+	if err != nil {
+		return types.Hash{}, err
+	}
+
+	if commitHash == ZeroHash {
+		return ZeroHash, nil
+	}
+
+	commit, err := s.commitMgr.GetCommit(commitHash)
+	if err != nil {
+		return types.Hash{}, ErrCommitNotFound
+	}
+	return commit.RootHash, nil
+}
+
 // Log returns the commit history from the current HEAD
 // Requirements: 5.3
 func (s *Store) Log() ([]*types.Commit, error) {
@@ -403,52 +682,55 @@ func (s *Store) Log() ([]*types.Commit, error) {
 // CreateBranch creates a new branch at the current HEAD commit
 // Requirements: 1.1
 func (s *Store) CreateBranch(name string) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.branchMgr == nil {
-		return errors.New("branch manager not initialized")
+	if err := s.checkBranchUpdate(name, s.head); err != nil {
+		return err
 	}
-
-	return s.branchMgr.CreateBranch(name, s.head)
+	return s.refs.CreateBranch(name, s.head)
 }
 
 // CreateBranchAt creates a new branch at a specific commit
 // Requirements: 1.2, 1.3
 func (s *Store) CreateBranchAt(name string, commitHash types.Hash) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.branchMgr == nil {
-		return errors.New("branch manager not initialized")
+	if err := s.checkBranchUpdate(name, commitHash); err != nil {
+		return err
 	}
-
-	return s.branchMgr.CreateBranch(name, commitHash)
+	return s.refs.CreateBranch(name, commitHash)
 }
 
 // SwitchBranch switches to a different branch, updating HEAD and working state
 // Requirements: 3.1, 3.2, 3.3, 3.4
 func (s *Store) SwitchBranch(name string) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.branchMgr == nil || s.headMgr == nil {
-		return errors.New("branch manager not initialized")
-	}
-
 	// Check if branch exists
-	if !s.branchMgr.BranchExists(name) {
+	if !s.refs.BranchExists(name) {
 		return branch.ErrBranchNotFound
 	}
 
 	// Get the commit hash the branch points to
-	commitHash, err := s.branchMgr.GetBranch(name)
+	commitHash, err := s.refs.GetBranch(name)
 	if err != nil {
 		return err
 	}
 
 	// Update HEAD to point to the branch (attached state)
-	if err := s.headMgr.SetHeadToBranch(name); err != nil {
+	if err := s.refs.SetHeadToBranch(name); err != nil {
 		return err
 	}
 
@@ -463,27 +745,16 @@ func (s *Store) SwitchBranch(name string) error {
 			return err
 		}
 
-		// Load all KV pairs from the commit's tree
-		pairs, err := s.traverser.GetAll(commit.RootHash)
-		if err != nil {
+		// Replace the working state with the commit's data
+		if err := s.loadWorkingState(commit); err != nil {
 			return err
 		}
-
-		// Clear current working state and populate with commit's data
-		s.workingState = make(map[string][]byte)
-		for _, pair := range pairs {
-			keyCopy := make([]byte, len(pair.Key))
-			copy(keyCopy, pair.Key)
-			valueCopy := make([]byte, len(pair.Value))
-			copy(valueCopy, pair.Value)
-			s.workingState[string(keyCopy)] = valueCopy
-		}
 	} else {
 		// Branch points to ZeroHash (no commits yet), clear working state
-		s.workingState = make(map[string][]byte)
+		s.clearWorkingState()
 	}
 
-	return nil
+	return s.resetWAL()
 }
 
 // CurrentBranch returns the current branch name and whether HEAD is detached
@@ -493,11 +764,7 @@ func (s *Store) CurrentBranch() (string, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	if s.headMgr == nil {
-		return "", false, errors.New("head manager not initialized")
-	}
-
-	headState, err := s.headMgr.GetHead()
+	headState, err := s.refs.GetHead()
 	if err != nil {
 		return "", false, err
 	}
@@ -509,20 +776,19 @@ func (s *Store) CurrentBranch() (string, bool, error) {
 // Cannot delete the currently checked-out branch
 // Requirements: 4.1, 4.2, 4.3
 func (s *Store) DeleteBranch(name string) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.branchMgr == nil || s.headMgr == nil {
-		return errors.New("branch manager not initialized")
-	}
-
 	// Check if branch exists
-	if !s.branchMgr.BranchExists(name) {
+	if !s.refs.BranchExists(name) {
 		return branch.ErrBranchNotFound
 	}
 
 	// Check if this is the current branch
-	headState, err := s.headMgr.GetHead()
+	headState, err := s.refs.GetHead()
 	if err != nil {
 		return err
 	}
@@ -531,19 +797,18 @@ func (s *Store) DeleteBranch(name string) error {
 		return ErrCannotDeleteCurrentBranch
 	}
 
-	return s.branchMgr.DeleteBranch(name)
+	return s.refs.DeleteBranch(name)
 }
 
 // DetachHead sets HEAD to point directly to a commit (detached state)
 // Requirements: 7.3
 func (s *Store) DetachHead(commitHash types.Hash) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.headMgr == nil {
-		return errors.New("head manager not initialized")
-	}
-
 	// Verify the commit exists
 	_, err := s.commitMgr.GetCommit(commitHash)
 	if err != nil {
@@ -551,7 +816,7 @@ func (s *Store) DetachHead(commitHash types.Hash) error {
 	}
 
 	// Set HEAD to detached state
-	if err := s.headMgr.SetHeadToCommit(commitHash); err != nil {
+	if err := s.refs.SetHeadToCommit(commitHash); err != nil {
 		return err
 	}
 
@@ -564,21 +829,10 @@ func (s *Store) DetachHead(commitHash types.Hash) error {
 		return err
 	}
 
-	pairs, err := s.traverser.GetAll(commit.RootHash)
-	if err != nil {
+	if err := s.loadWorkingState(commit); err != nil {
 		return err
 	}
-
-	s.workingState = make(map[string][]byte)
-	for _, pair := range pairs {
-		keyCopy := make([]byte, len(pair.Key))
-		copy(keyCopy, pair.Key)
-		valueCopy := make([]byte, len(pair.Value))
-		copy(valueCopy, pair.Value)
-		s.workingState[string(keyCopy)] = valueCopy
-	}
-
-	return nil
+	return s.resetWAL()
 }
 
 // ListBranches returns all branch names
@@ -587,9 +841,41 @@ func (s *Store) ListBranches() ([]string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	if s.branchMgr == nil {
-		return nil, errors.New("branch manager not initialized")
+	return s.refs.ListBranches()
+}
+
+// checkWritable returns ErrReadOnly if the store was opened read-only
+func (s *Store) checkWritable() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// syncObjects flushes buffered CAS writes for backends that batch fsyncs
+func (s *Store) syncObjects() error {
+	if s.syncPolicy == SyncNever {
+		return nil
+	}
+	if syncer, ok := s.cas.(cas.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Repack migrates loose objects into pack files.
+// Returns the number of objects moved, or ErrRepackUnsupported if the
+// store is not backed by a pack-capable CAS.
+func (s *Store) Repack() (int, error) {
+	if err := s.checkWritable(); err != nil {
+		return 0, err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return s.branchMgr.ListBranches()
+	repacker, ok := s.cas.(cas.Repacker)
+	if !ok {
+		return 0, ErrRepackUnsupported
+	}
+	return repacker.Repack()
 }
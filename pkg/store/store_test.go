@@ -1,10 +1,15 @@
 package store
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"os"
 	"testing"
 
+	"microprolly/pkg/branch"
 	"microprolly/pkg/cas"
+	"microprolly/pkg/tree"
 	"microprolly/pkg/types"
 
 	"pgregory.net/rapid"
@@ -395,6 +400,95 @@ func TestStore_DiffIdenticalCommits(t *testing.T) {
 	}
 }
 
+// TestStore_DiffStatsBranches tests counting changes between branches
+func TestStore_DiffStatsBranches(t *testing.T) {
+	store := NewInMemory()
+	defer store.Close()
+
+	store.Put([]byte("keep"), []byte("same"))
+	store.Put([]byte("change"), []byte("old"))
+	store.Put([]byte("remove"), []byte("gone"))
+	if _, err := store.Commit("base"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	if err := store.CreateBranch("feature"); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+	if err := store.CreateBranch("snapshot"); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+	if err := store.SwitchBranch("feature"); err != nil {
+		t.Fatalf("SwitchBranch failed: %v", err)
+	}
+	store.Put([]byte("change"), []byte("newer"))
+	store.Put([]byte("add"), []byte("fresh"))
+	store.Delete([]byte("remove"))
+	if _, err := store.Commit("feature work"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	stats, err := store.DiffStatsBranches("main", "feature")
+	if err != nil {
+		t.Fatalf("DiffStatsBranches failed: %v", err)
+	}
+	if stats.Added != 1 || stats.Modified != 1 || stats.Deleted != 1 {
+		t.Fatalf("Expected 1/1/1 changes, got added=%d, modified=%d, deleted=%d",
+			stats.Added, stats.Modified, stats.Deleted)
+	}
+	// "add"+"fresh" plus "newer"; "remove"+"gone" plus "old"
+	if stats.BytesAdded != 13 || stats.BytesDeleted != 13 {
+		t.Fatalf("Expected 13 bytes added and deleted, got %d and %d", stats.BytesAdded, stats.BytesDeleted)
+	}
+	if stats.NodesVisited == 0 {
+		t.Fatal("Expected nodes to be visited")
+	}
+
+	same, err := store.DiffStatsBranches("main", "snapshot")
+	if err != nil {
+		t.Fatalf("DiffStatsBranches failed: %v", err)
+	}
+	if same != (tree.DiffStats{}) {
+		t.Fatalf("Expected empty stats for branches at the same commit, got %+v", same)
+	}
+
+	if _, err := store.DiffStatsBranches("main", "missing"); !errors.Is(err, branch.ErrBranchNotFound) {
+		t.Fatalf("Expected ErrBranchNotFound, got %v", err)
+	}
+}
+
+// TestStore_DiffWithEmptyWritesNothing tests that diffs against a branch
+// without commits or a commit without tables read the empty tree without
+// writing it
+func TestStore_DiffWithEmptyWritesNothing(t *testing.T) {
+	tracking := cas.NewTrackingCAS(cas.NewMemoryCAS())
+	store := NewStoreWithCAS(tracking)
+	defer store.Close()
+
+	plain := fillAndCommit(t, store, "k", 10)
+	fillTable(t, store.Table("variants"), "v", 10)
+	withTables, err := store.Commit("tables")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := store.refs.CreateBranch("empty", ZeroHash); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+	tracking.ResetStats()
+
+	stats, err := store.DiffStatsBranches("main", "empty")
+	if err != nil || stats.Deleted != 10 {
+		t.Errorf("DiffStatsBranches = %+v, %v; expected 10 deleted", stats, err)
+	}
+	diffs, err := store.DiffTables(plain, withTables)
+	if err != nil || len(diffs) != 1 || len(diffs[0].Changes.Added) != 10 {
+		t.Errorf("DiffTables = %v, %v; expected 10 keys added to variants", diffs, err)
+	}
+	if writes := tracking.Stats().TotalWrites; writes != 0 {
+		t.Errorf("diffs wrote %d objects, expected none", writes)
+	}
+}
+
 // TestProperty_PersistenceAcrossRestarts tests Property 16: Persistence Across Restarts
 // **Feature: versioned-kv-store, Property 16: Persistence Across Restarts**
 // **Validates: Requirements 9.2**
@@ -505,6 +599,79 @@ func TestProperty_PersistenceAcrossRestarts(t *testing.T) {
 	})
 }
 
+// TestStore_LargeValues tests that values stored out of line survive a
+// commit and reopen, and can be streamed with GetReader
+func TestStore_LargeValues(t *testing.T) {
+	s, dir, cleanup := createTestStoreWithDir(t)
+	defer cleanup()
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	if err := s.Put([]byte("big"), large); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Put([]byte("small"), []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	commitHash, err := s.Commit("large value")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	s.Close()
+
+	// After reopening, the value is loaded as a blob reference
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if _, ok := s.working.blobs["big"]; !ok {
+		t.Fatal("expected the large value to stay out of line in the working state")
+	}
+
+	reader, err := s.GetReader([]byte("big"))
+	if err != nil {
+		t.Fatalf("GetReader failed: %v", err)
+	}
+	streamed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(streamed, large) {
+		t.Error("GetReader returned a different value")
+	}
+
+	value, err := s.Get([]byte("big"))
+	if err != nil || !bytes.Equal(value, large) {
+		t.Errorf("Get returned %d bytes, %v", len(value), err)
+	}
+	value, err = s.GetAt([]byte("big"), commitHash)
+	if err != nil || !bytes.Equal(value, large) {
+		t.Errorf("GetAt returned %d bytes, %v", len(value), err)
+	}
+
+	// Committing again without touching the value reuses its blob
+	if err := s.Put([]byte("small"), []byte("w")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	next, err := s.Commit("small change")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	diff, err := s.Diff(commitHash, next)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(diff.Modified) != 1 || string(diff.Modified[0].Key) != "small" {
+		t.Errorf("expected only %q to change, got %+v", "small", diff.Modified)
+	}
+
+	if err := s.Delete([]byte("big")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := s.GetReader([]byte("big")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetReader after Delete returned %v, expected ErrKeyNotFound", err)
+	}
+}
+
 // createTestStoreWithDir creates a Store with a specific directory for testing
 func createTestStoreWithDir(t *testing.T) (*Store, string, func()) {
 	tmpDir, err := os.MkdirTemp("", "store-branch-test-*")
@@ -0,0 +1,394 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"sort"
+
+	"microprolly/pkg/tree"
+	"microprolly/pkg/types"
+)
+
+var (
+	// ErrInvalidTableName is returned when an empty table name is provided
+	ErrInvalidTableName = errors.New("invalid table name: empty names not allowed")
+	// ErrTableNotFound is returned when a table holds no keys
+	ErrTableNotFound = errors.New("table not found")
+)
+
+// Table is a named keyspace with its own prolly tree, separate from the
+// default keyspace of Put and Get. A commit records the root of every table
+// in a table map, so a change to one table leaves the trees of the others
+// untouched, and comparing two commits skips every table whose root is the
+// same in both.
+//
+// A table exists while it holds keys: its first Put creates it, and a table
+// left empty is not recorded in the next commit.
+type Table struct {
+	s    *Store
+	name string
+}
+
+// Table returns the table with the given name. The handle refers to the
+// table in the current working state, across commits and branch switches.
+func (s *Store) Table(name string) *Table {
+	return &Table{s: s, name: name}
+}
+
+// Name returns the table name
+func (t *Table) Name() string {
+	return t.name
+}
+
+// Put stores a key-value pair in the table
+func (t *Table) Put(key, value []byte) error {
+	s := t.s
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if err := t.check(key); err != nil {
+		return err
+	}
+	key, value = cloneBytes(key), append([]byte{}, value...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, err := s.tableWorkingSet(t.name)
+	if err != nil {
+		return err
+	}
+	if err := s.logTable(t.name, walPut, key, value); err != nil {
+		return err
+	}
+	w.put(key, value)
+	return nil
+}
+
+// Get retrieves a value from the table. A table not changed since HEAD is
+// read from its tree without being loaded.
+func (t *Table) Get(key []byte) ([]byte, error) {
+	s := t.s
+	if err := t.check(key); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if w := s.tables[t.name]; w != nil {
+		return w.value(s.traverser, key)
+	}
+	root, exists := s.tableRoots[t.name]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	value, err := s.traverser.Get(root, key)
+	if errors.Is(err, tree.ErrKeyNotFound) {
+		return nil, ErrKeyNotFound
+	}
+	return value, err
+}
+
+// Delete removes a key from the table
+func (t *Table) Delete(key []byte) error {
+	s := t.s
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if err := t.check(key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, err := s.tableWorkingSet(t.name)
+	if err != nil {
+		return err
+	}
+	if !w.has(key) {
+		return ErrKeyNotFound
+	}
+	if err := s.logTable(t.name, walDelete, key, nil); err != nil {
+		return err
+	}
+	w.delete(key)
+	return nil
+}
+
+// Scan calls fn for each key of the table with start <= key < end, in key
+// order. A nil end is unbounded. fn runs without the store lock held, so it
+// may use the store; changes it makes are not seen by the running scan.
+// Scanning stops at the first error fn returns, which Scan returns.
+func (t *Table) Scan(start, end []byte, fn func(key, value []byte) error) error {
+	s := t.s
+	if t.name == "" {
+		return ErrInvalidTableName
+	}
+
+	s.mu.RLock()
+	w := s.tables[t.name]
+	root, exists := s.tableRoots[t.name]
+	var pairs []types.KVPair
+	if w != nil {
+		pairs = w.rangePairs(start, end)
+	}
+	s.mu.RUnlock()
+
+	if w == nil {
+		// Committed trees never change, so the scan can stream from it
+		if !exists {
+			return nil
+		}
+		return s.traverser.Scan(root, start, end, fn)
+	}
+
+	return s.scanPairs(pairs, fn)
+}
+
+// check validates the table name and a key
+func (t *Table) check(key []byte) error {
+	if t.name == "" {
+		return ErrInvalidTableName
+	}
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// Tables returns the names of the tables holding keys in the working state,
+// sorted
+func (s *Store) Tables() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var names []string
+	for name := range s.tableRoots {
+		if _, changed := s.tables[name]; !changed {
+			names = append(names, name)
+		}
+	}
+	for name, w := range s.tables {
+		if w.len() > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropTable removes a table and all of its keys. The table is not read.
+func (s *Store) DropTable(name string) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if name == "" {
+		return ErrInvalidTableName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, changed := s.tables[name]
+	_, committed := s.tableRoots[name]
+	if (changed && w.len() == 0) || (!changed && !committed) {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	if err := s.logTable(name, walDeleteRange, nil, nil); err != nil {
+		return err
+	}
+	s.tables[name] = newWorkingSet()
+	return nil
+}
+
+// TableDiff holds the changes to one table between two commits
+type TableDiff struct {
+	Name    string
+	Changes tree.DiffResult
+}
+
+// DiffTables compares the tables of two commits, returning the changes of
+// each table that differs, sorted by name. Tables with the same root in both
+// commits are skipped without reading them, and a table present in only one
+// commit has all of its keys added or deleted.
+func (s *Store) DiffTables(hashA, hashB types.Hash) ([]TableDiff, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	commitA, err := s.commitMgr.GetCommit(hashA)
+	if err != nil {
+		return nil, ErrCommitNotFound
+	}
+	commitB, err := s.commitMgr.GetCommit(hashB)
+	if err != nil {
+		return nil, ErrCommitNotFound
+	}
+	if commitA.Tables == commitB.Tables {
+		return nil, nil
+	}
+
+	// ZeroHash, the table map of a commit without tables, reads as the
+	// empty tree, and so stands for a missing table too
+	mapA, mapB := commitA.Tables, commitB.Tables
+	changed, err := s.differ.Diff(mapA, mapB)
+	if err != nil {
+		return nil, err
+	}
+
+	// The table map diff names the tables whose roots differ
+	roots := make(map[string][2]types.Hash)
+	for _, pair := range changed.Added {
+		root, err := decodeTableRoot(pair.Key, pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		roots[string(pair.Key)] = [2]types.Hash{ZeroHash, root}
+	}
+	for _, m := range changed.Modified {
+		oldRoot, err := decodeTableRoot(m.Key, m.OldValue)
+		if err != nil {
+			return nil, err
+		}
+		newRoot, err := decodeTableRoot(m.Key, m.NewValue)
+		if err != nil {
+			return nil, err
+		}
+		roots[string(m.Key)] = [2]types.Hash{oldRoot, newRoot}
+	}
+	for _, key := range changed.Deleted {
+		value, err := s.traverser.Get(mapA, key)
+		if err != nil {
+			return nil, err
+		}
+		root, err := decodeTableRoot(key, value)
+		if err != nil {
+			return nil, err
+		}
+		roots[string(key)] = [2]types.Hash{root, ZeroHash}
+	}
+
+	names := slices.Sorted(maps.Keys(roots))
+	diffs := make([]TableDiff, 0, len(names))
+	for _, name := range names {
+		changes, err := s.differ.Diff(roots[name][0], roots[name][1])
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", name, err)
+		}
+		diffs = append(diffs, TableDiff{Name: name, Changes: changes})
+	}
+	return diffs, nil
+}
+
+// tableWorkingSet returns the working set of a table, loading it from its
+// tree on the first change since HEAD
+func (s *Store) tableWorkingSet(name string) (*workingSet, error) {
+	if w, exists := s.tables[name]; exists {
+		return w, nil
+	}
+	w := newWorkingSet()
+	if root, exists := s.tableRoots[name]; exists {
+		loaded, err := loadWorkingSet(s.traverser, root)
+		if err != nil {
+			return nil, err
+		}
+		w = loaded
+	}
+	s.tables[name] = w
+	return w, nil
+}
+
+// loadTableRoots reads a table map into a map from table name to root
+func (s *Store) loadTableRoots(tablesHash types.Hash) (map[string]types.Hash, error) {
+	roots := make(map[string]types.Hash)
+	if tablesHash == ZeroHash {
+		return roots, nil
+	}
+	pairs, err := s.traverser.GetAll(tablesHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		root, err := decodeTableRoot(pair.Key, pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		roots[string(pair.Key)] = root
+	}
+	return roots, nil
+}
+
+// decodeTableRoot decodes a table map value
+func decodeTableRoot(name, value []byte) (types.Hash, error) {
+	if len(value) != len(types.Hash{}) {
+		return types.Hash{}, fmt.Errorf("table %s: root must be 32 bytes, got %d", name, len(value))
+	}
+	return types.Hash(value), nil
+}
+
+// buildTables builds the trees of the tables changed since HEAD and the
+// table map holding every table with keys. Unchanged tables keep their
+// roots without being read. The map is ZeroHash when no table has keys.
+func (s *Store) buildTables() (types.Hash, map[string]types.Hash, error) {
+	roots := maps.Clone(s.tableRoots)
+	for name, w := range s.tables {
+		if w.len() == 0 {
+			delete(roots, name)
+			continue
+		}
+		root, err := w.build(s.builder)
+		if err != nil {
+			return types.Hash{}, nil, fmt.Errorf("table %s: %w", name, err)
+		}
+		roots[name] = root
+	}
+	if len(roots) == 0 {
+		return ZeroHash, roots, nil
+	}
+
+	tablesHash, err := s.buildTableMap(s.builder, roots)
+	if err != nil {
+		return types.Hash{}, nil, err
+	}
+	return tablesHash, roots, nil
+}
+
+// buildTableMap builds a table map from table roots with builder
+func (s *Store) buildTableMap(builder *tree.TreeBuilder, roots map[string]types.Hash) (types.Hash, error) {
+	pairs := make([]types.KVPair, 0, len(roots))
+	for _, name := range slices.Sorted(maps.Keys(roots)) {
+		root := roots[name]
+		pairs = append(pairs, types.KVPair{Key: []byte(name), Value: root[:]})
+	}
+	return builder.Build(pairs)
+}
+
+// recordTablesFeature adds FeatureTables to the config before the first
+// commit with tables, so versions that cannot read tables refuse the
+// repository instead of ignoring them
+func (s *Store) recordTablesFeature() error {
+	if s.tablesRecorded || s.dataDir == "" {
+		return nil
+	}
+	cfg, err := readConfig(s.dataDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Stores without a config have no feature flags to record
+		s.tablesRecorded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !cfg.hasFeature(FeatureTables) {
+		cfg.Features = append(cfg.Features, FeatureTables)
+		if err := writeConfig(s.dataDir, cfg); err != nil {
+			return err
+		}
+	}
+	s.tablesRecorded = true
+	return nil
+}
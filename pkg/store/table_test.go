@@ -0,0 +1,416 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"microprolly/pkg/types"
+)
+
+// fillTable puts count keys with the given prefix into a table
+func fillTable(t *testing.T, table *Table, prefix string, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("%s-%04d", prefix, i))
+		if err := table.Put(key, []byte(fmt.Sprintf("%s/value-%s-%d", table.Name(), prefix, i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+}
+
+// tableRootsOf returns the table roots recorded in a commit
+func tableRootsOf(t *testing.T, s *Store, commitHash types.Hash) map[string]types.Hash {
+	t.Helper()
+	commit, err := s.commitMgr.GetCommit(commitHash)
+	if err != nil {
+		t.Fatalf("GetCommit failed: %v", err)
+	}
+	roots, err := s.loadTableRoots(commit.Tables)
+	if err != nil {
+		t.Fatalf("loadTableRoots failed: %v", err)
+	}
+	return roots
+}
+
+// expectTableValue fails unless a table holds key with value
+func expectTableValue(t *testing.T, table *Table, key, value string) {
+	t.Helper()
+	got, err := table.Get([]byte(key))
+	if err != nil || string(got) != value {
+		t.Errorf("%s.Get(%s) = %q, %v; expected %q", table.Name(), key, got, err, value)
+	}
+}
+
+// TestTable_SeparateKeyspaces tests that tables and the default keyspace do
+// not see each other's keys, before and after a commit
+func TestTable_SeparateKeyspaces(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+
+	variants, samples := s.Table("variants"), s.Table("samples")
+	if err := s.Put([]byte("k-0000"), []byte("default")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	fillTable(t, variants, "k", 300)
+	fillTable(t, samples, "k", 10)
+
+	check := func() {
+		t.Helper()
+		expectValue(t, s, "k-0000", "default")
+		expectMissing(t, s, "k-0001")
+		expectTableValue(t, variants, "k-0299", "variants/value-k-299")
+		expectTableValue(t, samples, "k-0000", "samples/value-k-0")
+		if _, err := samples.Get([]byte("k-0010")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get(k-0010) returned %v, expected ErrKeyNotFound", err)
+		}
+		if _, err := s.Table("annotations").Get([]byte("k-0000")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get from a missing table returned %v, expected ErrKeyNotFound", err)
+		}
+		if names := s.Tables(); strings.Join(names, ",") != "samples,variants" {
+			t.Errorf("Tables() = %v", names)
+		}
+	}
+	check()
+	if _, err := s.Commit("tables"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	check()
+
+	if err := s.Table("").Put([]byte("k"), nil); !errors.Is(err, ErrInvalidTableName) {
+		t.Errorf("Put to an unnamed table returned %v, expected ErrInvalidTableName", err)
+	}
+	if err := samples.Delete([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Delete(missing) returned %v, expected ErrKeyNotFound", err)
+	}
+}
+
+// TestTable_Scan tests range scans over committed and changed tables
+func TestTable_Scan(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	variants := s.Table("variants")
+	fillTable(t, variants, "k", 500)
+	big := bytes.Repeat([]byte("x"), 10000)
+	if err := variants.Put([]byte("k-0250"), big); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	scan := func() []string {
+		t.Helper()
+		var keys []string
+		err := variants.Scan([]byte("k-0248"), []byte("k-0253"), func(key, value []byte) error {
+			if string(key) == "k-0250" && !bytes.Equal(value, big) {
+				t.Errorf("Scan returned the wrong value for k-0250")
+			}
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		return keys
+	}
+	want := "k-0248,k-0249,k-0250,k-0251,k-0252"
+	if got := strings.Join(scan(), ","); got != want {
+		t.Errorf("uncommitted scan = %s, expected %s", got, want)
+	}
+	if _, err := s.Commit("variants"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got := strings.Join(scan(), ","); got != want {
+		t.Errorf("committed scan = %s, expected %s", got, want)
+	}
+	if err := variants.Delete([]byte("k-0249")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if got := strings.Join(scan(), ","); got != "k-0248,k-0250,k-0251,k-0252" {
+		t.Errorf("scan after Delete = %s", got)
+	}
+}
+
+// TestTable_UnchangedTablesKeepRoots tests that a commit changing one table
+// keeps the roots of the others, and that DiffTables reports only the
+// tables whose roots differ
+func TestTable_UnchangedTablesKeepRoots(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+
+	plain, err := s.Commit("no tables")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	data, err := s.cas.Read(plain)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if bytes.Contains(data, []byte(`"tables"`)) {
+		t.Error("a commit without tables should not encode a table map")
+	}
+
+	fillTable(t, s.Table("variants"), "v", 1000)
+	fillTable(t, s.Table("samples"), "s", 100)
+	base, err := s.Commit("load")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	if err := s.Table("samples").Put([]byte("s-0100"), []byte("new")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Table("samples").Delete([]byte("s-0000")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	head, err := s.Commit("new sample")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, loaded := s.tables["variants"]; loaded {
+		t.Error("expected the unchanged table not to be loaded")
+	}
+
+	before, after := tableRootsOf(t, s, base), tableRootsOf(t, s, head)
+	if before["variants"] != after["variants"] {
+		t.Error("expected the unchanged table to keep its root")
+	}
+	if before["samples"] == after["samples"] {
+		t.Error("expected the changed table to get a new root")
+	}
+
+	diffs, err := s.DiffTables(base, head)
+	if err != nil {
+		t.Fatalf("DiffTables failed: %v", err)
+	}
+	if len(diffs) != 1 || diffs[0].Name != "samples" {
+		t.Fatalf("expected a diff of samples only, got %v", diffs)
+	}
+	if len(diffs[0].Changes.Added) != 1 || len(diffs[0].Changes.Deleted) != 1 {
+		t.Errorf("expected one added and one deleted key, got %+v", diffs[0].Changes)
+	}
+
+	diffs, err = s.DiffTables(plain, base)
+	if err != nil {
+		t.Fatalf("DiffTables failed: %v", err)
+	}
+	if len(diffs) != 2 || diffs[1].Name != "variants" || len(diffs[1].Changes.Added) != 1000 {
+		t.Errorf("expected both tables added in full, got %d diffs", len(diffs))
+	}
+	if diffs, err := s.DiffTables(head, head); err != nil || diffs != nil {
+		t.Errorf("DiffTables of a commit with itself = %v, %v", diffs, err)
+	}
+}
+
+// TestTable_Drop tests that a dropped table disappears from the working
+// state and from the next commit, and that emptying the last table leaves
+// the commit without a table map
+func TestTable_Drop(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	fillTable(t, s.Table("variants"), "v", 100)
+	fillTable(t, s.Table("samples"), "s", 1)
+	if _, err := s.Commit("load"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	if err := s.DropTable("variants"); err != nil {
+		t.Fatalf("DropTable failed: %v", err)
+	}
+	if err := s.DropTable("variants"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("dropping a dropped table returned %v, expected ErrTableNotFound", err)
+	}
+	if _, err := s.Table("variants").Get([]byte("v-0000")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get from a dropped table returned %v", err)
+	}
+	if err := s.Table("samples").Delete([]byte("s-0000")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if names := s.Tables(); len(names) != 0 {
+		t.Errorf("Tables() = %v, expected none", names)
+	}
+
+	head, err := s.Commit("drop")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	commit, err := s.commitMgr.GetCommit(head)
+	if err != nil {
+		t.Fatalf("GetCommit failed: %v", err)
+	}
+	if commit.Tables != ZeroHash {
+		t.Error("expected a commit without tables to have no table map")
+	}
+}
+
+// TestTable_FollowsHead tests that branch switches, checkouts and resets
+// restore the tables of the commit
+func TestTable_FollowsHead(t *testing.T) {
+	s := NewInMemory()
+	defer s.Close()
+	variants := s.Table("variants")
+	fillTable(t, variants, "v", 10)
+	base, err := s.Commit("base")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := s.CreateBranch("feature"); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+	if err := variants.Put([]byte("v-0000"), []byte("main")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := s.Commit("main"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	if err := s.SwitchBranch("feature"); err != nil {
+		t.Fatalf("SwitchBranch failed: %v", err)
+	}
+	expectTableValue(t, variants, "v-0000", "variants/value-v-0")
+
+	if err := variants.Delete([]byte("v-0001")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := s.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	expectTableValue(t, variants, "v-0001", "variants/value-v-1")
+
+	if err := s.SwitchBranch("main"); err != nil {
+		t.Fatalf("SwitchBranch failed: %v", err)
+	}
+	expectTableValue(t, variants, "v-0000", "main")
+	if err := s.Checkout(base); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	expectTableValue(t, variants, "v-0000", "variants/value-v-0")
+}
+
+// TestTable_ReplayedFromWAL tests that table changes survive a crash and
+// that the first commit with tables records the feature flag
+func TestTable_ReplayedFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fillTable(t, s.Table("variants"), "v", 20)
+	fillTable(t, s.Table("samples"), "s", 20)
+	if _, err := s.Commit("load"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	cfg, err := readConfig(dir)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if !cfg.hasFeature(FeatureTables) {
+		t.Errorf("expected the config to list %q, got %v", FeatureTables, cfg.Features)
+	}
+
+	if err := s.Table("variants").Put([]byte("v-0000"), []byte("changed")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Table("variants").Delete([]byte("v-0001")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := s.DropTable("samples"); err != nil {
+		t.Fatalf("DropTable failed: %v", err)
+	}
+	crash(s)
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	expectTableValue(t, s.Table("variants"), "v-0000", "changed")
+	if _, err := s.Table("variants").Get([]byte("v-0001")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(v-0001) returned %v, expected ErrKeyNotFound", err)
+	}
+	if names := s.Tables(); strings.Join(names, ",") != "variants" {
+		t.Errorf("Tables() = %v, expected [variants]", names)
+	}
+}
+
+// TestTable_BundleAndMigrate tests that bundles carry table trees and that
+// migration rewrites them along with the default tree
+func TestTable_BundleAndMigrate(t *testing.T) {
+	dir := t.TempDir()
+	config := `{"version": 2, "chunker": {"target_size": 4096, "min_size": 512, "max_size": 16384}}`
+	if err := os.WriteFile(filepath.Join(dir, configFileName), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	fillTable(t, s.Table("variants"), "v", 2000)
+	fillTable(t, s.Table("samples"), "s", 2000)
+	if _, err := s.Commit("load"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	// An uncommitted change survives the migration
+	if err := s.Table("samples").Put([]byte("s-0000"), []byte("pending")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if err := s.Migrate(nil); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	for name, root := range tableRootsOf(t, s, s.Head()) {
+		data, err := s.cas.Read(root)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if data[0] != 0x05 {
+			t.Errorf("migrated table %s has root node type %#x, expected a counted internal node", name, data[0])
+		}
+	}
+	head, err := s.Commit("pending")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if data, _ := s.cas.Read(tableRootsOf(t, s, head)["variants"]); data[0] != 0x05 {
+		t.Error("expected the unchanged table to keep its migrated tree")
+	}
+
+	var buf bytes.Buffer
+	if err := s.CreateBundle(&buf, []string{"main"}, nil); err != nil {
+		t.Fatalf("CreateBundle failed: %v", err)
+	}
+	dst := NewInMemory()
+	defer dst.Close()
+	if _, err := dst.ImportBundle(&buf); err != nil {
+		t.Fatalf("ImportBundle failed: %v", err)
+	}
+	expectTableValue(t, dst.Table("variants"), "v-1999", "variants/value-v-1999")
+	expectTableValue(t, dst.Table("samples"), "s-0000", "pending")
+}
+
+// TestTable_CommitWithoutConfig tests that tables can be committed in a
+// store created with NewStore, whose directory may have no config
+func TestTable_CommitWithoutConfig(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	fillTable(t, s.Table("variants"), "v", 10)
+	if _, err := s.Commit("tables"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	s.Close()
+
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	defer s.Close()
+	expectTableValue(t, s.Table("variants"), "v-0009", "variants/value-v-9")
+}
@@ -0,0 +1,203 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"microprolly/pkg/branch"
+	"microprolly/pkg/types"
+)
+
+// ErrInvalidTagOptions is returned for a tag message or tagger that cannot
+// be encoded exactly
+var ErrInvalidTagOptions = errors.New("invalid tag options")
+
+// tagJSON is the JSON representation of a Tag. Like commitJSON it is
+// canonical, so a tag object's hash depends only on its fields.
+type tagJSON struct {
+	Name    string         `json:"name"`
+	Commit  string         `json:"commit"`
+	Message string         `json:"message"`
+	Tagger  *signatureJSON `json:"tagger,omitempty"`
+	Sig     *commitSigJSON `json:"sig,omitempty"`
+}
+
+// MarshalTag serializes a Tag to JSON bytes
+func MarshalTag(t *types.Tag) ([]byte, error) {
+	tj := tagJSON{
+		Name:    t.Name,
+		Commit:  hex.EncodeToString(t.Commit[:]),
+		Message: t.Message,
+		Tagger:  marshalSignature(t.Tagger),
+	}
+	if t.Sig != nil {
+		tj.Sig = &commitSigJSON{KeyID: t.Sig.KeyID, Value: hex.EncodeToString(t.Sig.Value)}
+	}
+	return json.Marshal(tj)
+}
+
+// UnmarshalTag deserializes JSON bytes to a Tag
+func UnmarshalTag(data []byte) (*types.Tag, error) {
+	var tj tagJSON
+	if err := json.Unmarshal(data, &tj); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tag JSON: %w", err)
+	}
+
+	commitBytes, err := hex.DecodeString(tj.Commit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit hex: %w", err)
+	}
+	if len(commitBytes) != 32 {
+		return nil, fmt.Errorf("commit must be 32 bytes, got %d", len(commitBytes))
+	}
+
+	t := &types.Tag{
+		Name:    tj.Name,
+		Message: tj.Message,
+		Tagger:  unmarshalSignature(tj.Tagger),
+	}
+	if tj.Sig != nil {
+		value, err := hex.DecodeString(tj.Sig.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature hex: %w", err)
+		}
+		t.Sig = &types.CommitSignature{KeyID: tj.Sig.KeyID, Value: value}
+	}
+	copy(t.Commit[:], commitBytes)
+	return t, nil
+}
+
+// TagOptions sets the tagger and signature of a new tag
+type TagOptions struct {
+	// Tagger.When defaults to the current time
+	Tagger types.Signature
+	// SigningKey, if set, signs the tag
+	SigningKey ed25519.PrivateKey
+}
+
+// TagOption sets a field of TagOptions
+type TagOption func(*TagOptions)
+
+// WithTagger sets who made the tag. A non-zero When fixes the tag time.
+func WithTagger(tagger types.Signature) TagOption {
+	return func(o *TagOptions) { o.Tagger = tagger }
+}
+
+// WithTagSigningKey signs the tag with an ed25519 key
+func WithTagSigningKey(key ed25519.PrivateKey) TagOption {
+	return func(o *TagOptions) { o.SigningKey = key }
+}
+
+// CreateTag tags a commit: it writes a tag object recording the commit,
+// message and tagger, signed if WithTagSigningKey is given, and a tag ref
+// pointing at the object. Tags do not
+// move; a name already in use fails with branch.ErrTagExists. It returns
+// the hash of the tag object.
+func (s *Store) CreateTag(name string, commitHash types.Hash, message string, opts ...TagOption) (types.Hash, error) {
+	if err := s.checkWritable(); err != nil {
+		return types.Hash{}, err
+	}
+	if err := branch.ValidateBranchName(name); err != nil {
+		return types.Hash{}, err
+	}
+	var tagOpts TagOptions
+	for _, opt := range opts {
+		opt(&tagOpts)
+	}
+	if !utf8.ValidString(message) || !utf8.ValidString(tagOpts.Tagger.Name) || !utf8.ValidString(tagOpts.Tagger.Email) {
+		return types.Hash{}, fmt.Errorf("%w: message or tagger is not valid UTF-8", ErrInvalidTagOptions)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs.TagExists(name) {
+		return types.Hash{}, branch.ErrTagExists
+	}
+	if _, err := s.commitMgr.GetCommit(commitHash); err != nil {
+		return types.Hash{}, ErrCommitNotFound
+	}
+
+	tag := &types.Tag{Name: name, Commit: commitHash, Message: message, Tagger: tagOpts.Tagger}
+	if tag.Tagger.When.IsZero() {
+		tag.Tagger.When = time.Now()
+	}
+	if tagOpts.SigningKey != nil {
+		if err := signTag(tag, tagOpts.SigningKey); err != nil {
+			return types.Hash{}, err
+		}
+	}
+	tagHash, err := s.writeTag(tag)
+	if err != nil {
+		return types.Hash{}, err
+	}
+
+	// Make the tag object durable before the ref points at it
+	if err := s.syncObjects(); err != nil {
+		return types.Hash{}, err
+	}
+	if err := s.refs.CreateTag(name, tagHash); err != nil {
+		return types.Hash{}, err
+	}
+	return tagHash, nil
+}
+
+// GetTag returns the tag object a tag ref points to
+func (s *Store) GetTag(name string) (*types.Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tagHash, err := s.refs.GetTag(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.readTag(tagHash)
+}
+
+// ListTags returns all tag names
+func (s *Store) ListTags() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.refs.ListTags()
+}
+
+// DeleteTag removes a tag ref. The tag object stays in the object store.
+func (s *Store) DeleteTag(name string) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refs.DeleteTag(name)
+}
+
+// writeTag stores a tag object and returns its hash
+func (s *Store) writeTag(tag *types.Tag) (types.Hash, error) {
+	data, err := MarshalTag(tag)
+	if err != nil {
+		return types.Hash{}, fmt.Errorf("failed to marshal tag: %w", err)
+	}
+	hash, err := s.cas.Write(data)
+	if err != nil {
+		return types.Hash{}, fmt.Errorf("failed to write tag to CAS: %w", err)
+	}
+	return hash, nil
+}
+
+// readTag loads a tag object by its hash
+func (s *Store) readTag(hash types.Hash) (*types.Tag, error) {
+	data, err := s.cas.Read(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tag from CAS: %w", err)
+	}
+	tag, err := UnmarshalTag(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tag: %w", err)
+	}
+	return tag, nil
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"microprolly/pkg/branch"
+	"microprolly/pkg/types"
+)
+
+// TestTag_Lifecycle tests creating, reading, listing and deleting tags in
+// memory and on disk
+func TestTag_Lifecycle(t *testing.T) {
+	dir := t.TempDir()
+	stores := map[string]func() (*Store, error){
+		"memory": func() (*Store, error) { return NewInMemory(), nil },
+		"file":   func() (*Store, error) { return Open(dir) },
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			s, err := open()
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			defer s.Close()
+
+			first := fillAndCommit(t, s, "a", 5)
+			fillAndCommit(t, s, "b", 5)
+
+			tagger := types.Signature{Name: "Ada", Email: "ada@example.com", When: time.Unix(1700000000, 0)}
+			tagHash, err := s.CreateTag("v1.0", first, "first release", WithTagger(tagger))
+			if err != nil {
+				t.Fatalf("CreateTag failed: %v", err)
+			}
+			if _, err := s.CreateTag("release/v2", s.Head(), "second release"); err != nil {
+				t.Fatalf("CreateTag failed: %v", err)
+			}
+
+			tag, err := s.GetTag("v1.0")
+			if err != nil {
+				t.Fatalf("GetTag failed: %v", err)
+			}
+			if tag.Name != "v1.0" || tag.Commit != first || tag.Message != "first release" || !tag.Tagger.When.Equal(tagger.When) || tag.Tagger.Email != tagger.Email {
+				t.Errorf("unexpected tag %+v", tag)
+			}
+			if data, err := MarshalTag(tag); err != nil || types.Hash(sha256.Sum256(data)) != tagHash {
+				t.Errorf("tag object does not round-trip to %s: %v", tagHash, err)
+			}
+
+			if _, err := s.CreateTag("v1.0", s.Head(), "again"); !errors.Is(err, branch.ErrTagExists) {
+				t.Errorf("CreateTag of an existing tag returned %v, expected ErrTagExists", err)
+			}
+			if _, err := s.CreateTag("v3", types.Hash{1}, "missing"); !errors.Is(err, ErrCommitNotFound) {
+				t.Errorf("CreateTag of a missing commit returned %v, expected ErrCommitNotFound", err)
+			}
+			if _, err := s.CreateTag("bad..name", first, ""); err == nil {
+				t.Error("CreateTag accepted an invalid name")
+			}
+			if _, err := s.CreateTag("v4", first, "\xff"); !errors.Is(err, ErrInvalidTagOptions) {
+				t.Errorf("CreateTag with invalid UTF-8 returned %v, expected ErrInvalidTagOptions", err)
+			}
+
+			names, err := s.ListTags()
+			if err != nil || !slices.Equal(names, []string{"release/v2", "v1.0"}) {
+				t.Errorf("ListTags() = %v, %v", names, err)
+			}
+			// Tags and branches have separate namespaces
+			if s.refs.BranchExists("v1.0") {
+				t.Error("tag is visible as a branch")
+			}
+
+			if err := s.DeleteTag("release/v2"); err != nil {
+				t.Fatalf("DeleteTag failed: %v", err)
+			}
+			if _, err := s.GetTag("release/v2"); !errors.Is(err, branch.ErrTagNotFound) {
+				t.Errorf("GetTag of a deleted tag returned %v, expected ErrTagNotFound", err)
+			}
+			if err := s.DeleteTag("release/v2"); !errors.Is(err, branch.ErrTagNotFound) {
+				t.Errorf("DeleteTag of a deleted tag returned %v, expected ErrTagNotFound", err)
+			}
+		})
+	}
+
+	// Tags persist across reopen
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+	if tag, err := s.GetTag("v1.0"); err != nil || tag.Message != "first release" {
+		t.Errorf("GetTag after reopen = %+v, %v", tag, err)
+	}
+}
+
+// TestTag_Bundle tests that bundles carry tags and that an import only
+// replaces a tag when forced
+func TestTag_Bundle(t *testing.T) {
+	src := NewInMemory()
+	defer src.Close()
+	first := fillAndCommit(t, src, "a", 10)
+	fillAndCommit(t, src, "b", 10)
+	tagHash, err := src.CreateTag("v1", first, "release")
+	if err != nil {
+		t.Fatalf("CreateTag failed: %v", err)
+	}
+
+	// Bundles without tags keep the original format
+	if data := bundleOf(t, src, "main"); binary.BigEndian.Uint32(data[len(bundleMagic):]) != bundleVersion {
+		t.Errorf("bundle without tags has version %d", binary.BigEndian.Uint32(data[len(bundleMagic):]))
+	}
+
+	data := bundleOf(t, src, "refs/tags/v1")
+	dst := NewInMemory()
+	defer dst.Close()
+	refs, err := dst.ImportBundle(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ImportBundle failed: %v", err)
+	}
+	if len(refs) != 1 || !refs[0].IsTag() || refs[0].Name != "v1" || refs[0].Tag != tagHash || refs[0].CommitHash != first {
+		t.Errorf("unexpected refs %+v", refs)
+	}
+	tag, err := dst.GetTag("v1")
+	if err != nil || tag.Commit != first || tag.Message != "release" {
+		t.Fatalf("GetTag = %+v, %v", tag, err)
+	}
+	if dst.refs.BranchExists("v1") {
+		t.Error("importing a tag created a branch")
+	}
+	if err := dst.Checkout(first); err != nil {
+		t.Fatalf("Checkout of the tagged commit failed: %v", err)
+	}
+	expectValue(t, dst, "a-0000", "value-a-0")
+
+	// Importing the same tag again is a no-op
+	if _, err := dst.ImportBundle(bytes.NewReader(data)); err != nil {
+		t.Errorf("re-import failed: %v", err)
+	}
+
+	// A different tag of the same name is only taken when forced
+	if err := src.DeleteTag("v1"); err != nil {
+		t.Fatalf("DeleteTag failed: %v", err)
+	}
+	retagged, err := src.CreateTag("v1", src.Head(), "moved")
+	if err != nil {
+		t.Fatalf("CreateTag failed: %v", err)
+	}
+	moved := bundleOf(t, src, "refs/tags/v1", "refs/heads/main")
+	if _, err := dst.ImportBundle(bytes.NewReader(moved)); !errors.Is(err, branch.ErrTagExists) {
+		t.Errorf("ImportBundle of a moved tag returned %v, expected ErrTagExists", err)
+	}
+	if _, err := dst.ImportBundle(bytes.NewReader(moved), WithForcedImport()); err != nil {
+		t.Fatalf("forced ImportBundle failed: %v", err)
+	}
+	if got, err := dst.refs.GetTag("v1"); err != nil || got != retagged {
+		t.Errorf("tag v1 = %s, %v; expected %s", got, err, retagged)
+	}
+}
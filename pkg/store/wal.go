@@ -0,0 +1,473 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"microprolly/pkg/types"
+)
+
+// walFileName is the write-ahead log of uncommitted changes in the data directory
+const walFileName = "wal"
+
+// WAL record kinds
+const (
+	// walBase is the first record: the HEAD commit the changes apply to
+	walBase = 1
+	// walPut sets a key to the record's value
+	walPut = 2
+	// walDelete removes a key
+	walDelete = 3
+	// walDeleteRange removes a key range: the key is the start, and the
+	// value a 1 byte followed by the end, or empty for an unbounded end
+	walDeleteRange = 4
+	// walBatch holds the records of one Batch as its value, so a batch is
+	// replayed whole or not at all
+	walBatch = 5
+	// walCopyPrefix copies the keys under the key prefix to the value prefix
+	walCopyPrefix = 6
+	// walTable applies the record held in the value to the table named by
+	// the key
+	walTable = 7
+)
+
+// walRecordHeaderSize is the size of a record header: payload length + CRC-32
+const walRecordHeaderSize = 8
+
+// WALOptions configures the write-ahead log of uncommitted changes
+type WALOptions struct {
+	// SyncEvery fsyncs the log after this many records, so a burst of
+	// writes shares one fsync. One fsyncs every Put and Delete.
+	SyncEvery int
+	// SyncInterval fsyncs records that have waited this long for a group
+	// to fill. Zero leaves them until the group fills or the store closes.
+	SyncInterval time.Duration
+}
+
+// DefaultWALOptions returns the options used for a log found on disk when
+// none were given
+func DefaultWALOptions() WALOptions {
+	return WALOptions{SyncEvery: 64, SyncInterval: 50 * time.Millisecond}
+}
+
+// WithWAL records every working-state change in a write-ahead log
+// in the data directory, so uncommitted changes survive a crash
+func WithWAL(opts WALOptions) Option {
+	return func(o *Options) { o.WAL = &opts }
+}
+
+// walRecord is one decoded log record
+type walRecord struct {
+	kind  byte
+	key   []byte
+	value []byte
+}
+
+// writeAheadLog appends working-state changes to a file.
+// A record is [4 payload length][4 CRC-32 of payload][payload]; the payload
+// is [1 kind][4 key length][key][value].
+type writeAheadLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	opts    WALOptions
+	pending int
+	timer   *time.Timer
+	// syncErr holds a failed background fsync until the next append
+	syncErr error
+}
+
+// attachWAL replays the log in the data directory on top of HEAD and keeps
+// appending to it. A log is created if opts is set. Without opts an existing
+// log is still replayed and kept until the next commit or reset, so changes
+// logged before a crash are never dropped silently.
+func (s *Store) attachWAL(opts *WALOptions) error {
+	path := filepath.Join(s.dataDir, walFileName)
+	exists := fileExists(path)
+	if !exists && opts == nil {
+		return nil
+	}
+
+	var records []walRecord
+	var valid int64
+	if exists {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		records, valid = decodeWALRecords(data)
+	}
+
+	// Changes are only replayed on the commit they were made on: after a
+	// commit or branch switch that crashed before resetting the log, they
+	// are already committed or were discarded
+	replay := len(records) > 0 && records[0].kind == walBase &&
+		types.Hash(records[0].key) == s.head
+	if replay {
+		for _, r := range records[1:] {
+			if err := s.applyWALRecord(s.working, r); err != nil {
+				return err
+			}
+		}
+	}
+	if s.readOnly {
+		return nil
+	}
+
+	o := DefaultWALOptions()
+	if opts != nil {
+		o = *opts
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w := &writeAheadLog{path: path, file: file, size: valid, opts: o}
+	s.wal = w
+	s.walRequested = opts != nil
+
+	if !replay {
+		return w.reset(s.head)
+	}
+	// Drop a record torn by the crash so new records follow the valid ones
+	if err := file.Truncate(valid); err != nil {
+		return err
+	}
+	return nil
+}
+
+// applyWALRecord replays one logged change into w, or into the table a
+// walTable record names
+func (s *Store) applyWALRecord(w *workingSet, r walRecord) error {
+	switch r.kind {
+	case walPut:
+		w.put(r.key, r.value)
+	case walDelete:
+		w.delete(r.key)
+	case walDeleteRange:
+		op := batchOp{kind: opDeleteRange, key: r.key}
+		if len(r.value) > 0 {
+			op.end = r.value[1:]
+		}
+		w.apply(op)
+	case walCopyPrefix:
+		w.copyPrefix(r.key, r.value)
+	case walBatch:
+		records, _ := decodeWALRecords(r.value)
+		for _, nested := range records {
+			if err := s.applyWALRecord(w, nested); err != nil {
+				return err
+			}
+		}
+	case walTable:
+		table, err := s.tableWorkingSet(string(r.key))
+		if err != nil {
+			return err
+		}
+		records, _ := decodeWALRecords(r.value)
+		for _, nested := range records {
+			if err := s.applyWALRecord(table, nested); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logPut records a Put before it is applied
+func (s *Store) logPut(key, value []byte) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(walPut, key, value)
+}
+
+// logDelete records a Delete before it is applied
+func (s *Store) logDelete(key []byte) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(walDelete, key, nil)
+}
+
+// logDeleteRange records a DeleteRange before it is applied
+func (s *Store) logDeleteRange(start, end []byte) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(walDeleteRange, start, deleteRangeEnd(end))
+}
+
+// logCopyPrefix records a CopyPrefix before it is applied
+func (s *Store) logCopyPrefix(src, dst []byte) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(walCopyPrefix, src, dst)
+}
+
+// logTable records a change to a table before it is applied
+func (s *Store) logTable(name string, kind byte, key, value []byte) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(walTable, []byte(name), encodeWALRecord(kind, key, value))
+}
+
+// deleteRangeEnd encodes the end of a range delete as a record value
+func deleteRangeEnd(end []byte) []byte {
+	if end == nil {
+		return nil
+	}
+	return append([]byte{1}, end...)
+}
+
+// logBatch records the changes of a batch as one record before they are applied
+func (s *Store) logBatch(ops []batchOp) error {
+	if s.wal == nil {
+		return nil
+	}
+
+	var nested []byte
+	for _, op := range ops {
+		var record []byte
+		switch op.kind {
+		case opPut:
+			record = encodeWALRecord(walPut, op.key, op.value)
+		case opDelete:
+			record = encodeWALRecord(walDelete, op.key, nil)
+		case opDeleteRange:
+			record = encodeWALRecord(walDeleteRange, op.key, deleteRangeEnd(op.end))
+		default:
+			continue
+		}
+		if op.inTable {
+			// Table changes nest as walTable records, as logTable writes them
+			record = encodeWALRecord(walTable, []byte(op.table), record)
+		}
+		nested = append(nested, record...)
+	}
+	if nested == nil {
+		return nil
+	}
+	return s.wal.append(walBatch, nil, nested)
+}
+
+// resetWAL empties the log once the working state matches HEAD again. A
+// log kept only because one was found on disk is removed instead.
+func (s *Store) resetWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+	if s.walRequested {
+		return s.wal.reset(s.head)
+	}
+	if err := s.wal.close(); err != nil {
+		return err
+	}
+	s.wal = nil
+	return os.Remove(filepath.Join(s.dataDir, walFileName))
+}
+
+// rebaseWAL points the logged changes at a new HEAD commit with the same
+// contents, as a migration rewriting commit hashes produces
+func (s *Store) rebaseWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.rebase(s.head)
+}
+
+// append writes a record and fsyncs it according to the options
+func (w *writeAheadLog) append(kind byte, key, value []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+
+	record := encodeWALRecord(kind, key, value)
+	if _, err := w.file.WriteAt(record, w.size); err != nil {
+		// Drop whatever part of the record made it to the file
+		w.file.Truncate(w.size)
+		return err
+	}
+	w.size += int64(len(record))
+
+	w.pending++
+	if w.opts.SyncEvery > 0 && w.pending >= w.opts.SyncEvery {
+		return w.syncLocked()
+	}
+	if w.opts.SyncInterval > 0 && w.timer == nil {
+		w.timer = time.AfterFunc(w.opts.SyncInterval, w.backgroundSync)
+	}
+	return nil
+}
+
+// backgroundSync fsyncs records left waiting by append
+func (w *writeAheadLog) backgroundSync() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer = nil
+	if w.file != nil && w.syncErr == nil {
+		w.syncErr = w.syncLocked()
+	}
+}
+
+// syncLocked fsyncs pending records. Caller must hold mu.
+func (w *writeAheadLog) syncLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.pending == 0 {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.pending = 0
+	return nil
+}
+
+// reset empties the log and records the commit new changes apply to
+func (w *writeAheadLog) reset(head types.Hash) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	record := encodeWALRecord(walBase, head[:], nil)
+	if _, err := w.file.WriteAt(record, 0); err != nil {
+		return err
+	}
+	w.size = int64(len(record))
+	w.pending++
+	w.syncErr = nil
+	return w.syncLocked()
+}
+
+// rebase rewrites the log with a new base commit, keeping its changes.
+// The new log replaces the old one atomically.
+func (w *writeAheadLog) rebase(head types.Hash) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data := make([]byte, w.size)
+	if _, err := w.file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return err
+	}
+	records, _ := decodeWALRecords(data)
+
+	rewritten := encodeWALRecord(walBase, head[:], nil)
+	for _, r := range records {
+		if r.kind != walBase {
+			rewritten = append(rewritten, encodeWALRecord(r.kind, r.key, r.value)...)
+		}
+	}
+
+	// Atomic write: temp file, fsync, rename
+	tmpFile, err := os.CreateTemp(filepath.Dir(w.path), ".wal-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := tmpFile.Write(rewritten); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.size = int64(len(rewritten))
+	w.pending = 0
+	return nil
+}
+
+// close fsyncs and closes the log
+func (w *writeAheadLog) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	syncErr := w.syncLocked()
+	closeErr := w.file.Close()
+	w.file = nil
+	return errors.Join(syncErr, closeErr)
+}
+
+// encodeWALRecord frames one record
+func encodeWALRecord(kind byte, key, value []byte) []byte {
+	payloadLen := 1 + 4 + len(key) + len(value)
+	record := make([]byte, walRecordHeaderSize, walRecordHeaderSize+payloadLen)
+	record = append(record, kind)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(key)))
+	record = append(record, key...)
+	record = append(record, value...)
+
+	binary.BigEndian.PutUint32(record[0:4], uint32(payloadLen))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[walRecordHeaderSize:]))
+	return record
+}
+
+// decodeWALRecords parses records until the end of data or the first
+// incomplete or corrupt one, and returns the length of the valid prefix
+func decodeWALRecords(data []byte) ([]walRecord, int64) {
+	var records []walRecord
+	pos := 0
+	for len(data)-pos >= walRecordHeaderSize {
+		payloadLen := int(binary.BigEndian.Uint32(data[pos:]))
+		checksum := binary.BigEndian.Uint32(data[pos+4:])
+		start := pos + walRecordHeaderSize
+		if payloadLen < 5 || len(data)-start < payloadLen {
+			break
+		}
+		payload := data[start : start+payloadLen]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+
+		keyLen := int(binary.BigEndian.Uint32(payload[1:5]))
+		if keyLen > payloadLen-5 {
+			break
+		}
+		r := walRecord{
+			kind:  payload[0],
+			key:   append([]byte(nil), payload[5:5+keyLen]...),
+			value: append([]byte{}, payload[5+keyLen:]...),
+		}
+		if r.kind == walBase && len(r.key) != len(types.Hash{}) {
+			break
+		}
+		records = append(records, r)
+		pos = start + payloadLen
+	}
+	return records, int64(pos)
+}
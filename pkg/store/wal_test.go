@@ -0,0 +1,271 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crash abandons a store without closing its write-ahead log, as a process
+// crash would: records not yet fsynced are still in the file, but nothing
+// is flushed or truncated
+func crash(s *Store) {
+	if s.wal != nil {
+		s.wal.mu.Lock()
+		if s.wal.timer != nil {
+			s.wal.timer.Stop()
+		}
+		s.wal.file.Close()
+		s.wal.mu.Unlock()
+	}
+	s.cas.Close()
+}
+
+// expectValue fails unless key holds value in the working state
+func expectValue(t *testing.T, s *Store, key, value string) {
+	t.Helper()
+	got, err := s.Get([]byte(key))
+	if err != nil || string(got) != value {
+		t.Errorf("Get(%q) = %q, %v; expected %q", key, got, err, value)
+	}
+}
+
+// expectMissing fails unless key is absent from the working state
+func expectMissing(t *testing.T, s *Store, key string) {
+	t.Helper()
+	if _, err := s.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(%q) returned %v, expected ErrKeyNotFound", key, err)
+	}
+}
+
+// walRecords returns the records in the log of dir
+func walRecords(t *testing.T, dir string) []walRecord {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatalf("reading WAL: %v", err)
+	}
+	records, _ := decodeWALRecords(data)
+	return records
+}
+
+// TestWAL_ReplaysUncommittedChanges tests that Puts and Deletes made after
+// the last commit are restored on top of HEAD after a crash
+func TestWAL_ReplaysUncommittedChanges(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := s.Put([]byte("committed"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Put([]byte("doomed"), []byte("x")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	head, err := s.Commit("base")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	for _, op := range []func() error{
+		func() error { return s.Put([]byte("staged"), []byte("a")) },
+		func() error { return s.Put([]byte("committed"), []byte("2")) },
+		func() error { return s.Delete([]byte("doomed")) },
+	} {
+		if err := op(); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	crash(s)
+
+	s, err = Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	if s.Head() != head {
+		t.Fatalf("HEAD moved to %s", s.Head())
+	}
+	expectValue(t, s, "staged", "a")
+	expectValue(t, s, "committed", "2")
+	expectMissing(t, s, "doomed")
+
+	// Committing empties the log down to its base record
+	if _, err := s.Commit("after recovery"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if records := walRecords(t, dir); len(records) != 1 || records[0].kind != walBase {
+		t.Errorf("expected only the base record after commit, got %d records", len(records))
+	}
+}
+
+// TestWAL_GroupedSyncKeepsRecords tests that records waiting for a group
+// fsync are still replayed, and that a torn final record is dropped
+func TestWAL_GroupedSyncKeepsRecords(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1000}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fillAndCommit(t, s, "base", 10)
+	for _, key := range []string{"x", "y", "z"} {
+		if err := s.Put([]byte(key), []byte(key+"-value")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	crash(s)
+
+	// A record cut short by the crash
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeWALRecord(walPut, []byte("torn"), []byte("value"))[:10])
+	f.Close()
+
+	s, err = Open(dir, WithWAL(WALOptions{SyncEvery: 1000}))
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	expectValue(t, s, "x", "x-value")
+	expectValue(t, s, "z", "z-value")
+	expectMissing(t, s, "torn")
+
+	// New records follow the valid ones
+	if err := s.Put([]byte("after"), []byte("ok")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	records := walRecords(t, dir)
+	if last := records[len(records)-1]; string(last.key) != "after" {
+		t.Errorf("last record is for %q, expected \"after\"", last.key)
+	}
+}
+
+// TestWAL_ResetAndBranchSwitchDiscard tests that Reset and switching branches
+// discard logged changes, so they are not replayed on the next open
+func TestWAL_ResetAndBranchSwitchDiscard(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	fillAndCommit(t, s, "base", 10)
+	if err := s.CreateBranch("feature"); err != nil {
+		t.Fatalf("CreateBranch failed: %v", err)
+	}
+
+	if err := s.Put([]byte("discarded"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Delete([]byte("base-0000")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := s.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	expectMissing(t, s, "discarded")
+	expectValue(t, s, "base-0000", "value-base-0")
+
+	if err := s.Put([]byte("left-behind"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.SwitchBranch("feature"); err != nil {
+		t.Fatalf("SwitchBranch failed: %v", err)
+	}
+	if err := s.Put([]byte("on-feature"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	crash(s)
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	expectMissing(t, s, "discarded")
+	expectMissing(t, s, "left-behind")
+	expectValue(t, s, "on-feature", "1")
+}
+
+// TestWAL_KeptUntilCommitWithoutOption tests that a log found on disk is
+// replayed by NewStore, which has no WAL option, and removed by the next commit
+func TestWAL_KeptUntilCommitWithoutOption(t *testing.T) {
+	dir := t.TempDir()
+	legacy, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	fillAndCommit(t, legacy, "base", 10)
+	legacy.Close()
+
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := s.Put([]byte("staged"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	crash(s)
+
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	defer s.Close()
+	expectValue(t, s, "staged", "1")
+
+	// Changes made before the commit are still logged
+	if err := s.Put([]byte("also-staged"), []byte("2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if records := walRecords(t, dir); len(records) != 3 {
+		t.Errorf("expected 3 records, got %d", len(records))
+	}
+
+	if _, err := s.Commit("recovered"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if fileExists(filepath.Join(dir, walFileName)) {
+		t.Error("expected the log to be removed after commit")
+	}
+}
+
+// TestWAL_SurvivesMigration tests that logged changes follow HEAD when a
+// migration rewrites commit hashes
+func TestWAL_SurvivesMigration(t *testing.T) {
+	dir := t.TempDir()
+	openInlineFormatStore(t, dir).Close()
+
+	s, err := Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := s.Put([]byte("big"), make([]byte, 10000)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	fillAndCommit(t, s, "base", 10)
+	if err := s.Put([]byte("staged"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	before := s.Head()
+	if err := s.Migrate(nil); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if s.Head() == before {
+		t.Fatal("expected the migration to rewrite HEAD")
+	}
+	crash(s)
+
+	s, err = Open(dir, WithWAL(WALOptions{SyncEvery: 1}))
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+	expectValue(t, s, "staged", "1")
+}
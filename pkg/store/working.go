@@ -0,0 +1,338 @@
+package store
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+
+	"microprolly/pkg/tree"
+	"microprolly/pkg/types"
+)
+
+// workingSet holds the uncommitted contents of one keyspace: the default
+// keyspace or a named table. Values loaded from a commit that are stored out
+// of line stay in blobs as references until read; a key is in at most one map.
+//
+// A set loaded from a tree also records how it has changed since: the range
+// edits in order, and the keys whose value may differ from what replaying
+// those edits on the tree gives. build applies both to the tree, so a commit
+// after a range edit does not rebuild the whole keyspace.
+type workingSet struct {
+	values map[string][]byte
+	blobs  map[string]tree.BlobRef
+
+	// base is the root the set was loaded from; ZeroHash if none
+	base  types.Hash
+	edits []rangeEdit
+	dirty map[string]struct{}
+}
+
+// rangeEdit is a DeleteRange of [start, end), or a CopyPrefix from start
+// to end if isCopy is set, recorded for build
+type rangeEdit struct {
+	isCopy     bool
+	start, end []byte
+}
+
+// newWorkingSet returns an empty working set
+func newWorkingSet() *workingSet {
+	return &workingSet{
+		values: make(map[string][]byte),
+		blobs:  make(map[string]tree.BlobRef),
+	}
+}
+
+// loadWorkingSet returns a working set holding the contents of a tree.
+// Values stored out of line are kept as blob references until read.
+func loadWorkingSet(traverser *tree.TreeTraverser, rootHash types.Hash) (*workingSet, error) {
+	// GetAllRaw returns copies, so the pairs can be kept as they are
+	pairs, err := traverser.GetAllRaw(rootHash)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &workingSet{
+		values: make(map[string][]byte, len(pairs)),
+		blobs:  make(map[string]tree.BlobRef),
+		base:   rootHash,
+		dirty:  make(map[string]struct{}),
+	}
+	for _, pair := range pairs {
+		if !pair.ValueRef {
+			w.values[string(pair.Key)] = pair.Value
+			continue
+		}
+		ref, err := tree.DecodeBlobRef(pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		w.blobs[string(pair.Key)] = ref
+	}
+	return w, nil
+}
+
+// len returns the number of keys
+func (w *workingSet) len() int {
+	return len(w.values) + len(w.blobs)
+}
+
+// value returns a copy of a key's value, reading it from its blob if it is
+// stored out of line
+func (w *workingSet) value(traverser *tree.TreeTraverser, key []byte) ([]byte, error) {
+	if ref, exists := w.blobs[string(key)]; exists {
+		return traverser.ReadBlob(ref)
+	}
+
+	value, exists := w.values[string(key)]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	// Return a copy to avoid external mutation
+	result := make([]byte, len(value))
+	copy(result, value)
+	return result, nil
+}
+
+// reader returns a streaming reader over a key's value
+func (w *workingSet) reader(traverser *tree.TreeTraverser, key []byte) (*tree.ValueReader, error) {
+	if ref, exists := w.blobs[string(key)]; exists {
+		return traverser.OpenBlob(ref)
+	}
+	value, exists := w.values[string(key)]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	// Copy so later writes to the key do not affect the reader
+	valueCopy := make([]byte, len(value))
+	copy(valueCopy, value)
+	return tree.NewValueReader(valueCopy), nil
+}
+
+// has reports whether key exists
+func (w *workingSet) has(key []byte) bool {
+	if _, exists := w.blobs[string(key)]; exists {
+		return true
+	}
+	_, exists := w.values[string(key)]
+	return exists
+}
+
+// put sets key to value; the caller must not modify value afterwards
+func (w *workingSet) put(key, value []byte) {
+	w.values[string(key)] = value
+	delete(w.blobs, string(key))
+	w.markDirty(string(key))
+}
+
+// delete removes key
+func (w *workingSet) delete(key []byte) {
+	delete(w.values, string(key))
+	delete(w.blobs, string(key))
+	w.markDirty(string(key))
+}
+
+// markDirty records that key may differ from the base tree after the edits
+func (w *workingSet) markDirty(key string) {
+	if w.dirty != nil {
+		w.dirty[key] = struct{}{}
+	}
+}
+
+// apply makes one batch change; conditions are ignored
+func (w *workingSet) apply(op batchOp) {
+	switch op.kind {
+	case opPut:
+		w.put(op.key, op.value)
+	case opDelete:
+		w.delete(op.key)
+	case opDeleteRange:
+		w.deleteRange(op.key, op.end)
+	}
+}
+
+// deleteRange removes every key with start <= key < end; a nil end is
+// unbounded
+func (w *workingSet) deleteRange(start, end []byte) {
+	if w.dirty != nil {
+		w.edits = append(w.edits, rangeEdit{start: start, end: end})
+	}
+	w.removeRange(start, end)
+}
+
+// removeRange removes the keys of a range from the maps
+func (w *workingSet) removeRange(start, end []byte) {
+	for key := range w.values {
+		if inRange(key, start, end) {
+			delete(w.values, key)
+		}
+	}
+	for key := range w.blobs {
+		if inRange(key, start, end) {
+			delete(w.blobs, key)
+		}
+	}
+}
+
+// inRange reports whether start <= key < end; a nil end is unbounded
+func inRange(key string, start, end []byte) bool {
+	return key >= string(start) && (end == nil || key < string(end))
+}
+
+// copyPrefix replaces the keys under dst with the keys under src, renamed.
+// Copies are taken before dst is cleared, so overlapping prefixes copy the
+// original keys.
+func (w *workingSet) copyPrefix(src, dst []byte) {
+	if string(src) == string(dst) {
+		return
+	}
+	if w.dirty != nil {
+		w.edits = append(w.edits, rangeEdit{isCopy: true, start: src, end: dst})
+		// Copying a changed key changes its copy too
+		for key := range w.dirty {
+			if strings.HasPrefix(key, string(src)) {
+				w.dirty[string(dst)+key[len(src):]] = struct{}{}
+			}
+		}
+	}
+
+	values := make(map[string][]byte)
+	for key, value := range w.values {
+		if strings.HasPrefix(key, string(src)) {
+			values[string(dst)+key[len(src):]] = value
+		}
+	}
+	blobs := make(map[string]tree.BlobRef)
+	for key, ref := range w.blobs {
+		if strings.HasPrefix(key, string(src)) {
+			blobs[string(dst)+key[len(src):]] = ref
+		}
+	}
+
+	w.removeRange(dst, tree.PrefixEnd(dst))
+	for key, value := range values {
+		w.values[key] = value
+	}
+	for key, ref := range blobs {
+		w.blobs[key] = ref
+	}
+}
+
+// build returns the root of a tree holding the set. A set with range edits
+// is built by applying them to its base tree and then replacing the span
+// from the first to the last dirty key; otherwise it is built from scratch.
+func (w *workingSet) build(builder *tree.TreeBuilder) (types.Hash, error) {
+	if w.base == ZeroHash || len(w.edits) == 0 {
+		return builder.Build(w.sortedPairs())
+	}
+
+	root := w.base
+	for _, edit := range w.edits {
+		var err error
+		if edit.isCopy {
+			root, err = builder.CopyPrefix(root, edit.start, edit.end)
+		} else {
+			root, err = builder.DeleteRange(root, edit.start, edit.end)
+		}
+		if err != nil {
+			return types.Hash{}, err
+		}
+	}
+	if len(w.dirty) == 0 {
+		return root, nil
+	}
+
+	keys := slices.Sorted(maps.Keys(w.dirty))
+	start, end := []byte(keys[0]), append([]byte(keys[len(keys)-1]), 0)
+	return builder.ReplaceRange(root, start, end, w.rangePairs(start, end))
+}
+
+// committed makes root the base of the set, once the set is committed as it
+func (w *workingSet) committed(root types.Hash) {
+	w.base = root
+	w.edits = nil
+	w.dirty = make(map[string]struct{})
+}
+
+// changedFrom reports whether the set may differ from the tree at root,
+// the tree it was loaded from or last committed as. Tracked changes answer
+// directly; a set that tracks none is compared with the tree.
+func (w *workingSet) changedFrom(traverser *tree.TreeTraverser, root types.Hash) (bool, error) {
+	if w.dirty != nil {
+		return len(w.edits) > 0 || len(w.dirty) > 0, nil
+	}
+
+	pairs, err := traverser.GetAllRaw(root)
+	if err != nil {
+		return false, err
+	}
+	if len(pairs) != w.len() {
+		return true, nil
+	}
+	for _, pair := range pairs {
+		if pair.ValueRef {
+			ref, exists := w.blobs[string(pair.Key)]
+			if !exists || !bytes.Equal(ref.Encode(), pair.Value) {
+				return true, nil
+			}
+			continue
+		}
+		value, exists := w.values[string(pair.Key)]
+		if !exists || !bytes.Equal(value, pair.Value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// forgetBase stops tracking changes, so the next build starts from scratch
+func (w *workingSet) forgetBase() {
+	w.base = ZeroHash
+	w.edits = nil
+	w.dirty = nil
+}
+
+// sortedPairs converts the working set to sorted KV pairs. Values still
+// stored out of line are passed to the builder as references.
+func (w *workingSet) sortedPairs() []types.KVPair {
+	pairs := make([]types.KVPair, 0, w.len())
+	for k, v := range w.values {
+		pairs = append(pairs, types.KVPair{
+			Key:   []byte(k),
+			Value: v,
+		})
+	}
+	for k, ref := range w.blobs {
+		pairs = append(pairs, types.KVPair{
+			Key:      []byte(k),
+			Value:    ref.Encode(),
+			ValueRef: true,
+		})
+	}
+
+	// Sort by key for deterministic tree construction
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0
+	})
+
+	return pairs
+}
+
+// rangePairs is sortedPairs restricted to keys with start <= key < end
+func (w *workingSet) rangePairs(start, end []byte) []types.KVPair {
+	subset := newWorkingSet()
+	for key, value := range w.values {
+		if inRange(key, start, end) {
+			subset.values[key] = value
+		}
+	}
+	for key, ref := range w.blobs {
+		if inRange(key, start, end) {
+			subset.blobs[key] = ref
+		}
+	}
+	return subset.sortedPairs()
+}
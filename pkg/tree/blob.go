@@ -0,0 +1,285 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+)
+
+const (
+	// DefaultBlobThreshold is the value size above which the builder stores
+	// values out of line as blobs instead of inline in leaf nodes
+	DefaultBlobThreshold = 4096
+
+	// Blob chunk sizes for content-defined chunking of large values
+	blobChunkTarget = 64 << 10
+	blobChunkMin    = 16 << 10
+	blobChunkMax    = 256 << 10
+
+	// blobTypeIndex prefixes a blob index object. It follows the node type
+	// bytes so blob objects can never be mistaken for tree nodes.
+	blobTypeIndex = 0x04
+
+	// blobRefSize is the encoded size of a BlobRef: index hash + total size
+	blobRefSize = 32 + 8
+)
+
+var (
+	// ErrInvalidBlob is returned when a blob reference or index is malformed
+	ErrInvalidBlob = errors.New("invalid value blob")
+)
+
+// BlobRef is the typed reference a leaf stores in place of a large value.
+// It names the blob's index object and records the value's total size.
+type BlobRef struct {
+	Index types.Hash
+	Size  uint64
+}
+
+// Encode returns the reference as stored in a leaf value
+func (r BlobRef) Encode() []byte {
+	buf := make([]byte, blobRefSize)
+	copy(buf, r.Index[:])
+	binary.BigEndian.PutUint64(buf[32:], r.Size)
+	return buf
+}
+
+// DecodeBlobRef parses a reference produced by Encode
+func DecodeBlobRef(data []byte) (BlobRef, error) {
+	if len(data) != blobRefSize {
+		return BlobRef{}, fmt.Errorf("%w: reference is %d bytes", ErrInvalidBlob, len(data))
+	}
+	var r BlobRef
+	copy(r.Index[:], data[:32])
+	r.Size = binary.BigEndian.Uint64(data[32:])
+	return r, nil
+}
+
+// blobChunk is one entry of a blob index
+type blobChunk struct {
+	hash types.Hash
+	size uint32
+}
+
+// serializeBlobIndex encodes the list of chunks making up a blob.
+//
+// Format (big-endian):
+//
+//	[1 byte: 0x04][8 bytes: total size][4 bytes: chunk count]
+//	For each chunk: [32 bytes: chunk hash][4 bytes: chunk size]
+func serializeBlobIndex(size uint64, chunks []blobChunk) []byte {
+	buf := make([]byte, 0, 1+8+4+len(chunks)*36)
+	buf = append(buf, blobTypeIndex)
+	buf = binary.BigEndian.AppendUint64(buf, size)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(chunks)))
+	for _, c := range chunks {
+		buf = append(buf, c.hash[:]...)
+		buf = binary.BigEndian.AppendUint32(buf, c.size)
+	}
+	return buf
+}
+
+// deserializeBlobIndex decodes a blob index and checks it against the reference
+func deserializeBlobIndex(data []byte, ref BlobRef) ([]blobChunk, error) {
+	if len(data) < 13 || data[0] != blobTypeIndex {
+		return nil, fmt.Errorf("%w: bad index header", ErrInvalidBlob)
+	}
+	size := binary.BigEndian.Uint64(data[1:])
+	count := int(binary.BigEndian.Uint32(data[9:]))
+	if len(data) != 13+count*36 {
+		return nil, fmt.Errorf("%w: index length mismatch", ErrInvalidBlob)
+	}
+	if size != ref.Size {
+		return nil, fmt.Errorf("%w: index size %d, reference size %d", ErrInvalidBlob, size, ref.Size)
+	}
+
+	chunks := make([]blobChunk, count)
+	var total uint64
+	pos := 13
+	for i := range chunks {
+		copy(chunks[i].hash[:], data[pos:pos+32])
+		chunks[i].size = binary.BigEndian.Uint32(data[pos+32:])
+		total += uint64(chunks[i].size)
+		pos += 36
+	}
+	if total != size {
+		return nil, fmt.Errorf("%w: chunk sizes add up to %d, expected %d", ErrInvalidBlob, total, size)
+	}
+	return chunks, nil
+}
+
+// writeBlob splits value into content-defined chunks, stores the chunks and
+// an index object, and returns a reference to the index
+func writeBlob(ctx context.Context, c cas.BatchCAS, value []byte) (BlobRef, error) {
+	pieces := chunker.SplitBytes(value, blobChunkTarget, blobChunkMin, blobChunkMax)
+
+	hashes, err := c.WriteMany(ctx, pieces)
+	if err != nil {
+		return BlobRef{}, err
+	}
+
+	chunks := make([]blobChunk, len(pieces))
+	for i, piece := range pieces {
+		chunks[i] = blobChunk{hash: hashes[i], size: uint32(len(piece))}
+	}
+
+	index, err := c.WriteContext(ctx, serializeBlobIndex(uint64(len(value)), chunks))
+	if err != nil {
+		return BlobRef{}, err
+	}
+	return BlobRef{Index: index, Size: uint64(len(value))}, nil
+}
+
+// readBlobIndex loads the chunk list of a blob
+func readBlobIndex(ctx context.Context, c cas.BatchCAS, ref BlobRef) ([]blobChunk, error) {
+	data, err := c.ReadContext(ctx, ref.Index)
+	if err != nil {
+		return nil, err
+	}
+	return deserializeBlobIndex(data, ref)
+}
+
+// readBlob reassembles a whole blob with one batched chunk read
+func readBlob(ctx context.Context, c cas.BatchCAS, ref BlobRef) ([]byte, error) {
+	chunks, err := readBlobIndex(ctx, c, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]types.Hash, len(chunks))
+	for i, chunk := range chunks {
+		hashes[i] = chunk.hash
+	}
+	data, err := c.ReadMany(ctx, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the chunks against the index before allocating, so the buffer
+	// is sized by the bytes actually read rather than by the stored size
+	total := 0
+	for i, d := range data {
+		if len(d) != int(chunks[i].size) {
+			return nil, fmt.Errorf("%w: chunk %d has %d bytes, expected %d", ErrInvalidBlob, i, len(d), chunks[i].size)
+		}
+		total += len(d)
+	}
+
+	value := make([]byte, 0, total)
+	for _, d := range data {
+		value = append(value, d...)
+	}
+	return value, nil
+}
+
+// BlobObjects returns the hashes of every CAS object making up a blob:
+// its index followed by its chunks
+func BlobObjects(c cas.CAS, ref BlobRef) ([]types.Hash, error) {
+	chunks, err := readBlobIndex(context.Background(), cas.AsBatch(c), ref)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]types.Hash, 0, len(chunks)+1)
+	hashes = append(hashes, ref.Index)
+	for _, chunk := range chunks {
+		hashes = append(hashes, chunk.hash)
+	}
+	return hashes, nil
+}
+
+// ValueReader streams a value. Blob values are read one chunk at a time,
+// so only a single chunk is held in memory.
+type ValueReader struct {
+	ctx    context.Context
+	cas    cas.BatchCAS
+	chunks []blobChunk
+	next   int
+	buf    *bytes.Reader
+	size   int64
+}
+
+// NewValueReader returns a ValueReader over an in-memory value
+func NewValueReader(value []byte) *ValueReader {
+	return &ValueReader{buf: bytes.NewReader(value), size: int64(len(value))}
+}
+
+// openBlob returns a ValueReader over a blob
+func openBlob(ctx context.Context, c cas.BatchCAS, ref BlobRef) (*ValueReader, error) {
+	chunks, err := readBlobIndex(ctx, c, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &ValueReader{
+		ctx:    ctx,
+		cas:    c,
+		chunks: chunks,
+		buf:    bytes.NewReader(nil),
+		size:   int64(ref.Size),
+	}, nil
+}
+
+// Size returns the total length of the value in bytes
+func (r *ValueReader) Size() int64 {
+	return r.size
+}
+
+// Read implements io.Reader
+func (r *ValueReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.next >= len(r.chunks) {
+			return 0, io.EOF
+		}
+
+		chunk := r.chunks[r.next]
+		data, err := r.cas.ReadContext(r.ctx, chunk.hash)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) != int(chunk.size) {
+			return 0, fmt.Errorf("%w: chunk %d has %d bytes, expected %d", ErrInvalidBlob, r.next, len(data), chunk.size)
+		}
+		r.buf = bytes.NewReader(data)
+		r.next++
+	}
+	return r.buf.Read(p)
+}
+
+// OpenBlob returns a streaming reader over the blob ref points to
+func (t *TreeTraverser) OpenBlob(ref BlobRef) (*ValueReader, error) {
+	return openBlob(context.Background(), t.loader.cas, ref)
+}
+
+// ReadBlob returns the whole value the blob ref points to
+func (t *TreeTraverser) ReadBlob(ref BlobRef) ([]byte, error) {
+	return readBlob(context.Background(), t.loader.cas, ref)
+}
+
+// resolveValue returns a copy of a pair's value, reading it from its blob
+// if it is stored out of line
+func resolveValue(ctx context.Context, c cas.BatchCAS, pair types.KVPair) ([]byte, error) {
+	if !pair.ValueRef {
+		return copyBytes(pair.Value), nil
+	}
+	ref, err := DecodeBlobRef(pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	return readBlob(ctx, c, ref)
+}
+
+// valueSize returns the length of a pair's value without reading its blob
+func valueSize(pair types.KVPair) int64 {
+	if pair.ValueRef {
+		if ref, err := DecodeBlobRef(pair.Value); err == nil {
+			return int64(ref.Size)
+		}
+	}
+	return int64(len(pair.Value))
+}
@@ -0,0 +1,250 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// randomBytes returns n pseudo-random bytes from a fixed seed
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// TestBlob_LargeValueRoundTrip checks that a value above the threshold is
+// stored out of line and read back unchanged through every read path
+func TestBlob_LargeValueRoundTrip(t *testing.T) {
+	store := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(store, chunker.DefaultChunker())
+	traverser := NewTreeTraverser(store)
+
+	large := randomBytes(1, 1<<20)
+	pairs := []types.KVPair{
+		{Key: []byte("a"), Value: []byte("small")},
+		{Key: []byte("b"), Value: large},
+		{Key: []byte("c"), Value: []byte("tiny")},
+	}
+
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	// The leaf stays small: it holds a reference, not the value
+	data, err := store.Read(root)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(data) > 1024 {
+		t.Errorf("leaf is %d bytes, expected the value to be stored out of line", len(data))
+	}
+
+	got, err := traverser.Get(root, []byte("b"))
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !bytes.Equal(got, large) {
+		t.Error("Get returned a different value")
+	}
+
+	all, err := traverser.GetAll(root)
+	if err != nil {
+		t.Fatalf("GetAll failed: %v", err)
+	}
+	for i := range pairs {
+		if !bytes.Equal(all[i].Value, pairs[i].Value) || all[i].ValueRef {
+			t.Errorf("GetAll pair %q not resolved", pairs[i].Key)
+		}
+	}
+
+	raw, err := traverser.GetAllRaw(root)
+	if err != nil {
+		t.Fatalf("GetAllRaw failed: %v", err)
+	}
+	if !raw[1].ValueRef || raw[0].ValueRef {
+		t.Error("GetAllRaw should keep only the large value as a reference")
+	}
+
+	reader, err := traverser.GetReader(root, []byte("b"))
+	if err != nil {
+		t.Fatalf("GetReader failed: %v", err)
+	}
+	if reader.Size() != int64(len(large)) {
+		t.Errorf("Size() = %d, expected %d", reader.Size(), len(large))
+	}
+	streamed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(streamed, large) {
+		t.Error("GetReader returned a different value")
+	}
+}
+
+// TestBlob_ChunksAreShared checks that two large values differing in a few
+// bytes share most of their chunks
+func TestBlob_ChunksAreShared(t *testing.T) {
+	store := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(store, chunker.DefaultChunker())
+
+	original := randomBytes(2, 2<<20)
+	if _, err := builder.Build([]types.KVPair{{Key: []byte("k"), Value: original}}); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	before := store.Len()
+
+	edited := append([]byte(nil), original...)
+	copy(edited[1<<20:], "an edit in the middle of the value")
+	if _, err := builder.Build([]types.KVPair{{Key: []byte("k"), Value: edited}}); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	// A new index, a new leaf and the one or two chunks around the edit
+	if added := store.Len() - before; added > 5 {
+		t.Errorf("edit added %d objects, expected most chunks to be shared", added)
+	}
+}
+
+// TestBlob_DiffResolvesValues checks that diffs report the values themselves,
+// not their references
+func TestBlob_DiffResolvesValues(t *testing.T) {
+	store := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(store, chunker.DefaultChunker())
+	builder.SetBlobThreshold(16)
+	differ := NewDiffEngine(store)
+
+	oldValue := bytes.Repeat([]byte("old"), 100)
+	newValue := bytes.Repeat([]byte("new"), 100)
+	rootA, err := builder.Build([]types.KVPair{{Key: []byte("k"), Value: oldValue}})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	rootB, err := builder.Build([]types.KVPair{{Key: []byte("k"), Value: newValue}})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	result, err := differ.Diff(rootA, rootB)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(result.Modified) != 1 ||
+		!bytes.Equal(result.Modified[0].OldValue, oldValue) ||
+		!bytes.Equal(result.Modified[0].NewValue, newValue) {
+		t.Errorf("unexpected diff: %+v", result)
+	}
+
+	stats, err := differ.DiffStats(rootA, rootB)
+	if err != nil {
+		t.Fatalf("DiffStats failed: %v", err)
+	}
+	if stats.BytesAdded != int64(len(newValue)) || stats.BytesDeleted != int64(len(oldValue)) {
+		t.Errorf("stats sizes = +%d -%d, expected +%d -%d",
+			stats.BytesAdded, stats.BytesDeleted, len(newValue), len(oldValue))
+	}
+}
+
+// TestBlob_InlineAndBlobCompareByContent checks that a value stored inline in
+// one tree and as a blob in another is not reported as modified
+func TestBlob_InlineAndBlobCompareByContent(t *testing.T) {
+	store := cas.NewMemoryCAS()
+	value := bytes.Repeat([]byte("v"), 100)
+	pairs := []types.KVPair{{Key: []byte("k"), Value: value}}
+
+	inline := NewTreeBuilder(store, chunker.DefaultChunker())
+	rootA, err := inline.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	external := NewTreeBuilder(store, chunker.DefaultChunker())
+	external.SetBlobThreshold(16)
+	rootB, err := external.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if rootA == rootB {
+		t.Fatal("expected different encodings of the same value")
+	}
+
+	result, err := NewDiffEngine(store).Diff(rootA, rootB)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(result.Added)+len(result.Modified)+len(result.Deleted) != 0 {
+		t.Errorf("expected no differences, got %+v", result)
+	}
+}
+
+// TestBlob_OversizedIndexRejected checks that an index claiming far more
+// bytes than its chunks hold is rejected instead of sizing a buffer from it
+func TestBlob_OversizedIndexRejected(t *testing.T) {
+	store := cas.NewMemoryCAS()
+	chunk, err := store.Write([]byte("small chunk"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// 256 entries of 4 GiB each add up to the claimed size, so the index
+	// itself is consistent; only the chunk data betrays it
+	chunks := make([]blobChunk, 256)
+	var size uint64
+	for i := range chunks {
+		chunks[i] = blobChunk{hash: chunk, size: 0xFFFFFFFF}
+		size += uint64(chunks[i].size)
+	}
+	index, err := store.Write(serializeBlobIndex(size, chunks))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	_, err = NewTreeTraverser(store).ReadBlob(BlobRef{Index: index, Size: size})
+	if !errors.Is(err, ErrInvalidBlob) {
+		t.Errorf("ReadBlob error = %v, expected ErrInvalidBlob", err)
+	}
+}
+
+// TestProperty_BlobValuesRoundTrip checks Get for trees mixing inline and
+// out-of-line values around a random threshold
+func TestProperty_BlobValuesRoundTrip(t *testing.T) {
+	rapid.Check(t, func(rt *rapid.T) {
+		store := cas.NewMemoryCAS()
+		builder := NewTreeBuilder(store, chunker.NewBuzhashChunker(256, 64, 1024))
+		builder.SetBlobThreshold(rapid.IntRange(1, 64).Draw(rt, "threshold"))
+		traverser := NewTreeTraverser(store)
+
+		n := rapid.IntRange(1, 50).Draw(rt, "n")
+		pairs := make([]types.KVPair, n)
+		for i := range pairs {
+			pairs[i] = types.KVPair{
+				Key:   []byte(fmt.Sprintf("key%04d", i)),
+				Value: rapid.SliceOfN(rapid.Byte(), 0, 200).Draw(rt, "value"),
+			}
+		}
+
+		root, err := builder.Build(pairs)
+		if err != nil {
+			rt.Fatalf("Build failed: %v", err)
+		}
+		for _, pair := range pairs {
+			got, err := traverser.Get(root, pair.Key)
+			if err != nil {
+				rt.Fatalf("Get(%q) failed: %v", pair.Key, err)
+			}
+			if !bytes.Equal(got, pair.Value) {
+				rt.Fatalf("Get(%q) returned a different value", pair.Key)
+			}
+		}
+	})
+}
@@ -1,25 +1,63 @@
 package tree
 
 import (
+	"context"
+
 	"microprolly/pkg/cas"
 	"microprolly/pkg/chunker"
 	"microprolly/pkg/types"
 )
 
+// writeBatchSize is the maximum number of nodes passed to one WriteMany call
+const writeBatchSize = 256
+
 // TreeBuilder constructs Prolly Trees from sorted KV pairs
 type TreeBuilder struct {
-	cas     cas.CAS
-	chunker chunker.Chunker
+	cas           cas.BatchCAS
+	chunker       chunker.Chunker
+	cache         *NodeCache
+	loader        nodeLoader
+	blobThreshold int  // values longer than this are stored as blobs, 0 = never
+	subtreeCounts bool // record subtree key counts in internal nodes
 }
 
 // NewTreeBuilder creates a new TreeBuilder with the given CAS and chunker
 func NewTreeBuilder(cas cas.CAS, chunker chunker.Chunker) *TreeBuilder {
+	return NewTreeBuilderWithCache(cas, chunker, nil)
+}
+
+// NewTreeBuilderWithCache creates a new TreeBuilder that adds every node it
+// writes to the given cache, so freshly built trees are read without CAS access.
+// A nil cache disables caching.
+func NewTreeBuilderWithCache(casStore cas.CAS, chunker chunker.Chunker, cache *NodeCache) *TreeBuilder {
 	return &TreeBuilder{
-		cas:     cas,
-		chunker: chunker,
+		cas:           cas.AsBatch(casStore),
+		chunker:       chunker,
+		cache:         cache,
+		loader:        newNodeLoader(casStore, cache),
+		blobThreshold: DefaultBlobThreshold,
+		subtreeCounts: true,
 	}
 }
 
+// SetBlobThreshold sets the value size above which values are stored out of
+// line as blobs. Zero keeps every value inline.
+func (b *TreeBuilder) SetBlobThreshold(threshold int) {
+	b.blobThreshold = threshold
+}
+
+// SetSubtreeCounts sets whether internal nodes record the number of keys
+// under each child. Disabling it writes nodes in the format used before
+// counts existed.
+func (b *TreeBuilder) SetSubtreeCounts(enabled bool) {
+	b.subtreeCounts = enabled
+}
+
+// Chunker returns the chunker that places node boundaries
+func (b *TreeBuilder) Chunker() chunker.Chunker {
+	return b.chunker
+}
+
 // Build creates a Prolly Tree from sorted KV pairs and returns the root hash.
 // The tree is built bottom-up:
 // 1. Chunk the KV pairs using rolling hash boundaries
@@ -27,85 +65,145 @@ func NewTreeBuilder(cas cas.CAS, chunker chunker.Chunker) *TreeBuilder {
 // 3. Recursively build internal nodes until a single root remains
 // All nodes are stored in CAS during construction.
 func (b *TreeBuilder) Build(pairs []types.KVPair) (types.Hash, error) {
+	return b.BuildContext(context.Background(), pairs)
+}
+
+// BuildContext is Build with cancellation. Each tree level is written to
+// the CAS with WriteMany calls of up to writeBatchSize nodes, and ctx is
+// checked between levels.
+func (b *TreeBuilder) BuildContext(ctx context.Context, pairs []types.KVPair) (types.Hash, error) {
 	// Handle empty input
 	if len(pairs) == 0 {
 		// Create an empty leaf node as root
 		emptyLeaf := &types.LeafNode{Pairs: []types.KVPair{}}
-		return b.storeNode(emptyLeaf)
+		hashes, err := b.storeNodes(ctx, []types.Node{emptyLeaf})
+		if err != nil {
+			return types.Hash{}, err
+		}
+		return hashes[0], nil
+	}
+
+	// Move large values out of line so leaves only hold references
+	pairs, err := b.externalizeValues(ctx, pairs)
+	if err != nil {
+		return types.Hash{}, err
 	}
 
 	// Step 1: Chunk the KV pairs using rolling hash boundaries (Requirement 3.1)
 	chunks := b.chunker.Chunk(pairs)
 
 	// Step 2: Build leaf nodes from chunks
-	leafRefs, err := b.buildLeafNodes(chunks)
+	leafRefs, err := b.buildLeafNodes(ctx, chunks)
 	if err != nil {
 		return types.Hash{}, err
 	}
 
 	// Step 3: Recursively build internal nodes until single root (Requirement 3.3)
-	return b.buildInternalLayers(leafRefs)
+	return b.buildInternalLayers(ctx, leafRefs)
 }
 
-// buildLeafNodes creates leaf nodes from chunks and stores them in CAS
-func (b *TreeBuilder) buildLeafNodes(chunks [][]types.KVPair) ([]types.ChildRef, error) {
-	refs := make([]types.ChildRef, 0, len(chunks))
+// externalizeValues writes values above the blob threshold as blobs and
+// returns pairs referencing them. The caller's slice is never modified.
+// Pairs that already hold a blob reference are passed through.
+func (b *TreeBuilder) externalizeValues(ctx context.Context, pairs []types.KVPair) ([]types.KVPair, error) {
+	if b.blobThreshold <= 0 {
+		return pairs, nil
+	}
 
-	for _, chunk := range chunks {
-		// Create leaf node
-		leaf := &types.LeafNode{Pairs: chunk}
+	var result []types.KVPair
+	for i, pair := range pairs {
+		if pair.ValueRef || len(pair.Value) <= b.blobThreshold {
+			if result != nil {
+				result = append(result, pair)
+			}
+			continue
+		}
 
-		// Store in CAS and get hash (Requirement 3.2)
-		hash, err := b.storeNode(leaf)
+		if result == nil {
+			result = make([]types.KVPair, i, len(pairs))
+			copy(result, pairs[:i])
+		}
+		ref, err := writeBlob(ctx, b.cas, pair.Value)
 		if err != nil {
 			return nil, err
 		}
+		result = append(result, types.KVPair{Key: pair.Key, Value: ref.Encode(), ValueRef: true})
+	}
+
+	if result == nil {
+		return pairs, nil
+	}
+	return result, nil
+}
+
+// buildLeafNodes creates leaf nodes from chunks and stores them in CAS
+func (b *TreeBuilder) buildLeafNodes(ctx context.Context, chunks [][]types.KVPair) ([]types.ChildRef, error) {
+	nodes := make([]types.Node, len(chunks))
+	for i, chunk := range chunks {
+		nodes[i] = &types.LeafNode{Pairs: chunk}
+	}
+
+	// Store the whole level in CAS and get hashes (Requirement 3.2)
+	hashes, err := b.storeNodes(ctx, nodes)
+	if err != nil {
+		return nil, err
+	}
 
-		// Create child reference using first key of the chunk
-		ref := types.ChildRef{
+	// Create child references using first key of each chunk
+	refs := make([]types.ChildRef, len(chunks))
+	for i, chunk := range chunks {
+		refs[i] = types.ChildRef{
 			Key:  chunk[0].Key,
-			Hash: hash,
+			Hash: hashes[i],
+		}
+		if b.subtreeCounts {
+			refs[i].Count = uint64(len(chunk))
 		}
-		refs = append(refs, ref)
 	}
 
 	return refs, nil
 }
 
 // buildInternalLayers recursively builds internal node layers until a single root
-func (b *TreeBuilder) buildInternalLayers(childRefs []types.ChildRef) (types.Hash, error) {
+func (b *TreeBuilder) buildInternalLayers(ctx context.Context, childRefs []types.ChildRef) (types.Hash, error) {
 	// Base case: single child means we have our root
 	if len(childRefs) == 1 {
 		return childRefs[0].Hash, nil
 	}
 
+	if err := ctx.Err(); err != nil {
+		return types.Hash{}, err
+	}
+
 	// Chunk the child references to create internal nodes
 	// We need to convert ChildRefs to a format the chunker can work with
 	internalChunks := b.chunkChildRefs(childRefs)
 
 	// Build internal nodes from chunks
-	parentRefs := make([]types.ChildRef, 0, len(internalChunks))
-
-	for _, chunk := range internalChunks {
-		// Create internal node
-		internal := &types.InternalNode{Children: chunk}
+	nodes := make([]types.Node, len(internalChunks))
+	for i, chunk := range internalChunks {
+		nodes[i] = &types.InternalNode{Children: chunk}
+	}
 
-		// Store in CAS
-		hash, err := b.storeNode(internal)
-		if err != nil {
-			return types.Hash{}, err
-		}
+	hashes, err := b.storeNodes(ctx, nodes)
+	if err != nil {
+		return types.Hash{}, err
+	}
 
-		// Create parent reference using first key of the chunk
-		ref := types.ChildRef{
+	// Create parent references using first key of each chunk
+	parentRefs := make([]types.ChildRef, len(internalChunks))
+	for i, chunk := range internalChunks {
+		parentRefs[i] = types.ChildRef{
 			Key:  chunk[0].Key,
-			Hash: hash,
+			Hash: hashes[i],
+		}
+		for _, child := range chunk {
+			parentRefs[i].Count += child.Count
 		}
-		parentRefs = append(parentRefs, ref)
 	}
 
 	// Recurse to build next layer
-	return b.buildInternalLayers(parentRefs)
+	return b.buildInternalLayers(ctx, parentRefs)
 }
 
 // chunkChildRefs chunks child references using the same rolling hash approach
@@ -139,14 +237,41 @@ func (b *TreeBuilder) chunkChildRefs(refs []types.ChildRef) [][]types.ChildRef {
 	return result
 }
 
-// storeNode serializes a node and stores it in CAS, returning its hash
-func (b *TreeBuilder) storeNode(node types.Node) (types.Hash, error) {
-	// Serialize the node
-	data, err := node.Serialize()
-	if err != nil {
-		return types.Hash{}, err
+// storeNodes serializes one tree level and stores it in CAS using WriteMany,
+// returning the node hashes in order. Large levels are written in batches of
+// writeBatchSize nodes so the serialized level is never held in memory at once.
+func (b *TreeBuilder) storeNodes(ctx context.Context, nodes []types.Node) ([]types.Hash, error) {
+	hashes := make([]types.Hash, 0, len(nodes))
+
+	for start := 0; start < len(nodes); start += writeBatchSize {
+		end := min(start+writeBatchSize, len(nodes))
+
+		data := make([][]byte, 0, end-start)
+		for _, node := range nodes[start:end] {
+			serialized, err := node.Serialize()
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, serialized)
+		}
+
+		// Store in CAS - this computes SHA-256 hashes (Requirement 3.2)
+		batch, err := b.cas.WriteMany(ctx, data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Cache deserialized copies: the nodes themselves share memory with the caller's pairs
+		if b.cache != nil {
+			for i, d := range data {
+				if cached, err := DeserializeNode(d); err == nil {
+					b.cache.Add(batch[i], cached, len(d))
+				}
+			}
+		}
+
+		hashes = append(hashes, batch...)
 	}
 
-	// Store in CAS - this computes SHA-256 hash (Requirement 3.2)
-	return b.cas.Write(data)
+	return hashes, nil
 }
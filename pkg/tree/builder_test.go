@@ -1,6 +1,8 @@
 package tree
 
 import (
+	"fmt"
+	"math/rand"
 	"os"
 	"sort"
 	"testing"
@@ -101,3 +103,86 @@ func TestProperty_TreeConstructionDeterminism(t *testing.T) {
 		}
 	})
 }
+
+// treeLevels returns the number of levels in the tree rooted at root
+func treeLevels(t *testing.T, loader nodeLoader, root types.Hash) int {
+	levels := 1
+	node, err := loader.load(root)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	for !node.IsLeaf() {
+		if node, err = loader.load(node.(*types.InternalNode).Children[0].Hash); err != nil {
+			t.Fatalf("load failed: %v", err)
+		}
+		levels++
+	}
+	return levels
+}
+
+// countValueUpdateRewrites builds a tree, then rebuilds it once per update
+// with a single value changed, and returns the total number of nodes each
+// rebuild wrote along with the tree height
+func countValueUpdateRewrites(t *testing.T, c chunker.Chunker, pairs []types.KVPair, updates []types.KVPair) (int, int) {
+	store := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(store, c)
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	levels := treeLevels(t, newNodeLoader(store, nil), root)
+
+	total := 0
+	for _, update := range updates {
+		updated := make([]types.KVPair, len(pairs))
+		copy(updated, pairs)
+		i := sort.Search(len(updated), func(i int) bool { return string(updated[i].Key) >= string(update.Key) })
+		updated[i] = update
+
+		before := store.Len()
+		if _, err := builder.Build(updated); err != nil {
+			t.Fatalf("Build failed: %v", err)
+		}
+		total += store.Len() - before
+	}
+	return total, levels
+}
+
+// TestKeyHashChunker_ValueUpdateRewritesOnePath tests that with key-only
+// boundaries a value update writes exactly one new node per level, and
+// measures the Buzhash chunker on the same updates for comparison
+func TestKeyHashChunker_ValueUpdateRewritesOnePath(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	pairs := make([]types.KVPair, 5000)
+	for i := range pairs {
+		value := make([]byte, 20+rng.Intn(80))
+		rng.Read(value)
+		pairs[i] = types.KVPair{Key: []byte(fmt.Sprintf("key%06d", i)), Value: value}
+	}
+
+	updates := make([]types.KVPair, 50)
+	for i := range updates {
+		value := make([]byte, 1+rng.Intn(200))
+		rng.Read(value)
+		updates[i] = types.KVPair{Key: pairs[rng.Intn(len(pairs))].Key, Value: value}
+	}
+
+	keyHashTotal, levels := countValueUpdateRewrites(t, chunker.NewKeyHashChunker(256, 64, 1024), pairs, updates)
+	if levels < 3 {
+		t.Fatalf("expected a tree with at least 3 levels, got %d", levels)
+	}
+	if keyHashTotal != levels*len(updates) {
+		t.Errorf("key-hash chunker wrote %d nodes for %d updates, expected %d per update",
+			keyHashTotal, len(updates), levels)
+	}
+
+	// Buzhash always rewrites the path too; anything beyond it is leaves
+	// and ancestors reshaped by moved boundaries
+	buzhashTotal, buzhashLevels := countValueUpdateRewrites(t, chunker.NewBuzhashChunker(1024, 256, 4096), pairs, updates)
+	if buzhashTotal < buzhashLevels*len(updates) {
+		t.Errorf("buzhash chunker wrote %d nodes, fewer than one per level", buzhashTotal)
+	}
+	t.Logf("nodes written beyond the updated path per value update: key-hash %.2f, buzhash %.2f",
+		float64(keyHashTotal-levels*len(updates))/float64(len(updates)),
+		float64(buzhashTotal-buzhashLevels*len(updates))/float64(len(updates)))
+}
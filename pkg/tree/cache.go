@@ -0,0 +1,221 @@
+package tree
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/types"
+)
+
+const (
+	// DefaultNodeCacheSize is the default byte budget for a NodeCache (64 MiB)
+	DefaultNodeCacheSize = 64 << 20
+
+	// nodeEntryOverhead approximates the in-memory cost of a cached node
+	// beyond its serialized size (map entry, list element, slice headers)
+	nodeEntryOverhead = 128
+	// pairOverhead approximates the per-pair or per-child slice header cost
+	pairOverhead = 48
+)
+
+// CacheStats reports NodeCache usage
+type CacheStats struct {
+	Hits      uint64 // Lookups served from the cache
+	Misses    uint64 // Lookups that had to read from CAS
+	Evictions uint64 // Nodes dropped to stay within the byte budget
+	Entries   int    // Nodes currently cached
+	Bytes     int64  // Estimated bytes currently cached
+	MaxBytes  int64  // Byte budget
+}
+
+// NodeCache is a bounded, byte-budgeted LRU cache of deserialized nodes keyed by hash.
+// Nodes are immutable by hash, so entries never need invalidation.
+// Cached nodes are shared between callers and must not be modified.
+// A NodeCache is safe for concurrent use.
+type NodeCache struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	usedBytes int64
+	lru       *list.List // front = most recently used
+	items     map[types.Hash]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// cacheEntry is the value stored in each LRU list element
+type cacheEntry struct {
+	hash types.Hash
+	node types.Node
+	size int64
+}
+
+// NewNodeCache creates a NodeCache holding at most maxBytes of nodes
+func NewNodeCache(maxBytes int64) *NodeCache {
+	return &NodeCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[types.Hash]*list.Element),
+	}
+}
+
+// Get returns the cached node for hash, recording a hit or miss
+func (c *NodeCache) Get(hash types.Hash) (types.Node, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[hash]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).node, true
+}
+
+// Add caches a node, evicting least recently used nodes to stay within budget.
+// size is the node's serialized length; nodes larger than the whole budget are not cached.
+func (c *NodeCache) Add(hash types.Hash, node types.Node, size int) {
+	cost := estimateNodeCost(node, size)
+	if cost > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[hash]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.items[hash] = c.lru.PushFront(&cacheEntry{hash: hash, node: node, size: cost})
+	c.usedBytes += cost
+
+	for c.usedBytes > c.maxBytes {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.items, entry.hash)
+		c.usedBytes -= entry.size
+		c.evictions++
+	}
+}
+
+// Stats returns a snapshot of cache statistics
+func (c *NodeCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.items),
+		Bytes:     c.usedBytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
+
+// estimateNodeCost approximates the memory held by a deserialized node
+func estimateNodeCost(node types.Node, size int) int64 {
+	entries := 0
+	switch n := node.(type) {
+	case *types.LeafNode:
+		entries = len(n.Pairs)
+	case *types.InternalNode:
+		entries = len(n.Children)
+	}
+	return int64(nodeEntryOverhead + size + entries*pairOverhead)
+}
+
+// nodeLoader reads and deserializes nodes, going through an optional cache
+type nodeLoader struct {
+	cas   cas.BatchCAS
+	cache *NodeCache
+}
+
+// newNodeLoader creates a nodeLoader, adapting c to batch operations if needed
+func newNodeLoader(c cas.CAS, cache *NodeCache) nodeLoader {
+	return nodeLoader{cas: cas.AsBatch(c), cache: cache}
+}
+
+// load returns the node stored under hash
+func (l nodeLoader) load(hash types.Hash) (types.Node, error) {
+	return l.loadContext(context.Background(), hash)
+}
+
+// loadContext returns the node stored under hash, honouring cancellation.
+// The zero hash names the empty tree, which is read without being stored.
+func (l nodeLoader) loadContext(ctx context.Context, hash types.Hash) (types.Node, error) {
+	if hash == (types.Hash{}) {
+		return &types.LeafNode{}, nil
+	}
+	if l.cache != nil {
+		if node, ok := l.cache.Get(hash); ok {
+			return node, nil
+		}
+	}
+
+	data, err := l.cas.ReadContext(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return l.decode(hash, data)
+}
+
+// loadMany returns the nodes stored under hashes, in order.
+// Cache misses are fetched from the CAS with a single ReadMany call.
+func (l nodeLoader) loadMany(ctx context.Context, hashes []types.Hash) ([]types.Node, error) {
+	nodes := make([]types.Node, len(hashes))
+
+	var missing []types.Hash
+	var missingIdx []int
+	for i, h := range hashes {
+		if h == (types.Hash{}) {
+			nodes[i] = &types.LeafNode{}
+			continue
+		}
+		if l.cache != nil {
+			if node, ok := l.cache.Get(h); ok {
+				nodes[i] = node
+				continue
+			}
+		}
+		missing = append(missing, h)
+		missingIdx = append(missingIdx, i)
+	}
+
+	if len(missing) == 0 {
+		return nodes, nil
+	}
+
+	data, err := l.cas.ReadMany(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for j, d := range data {
+		node, err := l.decode(missing[j], d)
+		if err != nil {
+			return nil, err
+		}
+		nodes[missingIdx[j]] = node
+	}
+	return nodes, nil
+}
+
+// decode deserializes node data and adds the result to the cache
+func (l nodeLoader) decode(hash types.Hash, data []byte) (types.Node, error) {
+	node, err := DeserializeNode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.cache != nil {
+		l.cache.Add(hash, node, len(data))
+	}
+	return node, nil
+}
@@ -0,0 +1,154 @@
+package tree
+
+import (
+	"fmt"
+	"testing"
+
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+)
+
+// countingCAS wraps memoryCAS and counts reads
+type countingCAS struct {
+	*memoryCAS
+	reads int
+}
+
+func (c *countingCAS) Read(hash types.Hash) ([]byte, error) {
+	c.reads++
+	return c.memoryCAS.Read(hash)
+}
+
+// buildTestTree builds a tree of count sequential keys and returns its root
+func buildTestTree(t *testing.T, builder *TreeBuilder, count int) types.Hash {
+	pairs := make([]types.KVPair, count)
+	for i := range pairs {
+		pairs[i] = types.KVPair{
+			Key:   []byte(fmt.Sprintf("key-%05d", i)),
+			Value: []byte(fmt.Sprintf("value-%d", i)),
+		}
+	}
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	return root
+}
+
+// TestNodeCache_RepeatedGetsHitCache tests that repeated lookups are served
+// from the cache instead of the CAS
+func TestNodeCache_RepeatedGetsHitCache(t *testing.T) {
+	storage := &countingCAS{memoryCAS: newMemoryCAS()}
+	c := chunker.NewBuzhashChunker(64, 16, 256)
+	root := buildTestTree(t, NewTreeBuilder(storage, c), 500)
+
+	cache := NewNodeCache(DefaultNodeCacheSize)
+	traverser := NewTreeTraverserWithCache(storage, cache)
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i += 7 {
+			if _, err := traverser.Get(root, []byte(fmt.Sprintf("key-%05d", i))); err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+		}
+		if round == 0 {
+			storage.reads = 0
+		}
+	}
+
+	if storage.reads != 0 {
+		t.Fatalf("Expected warm lookups to skip CAS, got %d reads", storage.reads)
+	}
+	stats := cache.Stats()
+	if stats.Hits == 0 || stats.Misses == 0 || stats.Entries == 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestNodeCache_SharedWithBuilderAndDiffer tests that nodes written by the
+// builder are served to the diff engine without CAS reads
+func TestNodeCache_SharedWithBuilderAndDiffer(t *testing.T) {
+	storage := &countingCAS{memoryCAS: newMemoryCAS()}
+	c := chunker.NewBuzhashChunker(64, 16, 256)
+	cache := NewNodeCache(DefaultNodeCacheSize)
+	builder := NewTreeBuilderWithCache(storage, c, cache)
+
+	rootA := buildTestTree(t, builder, 300)
+	rootB, err := builder.Build([]types.KVPair{{Key: []byte("other"), Value: []byte("x")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	differ := NewDiffEngineWithCache(storage, cache)
+	result, err := differ.Diff(rootA, rootB)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(result.Added) != 1 || len(result.Deleted) != 300 {
+		t.Fatalf("Unexpected diff: %d added, %d deleted", len(result.Added), len(result.Deleted))
+	}
+	if storage.reads != 0 {
+		t.Fatalf("Expected diff to be served from cache, got %d reads", storage.reads)
+	}
+}
+
+// TestNodeCache_ByteBudgetEviction tests that the cache never exceeds its budget
+// and evicts least recently used nodes first
+func TestNodeCache_ByteBudgetEviction(t *testing.T) {
+	leaf := func(i int) *types.LeafNode {
+		return &types.LeafNode{Pairs: []types.KVPair{{Key: []byte(fmt.Sprintf("k%d", i)), Value: make([]byte, 100)}}}
+	}
+	cost := estimateNodeCost(leaf(0), 100)
+	cache := NewNodeCache(cost * 3)
+
+	hashes := make([]types.Hash, 4)
+	for i := 0; i < 3; i++ {
+		hashes[i] = types.HashFromBytes([]byte{byte(i)})
+		cache.Add(hashes[i], leaf(i), 100)
+	}
+
+	// Touch the oldest entry so the second one becomes least recently used
+	if _, ok := cache.Get(hashes[0]); !ok {
+		t.Fatal("Expected hit for first entry")
+	}
+
+	hashes[3] = types.HashFromBytes([]byte{3})
+	cache.Add(hashes[3], leaf(3), 100)
+
+	if _, ok := cache.Get(hashes[1]); ok {
+		t.Fatal("Least recently used entry was not evicted")
+	}
+	if _, ok := cache.Get(hashes[0]); !ok {
+		t.Fatal("Recently used entry was evicted")
+	}
+
+	stats := cache.Stats()
+	if stats.Bytes > stats.MaxBytes || stats.Evictions != 1 || stats.Entries != 3 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Nodes larger than the budget are never cached
+	big := &types.LeafNode{Pairs: []types.KVPair{{Key: []byte("big"), Value: make([]byte, 4096)}}}
+	cache.Add(types.HashFromBytes([]byte("big")), big, 4096)
+	if cache.Stats().Entries != 3 {
+		t.Fatal("Oversized node was cached")
+	}
+}
+
+// TestNodeCache_ReturnedValuesAreCopies tests that callers cannot corrupt cached nodes
+func TestNodeCache_ReturnedValuesAreCopies(t *testing.T) {
+	storage := newMemoryCAS()
+	c := chunker.NewBuzhashChunker(64, 16, 256)
+	root := buildTestTree(t, NewTreeBuilder(storage, c), 50)
+	traverser := NewTreeTraverserWithCache(storage, NewNodeCache(DefaultNodeCacheSize))
+
+	value, _ := traverser.Get(root, []byte("key-00010"))
+	value[0] = 'X'
+	all, _ := traverser.GetAll(root)
+	all[10].Value[1] = 'Y'
+
+	again, err := traverser.Get(root, []byte("key-00010"))
+	if err != nil || string(again) != "value-10" {
+		t.Fatalf("Cached node was mutated: %q, %v", again, err)
+	}
+}
@@ -0,0 +1,113 @@
+package tree
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+)
+
+// batchCountingCAS records how many batched and single reads were issued
+type batchCountingCAS struct {
+	*cas.MemoryCAS
+	singleReads int
+	batchReads  int
+	batchWrites int
+}
+
+func (c *batchCountingCAS) Read(hash types.Hash) ([]byte, error) {
+	c.singleReads++
+	return c.MemoryCAS.Read(hash)
+}
+
+func (c *batchCountingCAS) ReadContext(ctx context.Context, hash types.Hash) ([]byte, error) {
+	c.singleReads++
+	return c.MemoryCAS.ReadContext(ctx, hash)
+}
+
+func (c *batchCountingCAS) ReadMany(ctx context.Context, hashes []types.Hash) ([][]byte, error) {
+	c.batchReads++
+	return c.MemoryCAS.ReadMany(ctx, hashes)
+}
+
+func (c *batchCountingCAS) WriteMany(ctx context.Context, data [][]byte) ([]types.Hash, error) {
+	c.batchWrites++
+	return c.MemoryCAS.WriteMany(ctx, data)
+}
+
+// sequentialPairs returns count pairs with ordered keys
+func sequentialPairs(count int, valuePrefix string) []types.KVPair {
+	pairs := make([]types.KVPair, count)
+	for i := range pairs {
+		pairs[i] = types.KVPair{
+			Key:   []byte(fmt.Sprintf("key-%06d", i)),
+			Value: []byte(fmt.Sprintf("%s-%d", valuePrefix, i)),
+		}
+	}
+	return pairs
+}
+
+// TestBatchedTreeOperations tests that the builder writes and the traverser
+// reads whole tree levels through batch calls
+func TestBatchedTreeOperations(t *testing.T) {
+	storage := &batchCountingCAS{MemoryCAS: cas.NewMemoryCAS()}
+	c := chunker.NewBuzhashChunker(64, 16, 256)
+	builder := NewTreeBuilder(storage, c)
+
+	root, err := builder.Build(sequentialPairs(2000, "v"))
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if storage.batchWrites == 0 {
+		t.Fatal("Builder did not use WriteMany")
+	}
+
+	traverser := NewTreeTraverser(storage)
+	pairs, err := traverser.GetAll(root)
+	if err != nil {
+		t.Fatalf("GetAll failed: %v", err)
+	}
+	if len(pairs) != 2000 {
+		t.Fatalf("GetAll returned %d pairs, want 2000", len(pairs))
+	}
+	if storage.singleReads != 1 || storage.batchReads == 0 {
+		t.Fatalf("Expected one root read and batched child reads, got %d single and %d batch",
+			storage.singleReads, storage.batchReads)
+	}
+}
+
+// TestContextCancellation tests that Build, GetAll and Diff stop when the
+// context is cancelled
+func TestContextCancellation(t *testing.T) {
+	storage := cas.NewMemoryCAS()
+	c := chunker.NewBuzhashChunker(64, 16, 256)
+	builder := NewTreeBuilder(storage, c)
+
+	rootA, err := builder.Build(sequentialPairs(1000, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootB, err := builder.Build(sequentialPairs(1000, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := builder.BuildContext(ctx, sequentialPairs(1000, "c")); err != context.Canceled {
+		t.Fatalf("BuildContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := NewTreeTraverser(storage).GetAllContext(ctx, rootA); err != context.Canceled {
+		t.Fatalf("GetAllContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := NewTreeTraverser(storage).GetContext(ctx, rootA, []byte("key-000001")); err != context.Canceled {
+		t.Fatalf("GetContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := NewDiffEngine(storage).DiffContext(ctx, rootA, rootB); err != context.Canceled {
+		t.Fatalf("DiffContext: expected context.Canceled, got %v", err)
+	}
+}
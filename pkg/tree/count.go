@@ -0,0 +1,160 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"microprolly/pkg/types"
+)
+
+var (
+	// ErrIndexOutOfRange is returned by GetByIndex for an index past the last key
+	ErrIndexOutOfRange = errors.New("index out of range")
+)
+
+// Count returns the number of keys in the tree. Trees whose internal nodes
+// record subtree counts are counted in O(1) node loads; subtrees written
+// without counts are walked.
+func (t *TreeTraverser) Count(rootHash types.Hash) (uint64, error) {
+	ctx := context.Background()
+	node, err := t.loader.loadContext(ctx, rootHash)
+	if err != nil {
+		return 0, err
+	}
+	return t.countNode(ctx, node)
+}
+
+// CountRange returns the number of keys with start <= key < end. A nil end
+// is unbounded. It loads O(log n) nodes.
+func (t *TreeTraverser) CountRange(rootHash types.Hash, start, end []byte) (uint64, error) {
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, nil
+	}
+
+	below, err := t.Rank(rootHash, start)
+	if err != nil {
+		return 0, err
+	}
+	var upTo uint64
+	if end == nil {
+		upTo, err = t.Count(rootHash)
+	} else {
+		upTo, err = t.Rank(rootHash, end)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return upTo - below, nil
+}
+
+// Rank returns the number of keys less than key, which is the index of key
+// if it is present. It loads O(log n) nodes.
+func (t *TreeTraverser) Rank(rootHash types.Hash, key []byte) (uint64, error) {
+	ctx := context.Background()
+	node, err := t.loader.loadContext(ctx, rootHash)
+	if err != nil {
+		return 0, err
+	}
+
+	var rank uint64
+	for !node.IsLeaf() {
+		children := node.(*types.InternalNode).Children
+		i := findChildIndex(children, key)
+		for _, child := range children[:i] {
+			count, err := t.subtreeCount(ctx, child)
+			if err != nil {
+				return 0, err
+			}
+			rank += count
+		}
+
+		node, err = t.loader.loadContext(ctx, children[i].Hash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	pairs := node.(*types.LeafNode).Pairs
+	return rank + uint64(sort.Search(len(pairs), func(i int) bool {
+		return bytes.Compare(pairs[i].Key, key) >= 0
+	})), nil
+}
+
+// GetByIndex returns the pair at position index in key order, with its
+// value resolved. It loads O(log n) nodes, so callers can page by offset.
+func (t *TreeTraverser) GetByIndex(rootHash types.Hash, index uint64) (types.KVPair, error) {
+	ctx := context.Background()
+	node, err := t.loader.loadContext(ctx, rootHash)
+	if err != nil {
+		return types.KVPair{}, err
+	}
+
+	remaining := index
+	for !node.IsLeaf() {
+		children := node.(*types.InternalNode).Children
+		next := -1
+		for i, child := range children {
+			count, err := t.subtreeCount(ctx, child)
+			if err != nil {
+				return types.KVPair{}, err
+			}
+			if remaining < count {
+				next = i
+				break
+			}
+			remaining -= count
+		}
+		if next < 0 {
+			return types.KVPair{}, fmt.Errorf("%w: %d", ErrIndexOutOfRange, index)
+		}
+
+		node, err = t.loader.loadContext(ctx, children[next].Hash)
+		if err != nil {
+			return types.KVPair{}, err
+		}
+	}
+
+	pairs := node.(*types.LeafNode).Pairs
+	if remaining >= uint64(len(pairs)) {
+		return types.KVPair{}, fmt.Errorf("%w: %d", ErrIndexOutOfRange, index)
+	}
+	pair := pairs[remaining]
+	value, err := resolveValue(ctx, t.loader.cas, pair)
+	if err != nil {
+		return types.KVPair{}, err
+	}
+	return types.KVPair{Key: copyBytes(pair.Key), Value: value}, nil
+}
+
+// subtreeCount returns the number of keys under child, walking the subtree
+// if its parent was written without counts
+func (t *TreeTraverser) subtreeCount(ctx context.Context, child types.ChildRef) (uint64, error) {
+	if child.Count > 0 {
+		return child.Count, nil
+	}
+	node, err := t.loader.loadContext(ctx, child.Hash)
+	if err != nil {
+		return 0, err
+	}
+	return t.countNode(ctx, node)
+}
+
+// countNode returns the number of keys under node
+func (t *TreeTraverser) countNode(ctx context.Context, node types.Node) (uint64, error) {
+	if node.IsLeaf() {
+		return uint64(len(node.(*types.LeafNode).Pairs)), nil
+	}
+
+	var total uint64
+	for _, child := range node.(*types.InternalNode).Children {
+		count, err := t.subtreeCount(ctx, child)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
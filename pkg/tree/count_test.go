@@ -0,0 +1,137 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// TestCount_SerializesSubtreeCounts checks that internal nodes with counts
+// use the counted format and round-trip, and nodes without keep the old one
+func TestCount_SerializesSubtreeCounts(t *testing.T) {
+	node := &types.InternalNode{Children: []types.ChildRef{
+		{Key: []byte("a"), Hash: types.Hash{1}, Count: 10},
+		{Key: []byte("m"), Hash: types.Hash{2}, Count: 1 << 40},
+	}}
+	data, err := SerializeInternalNode(node)
+	if err != nil {
+		t.Fatalf("SerializeInternalNode failed: %v", err)
+	}
+	if data[0] != nodeTypeInternalCounted {
+		t.Errorf("node type %#x, expected %#x", data[0], nodeTypeInternalCounted)
+	}
+	decoded, err := DeserializeNode(data)
+	if err != nil {
+		t.Fatalf("DeserializeNode failed: %v", err)
+	}
+	children := decoded.(*types.InternalNode).Children
+	if children[0].Count != 10 || children[1].Count != 1<<40 {
+		t.Errorf("counts decoded as %d, %d", children[0].Count, children[1].Count)
+	}
+
+	node.Children[1].Count = 0
+	data, err = SerializeInternalNode(node)
+	if err != nil {
+		t.Fatalf("SerializeInternalNode failed: %v", err)
+	}
+	if data[0] != nodeTypeInternal {
+		t.Errorf("node type %#x, expected %#x for a node without counts", data[0], nodeTypeInternal)
+	}
+}
+
+// TestCount_GetByIndexOutOfRange checks the error past the last key
+func TestCount_GetByIndexOutOfRange(t *testing.T) {
+	store, root, pairs := buildProofTree(t, 300)
+	traverser := NewTreeTraverser(store)
+
+	if _, err := traverser.GetByIndex(root, uint64(len(pairs))); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Errorf("expected ErrIndexOutOfRange, got %v", err)
+	}
+
+	empty, err := NewTreeBuilder(store, chunker.DefaultChunker()).Build(nil)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if count, err := traverser.Count(empty); err != nil || count != 0 {
+		t.Errorf("Count(empty) = %d, %v", count, err)
+	}
+	if _, err := traverser.GetByIndex(empty, 0); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Errorf("expected ErrIndexOutOfRange, got %v", err)
+	}
+}
+
+// TestProperty_CountQueries checks Count, Rank, CountRange and GetByIndex
+// against the sorted pairs, for trees built with and without subtree counts
+func TestProperty_CountQueries(t *testing.T) {
+	rapid.Check(t, func(rt *rapid.T) {
+		store := cas.NewMemoryCAS()
+		builder := NewTreeBuilder(store, chunker.NewBuzhashChunker(128, 32, 512))
+		builder.SetBlobThreshold(32)
+		builder.SetSubtreeCounts(rapid.Bool().Draw(rt, "counts"))
+		traverser := NewTreeTraverser(store)
+
+		keys := rapid.SliceOfNDistinct(rapid.IntRange(0, 9999), 0, 500, rapid.ID[int]).Draw(rt, "keys")
+		sort.Ints(keys)
+		pairs := make([]types.KVPair, len(keys))
+		for i, k := range keys {
+			pairs[i] = types.KVPair{
+				Key:   []byte(fmt.Sprintf("k%04d", k)),
+				Value: bytes.Repeat([]byte{byte(k)}, k%50),
+			}
+		}
+		root, err := builder.Build(pairs)
+		if err != nil {
+			rt.Fatalf("Build failed: %v", err)
+		}
+
+		count, err := traverser.Count(root)
+		if err != nil || count != uint64(len(pairs)) {
+			rt.Fatalf("Count() = %d, %v; want %d", count, err, len(pairs))
+		}
+
+		rank := func(key []byte) uint64 {
+			return uint64(sort.Search(len(pairs), func(i int) bool {
+				return bytes.Compare(pairs[i].Key, key) >= 0
+			}))
+		}
+		start := []byte(fmt.Sprintf("k%04d", rapid.IntRange(0, 9999).Draw(rt, "start")))
+		end := []byte(fmt.Sprintf("k%04d", rapid.IntRange(0, 9999).Draw(rt, "end")))
+
+		got, err := traverser.Rank(root, start)
+		if err != nil || got != rank(start) {
+			rt.Fatalf("Rank(%q) = %d, %v; want %d", start, got, err, rank(start))
+		}
+
+		want := uint64(0)
+		if rank(end) > rank(start) {
+			want = rank(end) - rank(start)
+		}
+		got, err = traverser.CountRange(root, start, end)
+		if err != nil || got != want {
+			rt.Fatalf("CountRange(%q, %q) = %d, %v; want %d", start, end, got, err, want)
+		}
+		got, err = traverser.CountRange(root, start, nil)
+		if err != nil || got != uint64(len(pairs))-rank(start) {
+			rt.Fatalf("CountRange(%q, nil) = %d, %v; want %d", start, got, err, uint64(len(pairs))-rank(start))
+		}
+
+		if len(pairs) > 0 {
+			i := rapid.IntRange(0, len(pairs)-1).Draw(rt, "index")
+			pair, err := traverser.GetByIndex(root, uint64(i))
+			if err != nil {
+				rt.Fatalf("GetByIndex(%d) failed: %v", i, err)
+			}
+			if !bytes.Equal(pair.Key, pairs[i].Key) || !bytes.Equal(pair.Value, pairs[i].Value) {
+				rt.Fatalf("GetByIndex(%d) = %q, want %q", i, pair.Key, pairs[i].Key)
+			}
+		}
+	})
+}
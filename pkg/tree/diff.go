@@ -2,6 +2,8 @@ package tree
 
 import (
 	"bytes"
+	"context"
+	"sync/atomic"
 
 	"microprolly/pkg/cas"
 	"microprolly/pkg/types"
@@ -23,12 +25,69 @@ type ModifiedPair struct {
 
 // DiffEngine computes differences between tree versions
 type DiffEngine struct {
-	cas cas.CAS
+	cas     cas.CAS
+	loader  nodeLoader
+	workers int // concurrent partition walks, <= 1 = sequential
 }
 
 // NewDiffEngine creates a new DiffEngine with the given CAS
 func NewDiffEngine(cas cas.CAS) *DiffEngine {
-	return &DiffEngine{cas: cas}
+	return NewDiffEngineWithCache(cas, nil)
+}
+
+// NewDiffEngineWithCache creates a new DiffEngine that loads nodes
+// through the given cache. A nil cache disables caching.
+func NewDiffEngineWithCache(cas cas.CAS, cache *NodeCache) *DiffEngine {
+	return &DiffEngine{
+		cas:    cas,
+		loader: newNodeLoader(cas, cache),
+	}
+}
+
+// DiffKind identifies the kind of change a DiffEntry describes
+type DiffKind int
+
+const (
+	// DiffAdded means the key is present in B but not A
+	DiffAdded DiffKind = iota
+	// DiffModified means the key is present in both with different values
+	DiffModified
+	// DiffDeleted means the key is present in A but not B
+	DiffDeleted
+)
+
+// String returns a human-readable name for the diff kind
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffModified:
+		return "modified"
+	case DiffDeleted:
+		return "deleted"
+	default:
+		return "unknown"
+	}
+}
+
+// DiffEntry is a single change emitted by DiffStream.
+// OldValue is nil for added keys and NewValue is nil for deleted keys.
+type DiffEntry struct {
+	Kind     DiffKind
+	Key      []byte
+	OldValue []byte
+	NewValue []byte
+}
+
+// DiffOptions restricts a diff to part of the key space.
+// Only subtrees intersecting the range are visited.
+type DiffOptions struct {
+	// Start is the inclusive lower bound (nil = unbounded)
+	Start []byte
+	// End is the exclusive upper bound (nil = unbounded)
+	End []byte
+	// Prefix, if set, further restricts the diff to keys with this prefix
+	Prefix []byte
 }
 
 // Diff returns changes between two tree roots.
@@ -38,245 +97,433 @@ func NewDiffEngine(cas cas.CAS) *DiffEngine {
 // - Skips subtrees with matching hashes
 // - Recursively compares only differing subtrees
 func (d *DiffEngine) Diff(hashA, hashB types.Hash) (DiffResult, error) {
+	return d.DiffContext(context.Background(), hashA, hashB)
+}
+
+// DiffContext is Diff with cancellation. Differing children of aligned
+// internal nodes are fetched with one batched read per tree level, and ctx
+// is checked before every node load.
+func (d *DiffEngine) DiffContext(ctx context.Context, hashA, hashB types.Hash) (DiffResult, error) {
 	result := DiffResult{
 		Added:    []types.KVPair{},
 		Modified: []ModifiedPair{},
 		Deleted:  [][]byte{},
 	}
 
+	_, err := d.walk(ctx, hashA, hashB, DiffOptions{}, func(kind DiffKind, oldPair, newPair types.KVPair) error {
+		switch kind {
+		case DiffAdded:
+			value, err := resolveValue(ctx, d.loader.cas, newPair)
+			if err != nil {
+				return err
+			}
+			result.Added = append(result.Added, types.KVPair{Key: copyBytes(newPair.Key), Value: value})
+		case DiffModified:
+			entry, err := d.resolveEntry(ctx, kind, oldPair, newPair)
+			if err != nil {
+				return err
+			}
+			result.Modified = append(result.Modified, ModifiedPair{
+				Key:      entry.Key,
+				OldValue: entry.OldValue,
+				NewValue: entry.NewValue,
+			})
+		case DiffDeleted:
+			result.Deleted = append(result.Deleted, copyBytes(oldPair.Key))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// DiffStream walks the differences between two tree roots and calls fn for
+// each change in ascending key order, without materializing a DiffResult.
+// If fn returns an error the walk stops and that error is returned.
+func (d *DiffEngine) DiffStream(hashA, hashB types.Hash, fn func(DiffEntry) error) error {
+	return d.DiffStreamContext(context.Background(), hashA, hashB, DiffOptions{}, fn)
+}
+
+// DiffStreamContext is DiffStream with cancellation and an optional key range.
+// Subtrees entirely outside the range are never loaded.
+func (d *DiffEngine) DiffStreamContext(ctx context.Context, hashA, hashB types.Hash, opts DiffOptions, fn func(DiffEntry) error) error {
+	_, err := d.walk(ctx, hashA, hashB, opts, func(kind DiffKind, oldPair, newPair types.KVPair) error {
+		entry, err := d.resolveEntry(ctx, kind, oldPair, newPair)
+		if err != nil {
+			return err
+		}
+		return fn(entry)
+	})
+	return err
+}
+
+// resolveEntry builds a DiffEntry with copied keys and values, reading
+// values stored out of line from their blobs
+func (d *DiffEngine) resolveEntry(ctx context.Context, kind DiffKind, oldPair, newPair types.KVPair) (DiffEntry, error) {
+	entry := DiffEntry{Kind: kind}
+	var err error
+
+	if kind != DiffAdded {
+		entry.Key = copyBytes(oldPair.Key)
+		if entry.OldValue, err = resolveValue(ctx, d.loader.cas, oldPair); err != nil {
+			return DiffEntry{}, err
+		}
+	}
+	if kind != DiffDeleted {
+		entry.Key = copyBytes(newPair.Key)
+		if entry.NewValue, err = resolveValue(ctx, d.loader.cas, newPair); err != nil {
+			return DiffEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+// DiffStats summarizes the differences between two trees
+type DiffStats struct {
+	Added    int // Keys present in B but not A
+	Modified int // Keys with different values
+	Deleted  int // Keys present in A but not B
+
+	// BytesAdded counts key and value bytes only in B: added pairs plus
+	// the new values of modified keys
+	BytesAdded int64
+	// BytesDeleted counts key and value bytes only in A: deleted pairs plus
+	// the old values of modified keys
+	BytesDeleted int64
+
+	NodesVisited int // Nodes loaded during the walk, from cache or CAS
+}
+
+// DiffStats counts the differences between two tree roots without copying
+// any keys or values. Sizes of out-of-line values come from their blob
+// references, so blobs are never read.
+func (d *DiffEngine) DiffStats(hashA, hashB types.Hash) (DiffStats, error) {
+	return d.DiffStatsContext(context.Background(), hashA, hashB, DiffOptions{})
+}
+
+// DiffStatsContext is DiffStats with cancellation and an optional key range
+func (d *DiffEngine) DiffStatsContext(ctx context.Context, hashA, hashB types.Hash, opts DiffOptions) (DiffStats, error) {
+	var stats DiffStats
+	visited, err := d.walk(ctx, hashA, hashB, opts, func(kind DiffKind, oldPair, newPair types.KVPair) error {
+		switch kind {
+		case DiffAdded:
+			stats.Added++
+			stats.BytesAdded += int64(len(newPair.Key)) + valueSize(newPair)
+		case DiffModified:
+			stats.Modified++
+			stats.BytesAdded += valueSize(newPair)
+			stats.BytesDeleted += valueSize(oldPair)
+		case DiffDeleted:
+			stats.Deleted++
+			stats.BytesDeleted += int64(len(oldPair.Key)) + valueSize(oldPair)
+		}
+		return nil
+	})
+	stats.NodesVisited = visited
+	return stats, err
+}
+
+// diffEmitFunc receives each change found by a diff walk: the pair from A
+// (zero for added keys) and the pair from B (zero for deleted keys).
+// The pairs alias node memory, may hold blob references, and must be
+// copied if retained.
+type diffEmitFunc func(kind DiffKind, oldPair, newPair types.KVPair) error
+
+// diffWalker holds the state of a single diff walk
+type diffWalker struct {
+	ctx    context.Context
+	loader nodeLoader
+	start  []byte // inclusive lower bound, nil = unbounded
+	end    []byte // exclusive upper bound, nil = unbounded
+	emit   diffEmitFunc
+
+	// visited counts loaded nodes; shared by the partitions of a parallel walk
+	visited *atomic.Int64
+}
+
+// walk diffs two trees, restricted to opts, reporting changes to emit.
+// Returns the number of nodes visited.
+func (d *DiffEngine) walk(ctx context.Context, hashA, hashB types.Hash, opts DiffOptions, emit diffEmitFunc) (int, error) {
 	// Requirement 7.2: Early exit if identical root hashes
 	if hashA == hashB {
-		return result, nil
+		return 0, nil
+	}
+
+	start, end, ok := resolveRange(opts)
+	if !ok {
+		return 0, nil
+	}
+
+	w := &diffWalker{
+		ctx:     ctx,
+		loader:  d.loader,
+		start:   start,
+		end:     end,
+		emit:    emit,
+		visited: new(atomic.Int64),
 	}
 
+	var err error
+	if d.workers > 1 {
+		err = w.parallelDiff(hashA, hashB, d.workers)
+	} else {
+		err = w.run(hashA, hashB)
+	}
+	return int(w.visited.Load()), err
+}
+
+// load loads a single node, counting it as visited
+func (w *diffWalker) load(hash types.Hash) (types.Node, error) {
+	w.visited.Add(1)
+	return w.loader.loadContext(w.ctx, hash)
+}
+
+// loadMany loads nodes with one batched read, counting them as visited
+func (w *diffWalker) loadMany(hashes []types.Hash) ([]types.Node, error) {
+	w.visited.Add(int64(len(hashes)))
+	return w.loader.loadMany(w.ctx, hashes)
+}
+
+// run diffs the trees under hashA and hashB within the walker's range
+func (w *diffWalker) run(hashA, hashB types.Hash) error {
 	// Load both root nodes
-	nodeA, err := d.loadNode(hashA)
+	roots, err := w.loadMany([]types.Hash{hashA, hashB})
 	if err != nil {
-		return result, err
+		return err
 	}
 
-	nodeB, err := d.loadNode(hashB)
+	heightA, err := w.height(roots[0])
+	if err != nil {
+		return err
+	}
+	heightB, err := w.height(roots[1])
 	if err != nil {
-		return result, err
+		return err
 	}
 
 	// Recursively diff the trees
-	err = d.diffNodes(nodeA, nodeB, &result)
-	if err != nil {
-		return result, err
+	return w.diffNodes(roots[0], heightA, roots[1], heightB, nil)
+}
+
+// height returns the number of internal levels below and including node.
+// Trees are built bottom-up with uniform depth, so the leftmost path suffices.
+func (w *diffWalker) height(node types.Node) (int, error) {
+	h := 0
+	for !node.IsLeaf() {
+		internal := node.(*types.InternalNode)
+		if len(internal.Children) == 0 {
+			break
+		}
+		child, err := w.load(internal.Children[0].Hash)
+		if err != nil {
+			return 0, err
+		}
+		node = child
+		h++
+	}
+	return h, nil
+}
+
+// resolveRange combines the explicit bounds and the prefix into one range.
+// Returns ok=false if the range is empty.
+func resolveRange(opts DiffOptions) (start, end []byte, ok bool) {
+	start, end = opts.Start, opts.End
+
+	if len(opts.Prefix) > 0 {
+		if bytes.Compare(opts.Prefix, start) > 0 {
+			start = opts.Prefix
+		}
+		if prefixEnd := PrefixEnd(opts.Prefix); prefixEnd != nil && (end == nil || bytes.Compare(prefixEnd, end) < 0) {
+			end = prefixEnd
+		}
 	}
 
-	return result, nil
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, nil, false
+	}
+	return start, end, true
 }
 
-// loadNode loads a node from CAS by its hash
-func (d *DiffEngine) loadNode(hash types.Hash) (types.Node, error) {
-	data, err := d.cas.Read(hash)
-	if err != nil {
-		return nil, err
+// PrefixEnd returns the smallest key greater than every key with the given
+// prefix, or nil if no such key exists (the prefix is all 0xff bytes)
+func PrefixEnd(prefix []byte) []byte {
+	end := copyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// inRange reports whether key falls inside the walk's range
+func (w *diffWalker) inRange(key []byte) bool {
+	if bytes.Compare(key, w.start) < 0 {
+		return false
+	}
+	return w.end == nil || bytes.Compare(key, w.end) < 0
+}
+
+// intersects reports whether the key span [lo, hi) overlaps the walk's range.
+// hi == nil means the span is unbounded above.
+func (w *diffWalker) intersects(lo, hi []byte) bool {
+	if hi != nil && bytes.Compare(hi, w.start) <= 0 {
+		return false
 	}
-	return DeserializeNode(data)
+	return w.end == nil || bytes.Compare(lo, w.end) < 0
 }
 
-// diffNodes recursively compares two nodes and collects differences
-func (d *DiffEngine) diffNodes(nodeA, nodeB types.Node, result *DiffResult) error {
+// childUpperBound returns the exclusive upper key of children[i]'s subtree
+func childUpperBound(children []types.ChildRef, i int, parentHi []byte) []byte {
+	if i+1 < len(children) {
+		return children[i+1].Key
+	}
+	return parentHi
+}
+
+// diffNodes recursively compares two nodes covering keys below hi and emits differences.
+// heightA and heightB are the nodes' heights above the leaf level.
+func (w *diffWalker) diffNodes(nodeA types.Node, heightA int, nodeB types.Node, heightB int, hi []byte) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
 	// Both are leaf nodes - compare KV pairs directly
 	if nodeA.IsLeaf() && nodeB.IsLeaf() {
 		leafA := nodeA.(*types.LeafNode)
 		leafB := nodeB.(*types.LeafNode)
-		d.diffLeaves(leafA, leafB, result)
-		return nil
+		return w.diffPairLists(leafA.Pairs, leafB.Pairs)
 	}
 
-	// Both are internal nodes - compare children
+	// Both are internal nodes with aligned children - compare child by child
 	if !nodeA.IsLeaf() && !nodeB.IsLeaf() {
 		internalA := nodeA.(*types.InternalNode)
 		internalB := nodeB.(*types.InternalNode)
-		return d.diffInternalNodes(internalA, internalB, result)
-	}
-
-	// Mixed node types - collect all from both and diff
-	// This can happen when tree structure changes significantly
-	pairsA, err := d.collectAllPairs(nodeA)
-	if err != nil {
-		return err
-	}
-	pairsB, err := d.collectAllPairs(nodeB)
-	if err != nil {
-		return err
+		if childrenAligned(internalA.Children, internalB.Children) {
+			return w.diffAlignedChildren(internalA.Children, heightA-1, internalB.Children, heightB-1, hi)
+		}
 	}
-	d.diffPairLists(pairsA, pairsB, result)
-	return nil
-}
 
-// diffLeaves compares two leaf nodes and collects differences
-func (d *DiffEngine) diffLeaves(leafA, leafB *types.LeafNode, result *DiffResult) {
-	d.diffPairLists(leafA.Pairs, leafB.Pairs, result)
+	// Children don't align or the trees have different shapes - walk both
+	// in key order, skipping any subtrees whose hashes match
+	return w.cursorDiff(nodeA, heightA, nodeB, heightB, hi)
 }
 
-// diffPairLists compares two sorted lists of KV pairs
-func (d *DiffEngine) diffPairLists(pairsA, pairsB []types.KVPair, result *DiffResult) {
+// diffPairLists compares two sorted lists of KV pairs, emitting changes
+// for keys inside the walk's range
+func (w *diffWalker) diffPairLists(pairsA, pairsB []types.KVPair) error {
 	i, j := 0, 0
 
-	for i < len(pairsA) && j < len(pairsB) {
-		cmp := bytes.Compare(pairsA[i].Key, pairsB[j].Key)
+	for i < len(pairsA) || j < len(pairsB) {
+		var cmp int
+		switch {
+		case i == len(pairsA):
+			cmp = 1
+		case j == len(pairsB):
+			cmp = -1
+		default:
+			cmp = bytes.Compare(pairsA[i].Key, pairsB[j].Key)
+		}
 
+		var err error
 		if cmp < 0 {
 			// Key exists in A but not B - deleted
-			keyCopy := make([]byte, len(pairsA[i].Key))
-			copy(keyCopy, pairsA[i].Key)
-			result.Deleted = append(result.Deleted, keyCopy)
+			if w.inRange(pairsA[i].Key) {
+				err = w.emit(DiffDeleted, pairsA[i], types.KVPair{})
+			}
 			i++
 		} else if cmp > 0 {
 			// Key exists in B but not A - added
-			result.Added = append(result.Added, copyKVPair(pairsB[j]))
+			if w.inRange(pairsB[j].Key) {
+				err = w.emit(DiffAdded, types.KVPair{}, pairsB[j])
+			}
 			j++
 		} else {
 			// Same key - check if value changed
-			if !bytes.Equal(pairsA[i].Value, pairsB[j].Value) {
-				result.Modified = append(result.Modified, ModifiedPair{
-					Key:      copyBytes(pairsA[i].Key),
-					OldValue: copyBytes(pairsA[i].Value),
-					NewValue: copyBytes(pairsB[j].Value),
-				})
+			if w.inRange(pairsA[i].Key) {
+				err = w.emitIfChanged(pairsA[i], pairsB[j])
 			}
 			i++
 			j++
 		}
+		if err != nil {
+			return err
+		}
 	}
 
-	// Remaining in A are deleted
-	for ; i < len(pairsA); i++ {
-		keyCopy := make([]byte, len(pairsA[i].Key))
-		copy(keyCopy, pairsA[i].Key)
-		result.Deleted = append(result.Deleted, keyCopy)
-	}
-
-	// Remaining in B are added
-	for ; j < len(pairsB); j++ {
-		result.Added = append(result.Added, copyKVPair(pairsB[j]))
-	}
+	return nil
 }
 
-// diffInternalNodes compares two internal nodes
-// Requirement 7.3, 7.4: Skip matching subtrees, recursively compare differing ones
-//
-// The algorithm handles the complex case where tree structure changes due to
-// content-defined chunking. When a single key is added/deleted, chunk boundaries
-// may shift, causing children to have different starting keys.
-//
-// Strategy: We use a merge-like algorithm that tracks which key ranges have been
-// processed. When children align (same starting key), we can compare them directly.
-// When they don't align, we need to carefully track which ranges overlap.
-func (d *DiffEngine) diffInternalNodes(nodeA, nodeB *types.InternalNode, result *DiffResult) error {
-	childrenA := nodeA.Children
-	childrenB := nodeB.Children
-
-	// Build a list of all unique boundary keys from both trees
-	// This helps us understand the key space partitioning
-	allKeys := make(map[string]bool)
-	for _, c := range childrenA {
-		allKeys[string(c.Key)] = true
-	}
-	for _, c := range childrenB {
-		allKeys[string(c.Key)] = true
-	}
-
-	// If children align perfectly (same keys), use optimized path
-	if len(childrenA) == len(childrenB) {
-		aligned := true
-		for i := range childrenA {
-			if !bytes.Equal(childrenA[i].Key, childrenB[i].Key) {
-				aligned = false
-				break
-			}
-		}
-		if aligned {
-			return d.diffAlignedChildren(childrenA, childrenB, result)
+// emitIfChanged emits a modification if two pairs for the same key hold
+// different values. Identical encodings are equal without reading blobs;
+// an inline value and a blob reference are compared by content.
+func (w *diffWalker) emitIfChanged(a, b types.KVPair) error {
+	if a.ValueRef == b.ValueRef {
+		if bytes.Equal(a.Value, b.Value) {
+			return nil
 		}
+		return w.emit(DiffModified, a, b)
 	}
 
-	// Children don't align - fall back to collecting all pairs and comparing
-	// This is correct but less efficient for the misaligned case
-	pairsA, err := d.collectAllPairsFromChildren(childrenA)
+	valueA, err := resolveValue(w.ctx, w.loader.cas, a)
 	if err != nil {
 		return err
 	}
-	pairsB, err := d.collectAllPairsFromChildren(childrenB)
+	valueB, err := resolveValue(w.ctx, w.loader.cas, b)
 	if err != nil {
 		return err
 	}
-	d.diffPairLists(pairsA, pairsB, result)
-	return nil
+	if bytes.Equal(valueA, valueB) {
+		return nil
+	}
+	return w.emit(DiffModified, a, b)
 }
 
-// diffAlignedChildren handles the case where children have the same starting keys
-func (d *DiffEngine) diffAlignedChildren(childrenA, childrenB []types.ChildRef, result *DiffResult) error {
+// childrenAligned reports whether two child lists have the same starting keys
+func childrenAligned(childrenA, childrenB []types.ChildRef) bool {
+	if len(childrenA) != len(childrenB) {
+		return false
+	}
 	for i := range childrenA {
-		if childrenA[i].Hash == childrenB[i].Hash {
-			// Requirement 7.3: Skip subtrees with matching hashes
-			continue
-		}
-
-		// Hashes differ - recursively compare (Requirement 7.4)
-		childNodeA, err := d.loadNode(childrenA[i].Hash)
-		if err != nil {
-			return err
-		}
-		childNodeB, err := d.loadNode(childrenB[i].Hash)
-		if err != nil {
-			return err
-		}
-		if err := d.diffNodes(childNodeA, childNodeB, result); err != nil {
-			return err
+		if !bytes.Equal(childrenA[i].Key, childrenB[i].Key) {
+			return false
 		}
 	}
-	return nil
+	return true
 }
 
-// collectAllPairsFromChildren collects all KV pairs from a list of children
-func (d *DiffEngine) collectAllPairsFromChildren(children []types.ChildRef) ([]types.KVPair, error) {
-	var allPairs []types.KVPair
-	for _, child := range children {
-		pairs, err := d.collectAllPairsFromHash(child.Hash)
-		if err != nil {
-			return nil, err
+// diffAlignedChildren handles the case where children have the same starting keys.
+// All differing children on both sides are loaded with a single batched read.
+// Requirement 7.3, 7.4: Skip matching subtrees, recursively compare differing ones
+func (w *diffWalker) diffAlignedChildren(childrenA []types.ChildRef, heightA int, childrenB []types.ChildRef, heightB int, hi []byte) error {
+	var hashes []types.Hash
+	var bounds [][]byte
+	for i := range childrenA {
+		if childrenA[i].Hash == childrenB[i].Hash {
+			// Requirement 7.3: Skip subtrees with matching hashes
+			continue
 		}
-		allPairs = append(allPairs, pairs...)
-	}
-	return allPairs, nil
-}
 
-// collectAllPairs collects all KV pairs from a node recursively
-func (d *DiffEngine) collectAllPairs(node types.Node) ([]types.KVPair, error) {
-	if node.IsLeaf() {
-		leaf := node.(*types.LeafNode)
-		return leaf.Pairs, nil
-	}
-
-	internal := node.(*types.InternalNode)
-	var allPairs []types.KVPair
-	for _, child := range internal.Children {
-		childNode, err := d.loadNode(child.Hash)
-		if err != nil {
-			return nil, err
-		}
-		pairs, err := d.collectAllPairs(childNode)
-		if err != nil {
-			return nil, err
+		childHi := childUpperBound(childrenA, i, hi)
+		if !w.intersects(childrenA[i].Key, childHi) {
+			// Entirely outside the requested range
+			continue
 		}
-		allPairs = append(allPairs, pairs...)
+		hashes = append(hashes, childrenA[i].Hash, childrenB[i].Hash)
+		bounds = append(bounds, childHi)
 	}
-	return allPairs, nil
-}
 
-// collectAllPairsFromHash loads a node and collects all its pairs
-func (d *DiffEngine) collectAllPairsFromHash(hash types.Hash) ([]types.KVPair, error) {
-	node, err := d.loadNode(hash)
+	// Hashes differ - recursively compare (Requirement 7.4)
+	nodes, err := w.loadMany(hashes)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return d.collectAllPairs(node)
+	for i := 0; i < len(nodes); i += 2 {
+		if err := w.diffNodes(nodes[i], heightA, nodes[i+1], heightB, bounds[i/2]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // copyBytes creates a copy of a byte slice
@@ -292,7 +539,8 @@ func copyBytes(b []byte) []byte {
 // copyKVPair creates a deep copy of a KVPair
 func copyKVPair(p types.KVPair) types.KVPair {
 	return types.KVPair{
-		Key:   copyBytes(p.Key),
-		Value: copyBytes(p.Value),
+		Key:      copyBytes(p.Key),
+		Value:    copyBytes(p.Value),
+		ValueRef: p.ValueRef,
 	}
 }
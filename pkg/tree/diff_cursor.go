@@ -0,0 +1,183 @@
+package tree
+
+import (
+	"bytes"
+
+	"microprolly/pkg/types"
+)
+
+// diffItem is one entry on a diffCursor: either a single KV pair or a
+// reference to a subtree that has not been loaded yet
+type diffItem struct {
+	isPair bool
+	key    []byte       // the pair's key, or the first key of the subtree
+	pair   types.KVPair // the pair itself
+	hash   types.Hash   // subtree hash
+	hi     []byte       // exclusive upper key of the subtree, nil = unbounded
+	height int          // subtree height above the leaf level
+}
+
+// diffCursor yields the contents of a tree in key order, expanding
+// subtrees only when they have to be compared entry by entry.
+// Items are kept on a stack with the next item last.
+type diffCursor struct {
+	stack []diffItem
+}
+
+func (c *diffCursor) done() bool {
+	return len(c.stack) == 0
+}
+
+func (c *diffCursor) peek() *diffItem {
+	return &c.stack[len(c.stack)-1]
+}
+
+func (c *diffCursor) pop() diffItem {
+	item := c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+	return item
+}
+
+// push adds the entries of node that fall inside the walk's range
+func (w *diffWalker) push(c *diffCursor, node types.Node, height int, hi []byte) {
+	if node.IsLeaf() {
+		pairs := node.(*types.LeafNode).Pairs
+		for i := len(pairs) - 1; i >= 0; i-- {
+			if w.inRange(pairs[i].Key) {
+				c.stack = append(c.stack, diffItem{isPair: true, key: pairs[i].Key, pair: pairs[i]})
+			}
+		}
+		return
+	}
+
+	children := node.(*types.InternalNode).Children
+	for i := len(children) - 1; i >= 0; i-- {
+		childHi := childUpperBound(children, i, hi)
+		if w.intersects(children[i].Key, childHi) {
+			c.stack = append(c.stack, diffItem{
+				key:    children[i].Key,
+				hash:   children[i].Hash,
+				hi:     childHi,
+				height: height - 1,
+			})
+		}
+	}
+}
+
+// expand replaces the subtree at the top of c with its entries
+func (w *diffWalker) expand(c *diffCursor) error {
+	item := c.pop()
+	node, err := w.load(item.hash)
+	if err != nil {
+		return err
+	}
+	w.push(c, node, item.height, item.hi)
+	return nil
+}
+
+// expandBoth expands the subtrees at the top of a and b with one batched read
+func (w *diffWalker) expandBoth(a, b *diffCursor) error {
+	itemA, itemB := a.pop(), b.pop()
+	nodes, err := w.loadMany([]types.Hash{itemA.hash, itemB.hash})
+	if err != nil {
+		return err
+	}
+	w.push(a, nodes[0], itemA.height, itemA.hi)
+	w.push(b, nodes[1], itemB.height, itemB.hi)
+	return nil
+}
+
+// cursorDiff compares two nodes whose children do not line up.
+//
+// Both trees are walked in key order. Everything before the head of each
+// cursor has already been compared, so two subtree heads with the same hash
+// cover the same keys and are skipped together, whatever their position or
+// parent. Otherwise the head that starts first (or, at the same key, the
+// taller one) is expanded, so only subtrees overlapping a change are loaded.
+func (w *diffWalker) cursorDiff(nodeA types.Node, heightA int, nodeB types.Node, heightB int, hi []byte) error {
+	var a, b diffCursor
+	w.push(&a, nodeA, heightA, hi)
+	w.push(&b, nodeB, heightB, hi)
+
+	for !a.done() || !b.done() {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+
+		var err error
+		switch {
+		case b.done():
+			if a.peek().isPair {
+				item := a.pop()
+				err = w.emit(DiffDeleted, item.pair, types.KVPair{})
+			} else {
+				err = w.expand(&a)
+			}
+
+		case a.done():
+			if b.peek().isPair {
+				item := b.pop()
+				err = w.emit(DiffAdded, types.KVPair{}, item.pair)
+			} else {
+				err = w.expand(&b)
+			}
+
+		default:
+			err = w.step(&a, &b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// step advances two non-empty cursors by one comparison
+func (w *diffWalker) step(a, b *diffCursor) error {
+	headA, headB := a.peek(), b.peek()
+	cmp := bytes.Compare(headA.key, headB.key)
+
+	switch {
+	case headA.isPair && headB.isPair:
+		if cmp < 0 {
+			item := a.pop()
+			return w.emit(DiffDeleted, item.pair, types.KVPair{})
+		}
+		if cmp > 0 {
+			item := b.pop()
+			return w.emit(DiffAdded, types.KVPair{}, item.pair)
+		}
+		itemA, itemB := a.pop(), b.pop()
+		return w.emitIfChanged(itemA.pair, itemB.pair)
+
+	case headA.isPair:
+		// The pair precedes everything left in B, so B cannot contain it
+		if cmp < 0 {
+			item := a.pop()
+			return w.emit(DiffDeleted, item.pair, types.KVPair{})
+		}
+		return w.expand(b)
+
+	case headB.isPair:
+		if cmp > 0 {
+			item := b.pop()
+			return w.emit(DiffAdded, types.KVPair{}, item.pair)
+		}
+		return w.expand(a)
+
+	case headA.hash == headB.hash:
+		// Requirement 7.3: Skip subtrees with matching hashes
+		a.pop()
+		b.pop()
+		return nil
+
+	case cmp < 0 || (cmp == 0 && headA.height > headB.height):
+		return w.expand(a)
+
+	case cmp > 0 || (cmp == 0 && headB.height > headA.height):
+		return w.expand(b)
+
+	default:
+		return w.expandBoth(a, b)
+	}
+}
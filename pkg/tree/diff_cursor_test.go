@@ -0,0 +1,117 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// countTreeNodes returns the number of nodes reachable from root
+func countTreeNodes(t *testing.T, loader nodeLoader, root types.Hash) int {
+	node, err := loader.load(root)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	count := 1
+	if internal, ok := node.(*types.InternalNode); ok {
+		for _, child := range internal.Children {
+			count += countTreeNodes(t, loader, child.Hash)
+		}
+	}
+	return count
+}
+
+// insertPair returns a copy of sorted pairs with p inserted in order
+func insertPair(pairs []types.KVPair, p types.KVPair) []types.KVPair {
+	i := sort.Search(len(pairs), func(i int) bool {
+		return bytes.Compare(pairs[i].Key, p.Key) >= 0
+	})
+	result := make([]types.KVPair, 0, len(pairs)+1)
+	result = append(result, pairs[:i]...)
+	result = append(result, p)
+	return append(result, pairs[i:]...)
+}
+
+// TestCursorDiff_SingleInsertReadsFewNodes tests that inserting one key reads
+// only a handful of nodes, even where the insert shifts chunk boundaries
+func TestCursorDiff_SingleInsertReadsFewNodes(t *testing.T) {
+	storage := &countingCAS{memoryCAS: newMemoryCAS()}
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+	differ := NewDiffEngine(storage)
+
+	base := sequentialPairs(20000, "v")
+	rootA, err := builder.Build(base)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	total := countTreeNodes(t, newNodeLoader(storage, nil), rootA)
+
+	for i := 0; i < 20000; i += 997 {
+		key := []byte(fmt.Sprintf("key-%06d-x", i))
+		rootB, err := builder.Build(insertPair(base, types.KVPair{Key: key, Value: []byte("new")}))
+		if err != nil {
+			t.Fatalf("Build failed: %v", err)
+		}
+
+		storage.reads = 0
+		result, err := differ.Diff(rootA, rootB)
+		if err != nil {
+			t.Fatalf("Diff failed: %v", err)
+		}
+		if len(result.Added) != 1 || len(result.Modified) != 0 || len(result.Deleted) != 0 {
+			t.Fatalf("Unexpected diff for insert at %d: %d added, %d modified, %d deleted",
+				i, len(result.Added), len(result.Modified), len(result.Deleted))
+		}
+		if storage.reads > 40 {
+			t.Fatalf("Diff for insert at %d read %d of %d nodes", i, storage.reads, total)
+		}
+	}
+}
+
+// TestProperty_CursorDiffDifferentHeights tests diffs between trees of very
+// different sizes, whose roots sit at different heights
+func TestProperty_CursorDiffDifferentHeights(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		storage := cas.NewMemoryCAS()
+		builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+		differ := NewDiffEngine(storage)
+
+		all := sequentialPairs(rapid.IntRange(0, 3000).Draw(t, "count"), "v")
+		lo := rapid.IntRange(0, len(all)).Draw(t, "lo")
+		hi := rapid.IntRange(lo, len(all)).Draw(t, "hi")
+		subset := all[lo:hi]
+
+		rootAll, err := builder.Build(all)
+		if err != nil {
+			t.Fatalf("Build failed: %v", err)
+		}
+		rootSubset, err := builder.Build(subset)
+		if err != nil {
+			t.Fatalf("Build failed: %v", err)
+		}
+
+		for _, dir := range []struct {
+			a, b           types.Hash
+			pairsA, pairsB []types.KVPair
+		}{
+			{rootAll, rootSubset, all, subset},
+			{rootSubset, rootAll, subset, all},
+		} {
+			actual, err := collectStream(differ, dir.a, dir.b, DiffOptions{})
+			if err != nil {
+				t.Fatalf("DiffStream failed: %v", err)
+			}
+			expected := expectedDiffEntries(dir.pairsA, dir.pairsB, DiffOptions{})
+			if !diffEntriesEqual(expected, actual) {
+				t.Fatalf("Diff mismatch: expected %d entries, got %d", len(expected), len(actual))
+			}
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/types"
+)
+
+const (
+	// partitionsPerWorker is how many key range partitions a parallel diff
+	// aims to create per worker, so that uneven partitions still keep
+	// workers busy
+	partitionsPerWorker = 4
+	// diffBufferSize is how many changes a partition buffers before its
+	// worker waits for the partitions before it to be reported
+	diffBufferSize = 1024
+)
+
+// NewParallelDiffEngine creates a DiffEngine that compares independent parts
+// of the trees on up to workers goroutines. The key space is split at child
+// boundaries near the root and each part is diffed separately, so differing
+// subtrees are read and deserialized concurrently. Changes are still reported
+// in ascending key order; each part buffers up to diffBufferSize changes
+// until its turn, and its worker then waits.
+//
+// Parallel diffing is opt-in: Store diffs with a sequential engine, and
+// callers wanting parallel diffs create one over the same CAS.
+func NewParallelDiffEngine(cas cas.CAS, cache *NodeCache, workers int) *DiffEngine {
+	d := NewDiffEngineWithCache(cas, cache)
+	d.workers = workers
+	return d
+}
+
+// diffBuffer passes the changes of one partition to the reporting loop in
+// parallel mode. Pairs alias immutable node memory, so they are not copied.
+// err is set before changes is closed.
+type diffBuffer struct {
+	ctx     context.Context
+	changes chan bufferedChange
+	err     error
+}
+
+type bufferedChange struct {
+	kind             DiffKind
+	oldPair, newPair types.KVPair
+}
+
+// add buffers a change, waiting while the buffer is full
+func (b *diffBuffer) add(kind DiffKind, oldPair, newPair types.KVPair) error {
+	select {
+	case b.changes <- bufferedChange{kind, oldPair, newPair}:
+		return nil
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	}
+}
+
+// parallelDiff splits the walker's range into partitions, diffs them on a
+// bounded pool of workers and replays the results in key order
+func (w *diffWalker) parallelDiff(hashA, hashB types.Hash, workers int) error {
+	splits, err := w.partitionKeys(hashA, workers*partitionsPerWorker)
+	if err != nil {
+		return err
+	}
+	if len(splits) == 0 {
+		return w.run(hashA, hashB)
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		// Returning early cancels the remaining partitions before waiting
+		cancel()
+		wg.Wait()
+	}()
+
+	// Partition i covers [bounds[i], bounds[i+1]); nil ends are unbounded
+	bounds := make([][]byte, 0, len(splits)+2)
+	bounds = append(bounds, w.start)
+	bounds = append(bounds, splits...)
+	bounds = append(bounds, w.end)
+
+	buffers := make([]*diffBuffer, len(bounds)-1)
+	jobs := make(chan int, len(buffers))
+	for i := range buffers {
+		buffers[i] = &diffBuffer{ctx: ctx, changes: make(chan bufferedChange, diffBufferSize)}
+		jobs <- i
+	}
+	close(jobs)
+
+	for n := 0; n < workers && n < len(buffers); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				buf := buffers[i]
+				sub := &diffWalker{
+					ctx:     ctx,
+					loader:  w.loader,
+					start:   bounds[i],
+					end:     bounds[i+1],
+					emit:    buf.add,
+					visited: w.visited,
+				}
+				if ctx.Err() != nil {
+					buf.err = ctx.Err()
+				} else {
+					buf.err = sub.run(hashA, hashB)
+				}
+				close(buf.changes)
+			}
+		}()
+	}
+	// Jobs start in partition order, so the partition being reported has
+	// always started and its worker cannot be stuck behind a later one
+	for _, buf := range buffers {
+		for c := range buf.changes {
+			if err := w.emit(c.kind, c.oldPair, c.newPair); err != nil {
+				return err
+			}
+		}
+		if buf.err != nil {
+			return buf.err
+		}
+	}
+	return nil
+}
+
+// partitionKeys returns sorted keys strictly inside the walker's range that
+// split tree A into roughly want parts. It descends level by level from the
+// root until a level has enough children, and returns nil for small trees.
+func (w *diffWalker) partitionKeys(root types.Hash, want int) ([][]byte, error) {
+	level, err := w.loadMany([]types.Hash{root})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var keys [][]byte
+		var hashes []types.Hash
+		for _, node := range level {
+			internal, ok := node.(*types.InternalNode)
+			if !ok {
+				// Reached the leaves without finding enough boundaries
+				return nil, nil
+			}
+			for _, child := range internal.Children {
+				keys = append(keys, child.Key)
+				hashes = append(hashes, child.Hash)
+			}
+		}
+
+		if len(keys) >= want {
+			return w.innerKeys(keys), nil
+		}
+
+		level, err = w.loadMany(hashes)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// innerKeys filters sorted keys down to those strictly inside the walker's range
+func (w *diffWalker) innerKeys(keys [][]byte) [][]byte {
+	var inner [][]byte
+	for _, key := range keys {
+		if bytes.Compare(key, w.start) > 0 && (w.end == nil || bytes.Compare(key, w.end) < 0) {
+			inner = append(inner, key)
+		}
+	}
+	return inner
+}
@@ -0,0 +1,140 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// TestProperty_ParallelDiffMatchesSequential tests that parallel mode emits
+// the same changes in the same order as the sequential engine
+func TestProperty_ParallelDiffMatchesSequential(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		storage := cas.NewMemoryCAS()
+		builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+		sequential := NewDiffEngine(storage)
+		parallel := NewParallelDiffEngine(storage, NewNodeCache(DefaultNodeCacheSize), rapid.IntRange(2, 8).Draw(t, "workers"))
+
+		count := rapid.IntRange(0, 3000).Draw(t, "count")
+		pairsA := sequentialPairs(count, "v")
+		pairsB := sequentialPairs(count, "v")
+		changes := rapid.IntRange(0, 100).Draw(t, "changes")
+		for i := 0; i < changes && count > 0; i++ {
+			j := rapid.IntRange(0, count-1).Draw(t, "index")
+			pairsB[j] = types.KVPair{Key: pairsB[j].Key, Value: []byte(fmt.Sprintf("changed-%d", i))}
+		}
+
+		rootA, err := builder.Build(pairsA)
+		if err != nil {
+			t.Fatalf("Build A failed: %v", err)
+		}
+		rootB, err := builder.Build(pairsB)
+		if err != nil {
+			t.Fatalf("Build B failed: %v", err)
+		}
+
+		var opts DiffOptions
+		if rapid.Bool().Draw(t, "has_range") {
+			opts.Start = []byte(fmt.Sprintf("key-%06d", rapid.IntRange(0, count).Draw(t, "start")))
+			opts.End = []byte(fmt.Sprintf("key-%06d", rapid.IntRange(0, count).Draw(t, "end")))
+		}
+
+		expected, err := collectStream(sequential, rootA, rootB, opts)
+		if err != nil {
+			t.Fatalf("Sequential diff failed: %v", err)
+		}
+		actual, err := collectStream(parallel, rootA, rootB, opts)
+		if err != nil {
+			t.Fatalf("Parallel diff failed: %v", err)
+		}
+		if !diffEntriesEqual(expected, actual) {
+			t.Fatalf("Parallel diff mismatch: expected %d entries, got %d", len(expected), len(actual))
+		}
+	})
+}
+
+// TestParallelDiff_StopsOnCallbackError tests that a callback error stops a
+// parallel diff and is returned unchanged
+func TestParallelDiff_StopsOnCallbackError(t *testing.T) {
+	storage := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+	differ := NewParallelDiffEngine(storage, nil, 4)
+
+	rootA, err := builder.Build(sequentialPairs(20000, "a"))
+	if err != nil {
+		t.Fatalf("Build A failed: %v", err)
+	}
+	pairsB := sequentialPairs(20000, "a")
+	for i := 0; i < len(pairsB); i += 50 {
+		pairsB[i].Value = []byte("changed")
+	}
+	rootB, err := builder.Build(pairsB)
+	if err != nil {
+		t.Fatalf("Build B failed: %v", err)
+	}
+
+	errStop := errors.New("stop")
+	var last []byte
+	calls := 0
+	err = differ.DiffStream(rootA, rootB, func(e DiffEntry) error {
+		if last != nil && string(e.Key) <= string(last) {
+			t.Fatalf("Keys out of order: %q after %q", e.Key, last)
+		}
+		last = e.Key
+		calls++
+		if calls == 100 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("Expected callback error, got %v", err)
+	}
+	if calls != 100 {
+		t.Fatalf("Callback called %d times, want 100", calls)
+	}
+}
+
+// TestParallelDiff_FullBuffers tests diffs whose partitions hold more
+// changes than a buffer: workers wait for their turn, the result matches
+// the sequential engine, and stopping early releases the waiting workers
+func TestParallelDiff_FullBuffers(t *testing.T) {
+	storage := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+	differ := NewParallelDiffEngine(storage, nil, 4)
+
+	rootA, err := builder.Build(sequentialPairs(20000, "a"))
+	if err != nil {
+		t.Fatalf("Build A failed: %v", err)
+	}
+	rootB, err := builder.Build(sequentialPairs(20000, "b"))
+	if err != nil {
+		t.Fatalf("Build B failed: %v", err)
+	}
+
+	expected, err := collectStream(NewDiffEngine(storage), rootA, rootB, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Sequential diff failed: %v", err)
+	}
+	actual, err := collectStream(differ, rootA, rootB, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Parallel diff failed: %v", err)
+	}
+	if len(expected) != 20000 || !diffEntriesEqual(expected, actual) {
+		t.Fatalf("Parallel diff mismatch: expected %d entries, got %d", len(expected), len(actual))
+	}
+
+	errStop := errors.New("stop")
+	err = differ.DiffStream(rootA, rootB, func(e DiffEntry) error {
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("Expected callback error, got %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// expectedDiffEntries computes the ordered diff entries between two pair sets,
+// restricted to [start, end) and prefix
+func expectedDiffEntries(pairsA, pairsB []types.KVPair, opts DiffOptions) []DiffEntry {
+	mapA := make(map[string][]byte)
+	for _, p := range pairsA {
+		mapA[string(p.Key)] = p.Value
+	}
+	mapB := make(map[string][]byte)
+	for _, p := range pairsB {
+		mapB[string(p.Key)] = p.Value
+	}
+
+	keys := make(map[string]bool)
+	for k := range mapA {
+		keys[k] = true
+	}
+	for k := range mapB {
+		keys[k] = true
+	}
+
+	var entries []DiffEntry
+	for k := range keys {
+		key := []byte(k)
+		if bytes.Compare(key, opts.Start) < 0 || (opts.End != nil && bytes.Compare(key, opts.End) >= 0) {
+			continue
+		}
+		if !bytes.HasPrefix(key, opts.Prefix) {
+			continue
+		}
+
+		oldValue, inA := mapA[k]
+		newValue, inB := mapB[k]
+		switch {
+		case inA && !inB:
+			entries = append(entries, DiffEntry{Kind: DiffDeleted, Key: key, OldValue: oldValue})
+		case !inA && inB:
+			entries = append(entries, DiffEntry{Kind: DiffAdded, Key: key, NewValue: newValue})
+		case !bytes.Equal(oldValue, newValue):
+			entries = append(entries, DiffEntry{Kind: DiffModified, Key: key, OldValue: oldValue, NewValue: newValue})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	return entries
+}
+
+// collectStream runs DiffStreamContext and returns all emitted entries
+func collectStream(differ *DiffEngine, a, b types.Hash, opts DiffOptions) ([]DiffEntry, error) {
+	var entries []DiffEntry
+	err := differ.DiffStreamContext(context.Background(), a, b, opts, func(e DiffEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func diffEntriesEqual(a, b []DiffEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Kind != b[i].Kind ||
+			!bytes.Equal(a[i].Key, b[i].Key) ||
+			!bytes.Equal(a[i].OldValue, b[i].OldValue) ||
+			!bytes.Equal(a[i].NewValue, b[i].NewValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestProperty_DiffStreamMatchesOracle tests that DiffStream emits exactly the
+// expected changes, in ascending key order, for arbitrary ranges and prefixes
+func TestProperty_DiffStreamMatchesOracle(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		storage := cas.NewMemoryCAS()
+		builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+		differ := NewDiffEngine(storage)
+
+		count := rapid.IntRange(0, 400).Draw(t, "count")
+		pairsA := sequentialPairs(count, "v")
+
+		// Mutate a copy of A to get B
+		mapB := make(map[string][]byte)
+		for _, p := range pairsA {
+			mapB[string(p.Key)] = p.Value
+		}
+		mutations := rapid.IntRange(0, 20).Draw(t, "mutations")
+		for i := 0; i < mutations; i++ {
+			key := fmt.Sprintf("key-%06d", rapid.IntRange(0, count+50).Draw(t, "key"))
+			switch rapid.IntRange(0, 2).Draw(t, "op") {
+			case 0:
+				delete(mapB, key)
+			default:
+				mapB[key] = []byte(fmt.Sprintf("changed-%d", i))
+			}
+		}
+		pairsB := make([]types.KVPair, 0, len(mapB))
+		for k, v := range mapB {
+			pairsB = append(pairsB, types.KVPair{Key: []byte(k), Value: v})
+		}
+		sort.Slice(pairsB, func(i, j int) bool {
+			return bytes.Compare(pairsB[i].Key, pairsB[j].Key) < 0
+		})
+
+		hashA, err := builder.Build(pairsA)
+		if err != nil {
+			t.Fatalf("Build A failed: %v", err)
+		}
+		hashB, err := builder.Build(pairsB)
+		if err != nil {
+			t.Fatalf("Build B failed: %v", err)
+		}
+
+		var opts DiffOptions
+		if rapid.Bool().Draw(t, "has_start") {
+			opts.Start = []byte(fmt.Sprintf("key-%06d", rapid.IntRange(0, count+50).Draw(t, "start")))
+		}
+		if rapid.Bool().Draw(t, "has_end") {
+			opts.End = []byte(fmt.Sprintf("key-%06d", rapid.IntRange(0, count+50).Draw(t, "end")))
+		}
+		if rapid.Bool().Draw(t, "has_prefix") {
+			opts.Prefix = []byte(fmt.Sprintf("key-%05d", rapid.IntRange(0, (count+50)/10).Draw(t, "prefix")))
+		}
+
+		actual, err := collectStream(differ, hashA, hashB, opts)
+		if err != nil {
+			t.Fatalf("DiffStream failed: %v", err)
+		}
+		expected := expectedDiffEntries(pairsA, pairsB, opts)
+		if !diffEntriesEqual(expected, actual) {
+			t.Fatalf("DiffStream mismatch: expected %d entries, got %d", len(expected), len(actual))
+		}
+	})
+}
+
+// TestDiffStats_MatchesStream tests that DiffStats counts the same changes
+// DiffStream emits, and visits fewer nodes than the trees contain
+func TestDiffStats_MatchesStream(t *testing.T) {
+	storage := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+	differ := NewDiffEngine(storage)
+
+	pairsA := sequentialPairs(5000, "v")
+	pairsB := sequentialPairs(5000, "v")[:4990]
+	pairsB[100].Value = []byte("changed")
+	pairsB = append(pairsB, types.KVPair{Key: []byte("key-zzz"), Value: []byte("added")})
+
+	hashA, err := builder.Build(pairsA)
+	if err != nil {
+		t.Fatalf("Build A failed: %v", err)
+	}
+	hashB, err := builder.Build(pairsB)
+	if err != nil {
+		t.Fatalf("Build B failed: %v", err)
+	}
+
+	stats, err := differ.DiffStats(hashA, hashB)
+	if err != nil {
+		t.Fatalf("DiffStats failed: %v", err)
+	}
+
+	var expected DiffStats
+	for _, e := range expectedDiffEntries(pairsA, pairsB, DiffOptions{}) {
+		switch e.Kind {
+		case DiffAdded:
+			expected.Added++
+			expected.BytesAdded += int64(len(e.Key) + len(e.NewValue))
+		case DiffModified:
+			expected.Modified++
+			expected.BytesAdded += int64(len(e.NewValue))
+			expected.BytesDeleted += int64(len(e.OldValue))
+		case DiffDeleted:
+			expected.Deleted++
+			expected.BytesDeleted += int64(len(e.Key) + len(e.OldValue))
+		}
+	}
+	expected.NodesVisited = stats.NodesVisited
+
+	if stats != expected {
+		t.Fatalf("DiffStats = %+v, want %+v", stats, expected)
+	}
+	total := countTreeNodes(t, newNodeLoader(storage, nil), hashA)
+	if stats.NodesVisited == 0 || stats.NodesVisited >= total {
+		t.Fatalf("Visited %d nodes of a %d node tree", stats.NodesVisited, total)
+	}
+}
+
+// TestDiffStream_StopsOnCallbackError tests that a callback error ends the walk
+func TestDiffStream_StopsOnCallbackError(t *testing.T) {
+	storage := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+	differ := NewDiffEngine(storage)
+
+	hashA, err := builder.Build(sequentialPairs(1000, "a"))
+	if err != nil {
+		t.Fatalf("Build A failed: %v", err)
+	}
+	hashB, err := builder.Build(sequentialPairs(1000, "b"))
+	if err != nil {
+		t.Fatalf("Build B failed: %v", err)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = differ.DiffStream(hashA, hashB, func(e DiffEntry) error {
+		calls++
+		if e.Kind != DiffModified {
+			t.Fatalf("Expected modified entry, got %s", e.Kind)
+		}
+		if calls == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("Expected callback error, got %v", err)
+	}
+	if calls != 10 {
+		t.Fatalf("Callback called %d times after stopping, want 10", calls)
+	}
+}
+
+// TestDiffStream_RangeSkipsSubtrees tests that a narrow range loads fewer
+// nodes than a full diff of the same trees
+func TestDiffStream_RangeSkipsSubtrees(t *testing.T) {
+	storage := &countingCAS{memoryCAS: newMemoryCAS()}
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(256, 64, 1024))
+	differ := NewDiffEngine(storage)
+
+	hashA, err := builder.Build(sequentialPairs(5000, "a"))
+	if err != nil {
+		t.Fatalf("Build A failed: %v", err)
+	}
+	hashB, err := builder.Build(sequentialPairs(5000, "b"))
+	if err != nil {
+		t.Fatalf("Build B failed: %v", err)
+	}
+
+	storage.reads = 0
+	full, err := collectStream(differ, hashA, hashB, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Full diff failed: %v", err)
+	}
+	fullReads := storage.reads
+
+	storage.reads = 0
+	ranged, err := collectStream(differ, hashA, hashB, DiffOptions{Prefix: []byte("key-0012")})
+	if err != nil {
+		t.Fatalf("Prefix diff failed: %v", err)
+	}
+
+	if len(full) != 5000 {
+		t.Fatalf("Full diff returned %d entries, want 5000", len(full))
+	}
+	if len(ranged) != 100 {
+		t.Fatalf("Prefix diff returned %d entries, want 100", len(ranged))
+	}
+	if storage.reads*10 > fullReads {
+		t.Fatalf("Prefix diff read %d nodes, full diff read %d", storage.reads, fullReads)
+	}
+}
+
+// TestPrefixEnd tests the exclusive upper bound computed for a prefix
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix []byte
+		want   []byte
+	}{
+		{[]byte("abc"), []byte("abd")},
+		{[]byte{'a', 0xff}, []byte("b")},
+		{[]byte{0xff, 0xff}, nil},
+	}
+	for _, tt := range tests {
+		if got := PrefixEnd(tt.prefix); !bytes.Equal(got, tt.want) {
+			t.Errorf("PrefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
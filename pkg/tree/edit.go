@@ -0,0 +1,364 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+)
+
+// ErrInvalidRangeEdit is returned when the pairs given to ReplaceRange are
+// not sorted or fall outside the range
+var ErrInvalidRangeEdit = errors.New("invalid range edit")
+
+// DeleteRange returns the root of a tree holding the pairs of rootHash
+// outside [start, end). A nil end is unbounded; a range with start >= end
+// leaves the tree unchanged.
+//
+// The result is the tree Build would produce from the remaining pairs, but
+// only the edges of the range are rebuilt: subtrees entirely inside it are
+// dropped without being loaded, and leaves outside it are reused without
+// being read, except for the few after the range that are rechunked until
+// the chunk boundaries line up with the old ones again.
+func (b *TreeBuilder) DeleteRange(rootHash types.Hash, start, end []byte) (types.Hash, error) {
+	r := keyRange{start: start, end: end}
+	if r.empty() {
+		return rootHash, nil
+	}
+	return b.replaceRange(context.Background(), rootHash, r, nil)
+}
+
+// CopyPrefix returns the root of a tree in which the keys under dst are
+// replaced by a copy of the keys under src, with the src prefix swapped for
+// dst. Values stored out of line are copied by reference. As in DeleteRange,
+// subtrees outside both prefixes are reused without reading their leaves.
+func (b *TreeBuilder) CopyPrefix(rootHash types.Hash, src, dst []byte) (types.Hash, error) {
+	if bytes.Equal(src, dst) {
+		return rootHash, nil
+	}
+	ctx := context.Background()
+
+	var pairs []types.KVPair
+	if err := b.collectRange(ctx, rootHash, keyRange{start: src, end: PrefixEnd(src)}, &pairs); err != nil {
+		return types.Hash{}, err
+	}
+	for i, pair := range pairs {
+		key := append(copyBytes(dst), pair.Key[len(src):]...)
+		pairs[i] = types.KVPair{Key: key, Value: copyBytes(pair.Value), ValueRef: pair.ValueRef}
+	}
+
+	return b.replaceRange(ctx, rootHash, keyRange{start: dst, end: PrefixEnd(dst)}, pairs)
+}
+
+// ReplaceRange returns the root of a tree holding the pairs of rootHash
+// outside [start, end) together with pairs, which must be sorted and inside
+// the range. A nil end is unbounded. As in DeleteRange, only the edges of
+// the range are rebuilt, and the result is the tree Build would produce.
+func (b *TreeBuilder) ReplaceRange(rootHash types.Hash, start, end []byte, pairs []types.KVPair) (types.Hash, error) {
+	r := keyRange{start: start, end: end}
+	for i, pair := range pairs {
+		if !r.contains(pair.Key) {
+			return types.Hash{}, fmt.Errorf("%w: key %q is outside the range", ErrInvalidRangeEdit, pair.Key)
+		}
+		if i > 0 && bytes.Compare(pairs[i-1].Key, pair.Key) >= 0 {
+			return types.Hash{}, fmt.Errorf("%w: keys are not sorted at %q", ErrInvalidRangeEdit, pair.Key)
+		}
+	}
+	if r.empty() {
+		return rootHash, nil
+	}
+	return b.replaceRange(context.Background(), rootHash, r, pairs)
+}
+
+// leafSpan is a leaf reference with the exclusive upper bound of its keys;
+// nil is unbounded
+type leafSpan struct {
+	ref types.ChildRef
+	hi  []byte
+}
+
+// replaceRange returns the root of the tree holding the pairs of rootHash
+// outside r together with insert, which must be sorted and inside r.
+//
+// Every chunker in package chunker restarts its boundary search after each
+// boundary, so the leaves before the range and the leaves after the first
+// boundary the new and old chunkings share are exactly the leaves Build would
+// produce. The internal levels are then rechunked from the leaf references.
+// A chunker that is not a chunker.Splitter, or a tree that is a single leaf,
+// is rebuilt from all of its pairs.
+func (b *TreeBuilder) replaceRange(ctx context.Context, rootHash types.Hash, r keyRange, insert []types.KVPair) (types.Hash, error) {
+	insert, err := b.externalizeValues(ctx, insert)
+	if err != nil {
+		return types.Hash{}, err
+	}
+
+	root, err := b.loader.loadContext(ctx, rootHash)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	splitter, ok := b.chunker.(chunker.Splitter)
+	internal, isInternal := root.(*types.InternalNode)
+	if !ok || !isInternal {
+		return b.rebuildRange(ctx, rootHash, r, insert)
+	}
+	if r.holds(internal.Children[0].Key, nil) {
+		// Every key is replaced
+		return b.BuildContext(ctx, insert)
+	}
+
+	depth, err := b.leafDepth(ctx, internal, nil, r)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	var leaves []leafSpan
+	if err := b.collectLeafSpans(ctx, internal, nil, depth, r, &leaves); err != nil {
+		return types.Hash{}, err
+	}
+
+	// Leaves entirely before the range are kept; the pairs outside the
+	// range of the leaves overlapping it are rechunked with insert
+	first := 0
+	for first < len(leaves) && leaves[first].hi != nil && bytes.Compare(leaves[first].hi, r.start) <= 0 {
+		first++
+	}
+	next := first
+	var before, after []types.KVPair
+	for next < len(leaves) && (r.end == nil || bytes.Compare(leaves[next].ref.Key, r.end) < 0) {
+		node, err := b.loader.loadContext(ctx, leaves[next].ref.Hash)
+		if err != nil {
+			return types.Hash{}, err
+		}
+		for _, pair := range node.(*types.LeafNode).Pairs {
+			if bytes.Compare(pair.Key, r.start) < 0 {
+				before = append(before, pair)
+			} else if !r.contains(pair.Key) {
+				after = append(after, pair)
+			}
+		}
+		next++
+	}
+	pending := append(append(before, insert...), after...)
+
+	// Rechunk leaves after the range until a new boundary falls where an
+	// old leaf starts; from there on the old leaves are the new ones
+	var chunks [][]types.KVPair
+	for ; next < len(leaves) && len(pending) > 0; next++ {
+		node, err := b.loader.loadContext(ctx, leaves[next].ref.Hash)
+		if err != nil {
+			return types.Hash{}, err
+		}
+		extended := append(pending[:len(pending):len(pending)], node.(*types.LeafNode).Pairs...)
+		split := splitter.Split(extended)
+
+		aligned, n := -1, 0
+		for i, chunk := range split {
+			n += len(chunk)
+			if n >= len(pending) {
+				if n == len(pending) {
+					aligned = i
+				}
+				break
+			}
+		}
+		if aligned >= 0 {
+			chunks = append(chunks, split[:aligned+1]...)
+			pending = nil
+			break
+		}
+		chunks = append(chunks, split[:len(split)-1]...)
+		pending = split[len(split)-1]
+	}
+	if len(pending) > 0 {
+		chunks = append(chunks, splitter.Split(pending)...)
+	}
+
+	newRefs, err := b.buildLeafNodes(ctx, chunks)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	refs := make([]types.ChildRef, 0, first+len(newRefs)+len(leaves)-next)
+	for _, leaf := range leaves[:first] {
+		refs = append(refs, leaf.ref)
+	}
+	refs = append(refs, newRefs...)
+	for _, leaf := range leaves[next:] {
+		refs = append(refs, leaf.ref)
+	}
+	if len(refs) == 0 {
+		return b.BuildContext(ctx, nil)
+	}
+
+	// Chunking merges a level of single-pair chunks into one chunk
+	single, err := b.singlePairLeaves(ctx, refs)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	if single && len(refs) > 1 {
+		return b.rebuildRange(ctx, rootHash, r, insert)
+	}
+
+	if err := b.fixLeafCounts(ctx, refs); err != nil {
+		return types.Hash{}, err
+	}
+	return b.buildInternalLayers(ctx, refs)
+}
+
+// rebuildRange is replaceRange for trees that cannot be edited in place:
+// it reads every pair and builds a new tree
+func (b *TreeBuilder) rebuildRange(ctx context.Context, rootHash types.Hash, r keyRange, insert []types.KVPair) (types.Hash, error) {
+	var pairs []types.KVPair
+	if err := b.collectRange(ctx, rootHash, keyRange{}, &pairs); err != nil {
+		return types.Hash{}, err
+	}
+	lo := sort.Search(len(pairs), func(i int) bool { return bytes.Compare(pairs[i].Key, r.start) >= 0 })
+	hi := len(pairs)
+	if r.end != nil {
+		hi = sort.Search(len(pairs), func(i int) bool { return bytes.Compare(pairs[i].Key, r.end) >= 0 })
+	}
+
+	result := make([]types.KVPair, 0, lo+len(insert)+len(pairs)-hi)
+	result = append(result, pairs[:lo]...)
+	result = append(result, insert...)
+	result = append(result, pairs[hi:]...)
+	return b.BuildContext(ctx, result)
+}
+
+// leafDepth returns the number of internal levels from node down to the
+// leaves. Trees are balanced, so it descends through children not entirely
+// inside r and never loads a leaf that r would drop.
+func (b *TreeBuilder) leafDepth(ctx context.Context, node *types.InternalNode, hi []byte, r keyRange) (int, error) {
+	for i, child := range node.Children {
+		upper := childUpperBound(node.Children, i, hi)
+		if r.holds(child.Key, upper) {
+			continue
+		}
+		childNode, err := b.loader.loadContext(ctx, child.Hash)
+		if err != nil {
+			return 0, err
+		}
+		internal, ok := childNode.(*types.InternalNode)
+		if !ok {
+			return 1, nil
+		}
+		depth, err := b.leafDepth(ctx, internal, upper, r)
+		return depth + 1, err
+	}
+	return 1, nil
+}
+
+// collectLeafSpans appends the leaves under node that are not entirely
+// inside r, in key order. Subtrees entirely inside r are skipped unread.
+func (b *TreeBuilder) collectLeafSpans(ctx context.Context, node *types.InternalNode, hi []byte, depth int, r keyRange, spans *[]leafSpan) error {
+	var kept []leafSpan
+	for i, child := range node.Children {
+		upper := childUpperBound(node.Children, i, hi)
+		if !r.holds(child.Key, upper) {
+			kept = append(kept, leafSpan{ref: child, hi: upper})
+		}
+	}
+	if depth == 1 {
+		*spans = append(*spans, kept...)
+		return nil
+	}
+
+	hashes := make([]types.Hash, len(kept))
+	for i, span := range kept {
+		hashes[i] = span.ref.Hash
+	}
+	children, err := b.loader.loadMany(ctx, hashes)
+	if err != nil {
+		return err
+	}
+	for i, child := range children {
+		if err := b.collectLeafSpans(ctx, child.(*types.InternalNode), kept[i].hi, depth-1, r, spans); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectRange appends copies of the stored pairs of the tree at hash that
+// fall inside r, loading only the subtrees overlapping it
+func (b *TreeBuilder) collectRange(ctx context.Context, hash types.Hash, r keyRange, pairs *[]types.KVPair) error {
+	node, err := b.loader.loadContext(ctx, hash)
+	if err != nil {
+		return err
+	}
+
+	if leaf, ok := node.(*types.LeafNode); ok {
+		for _, pair := range leaf.Pairs {
+			if r.contains(pair.Key) {
+				*pairs = append(*pairs, copyKVPair(pair))
+			}
+		}
+		return nil
+	}
+
+	internal := node.(*types.InternalNode)
+	for i, child := range internal.Children {
+		if r.coversChild(internal.Children, i) {
+			if err := b.collectRange(ctx, child.Hash, r, pairs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fixLeafCounts makes the counts of reused leaf references match the
+// builder: set when it records subtree counts, zero when it does not.
+// Leaves written without counts are read to count them.
+func (b *TreeBuilder) fixLeafCounts(ctx context.Context, refs []types.ChildRef) error {
+	for i := range refs {
+		if !b.subtreeCounts {
+			refs[i].Count = 0
+			continue
+		}
+		if refs[i].Count > 0 {
+			continue
+		}
+		node, err := b.loader.loadContext(ctx, refs[i].Hash)
+		if err != nil {
+			return err
+		}
+		refs[i].Count = uint64(len(node.(*types.LeafNode).Pairs))
+	}
+	return nil
+}
+
+// singlePairLeaves reports whether every leaf holds exactly one pair.
+// Leaves without a recorded count are read, stopping at the first larger one.
+func (b *TreeBuilder) singlePairLeaves(ctx context.Context, refs []types.ChildRef) (bool, error) {
+	for _, ref := range refs {
+		count := ref.Count
+		if count == 0 {
+			node, err := b.loader.loadContext(ctx, ref.Hash)
+			if err != nil {
+				return false, err
+			}
+			count = uint64(len(node.(*types.LeafNode).Pairs))
+		}
+		if count != 1 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// empty reports whether the range holds no keys
+func (r keyRange) empty() bool {
+	return r.end != nil && bytes.Compare(r.start, r.end) >= 0
+}
+
+// holds reports whether every key in [lo, hi) is inside the range; a nil
+// hi is unbounded
+func (r keyRange) holds(lo, hi []byte) bool {
+	if bytes.Compare(lo, r.start) < 0 {
+		return false
+	}
+	return r.end == nil || (hi != nil && bytes.Compare(hi, r.end) <= 0)
+}
@@ -0,0 +1,306 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// recordingCAS wraps memoryCAS and records which objects were read
+type recordingCAS struct {
+	*memoryCAS
+	read map[types.Hash]bool
+}
+
+func (c *recordingCAS) Read(hash types.Hash) ([]byte, error) {
+	c.read[hash] = true
+	return c.memoryCAS.Read(hash)
+}
+
+// editPairs returns n pairs with keys "<prefix>0000".. in order
+func editPairs(prefix string, n int) []types.KVPair {
+	pairs := make([]types.KVPair, n)
+	for i := range pairs {
+		pairs[i] = types.KVPair{
+			Key:   []byte(fmt.Sprintf("%s%04d", prefix, i)),
+			Value: []byte(fmt.Sprintf("value-%s%d", prefix, i)),
+		}
+	}
+	return pairs
+}
+
+// outsideRange returns the pairs with keys outside [start, end)
+func outsideRange(pairs []types.KVPair, start, end []byte) []types.KVPair {
+	r := keyRange{start: start, end: end}
+	var result []types.KVPair
+	for _, pair := range pairs {
+		if !r.contains(pair.Key) {
+			result = append(result, pair)
+		}
+	}
+	return result
+}
+
+// TestDeleteRange_SkipsLeavesInsideRange tests that leaves entirely inside
+// the range are never read, and that the result matches a fresh build
+func TestDeleteRange_SkipsLeavesInsideRange(t *testing.T) {
+	storage := &recordingCAS{memoryCAS: newMemoryCAS(), read: make(map[types.Hash]bool)}
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(128, 32, 512))
+
+	pairs := append(append(editPairs("a:", 300), editPairs("patient:123:", 2000)...), editPairs("z:", 300)...)
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	// The leaves whose whole key span lies inside the prefix
+	var inside []types.Hash
+	var collect func(hash types.Hash, hi []byte)
+	collect = func(hash types.Hash, hi []byte) {
+		data, _ := storage.memoryCAS.Read(hash)
+		node, err := DeserializeNode(data)
+		if err != nil {
+			t.Fatalf("DeserializeNode failed: %v", err)
+		}
+		internal, ok := node.(*types.InternalNode)
+		if !ok {
+			return
+		}
+		for i, child := range internal.Children {
+			upper := childUpperBound(internal.Children, i, hi)
+			data, _ := storage.memoryCAS.Read(child.Hash)
+			if childNode, _ := DeserializeNode(data); childNode.IsLeaf() {
+				if bytes.HasPrefix(child.Key, []byte("patient:123:")) && upper != nil && bytes.Compare(upper, []byte("patient:123;")) <= 0 {
+					inside = append(inside, child.Hash)
+				}
+				continue
+			}
+			collect(child.Hash, upper)
+		}
+	}
+	collect(root, nil)
+	if len(inside) < 10 {
+		t.Fatalf("expected many leaves inside the range, got %d", len(inside))
+	}
+
+	newRoot, err := builder.DeleteRange(root, []byte("patient:123:"), PrefixEnd([]byte("patient:123:")))
+	if err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	for _, hash := range inside {
+		if storage.read[hash] {
+			t.Errorf("leaf %s inside the range was read", hash)
+		}
+	}
+
+	want, err := builder.Build(append(editPairs("a:", 300), editPairs("z:", 300)...))
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if newRoot != want {
+		t.Errorf("DeleteRange root %s differs from a fresh build %s", newRoot, want)
+	}
+}
+
+// TestDeleteRange_EdgeCases tests empty, whole-tree and single-leaf deletes
+func TestDeleteRange_EdgeCases(t *testing.T) {
+	storage := newMemoryCAS()
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(128, 32, 512))
+	pairs := editPairs("k", 500)
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	empty, err := builder.Build(nil)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	if got, err := builder.DeleteRange(root, []byte("k0300"), []byte("k0100")); err != nil || got != root {
+		t.Errorf("empty range: got %s, %v; expected the root unchanged", got, err)
+	}
+	if got, err := builder.DeleteRange(root, nil, nil); err != nil || got != empty {
+		t.Errorf("whole tree: got %s, %v; expected the empty tree", got, err)
+	}
+	if got, err := builder.DeleteRange(root, []byte("x"), nil); err != nil || got != root {
+		t.Errorf("range past the last key: got %s, %v; expected the root unchanged", got, err)
+	}
+
+	leafRoot, err := builder.Build(pairs[:3])
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	want, err := builder.Build(pairs[:1])
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if got, err := builder.DeleteRange(leafRoot, []byte("k0001"), nil); err != nil || got != want {
+		t.Errorf("single leaf: got %s, %v; expected %s", got, err, want)
+	}
+}
+
+// TestCopyPrefix_CopiesBlobReferences tests that copied values stored out of
+// line keep their blob reference and that dst is replaced, not merged
+func TestCopyPrefix_CopiesBlobReferences(t *testing.T) {
+	storage := newMemoryCAS()
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(128, 32, 512))
+	traverser := NewTreeTraverser(storage)
+
+	pairs := append(editPairs("patient:1:", 200), editPairs("patient:2:", 50)...)
+	big := bytes.Repeat([]byte("scan"), 4096)
+	pairs[5].Value = big
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	newRoot, err := builder.CopyPrefix(root, []byte("patient:1:"), []byte("patient:2:"))
+	if err != nil {
+		t.Fatalf("CopyPrefix failed: %v", err)
+	}
+
+	got, err := traverser.GetAllRaw(newRoot)
+	if err != nil {
+		t.Fatalf("GetAllRaw failed: %v", err)
+	}
+	if len(got) != 400 {
+		t.Fatalf("expected 400 keys, got %d", len(got))
+	}
+	src, dst := got[5], got[205]
+	if string(dst.Key) != "patient:2:0005" || !dst.ValueRef || !bytes.Equal(src.Value, dst.Value) {
+		t.Errorf("expected patient:2:0005 to share the blob reference of %s", src.Key)
+	}
+	if _, err := traverser.Get(newRoot, []byte("patient:2:0049")); err != nil {
+		t.Errorf("Get(patient:2:0049) failed: %v", err)
+	}
+	if _, err := traverser.Get(newRoot, []byte("patient:2:0150")); err != nil {
+		t.Errorf("Get(patient:2:0150) failed: %v", err)
+	}
+}
+
+// TestProperty_EditsMatchBuild checks that DeleteRange, CopyPrefix and
+// ReplaceRange produce exactly the tree Build would for every chunking
+// algorithm
+func TestProperty_EditsMatchBuild(t *testing.T) {
+	rapid.Check(t, func(rt *rapid.T) {
+		algorithm := rapid.SampledFrom(chunker.Algorithms).Draw(rt, "algorithm")
+		c, err := chunker.New(algorithm, 128, 32, 512)
+		if err != nil {
+			rt.Fatalf("chunker.New failed: %v", err)
+		}
+		storage := newMemoryCAS()
+		builder := NewTreeBuilder(storage, c)
+		builder.SetSubtreeCounts(rapid.Bool().Draw(rt, "counts"))
+
+		prefixes := []string{"a", "b", "ba", "c"}
+		var pairs []types.KVPair
+		for _, prefix := range prefixes {
+			pairs = append(pairs, editPairs(prefix, rapid.IntRange(0, 400).Draw(rt, "n-"+prefix))...)
+		}
+		// Values past the maximum chunk size give single-pair leaves
+		if rapid.IntRange(0, 4).Draw(rt, "large") == 0 {
+			for i := range pairs {
+				pairs[i].Value = bytes.Repeat(pairs[i].Value, 64)
+			}
+		}
+
+		root, err := builder.Build(pairs)
+		if err != nil {
+			rt.Fatalf("Build failed: %v", err)
+		}
+
+		key := func(label string) []byte {
+			if rapid.IntRange(0, 9).Draw(rt, label+"-nil") == 0 {
+				return nil
+			}
+			prefix := rapid.SampledFrom(prefixes).Draw(rt, label+"-prefix")
+			return []byte(fmt.Sprintf("%s%04d", prefix, rapid.IntRange(0, 450).Draw(rt, label)))
+		}
+		start, end := key("start"), key("end")
+		got, err := builder.DeleteRange(root, start, end)
+		if err != nil {
+			rt.Fatalf("DeleteRange failed: %v", err)
+		}
+		want, err := builder.Build(outsideRange(pairs, start, end))
+		if err != nil {
+			rt.Fatalf("Build failed: %v", err)
+		}
+		if got != want {
+			rt.Fatalf("DeleteRange(%q, %q) root differs from a fresh build", start, end)
+		}
+
+		src := []byte(rapid.SampledFrom(prefixes).Draw(rt, "src"))
+		dst := []byte(rapid.SampledFrom(prefixes).Draw(rt, "dst"))
+		got, err = builder.CopyPrefix(root, src, dst)
+		if err != nil {
+			rt.Fatalf("CopyPrefix failed: %v", err)
+		}
+		expected := outsideRange(pairs, dst, PrefixEnd(dst))
+		for _, pair := range pairs {
+			if bytes.HasPrefix(pair.Key, src) {
+				copied := append(append([]byte{}, dst...), pair.Key[len(src):]...)
+				expected = append(expected, types.KVPair{Key: copied, Value: pair.Value})
+			}
+		}
+		sort.Slice(expected, func(i, j int) bool {
+			return bytes.Compare(expected[i].Key, expected[j].Key) < 0
+		})
+		want, err = builder.Build(expected)
+		if err != nil {
+			rt.Fatalf("Build failed: %v", err)
+		}
+		if got != want {
+			rt.Fatalf("CopyPrefix(%q, %q) root differs from a fresh build", src, dst)
+		}
+
+		// Replace the range with a changed copy of some of its pairs
+		var insert []types.KVPair
+		r := keyRange{start: start, end: end}
+		for i, pair := range pairs {
+			if r.contains(pair.Key) && rapid.IntRange(0, 2).Draw(rt, fmt.Sprintf("keep-%d", i)) > 0 {
+				insert = append(insert, types.KVPair{Key: pair.Key, Value: append([]byte("new-"), pair.Value...)})
+			}
+		}
+		got, err = builder.ReplaceRange(root, start, end, insert)
+		if err != nil {
+			rt.Fatalf("ReplaceRange failed: %v", err)
+		}
+		expected = append(outsideRange(pairs, start, end), insert...)
+		sort.Slice(expected, func(i, j int) bool {
+			return bytes.Compare(expected[i].Key, expected[j].Key) < 0
+		})
+		want, err = builder.Build(expected)
+		if err != nil {
+			rt.Fatalf("Build failed: %v", err)
+		}
+		if got != want {
+			rt.Fatalf("ReplaceRange(%q, %q) root differs from a fresh build", start, end)
+		}
+	})
+}
+
+// TestReplaceRange_RejectsPairsOutsideRange tests that ReplaceRange refuses
+// unsorted pairs and pairs outside the range
+func TestReplaceRange_RejectsPairsOutsideRange(t *testing.T) {
+	builder := NewTreeBuilder(newMemoryCAS(), chunker.NewBuzhashChunker(128, 32, 512))
+	root, err := builder.Build(editPairs("k", 100))
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	outside := []types.KVPair{{Key: []byte("z"), Value: []byte("v")}}
+	if _, err := builder.ReplaceRange(root, []byte("k"), []byte("l"), outside); !errors.Is(err, ErrInvalidRangeEdit) {
+		t.Errorf("ReplaceRange with a key outside the range returned %v, expected ErrInvalidRangeEdit", err)
+	}
+	unsorted := []types.KVPair{{Key: []byte("k2"), Value: []byte("v")}, {Key: []byte("k1"), Value: []byte("v")}}
+	if _, err := builder.ReplaceRange(root, []byte("k"), nil, unsorted); !errors.Is(err, ErrInvalidRangeEdit) {
+		t.Errorf("ReplaceRange with unsorted keys returned %v, expected ErrInvalidRangeEdit", err)
+	}
+}
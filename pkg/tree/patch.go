@@ -0,0 +1,310 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"microprolly/pkg/types"
+)
+
+const (
+	// patchMagic identifies a binary MicroProlly patch
+	patchMagic = "MPPATCH\x00"
+	// PatchVersion is the current patch format version
+	PatchVersion = 1
+)
+
+// Operation bytes in the binary patch format. These are fixed values rather
+// than DiffKind so the encoding does not change if DiffKind does.
+const (
+	patchOpAdded    byte = 1
+	patchOpModified byte = 2
+	patchOpDeleted  byte = 3
+)
+
+var (
+	// ErrInvalidPatch is returned when a patch is malformed or fails its checksum
+	ErrInvalidPatch = errors.New("invalid patch")
+	// ErrUnsupportedPatchVersion is returned for patches from a newer format
+	ErrUnsupportedPatchVersion = errors.New("unsupported patch version")
+)
+
+// Patch is a self-contained, serializable set of changes between two versions.
+// Unlike DiffResult it keeps the old value of deleted keys, so a receiver can
+// verify its current state before applying the patch.
+type Patch struct {
+	// Base and Target identify the versions the patch goes between
+	// (commit hashes for patches created by a Store)
+	Base   types.Hash
+	Target types.Hash
+	// Entries are the changes in ascending key order
+	Entries []DiffEntry
+}
+
+// CreatePatch builds a Patch from the differences between two tree roots.
+// The patch's Base and Target are set to the roots; callers may replace them.
+func (d *DiffEngine) CreatePatch(hashA, hashB types.Hash) (*Patch, error) {
+	patch := &Patch{Base: hashA, Target: hashB, Entries: []DiffEntry{}}
+	err := d.DiffStreamContext(context.Background(), hashA, hashB, DiffOptions{}, func(e DiffEntry) error {
+		patch.Entries = append(patch.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// MarshalBinary encodes the patch in the versioned binary format.
+//
+// Binary format (big-endian):
+//
+//	[8 bytes: magic "MPPATCH\0"]
+//	[4 bytes: format version]
+//	[32 bytes: base hash][32 bytes: target hash]
+//	[4 bytes: entry count]
+//	For each entry:
+//	  [1 byte: op (1=added, 2=modified, 3=deleted)]
+//	  [4 bytes: key length][N bytes: key]
+//	  [4 bytes: old value length][M bytes: old value] (modified, deleted)
+//	  [4 bytes: new value length][K bytes: new value] (added, modified)
+//	[32 bytes: SHA-256 of everything above]
+func (p *Patch) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(patchMagic)
+	buf.Write(binary.BigEndian.AppendUint32(nil, PatchVersion))
+	buf.Write(p.Base[:])
+	buf.Write(p.Target[:])
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(p.Entries))))
+
+	for _, e := range p.Entries {
+		op, err := patchOp(e.Kind)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(op)
+		writePatchBytes(&buf, e.Key)
+		if op != patchOpAdded {
+			writePatchBytes(&buf, e.OldValue)
+		}
+		if op != patchOpDeleted {
+			writePatchBytes(&buf, e.NewValue)
+		}
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a patch produced by MarshalBinary
+func (p *Patch) UnmarshalBinary(data []byte) error {
+	headerLen := len(patchMagic) + 4 + 2*len(types.Hash{}) + 4
+	if len(data) < headerLen+sha256.Size {
+		return fmt.Errorf("%w: truncated header", ErrInvalidPatch)
+	}
+
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if expected := sha256.Sum256(body); !bytes.Equal(sum, expected[:]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidPatch)
+	}
+	if string(body[:len(patchMagic)]) != patchMagic {
+		return fmt.Errorf("%w: bad magic", ErrInvalidPatch)
+	}
+	pos := len(patchMagic)
+
+	version := binary.BigEndian.Uint32(body[pos:])
+	if version != PatchVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedPatchVersion, version)
+	}
+	pos += 4
+
+	var result Patch
+	copy(result.Base[:], body[pos:])
+	pos += len(types.Hash{})
+	copy(result.Target[:], body[pos:])
+	pos += len(types.Hash{})
+
+	count := binary.BigEndian.Uint32(body[pos:])
+	pos += 4
+
+	result.Entries = make([]DiffEntry, 0, min(int(count), len(body)))
+	for i := uint32(0); i < count; i++ {
+		if pos >= len(body) {
+			return fmt.Errorf("%w: truncated entry %d", ErrInvalidPatch, i)
+		}
+		op := body[pos]
+		pos++
+
+		var e DiffEntry
+		var err error
+		switch op {
+		case patchOpAdded:
+			e.Kind = DiffAdded
+		case patchOpModified:
+			e.Kind = DiffModified
+		case patchOpDeleted:
+			e.Kind = DiffDeleted
+		default:
+			return fmt.Errorf("%w: unknown op %d", ErrInvalidPatch, op)
+		}
+
+		if e.Key, pos, err = readPatchBytes(body, pos); err != nil {
+			return err
+		}
+		if op != patchOpAdded {
+			if e.OldValue, pos, err = readPatchBytes(body, pos); err != nil {
+				return err
+			}
+		}
+		if op != patchOpDeleted {
+			if e.NewValue, pos, err = readPatchBytes(body, pos); err != nil {
+				return err
+			}
+		}
+		result.Entries = append(result.Entries, e)
+	}
+
+	if pos != len(body) {
+		return fmt.Errorf("%w: %d bytes of trailing data", ErrInvalidPatch, len(body)-pos)
+	}
+
+	*p = result
+	return nil
+}
+
+// patchJSON is the JSON representation of a Patch.
+// Hashes are hex strings; keys and values use standard base64.
+type patchJSON struct {
+	Version int              `json:"version"`
+	Base    string           `json:"base"`
+	Target  string           `json:"target"`
+	Entries []patchEntryJSON `json:"entries"`
+}
+
+type patchEntryJSON struct {
+	Op       string `json:"op"`
+	Key      []byte `json:"key"`
+	OldValue []byte `json:"old_value,omitempty"`
+	NewValue []byte `json:"new_value,omitempty"`
+}
+
+// MarshalJSON encodes the patch as versioned JSON
+func (p *Patch) MarshalJSON() ([]byte, error) {
+	pj := patchJSON{
+		Version: PatchVersion,
+		Base:    hex.EncodeToString(p.Base[:]),
+		Target:  hex.EncodeToString(p.Target[:]),
+		Entries: make([]patchEntryJSON, len(p.Entries)),
+	}
+	for i, e := range p.Entries {
+		if _, err := patchOp(e.Kind); err != nil {
+			return nil, err
+		}
+		pj.Entries[i] = patchEntryJSON{
+			Op:       e.Kind.String(),
+			Key:      e.Key,
+			OldValue: e.OldValue,
+			NewValue: e.NewValue,
+		}
+	}
+	return json.Marshal(pj)
+}
+
+// UnmarshalJSON decodes a patch produced by MarshalJSON
+func (p *Patch) UnmarshalJSON(data []byte) error {
+	var pj patchJSON
+	if err := json.Unmarshal(data, &pj); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	if pj.Version != PatchVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedPatchVersion, pj.Version)
+	}
+
+	var result Patch
+	var err error
+	if result.Base, err = decodePatchHash(pj.Base); err != nil {
+		return err
+	}
+	if result.Target, err = decodePatchHash(pj.Target); err != nil {
+		return err
+	}
+
+	result.Entries = make([]DiffEntry, len(pj.Entries))
+	for i, ej := range pj.Entries {
+		e := DiffEntry{Key: ej.Key}
+		// omitempty drops empty values, so restore them from the op
+		switch ej.Op {
+		case DiffAdded.String():
+			e.Kind = DiffAdded
+			e.NewValue = nonNil(ej.NewValue)
+		case DiffModified.String():
+			e.Kind = DiffModified
+			e.OldValue = nonNil(ej.OldValue)
+			e.NewValue = nonNil(ej.NewValue)
+		case DiffDeleted.String():
+			e.Kind = DiffDeleted
+			e.OldValue = nonNil(ej.OldValue)
+		default:
+			return fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, ej.Op)
+		}
+		result.Entries[i] = e
+	}
+
+	*p = result
+	return nil
+}
+
+// patchOp maps a DiffKind to its binary op byte
+func patchOp(kind DiffKind) (byte, error) {
+	switch kind {
+	case DiffAdded:
+		return patchOpAdded, nil
+	case DiffModified:
+		return patchOpModified, nil
+	case DiffDeleted:
+		return patchOpDeleted, nil
+	default:
+		return 0, fmt.Errorf("%w: unknown diff kind %d", ErrInvalidPatch, kind)
+	}
+}
+
+func writePatchBytes(buf *bytes.Buffer, b []byte) {
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+	buf.Write(b)
+}
+
+func readPatchBytes(data []byte, pos int) ([]byte, int, error) {
+	if len(data)-pos < 4 {
+		return nil, pos, fmt.Errorf("%w: truncated length", ErrInvalidPatch)
+	}
+	n := int(binary.BigEndian.Uint32(data[pos:]))
+	pos += 4
+	if len(data)-pos < n {
+		return nil, pos, fmt.Errorf("%w: truncated data", ErrInvalidPatch)
+	}
+	return copyBytes(data[pos : pos+n]), pos + n, nil
+}
+
+func decodePatchHash(s string) (types.Hash, error) {
+	var h types.Hash
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(types.Hash{}) {
+		return h, fmt.Errorf("%w: bad hash %q", ErrInvalidPatch, s)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
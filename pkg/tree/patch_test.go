@@ -0,0 +1,142 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+func patchesEqual(a, b *Patch) bool {
+	return a.Base == b.Base && a.Target == b.Target && diffEntriesEqual(a.Entries, b.Entries)
+}
+
+// genPatch generates a patch with arbitrary entries, including empty values
+func genPatch() *rapid.Generator[*Patch] {
+	return rapid.Custom(func(t *rapid.T) *Patch {
+		var p Patch
+		copy(p.Base[:], rapid.SliceOfN(rapid.Byte(), 32, 32).Draw(t, "base"))
+		copy(p.Target[:], rapid.SliceOfN(rapid.Byte(), 32, 32).Draw(t, "target"))
+
+		count := rapid.IntRange(0, 20).Draw(t, "count")
+		p.Entries = make([]DiffEntry, count)
+		for i := range p.Entries {
+			e := DiffEntry{
+				Kind: DiffKind(rapid.IntRange(0, 2).Draw(t, "kind")),
+				Key:  rapid.SliceOfN(rapid.Byte(), 1, 16).Draw(t, "key"),
+			}
+			if e.Kind != DiffAdded {
+				e.OldValue = rapid.SliceOf(rapid.Byte()).Draw(t, "old")
+			}
+			if e.Kind != DiffDeleted {
+				e.NewValue = rapid.SliceOf(rapid.Byte()).Draw(t, "new")
+			}
+			p.Entries[i] = e
+		}
+		return &p
+	})
+}
+
+// TestProperty_PatchBinaryRoundTrip tests that binary encoding round-trips
+func TestProperty_PatchBinaryRoundTrip(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		patch := genPatch().Draw(t, "patch")
+
+		data, err := patch.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		var decoded Patch
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary failed: %v", err)
+		}
+		if !patchesEqual(patch, &decoded) {
+			t.Fatal("Binary round trip changed the patch")
+		}
+	})
+}
+
+// TestProperty_PatchJSONRoundTrip tests that JSON encoding round-trips
+func TestProperty_PatchJSONRoundTrip(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		patch := genPatch().Draw(t, "patch")
+
+		data, err := json.Marshal(patch)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		var decoded Patch
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if !patchesEqual(patch, &decoded) {
+			t.Fatalf("JSON round trip changed the patch: %s", data)
+		}
+	})
+}
+
+// TestPatch_RejectsCorruptData tests checksum, version and op validation
+func TestPatch_RejectsCorruptData(t *testing.T) {
+	patch := &Patch{Entries: []DiffEntry{
+		{Kind: DiffModified, Key: []byte("k"), OldValue: []byte("a"), NewValue: []byte("b")},
+	}}
+	data, err := patch.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)-40] ^= 0xff
+	var decoded Patch
+	if err := decoded.UnmarshalBinary(corrupt); !errors.Is(err, ErrInvalidPatch) {
+		t.Fatalf("Expected ErrInvalidPatch for flipped byte, got %v", err)
+	}
+	if err := decoded.UnmarshalBinary(data[:20]); !errors.Is(err, ErrInvalidPatch) {
+		t.Fatalf("Expected ErrInvalidPatch for truncated data, got %v", err)
+	}
+
+	future := []byte(`{"version":99,"base":"","target":"","entries":[]}`)
+	if err := json.Unmarshal(future, &decoded); !errors.Is(err, ErrUnsupportedPatchVersion) {
+		t.Fatalf("Expected ErrUnsupportedPatchVersion, got %v", err)
+	}
+}
+
+// TestCreatePatch_KeepsDeletedValues tests that patches carry old values for deletes
+func TestCreatePatch_KeepsDeletedValues(t *testing.T) {
+	storage := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(storage, chunker.DefaultChunker())
+	differ := NewDiffEngine(storage)
+
+	hashA, err := builder.Build([]types.KVPair{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+	})
+	if err != nil {
+		t.Fatalf("Build A failed: %v", err)
+	}
+	hashB, err := builder.Build([]types.KVPair{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("c"), Value: []byte("3")},
+	})
+	if err != nil {
+		t.Fatalf("Build B failed: %v", err)
+	}
+
+	patch, err := differ.CreatePatch(hashA, hashB)
+	if err != nil {
+		t.Fatalf("CreatePatch failed: %v", err)
+	}
+	expected := []DiffEntry{
+		{Kind: DiffDeleted, Key: []byte("b"), OldValue: []byte("2")},
+		{Kind: DiffAdded, Key: []byte("c"), NewValue: []byte("3")},
+	}
+	if patch.Base != hashA || patch.Target != hashB || !diffEntriesEqual(expected, patch.Entries) {
+		t.Fatalf("Unexpected patch: %+v", patch)
+	}
+}
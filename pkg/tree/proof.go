@@ -0,0 +1,323 @@
+package tree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"microprolly/pkg/types"
+)
+
+// proofFormatVersion is the first byte of an encoded Proof
+const proofFormatVersion = 1
+
+var (
+	// ErrInvalidProof is returned when a proof does not verify against a root
+	ErrInvalidProof = errors.New("invalid proof")
+)
+
+// Proof shows what a tree holds for a key or key range to someone who
+// knows only the root hash. Because every node is addressed by its hash,
+// the nodes on the paths to the covered leaves commit to their contents.
+type Proof struct {
+	// Nodes are the serialized nodes visited, depth-first from the root
+	Nodes [][]byte
+	// Blobs are the index and chunks of each covered value stored out of
+	// line, in key order
+	Blobs [][]byte
+}
+
+// Prove returns a proof of the value of key in the tree at rootHash, or of
+// its absence. The proof holds the serialized nodes on the path from the
+// root to the leaf where the key is or would be.
+func (t *TreeTraverser) Prove(rootHash types.Hash, key []byte) (*Proof, error) {
+	start, end := pointRange(key)
+	return t.ProveRange(rootHash, start, end)
+}
+
+// ProveRange returns a proof of every pair with start <= key < end in the
+// tree at rootHash. A nil end is unbounded. The proof holds every node whose
+// key span overlaps the range, so it also shows that no other keys exist in it.
+func (t *TreeTraverser) ProveRange(rootHash types.Hash, start, end []byte) (*Proof, error) {
+	proof := &Proof{}
+	r := keyRange{start: start, end: end}
+	if err := t.proveNode(rootHash, r, proof); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// proveNode adds a node and the parts of its subtree overlapping r to proof
+func (t *TreeTraverser) proveNode(hash types.Hash, r keyRange, proof *Proof) error {
+	data, err := t.cas.Read(hash)
+	if err != nil {
+		return err
+	}
+	proof.Nodes = append(proof.Nodes, data)
+
+	node, err := DeserializeNode(data)
+	if err != nil {
+		return err
+	}
+
+	if internal, ok := node.(*types.InternalNode); ok {
+		for i, child := range internal.Children {
+			if r.coversChild(internal.Children, i) {
+				if err := t.proveNode(child.Hash, r, proof); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, pair := range node.(*types.LeafNode).Pairs {
+		if !pair.ValueRef || !r.contains(pair.Key) {
+			continue
+		}
+		if err := t.proveBlob(pair.Value, proof); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proveBlob adds the index and chunks of an out-of-line value to proof
+func (t *TreeTraverser) proveBlob(encodedRef []byte, proof *Proof) error {
+	ref, err := DecodeBlobRef(encodedRef)
+	if err != nil {
+		return err
+	}
+	index, err := t.cas.Read(ref.Index)
+	if err != nil {
+		return err
+	}
+	chunks, err := deserializeBlobIndex(index, ref)
+	if err != nil {
+		return err
+	}
+
+	proof.Blobs = append(proof.Blobs, index)
+	for _, chunk := range chunks {
+		data, err := t.cas.Read(chunk.hash)
+		if err != nil {
+			return err
+		}
+		proof.Blobs = append(proof.Blobs, data)
+	}
+	return nil
+}
+
+// VerifyProof checks a proof produced by Prove against rootHash without CAS
+// access. It returns the value of key and true if the proof shows the key
+// present, or false if it shows the key absent. Proofs that do not match
+// the root fail with ErrInvalidProof.
+func VerifyProof(rootHash types.Hash, key []byte, proof *Proof) ([]byte, bool, error) {
+	start, end := pointRange(key)
+	pairs, err := VerifyRangeProof(rootHash, start, end, proof)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(pairs) == 0 {
+		return nil, false, nil
+	}
+	return pairs[0].Value, true, nil
+}
+
+// VerifyRangeProof checks a proof produced by ProveRange against rootHash
+// without CAS access and returns every pair with start <= key < end, with
+// values resolved. The result is complete: the proof shows the tree holds
+// no other keys in the range.
+func VerifyRangeProof(rootHash types.Hash, start, end []byte, proof *Proof) ([]types.KVPair, error) {
+	v := proofVerifier{
+		r:     keyRange{start: start, end: end},
+		nodes: proof.Nodes,
+		blobs: proof.Blobs,
+	}
+	if err := v.verifyNode(rootHash); err != nil {
+		return nil, err
+	}
+	if len(v.nodes) > 0 || len(v.blobs) > 0 {
+		return nil, fmt.Errorf("%w: %d unused nodes and %d unused blob objects", ErrInvalidProof, len(v.nodes), len(v.blobs))
+	}
+	return v.pairs, nil
+}
+
+// proofVerifier consumes proof objects in the order the prover added them
+type proofVerifier struct {
+	r     keyRange
+	nodes [][]byte
+	blobs [][]byte
+	pairs []types.KVPair
+}
+
+// next pops the first object of objects and checks that it hashes to expected
+func (v *proofVerifier) next(objects *[][]byte, expected types.Hash) ([]byte, error) {
+	if len(*objects) == 0 {
+		return nil, fmt.Errorf("%w: missing object %s", ErrInvalidProof, expected.String())
+	}
+	data := (*objects)[0]
+	*objects = (*objects)[1:]
+	if sha256.Sum256(data) != expected {
+		return nil, fmt.Errorf("%w: object does not match hash %s", ErrInvalidProof, expected.String())
+	}
+	return data, nil
+}
+
+// verifyNode checks the node with the given hash and the covered part of its subtree
+func (v *proofVerifier) verifyNode(hash types.Hash) error {
+	data, err := v.next(&v.nodes, hash)
+	if err != nil {
+		return err
+	}
+	node, err := DeserializeNode(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+
+	if internal, ok := node.(*types.InternalNode); ok {
+		for i, child := range internal.Children {
+			if v.r.coversChild(internal.Children, i) {
+				if err := v.verifyNode(child.Hash); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, pair := range node.(*types.LeafNode).Pairs {
+		if !v.r.contains(pair.Key) {
+			continue
+		}
+		if pair.ValueRef {
+			value, err := v.verifyBlob(pair.Value)
+			if err != nil {
+				return err
+			}
+			pair = types.KVPair{Key: pair.Key, Value: value}
+		}
+		v.pairs = append(v.pairs, pair)
+	}
+	return nil
+}
+
+// verifyBlob checks and reassembles an out-of-line value from the proof
+func (v *proofVerifier) verifyBlob(encodedRef []byte) ([]byte, error) {
+	ref, err := DecodeBlobRef(encodedRef)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+	index, err := v.next(&v.blobs, ref.Index)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := deserializeBlobIndex(index, ref)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+
+	value := make([]byte, 0, ref.Size)
+	for _, chunk := range chunks {
+		data, err := v.next(&v.blobs, chunk.hash)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, data...)
+	}
+	return value, nil
+}
+
+// keyRange is the key range [start, end) a proof or edit covers; nil end is unbounded
+type keyRange struct {
+	start, end []byte
+}
+
+// pointRange returns the range holding only key
+func pointRange(key []byte) (start, end []byte) {
+	return key, append(copyBytes(key), 0)
+}
+
+// contains reports whether key falls inside the range
+func (r keyRange) contains(key []byte) bool {
+	if bytes.Compare(key, r.start) < 0 {
+		return false
+	}
+	return r.end == nil || bytes.Compare(key, r.end) < 0
+}
+
+// coversChild reports whether the keys routed to children[i] overlap the
+// range. Lookups send a key to the last child whose key is <= it, so child
+// i spans [children[i].Key, children[i+1].Key), the first child unbounded below.
+func (r keyRange) coversChild(children []types.ChildRef, i int) bool {
+	if i+1 < len(children) && bytes.Compare(children[i+1].Key, r.start) <= 0 {
+		return false
+	}
+	return i == 0 || r.end == nil || bytes.Compare(children[i].Key, r.end) < 0
+}
+
+// Encode serializes the proof for transfer.
+//
+// Format (big-endian):
+//
+//	[1 byte: version]
+//	[4 bytes: node count] For each node: [4 bytes: length][data]
+//	[4 bytes: blob object count] For each object: [4 bytes: length][data]
+func (p *Proof) Encode() []byte {
+	var buf []byte
+	buf = append(buf, proofFormatVersion)
+	for _, objects := range [][][]byte{p.Nodes, p.Blobs} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(objects)))
+		for _, data := range objects {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+			buf = append(buf, data...)
+		}
+	}
+	return buf
+}
+
+// DecodeProof parses a proof produced by Encode
+func DecodeProof(data []byte) (*Proof, error) {
+	if len(data) < 1 || data[0] != proofFormatVersion {
+		return nil, fmt.Errorf("%w: unsupported encoding", ErrInvalidProof)
+	}
+	pos := 1
+
+	readObjects := func() ([][]byte, error) {
+		if len(data)-pos < 4 {
+			return nil, fmt.Errorf("%w: truncated", ErrInvalidProof)
+		}
+		count := int(binary.BigEndian.Uint32(data[pos:]))
+		pos += 4
+
+		var objects [][]byte
+		for i := 0; i < count; i++ {
+			if len(data)-pos < 4 {
+				return nil, fmt.Errorf("%w: truncated", ErrInvalidProof)
+			}
+			n := int(binary.BigEndian.Uint32(data[pos:]))
+			pos += 4
+			if len(data)-pos < n {
+				return nil, fmt.Errorf("%w: truncated", ErrInvalidProof)
+			}
+			objects = append(objects, copyBytes(data[pos:pos+n]))
+			pos += n
+		}
+		return objects, nil
+	}
+
+	nodes, err := readObjects()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := readObjects()
+	if err != nil {
+		return nil, err
+	}
+	if pos != len(data) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidProof, len(data)-pos)
+	}
+	return &Proof{Nodes: nodes, Blobs: blobs}, nil
+}
@@ -0,0 +1,265 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"microprolly/pkg/cas"
+	"microprolly/pkg/chunker"
+	"microprolly/pkg/types"
+
+	"pgregory.net/rapid"
+)
+
+// buildProofTree builds a multi-level tree of n keys "key0000".. with small nodes
+func buildProofTree(t *testing.T, n int) (*cas.MemoryCAS, types.Hash, []types.KVPair) {
+	t.Helper()
+	store := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(store, chunker.NewBuzhashChunker(128, 32, 512))
+
+	pairs := make([]types.KVPair, n)
+	for i := range pairs {
+		pairs[i] = types.KVPair{
+			Key:   []byte(fmt.Sprintf("key%04d", i*2)),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+		}
+	}
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	return store, root, pairs
+}
+
+// TestProof_InclusionAndExclusion checks proofs for present and absent keys,
+// including keys before the first and after the last
+func TestProof_InclusionAndExclusion(t *testing.T) {
+	store, root, pairs := buildProofTree(t, 500)
+	traverser := NewTreeTraverser(store)
+
+	for _, pair := range pairs[:50] {
+		proof, err := traverser.Prove(root, pair.Key)
+		if err != nil {
+			t.Fatalf("Prove(%q) failed: %v", pair.Key, err)
+		}
+		value, found, err := VerifyProof(root, pair.Key, proof)
+		if err != nil {
+			t.Fatalf("VerifyProof(%q) failed: %v", pair.Key, err)
+		}
+		if !found || !bytes.Equal(value, pair.Value) {
+			t.Errorf("VerifyProof(%q) = %q, %v; want %q", pair.Key, value, found, pair.Value)
+		}
+	}
+
+	for _, key := range []string{"", "a", "key0001", "key0501", "key9999", "zzz"} {
+		proof, err := traverser.Prove(root, []byte(key))
+		if err != nil {
+			t.Fatalf("Prove(%q) failed: %v", key, err)
+		}
+		_, found, err := VerifyProof(root, []byte(key), proof)
+		if err != nil {
+			t.Fatalf("VerifyProof(%q) failed: %v", key, err)
+		}
+		if found {
+			t.Errorf("VerifyProof(%q) reported an absent key as present", key)
+		}
+	}
+}
+
+// TestProof_RejectsForgery checks that modified, incomplete, padded or
+// misapplied proofs fail with ErrInvalidProof
+func TestProof_RejectsForgery(t *testing.T) {
+	store, root, pairs := buildProofTree(t, 500)
+	traverser := NewTreeTraverser(store)
+	key := pairs[123].Key
+
+	prove := func() *Proof {
+		proof, err := traverser.Prove(root, key)
+		if err != nil {
+			t.Fatalf("Prove failed: %v", err)
+		}
+		if len(proof.Nodes) < 2 {
+			t.Fatalf("expected a multi-level tree, proof has %d nodes", len(proof.Nodes))
+		}
+		return proof
+	}
+
+	tampered := prove()
+	leaf := tampered.Nodes[len(tampered.Nodes)-1]
+	tampered.Nodes[len(tampered.Nodes)-1] = bytes.Replace(leaf, pairs[123].Value, []byte("forged!"), 1)
+
+	truncated := prove()
+	truncated.Nodes = truncated.Nodes[:len(truncated.Nodes)-1]
+
+	padded := prove()
+	padded.Nodes = append(padded.Nodes, padded.Nodes[0])
+
+	cases := map[string]struct {
+		root  types.Hash
+		key   []byte
+		proof *Proof
+	}{
+		"tampered leaf": {root, key, tampered},
+		"missing node":  {root, key, truncated},
+		"extra node":    {root, key, padded},
+		"wrong root":    {types.Hash{1}, key, prove()},
+		"other key":     {root, pairs[400].Key, prove()},
+		"empty proof":   {root, key, &Proof{}},
+	}
+	for name, tc := range cases {
+		if _, _, err := VerifyProof(tc.root, tc.key, tc.proof); !errors.Is(err, ErrInvalidProof) {
+			t.Errorf("%s: expected ErrInvalidProof, got %v", name, err)
+		}
+	}
+}
+
+// TestProof_BlobValues checks that proofs carry and verify out-of-line values
+func TestProof_BlobValues(t *testing.T) {
+	store := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(store, chunker.DefaultChunker())
+	traverser := NewTreeTraverser(store)
+
+	large := randomBytes(7, 100_000)
+	pairs := []types.KVPair{
+		{Key: []byte("a"), Value: []byte("small")},
+		{Key: []byte("b"), Value: large},
+	}
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	proof, err := traverser.Prove(root, []byte("b"))
+	if err != nil {
+		t.Fatalf("Prove failed: %v", err)
+	}
+	if len(proof.Blobs) < 2 {
+		t.Fatalf("expected the blob index and chunks in the proof, got %d objects", len(proof.Blobs))
+	}
+	value, found, err := VerifyProof(root, []byte("b"), proof)
+	if err != nil {
+		t.Fatalf("VerifyProof failed: %v", err)
+	}
+	if !found || !bytes.Equal(value, large) {
+		t.Error("VerifyProof returned a different value")
+	}
+
+	proof.Blobs[1] = append([]byte{0}, proof.Blobs[1]...)
+	if _, _, err := VerifyProof(root, []byte("b"), proof); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("expected ErrInvalidProof for a modified chunk, got %v", err)
+	}
+
+	// A proof for the inline value does not carry the blob
+	proof, err = traverser.Prove(root, []byte("a"))
+	if err != nil {
+		t.Fatalf("Prove failed: %v", err)
+	}
+	if len(proof.Blobs) != 0 {
+		t.Errorf("expected no blob objects, got %d", len(proof.Blobs))
+	}
+}
+
+// TestProof_EncodeRoundTrip checks Encode and DecodeProof
+func TestProof_EncodeRoundTrip(t *testing.T) {
+	store, root, pairs := buildProofTree(t, 200)
+	traverser := NewTreeTraverser(store)
+
+	proof, err := traverser.ProveRange(root, pairs[10].Key, pairs[40].Key)
+	if err != nil {
+		t.Fatalf("ProveRange failed: %v", err)
+	}
+	encoded := proof.Encode()
+	decoded, err := DecodeProof(encoded)
+	if err != nil {
+		t.Fatalf("DecodeProof failed: %v", err)
+	}
+	got, err := VerifyRangeProof(root, pairs[10].Key, pairs[40].Key, decoded)
+	if err != nil {
+		t.Fatalf("VerifyRangeProof failed: %v", err)
+	}
+	if len(got) != 30 {
+		t.Errorf("expected 30 pairs, got %d", len(got))
+	}
+
+	for _, bad := range [][]byte{nil, {9}, encoded[:len(encoded)-1], append(encoded, 0)} {
+		if _, err := DecodeProof(bad); !errors.Is(err, ErrInvalidProof) {
+			t.Errorf("expected ErrInvalidProof for %d bytes, got %v", len(bad), err)
+		}
+	}
+}
+
+// TestProperty_ProofsMatchTree checks that point proofs agree with Get and
+// range proofs with the filtered contents of the tree, for random trees
+func TestProperty_ProofsMatchTree(t *testing.T) {
+	rapid.Check(t, func(rt *rapid.T) {
+		store := cas.NewMemoryCAS()
+		builder := NewTreeBuilder(store, chunker.NewBuzhashChunker(128, 32, 512))
+		builder.SetBlobThreshold(rapid.IntRange(16, 256).Draw(rt, "threshold"))
+		traverser := NewTreeTraverser(store)
+
+		keys := rapid.SliceOfNDistinct(rapid.IntRange(0, 999), 0, 200, rapid.ID[int]).Draw(rt, "keys")
+		sort.Ints(keys)
+		pairs := make([]types.KVPair, len(keys))
+		for i, k := range keys {
+			pairs[i] = types.KVPair{
+				Key:   []byte(fmt.Sprintf("k%03d", k)),
+				Value: rapid.SliceOfN(rapid.Byte(), 0, 64).Draw(rt, "value"),
+			}
+		}
+		root, err := builder.Build(pairs)
+		if err != nil {
+			rt.Fatalf("Build failed: %v", err)
+		}
+
+		key := []byte(fmt.Sprintf("k%03d", rapid.IntRange(0, 999).Draw(rt, "probe")))
+		proof, err := traverser.Prove(root, key)
+		if err != nil {
+			rt.Fatalf("Prove failed: %v", err)
+		}
+		value, found, err := VerifyProof(root, key, proof)
+		if err != nil {
+			rt.Fatalf("VerifyProof failed: %v", err)
+		}
+		want, err := traverser.Get(root, key)
+		if errors.Is(err, ErrKeyNotFound) {
+			if found {
+				rt.Fatalf("VerifyProof found absent key %q", key)
+			}
+		} else if err != nil {
+			rt.Fatalf("Get failed: %v", err)
+		} else if !found || !bytes.Equal(value, want) {
+			rt.Fatalf("VerifyProof(%q) = %q, %v; want %q", key, value, found, want)
+		}
+
+		start := []byte(fmt.Sprintf("k%03d", rapid.IntRange(0, 999).Draw(rt, "start")))
+		var end []byte
+		if rapid.Bool().Draw(rt, "bounded") {
+			end = []byte(fmt.Sprintf("k%03d", rapid.IntRange(0, 999).Draw(rt, "end")))
+		}
+		rangeProof, err := traverser.ProveRange(root, start, end)
+		if err != nil {
+			rt.Fatalf("ProveRange failed: %v", err)
+		}
+		got, err := VerifyRangeProof(root, start, end, rangeProof)
+		if err != nil {
+			rt.Fatalf("VerifyRangeProof failed: %v", err)
+		}
+		var expected []types.KVPair
+		for _, pair := range pairs {
+			if bytes.Compare(pair.Key, start) >= 0 && (end == nil || bytes.Compare(pair.Key, end) < 0) {
+				expected = append(expected, pair)
+			}
+		}
+		if len(got) != len(expected) {
+			rt.Fatalf("range [%q, %q) returned %d pairs, want %d", start, end, len(got), len(expected))
+		}
+		for i := range got {
+			if !bytes.Equal(got[i].Key, expected[i].Key) || !bytes.Equal(got[i].Value, expected[i].Value) {
+				rt.Fatalf("range pair %d = %q, want %q", i, got[i].Key, expected[i].Key)
+			}
+		}
+	})
+}
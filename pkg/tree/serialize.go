@@ -12,6 +12,17 @@ const (
 	// Node type prefixes
 	nodeTypeLeaf     = 0x01
 	nodeTypeInternal = 0x02
+	// nodeTypeLeafRefs is a leaf with a kind byte per value, used only when
+	// at least one value is a blob reference so inline-only leaves keep
+	// their original encoding and hashes
+	nodeTypeLeafRefs = 0x03
+	// nodeTypeInternalCounted is an internal node that records the number
+	// of keys under each child. Nodes without counts keep the 0x02 format.
+	nodeTypeInternalCounted = 0x05
+
+	// Value kinds in nodeTypeLeafRefs leaves
+	valueKindInline = 0x00
+	valueKindBlob   = 0x01
 )
 
 var (
@@ -27,16 +38,31 @@ func init() {
 
 // SerializeLeafNode serializes a LeafNode to bytes using deterministic binary encoding
 func SerializeLeafNode(node *types.LeafNode) ([]byte, error) {
+	withRefs := false
+	for _, pair := range node.Pairs {
+		if pair.ValueRef {
+			withRefs = true
+			break
+		}
+	}
+
 	// Calculate total size needed
 	size := 1 + 4 // node type + pair count
 	for _, pair := range node.Pairs {
 		size += 4 + len(pair.Key) + 4 + len(pair.Value)
+		if withRefs {
+			size++
+		}
 	}
 
 	buf := make([]byte, 0, size)
 
 	// Write node type
-	buf = append(buf, nodeTypeLeaf)
+	if withRefs {
+		buf = append(buf, nodeTypeLeafRefs)
+	} else {
+		buf = append(buf, nodeTypeLeaf)
+	}
 
 	// Write pair count (big-endian)
 	pairCount := make([]byte, 4)
@@ -53,6 +79,15 @@ func SerializeLeafNode(node *types.LeafNode) ([]byte, error) {
 		// Write key
 		buf = append(buf, pair.Key...)
 
+		// Write value kind
+		if withRefs {
+			if pair.ValueRef {
+				buf = append(buf, valueKindBlob)
+			} else {
+				buf = append(buf, valueKindInline)
+			}
+		}
+
 		// Write value length
 		valueLen := make([]byte, 4)
 		binary.BigEndian.PutUint32(valueLen, uint32(len(pair.Value)))
@@ -65,18 +100,28 @@ func SerializeLeafNode(node *types.LeafNode) ([]byte, error) {
 	return buf, nil
 }
 
-// SerializeInternalNode serializes an InternalNode to bytes using deterministic binary encoding
+// SerializeInternalNode serializes an InternalNode to bytes using deterministic binary encoding.
+// Nodes whose children all carry subtree counts use the counted format.
 func SerializeInternalNode(node *types.InternalNode) ([]byte, error) {
+	counted := hasSubtreeCounts(node)
+
 	// Calculate total size needed
 	size := 1 + 4 // node type + child count
 	for _, child := range node.Children {
 		size += 4 + len(child.Key) + 32 // key length + key + hash (32 bytes)
+		if counted {
+			size += 8
+		}
 	}
 
 	buf := make([]byte, 0, size)
 
 	// Write node type
-	buf = append(buf, nodeTypeInternal)
+	if counted {
+		buf = append(buf, nodeTypeInternalCounted)
+	} else {
+		buf = append(buf, nodeTypeInternal)
+	}
 
 	// Write child count (big-endian)
 	childCount := make([]byte, 4)
@@ -95,11 +140,26 @@ func SerializeInternalNode(node *types.InternalNode) ([]byte, error) {
 
 		// Write hash (32 bytes)
 		buf = append(buf, child.Hash[:]...)
+
+		// Write subtree key count
+		if counted {
+			buf = binary.BigEndian.AppendUint64(buf, child.Count)
+		}
 	}
 
 	return buf, nil
 }
 
+// hasSubtreeCounts reports whether every child of node carries a subtree count
+func hasSubtreeCounts(node *types.InternalNode) bool {
+	for _, child := range node.Children {
+		if child.Count == 0 {
+			return false
+		}
+	}
+	return len(node.Children) > 0
+}
+
 // DeserializeNode deserializes bytes into a Node (either LeafNode or InternalNode)
 func DeserializeNode(data []byte) (types.Node, error) {
 	if len(data) < 1 {
@@ -109,9 +169,9 @@ func DeserializeNode(data []byte) (types.Node, error) {
 	nodeType := data[0]
 
 	switch nodeType {
-	case nodeTypeLeaf:
+	case nodeTypeLeaf, nodeTypeLeafRefs:
 		return DeserializeLeafNode(data)
-	case nodeTypeInternal:
+	case nodeTypeInternal, nodeTypeInternalCounted:
 		return DeserializeInternalNode(data)
 	default:
 		return nil, fmt.Errorf("%w: unknown node type %d", ErrCorruptedData, nodeType)
@@ -127,9 +187,10 @@ func DeserializeLeafNode(data []byte) (*types.LeafNode, error) {
 	pos := 0
 
 	// Read node type
-	if data[pos] != nodeTypeLeaf {
+	if data[pos] != nodeTypeLeaf && data[pos] != nodeTypeLeafRefs {
 		return nil, fmt.Errorf("%w: expected leaf node type", ErrCorruptedData)
 	}
+	withRefs := data[pos] == nodeTypeLeafRefs
 	pos++
 
 	// Read pair count
@@ -157,6 +218,22 @@ func DeserializeLeafNode(data []byte) (*types.LeafNode, error) {
 		copy(key, data[pos:pos+int(keyLen)])
 		pos += int(keyLen)
 
+		// Read value kind
+		valueRef := false
+		if withRefs {
+			if pos+1 > len(data) {
+				return nil, fmt.Errorf("%w: insufficient data for value kind", ErrCorruptedData)
+			}
+			switch data[pos] {
+			case valueKindInline:
+			case valueKindBlob:
+				valueRef = true
+			default:
+				return nil, fmt.Errorf("%w: unknown value kind %d", ErrCorruptedData, data[pos])
+			}
+			pos++
+		}
+
 		// Read value length
 		if pos+4 > len(data) {
 			return nil, fmt.Errorf("%w: insufficient data for value length", ErrCorruptedData)
@@ -172,7 +249,7 @@ func DeserializeLeafNode(data []byte) (*types.LeafNode, error) {
 		copy(value, data[pos:pos+int(valueLen)])
 		pos += int(valueLen)
 
-		pairs = append(pairs, types.KVPair{Key: key, Value: value})
+		pairs = append(pairs, types.KVPair{Key: key, Value: value, ValueRef: valueRef})
 	}
 
 	// Validate that we consumed all bytes (no trailing data)
@@ -192,9 +269,10 @@ func DeserializeInternalNode(data []byte) (*types.InternalNode, error) {
 	pos := 0
 
 	// Read node type
-	if data[pos] != nodeTypeInternal {
+	if data[pos] != nodeTypeInternal && data[pos] != nodeTypeInternalCounted {
 		return nil, fmt.Errorf("%w: expected internal node type", ErrCorruptedData)
 	}
+	counted := data[pos] == nodeTypeInternalCounted
 	pos++
 
 	// Read child count
@@ -230,7 +308,20 @@ func DeserializeInternalNode(data []byte) (*types.InternalNode, error) {
 		copy(hash[:], data[pos:pos+32])
 		pos += 32
 
-		children = append(children, types.ChildRef{Key: key, Hash: hash})
+		// Read subtree key count
+		var count uint64
+		if counted {
+			if pos+8 > len(data) {
+				return nil, fmt.Errorf("%w: insufficient data for subtree count", ErrCorruptedData)
+			}
+			count = binary.BigEndian.Uint64(data[pos : pos+8])
+			if count == 0 {
+				return nil, fmt.Errorf("%w: empty subtree count", ErrCorruptedData)
+			}
+			pos += 8
+		}
+
+		children = append(children, types.ChildRef{Key: key, Hash: hash, Count: count})
 	}
 
 	// Validate that we consumed all bytes (no trailing data)
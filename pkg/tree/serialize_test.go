@@ -16,7 +16,8 @@ func genKVPair() *rapid.Generator[types.KVPair] {
 	return rapid.Custom(func(t *rapid.T) types.KVPair {
 		key := rapid.SliceOfN(rapid.Byte(), 1, 100).Draw(t, "key")
 		value := rapid.SliceOf(rapid.Byte()).Draw(t, "value")
-		return types.KVPair{Key: key, Value: value}
+		valueRef := rapid.IntRange(0, 9).Draw(t, "value_ref") == 0
+		return types.KVPair{Key: key, Value: value, ValueRef: valueRef}
 	})
 }
 
@@ -140,6 +141,9 @@ func TestProperty_NodeSerializationRoundTrip(t *testing.T) {
 				if !bytes.Equal(original.Pairs[i].Value, deserialized.Pairs[i].Value) {
 					t.Fatalf("Round-trip failed: value mismatch at index %d", i)
 				}
+				if original.Pairs[i].ValueRef != deserialized.Pairs[i].ValueRef {
+					t.Fatalf("Round-trip failed: value kind mismatch at index %d", i)
+				}
 			}
 		})
 	})
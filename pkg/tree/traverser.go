@@ -2,6 +2,7 @@ package tree
 
 import (
 	"bytes"
+	"context"
 	"errors"
 
 	"microprolly/pkg/cas"
@@ -15,12 +16,22 @@ var (
 
 // TreeTraverser provides tree navigation operations
 type TreeTraverser struct {
-	cas cas.CAS
+	cas    cas.CAS
+	loader nodeLoader
 }
 
 // NewTreeTraverser creates a new TreeTraverser with the given CAS
 func NewTreeTraverser(cas cas.CAS) *TreeTraverser {
-	return &TreeTraverser{cas: cas}
+	return NewTreeTraverserWithCache(cas, nil)
+}
+
+// NewTreeTraverserWithCache creates a new TreeTraverser that loads nodes
+// through the given cache. A nil cache disables caching.
+func NewTreeTraverserWithCache(cas cas.CAS, cache *NodeCache) *TreeTraverser {
+	return &TreeTraverser{
+		cas:    cas,
+		loader: newNodeLoader(cas, cache),
+	}
 }
 
 // Get retrieves a value by key from a tree rooted at the given hash.
@@ -28,11 +39,45 @@ func NewTreeTraverser(cas cas.CAS) *TreeTraverser {
 // Nodes are loaded from CAS on demand.
 // Requirement 3.5: O(log n) time complexity
 func (t *TreeTraverser) Get(rootHash types.Hash, key []byte) ([]byte, error) {
-	// Load the root node
-	node, err := t.loadNode(rootHash)
+	return t.GetContext(context.Background(), rootHash, key)
+}
+
+// GetContext is Get with cancellation, checked before each node load.
+// Values stored out of line are reassembled from their blobs.
+func (t *TreeTraverser) GetContext(ctx context.Context, rootHash types.Hash, key []byte) ([]byte, error) {
+	pair, err := t.findPair(ctx, rootHash, key)
 	if err != nil {
 		return nil, err
 	}
+	return resolveValue(ctx, t.loader.cas, pair)
+}
+
+// GetReader returns a streaming reader over the value of key. Values stored
+// out of line are read one chunk at a time instead of being reassembled.
+func (t *TreeTraverser) GetReader(rootHash types.Hash, key []byte) (*ValueReader, error) {
+	ctx := context.Background()
+	pair, err := t.findPair(ctx, rootHash, key)
+	if err != nil {
+		return nil, err
+	}
+	if !pair.ValueRef {
+		return NewValueReader(copyBytes(pair.Value)), nil
+	}
+
+	ref, err := DecodeBlobRef(pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	return openBlob(ctx, t.loader.cas, ref)
+}
+
+// findPair returns the stored pair for key. The pair aliases node memory.
+func (t *TreeTraverser) findPair(ctx context.Context, rootHash types.Hash, key []byte) (types.KVPair, error) {
+	// Load the root node
+	node, err := t.loader.loadContext(ctx, rootHash)
+	if err != nil {
+		return types.KVPair{}, err
+	}
 
 	// Traverse down the tree until we reach a leaf
 	for !node.IsLeaf() {
@@ -42,9 +87,9 @@ func (t *TreeTraverser) Get(rootHash types.Hash, key []byte) ([]byte, error) {
 		childHash := t.findChild(internal, key)
 
 		// Load the child node
-		node, err = t.loadNode(childHash)
+		node, err = t.loader.loadContext(ctx, childHash)
 		if err != nil {
-			return nil, err
+			return types.KVPair{}, err
 		}
 	}
 
@@ -53,21 +98,16 @@ func (t *TreeTraverser) Get(rootHash types.Hash, key []byte) ([]byte, error) {
 	return t.searchLeaf(leaf, key)
 }
 
-// loadNode loads a node from CAS by its hash
-func (t *TreeTraverser) loadNode(hash types.Hash) (types.Node, error) {
-	data, err := t.cas.Read(hash)
-	if err != nil {
-		return nil, err
-	}
-	return DeserializeNode(data)
-}
-
 // findChild finds the appropriate child hash for a given key in an internal node.
 // Uses binary search to find the last child whose key is <= the search key.
 // Children are sorted by key, and each child's key represents the minimum key in that subtree.
 func (t *TreeTraverser) findChild(node *types.InternalNode, key []byte) types.Hash {
-	children := node.Children
+	return node.Children[findChildIndex(node.Children, key)].Hash
+}
 
+// findChildIndex returns the index of the last child whose key is <= key,
+// or 0 if every child key is greater
+func findChildIndex(children []types.ChildRef, key []byte) int {
 	// Binary search to find the rightmost child whose key is <= search key
 	// We want the largest index i where children[i].Key <= key
 	lo, hi := 0, len(children)-1
@@ -87,12 +127,12 @@ func (t *TreeTraverser) findChild(node *types.InternalNode, key []byte) types.Ha
 		}
 	}
 
-	return children[result].Hash
+	return result
 }
 
 // searchLeaf searches for a key in a leaf node using binary search.
-// Returns the value if found, or ErrKeyNotFound if not present.
-func (t *TreeTraverser) searchLeaf(leaf *types.LeafNode, key []byte) ([]byte, error) {
+// Returns the pair if found, or ErrKeyNotFound if not present.
+func (t *TreeTraverser) searchLeaf(leaf *types.LeafNode, key []byte) (types.KVPair, error) {
 	pairs := leaf.Pairs
 
 	// Binary search for the key
@@ -103,8 +143,7 @@ func (t *TreeTraverser) searchLeaf(leaf *types.LeafNode, key []byte) ([]byte, er
 		cmp := bytes.Compare(pairs[mid].Key, key)
 
 		if cmp == 0 {
-			// Found the key
-			return pairs[mid].Value, nil
+			return pairs[mid], nil
 		} else if cmp < 0 {
 			lo = mid + 1
 		} else {
@@ -112,22 +151,54 @@ func (t *TreeTraverser) searchLeaf(leaf *types.LeafNode, key []byte) ([]byte, er
 		}
 	}
 
-	return nil, ErrKeyNotFound
+	return types.KVPair{}, ErrKeyNotFound
 }
 
 // GetAll returns all KV pairs in the tree in sorted order.
 // It performs a full tree traversal, visiting all leaf nodes from left to right.
 // Requirement 3.5
 func (t *TreeTraverser) GetAll(rootHash types.Hash) ([]types.KVPair, error) {
+	return t.GetAllContext(context.Background(), rootHash)
+}
+
+// GetAllContext is GetAll with cancellation. The children of each internal
+// node are fetched with a single batched read. Values stored out of line
+// are reassembled from their blobs.
+func (t *TreeTraverser) GetAllContext(ctx context.Context, rootHash types.Hash) ([]types.KVPair, error) {
+	pairs, err := t.GetAllRawContext(ctx, rootHash)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pairs {
+		if pairs[i].ValueRef {
+			value, err := resolveValue(ctx, t.loader.cas, pairs[i])
+			if err != nil {
+				return nil, err
+			}
+			pairs[i] = types.KVPair{Key: pairs[i].Key, Value: value}
+		}
+	}
+	return pairs, nil
+}
+
+// GetAllRaw returns all KV pairs as stored in the tree: values kept out of
+// line are left as blob references with ValueRef set
+func (t *TreeTraverser) GetAllRaw(rootHash types.Hash) ([]types.KVPair, error) {
+	return t.GetAllRawContext(context.Background(), rootHash)
+}
+
+// GetAllRawContext is GetAllRaw with cancellation
+func (t *TreeTraverser) GetAllRawContext(ctx context.Context, rootHash types.Hash) ([]types.KVPair, error) {
 	// Load the root node
-	node, err := t.loadNode(rootHash)
+	node, err := t.loader.loadContext(ctx, rootHash)
 	if err != nil {
 		return nil, err
 	}
 
 	// Collect all pairs via recursive traversal
 	var pairs []types.KVPair
-	err = t.collectPairs(node, &pairs)
+	err = t.collectPairs(ctx, node, &pairs)
 	if err != nil {
 		return nil, err
 	}
@@ -135,27 +206,81 @@ func (t *TreeTraverser) GetAll(rootHash types.Hash) ([]types.KVPair, error) {
 	return pairs, nil
 }
 
+// Scan calls fn for each pair with start <= key < end in key order, with
+// values stored out of line reassembled. A nil end is unbounded. Only the
+// subtrees overlapping the range are loaded, and the pairs are not gathered
+// first, so a scan can stop early by returning an error from fn. The key
+// passed to fn is shared with the node cache and must not be modified.
+func (t *TreeTraverser) Scan(rootHash types.Hash, start, end []byte, fn func(key, value []byte) error) error {
+	return t.scanNode(context.Background(), rootHash, keyRange{start: start, end: end}, fn)
+}
+
+// scanNode is Scan for the subtree at hash
+func (t *TreeTraverser) scanNode(ctx context.Context, hash types.Hash, r keyRange, fn func(key, value []byte) error) error {
+	node, err := t.loader.loadContext(ctx, hash)
+	if err != nil {
+		return err
+	}
+
+	if internal, ok := node.(*types.InternalNode); ok {
+		for i, child := range internal.Children {
+			if r.coversChild(internal.Children, i) {
+				if err := t.scanNode(ctx, child.Hash, r, fn); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, pair := range node.(*types.LeafNode).Pairs {
+		if !r.contains(pair.Key) {
+			continue
+		}
+		value, err := resolveValue(ctx, t.loader.cas, pair)
+		if err != nil {
+			return err
+		}
+		if err := fn(pair.Key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // collectPairs recursively collects all KV pairs from a node and its descendants.
 // For leaf nodes, it appends all pairs directly.
 // For internal nodes, it recursively visits all children in order.
-func (t *TreeTraverser) collectPairs(node types.Node, pairs *[]types.KVPair) error {
+func (t *TreeTraverser) collectPairs(ctx context.Context, node types.Node, pairs *[]types.KVPair) error {
 	if node.IsLeaf() {
 		leaf := node.(*types.LeafNode)
-		*pairs = append(*pairs, leaf.Pairs...)
+		// Copy pairs, since nodes may be shared through the cache
+		for _, pair := range leaf.Pairs {
+			*pairs = append(*pairs, copyKVPair(pair))
+		}
 		return nil
 	}
 
-	// Internal node - visit all children in order
+	// Internal node - load all children in one batch, then visit them in order
 	internal := node.(*types.InternalNode)
-	for _, child := range internal.Children {
-		childNode, err := t.loadNode(child.Hash)
-		if err != nil {
-			return err
-		}
-		if err := t.collectPairs(childNode, pairs); err != nil {
+	children, err := t.loader.loadMany(ctx, childHashes(internal.Children))
+	if err != nil {
+		return err
+	}
+	for _, childNode := range children {
+		if err := t.collectPairs(ctx, childNode, pairs); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// childHashes returns the hashes of a list of child references
+func childHashes(children []types.ChildRef) []types.Hash {
+	hashes := make([]types.Hash, len(children))
+	for i, child := range children {
+		hashes[i] = child.Hash
+	}
+	return hashes
+}
@@ -2,6 +2,7 @@ package tree
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"sort"
 	"testing"
@@ -158,6 +159,39 @@ func TestGetAll_EmptyTree(t *testing.T) {
 	}
 }
 
+// TestZeroHash_ReadsAsEmptyTree tests that the zero hash is read as the
+// empty tree without being stored
+func TestZeroHash_ReadsAsEmptyTree(t *testing.T) {
+	storage := cas.NewMemoryCAS()
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(64, 16, 256))
+	traverser := NewTreeTraverser(storage)
+	differ := NewDiffEngine(storage)
+
+	if pairs, err := traverser.GetAll(types.Hash{}); err != nil || len(pairs) != 0 {
+		t.Errorf("GetAll(zero) = %v, %v; expected no pairs", pairs, err)
+	}
+	if _, err := traverser.Get(types.Hash{}, []byte("k")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(zero) returned %v, expected ErrKeyNotFound", err)
+	}
+
+	pairs := []types.KVPair{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}}
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	result, err := differ.Diff(types.Hash{}, root)
+	if err != nil || len(result.Added) != 2 {
+		t.Errorf("Diff(zero, root) = %+v, %v; expected 2 added", result, err)
+	}
+	empty, err := builder.Build(nil)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if result, err := differ.Diff(types.Hash{}, empty); err != nil || len(result.Added)+len(result.Deleted)+len(result.Modified) != 0 {
+		t.Errorf("Diff(zero, empty) = %+v, %v; expected no changes", result, err)
+	}
+}
+
 // memoryCAS is a simple in-memory CAS for fast property testing
 type memoryCAS struct {
 	data map[types.Hash][]byte
@@ -286,3 +320,50 @@ func TestProperty_GetFindsAllKeys(t *testing.T) {
 		}
 	})
 }
+
+// TestScan_RangeAndEarlyStop tests that Scan visits exactly the keys in
+// [start, end) in order, resolves blob values, and stops on an error from fn
+func TestScan_RangeAndEarlyStop(t *testing.T) {
+	storage := &recordingCAS{memoryCAS: newMemoryCAS(), read: make(map[types.Hash]bool)}
+	builder := NewTreeBuilder(storage, chunker.NewBuzhashChunker(128, 32, 512))
+	traverser := NewTreeTraverser(storage)
+
+	pairs := editPairs("k", 2000)
+	big := bytes.Repeat([]byte("scan"), 4096)
+	pairs[1500].Value = big
+	root, err := builder.Build(pairs)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	storage.read = make(map[types.Hash]bool)
+	var got []types.KVPair
+	err = traverser.Scan(root, []byte("k1490"), []byte("k1510"), func(key, value []byte) error {
+		got = append(got, types.KVPair{Key: copyBytes(key), Value: value})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(got) != 20 || string(got[0].Key) != "k1490" || string(got[19].Key) != "k1509" {
+		t.Fatalf("expected k1490..k1509, got %d keys", len(got))
+	}
+	if !bytes.Equal(got[10].Value, big) {
+		t.Error("expected the value stored out of line to be reassembled")
+	}
+	if len(storage.read) > 20 {
+		t.Errorf("a 20-key scan read %d objects", len(storage.read))
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = traverser.Scan(root, nil, nil, func(key, value []byte) error {
+		if n++; n == 5 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 5 {
+		t.Errorf("expected the scan to stop after 5 keys with the error from fn, got %d keys, %v", n, err)
+	}
+}
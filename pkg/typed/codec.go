@@ -0,0 +1,278 @@
+package typed
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidKeyEncoding is returned when stored key bytes cannot be decoded
+// by a Map's key codec
+var ErrInvalidKeyEncoding = errors.New("invalid key encoding")
+
+// KeyCodec encodes keys of type K so that the byte order of the encodings
+// matches the natural order of K. Encodings are self-delimiting, so key
+// codecs compose into tuples without changing the order.
+type KeyCodec[K any] interface {
+	// AppendKey appends the encoding of k to dst
+	AppendKey(dst []byte, k K) []byte
+	// DecodeKey decodes the key at the start of b and returns the number
+	// of bytes it used
+	DecodeKey(b []byte) (K, int, error)
+}
+
+// Uint64Key encodes uint64 keys as 8 big-endian bytes
+func Uint64Key() KeyCodec[uint64] {
+	return uint64Key{}
+}
+
+type uint64Key struct{}
+
+func (uint64Key) AppendKey(dst []byte, k uint64) []byte {
+	return binary.BigEndian.AppendUint64(dst, k)
+}
+
+func (uint64Key) DecodeKey(b []byte) (uint64, int, error) {
+	if len(b) < 8 {
+		return 0, 0, fmt.Errorf("%w: uint64 needs 8 bytes, got %d", ErrInvalidKeyEncoding, len(b))
+	}
+	return binary.BigEndian.Uint64(b), 8, nil
+}
+
+// Uint32Key encodes uint32 keys as 4 big-endian bytes
+func Uint32Key() KeyCodec[uint32] {
+	return uint32Key{}
+}
+
+type uint32Key struct{}
+
+func (uint32Key) AppendKey(dst []byte, k uint32) []byte {
+	return binary.BigEndian.AppendUint32(dst, k)
+}
+
+func (uint32Key) DecodeKey(b []byte) (uint32, int, error) {
+	if len(b) < 4 {
+		return 0, 0, fmt.Errorf("%w: uint32 needs 4 bytes, got %d", ErrInvalidKeyEncoding, len(b))
+	}
+	return binary.BigEndian.Uint32(b), 4, nil
+}
+
+// Int64Key encodes int64 keys as 8 big-endian bytes with the sign bit
+// flipped, so negative keys sort before positive ones
+func Int64Key() KeyCodec[int64] {
+	return int64Key{}
+}
+
+type int64Key struct{}
+
+func (int64Key) AppendKey(dst []byte, k int64) []byte {
+	return binary.BigEndian.AppendUint64(dst, uint64(k)^(1<<63))
+}
+
+func (int64Key) DecodeKey(b []byte) (int64, int, error) {
+	if len(b) < 8 {
+		return 0, 0, fmt.Errorf("%w: int64 needs 8 bytes, got %d", ErrInvalidKeyEncoding, len(b))
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63)), 8, nil
+}
+
+// Int32Key encodes int32 keys as 4 big-endian bytes with the sign bit
+// flipped
+func Int32Key() KeyCodec[int32] {
+	return int32Key{}
+}
+
+type int32Key struct{}
+
+func (int32Key) AppendKey(dst []byte, k int32) []byte {
+	return binary.BigEndian.AppendUint32(dst, uint32(k)^(1<<31))
+}
+
+func (int32Key) DecodeKey(b []byte) (int32, int, error) {
+	if len(b) < 4 {
+		return 0, 0, fmt.Errorf("%w: int32 needs 4 bytes, got %d", ErrInvalidKeyEncoding, len(b))
+	}
+	return int32(binary.BigEndian.Uint32(b) ^ (1 << 31)), 4, nil
+}
+
+// StringKey encodes string keys in byte order. Zero bytes are escaped as
+// 0x00 0xff and the key ends with 0x00 0x01, so a string sorts before every
+// longer string it is a prefix of, also inside a tuple.
+func StringKey() KeyCodec[string] {
+	return stringKey{}
+}
+
+type stringKey struct{}
+
+func (stringKey) AppendKey(dst []byte, k string) []byte {
+	return appendEscaped(dst, []byte(k))
+}
+
+func (stringKey) DecodeKey(b []byte) (string, int, error) {
+	raw, n, err := decodeEscaped(b)
+	return string(raw), n, err
+}
+
+// BytesKey encodes byte slice keys in byte order, escaped as StringKey does
+func BytesKey() KeyCodec[[]byte] {
+	return bytesKey{}
+}
+
+type bytesKey struct{}
+
+func (bytesKey) AppendKey(dst []byte, k []byte) []byte {
+	return appendEscaped(dst, k)
+}
+
+func (bytesKey) DecodeKey(b []byte) ([]byte, int, error) {
+	return decodeEscaped(b)
+}
+
+// appendEscaped appends b with zero bytes escaped, then the terminator
+func appendEscaped(dst, b []byte) []byte {
+	for _, c := range b {
+		dst = append(dst, c)
+		if c == 0x00 {
+			dst = append(dst, 0xff)
+		}
+	}
+	return append(dst, 0x00, 0x01)
+}
+
+// decodeEscaped decodes an escaped byte string from the start of b
+func decodeEscaped(b []byte) ([]byte, int, error) {
+	raw := []byte{}
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0x00 {
+			raw = append(raw, b[i])
+			continue
+		}
+		if i+1 == len(b) {
+			break // a 0x00 must be followed by its escape or terminator byte
+		}
+		switch b[i+1] {
+		case 0xff:
+			raw = append(raw, 0x00)
+			i++
+		case 0x01:
+			return raw, i + 2, nil
+		default:
+			return nil, 0, fmt.Errorf("%w: bad escape 0x00 %#x", ErrInvalidKeyEncoding, b[i+1])
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: unterminated string", ErrInvalidKeyEncoding)
+}
+
+// TimeKey encodes time keys as Unix seconds, encoded as Int64Key, followed
+// by 4 big-endian bytes of nanoseconds. Keys decode in UTC; the location
+// and monotonic clock reading are not kept.
+func TimeKey() KeyCodec[time.Time] {
+	return timeKey{}
+}
+
+type timeKey struct{}
+
+func (timeKey) AppendKey(dst []byte, k time.Time) []byte {
+	dst = int64Key{}.AppendKey(dst, k.Unix())
+	return binary.BigEndian.AppendUint32(dst, uint32(k.Nanosecond()))
+}
+
+func (timeKey) DecodeKey(b []byte) (time.Time, int, error) {
+	if len(b) < 12 {
+		return time.Time{}, 0, fmt.Errorf("%w: time needs 12 bytes, got %d", ErrInvalidKeyEncoding, len(b))
+	}
+	sec, _, _ := int64Key{}.DecodeKey(b)
+	nsec := binary.BigEndian.Uint32(b[8:])
+	if nsec >= uint32(time.Second) {
+		return time.Time{}, 0, fmt.Errorf("%w: %d nanoseconds", ErrInvalidKeyEncoding, nsec)
+	}
+	return time.Unix(sec, int64(nsec)).UTC(), 12, nil
+}
+
+// Tuple2 is a key of two parts, ordered by First and then by Second
+type Tuple2[T1, T2 any] struct {
+	First  T1
+	Second T2
+}
+
+// Tuple2Key encodes Tuple2 keys as the encodings of their parts in order
+func Tuple2Key[T1, T2 any](first KeyCodec[T1], second KeyCodec[T2]) KeyCodec[Tuple2[T1, T2]] {
+	return tuple2Key[T1, T2]{first, second}
+}
+
+type tuple2Key[T1, T2 any] struct {
+	first  KeyCodec[T1]
+	second KeyCodec[T2]
+}
+
+func (c tuple2Key[T1, T2]) AppendKey(dst []byte, k Tuple2[T1, T2]) []byte {
+	return c.second.AppendKey(c.first.AppendKey(dst, k.First), k.Second)
+}
+
+func (c tuple2Key[T1, T2]) DecodeKey(b []byte) (Tuple2[T1, T2], int, error) {
+	var k Tuple2[T1, T2]
+	first, n1, err := c.first.DecodeKey(b)
+	if err != nil {
+		return k, 0, err
+	}
+	second, n2, err := c.second.DecodeKey(b[n1:])
+	if err != nil {
+		return k, 0, err
+	}
+	return Tuple2[T1, T2]{first, second}, n1 + n2, nil
+}
+
+// Tuple3 is a key of three parts, ordered by First, Second and then Third
+type Tuple3[T1, T2, T3 any] struct {
+	First  T1
+	Second T2
+	Third  T3
+}
+
+// Tuple3Key encodes Tuple3 keys as the encodings of their parts in order
+func Tuple3Key[T1, T2, T3 any](first KeyCodec[T1], second KeyCodec[T2], third KeyCodec[T3]) KeyCodec[Tuple3[T1, T2, T3]] {
+	return tuple3Key[T1, T2, T3]{first, second, third}
+}
+
+type tuple3Key[T1, T2, T3 any] struct {
+	first  KeyCodec[T1]
+	second KeyCodec[T2]
+	third  KeyCodec[T3]
+}
+
+func (c tuple3Key[T1, T2, T3]) AppendKey(dst []byte, k Tuple3[T1, T2, T3]) []byte {
+	dst = c.first.AppendKey(dst, k.First)
+	dst = c.second.AppendKey(dst, k.Second)
+	return c.third.AppendKey(dst, k.Third)
+}
+
+func (c tuple3Key[T1, T2, T3]) DecodeKey(b []byte) (Tuple3[T1, T2, T3], int, error) {
+	var k Tuple3[T1, T2, T3]
+	first, n1, err := c.first.DecodeKey(b)
+	if err != nil {
+		return k, 0, err
+	}
+	second, n2, err := c.second.DecodeKey(b[n1:])
+	if err != nil {
+		return k, 0, err
+	}
+	third, n3, err := c.third.DecodeKey(b[n1+n2:])
+	if err != nil {
+		return k, 0, err
+	}
+	return Tuple3[T1, T2, T3]{first, second, third}, n1 + n2 + n3, nil
+}
+
+// decodeKey decodes a whole encoded key, rejecting trailing bytes
+func decodeKey[K any](codec KeyCodec[K], b []byte) (K, error) {
+	k, n, err := codec.DecodeKey(b)
+	if err != nil {
+		return k, err
+	}
+	if n != len(b) {
+		var zero K
+		return zero, fmt.Errorf("%w: %d trailing bytes", ErrInvalidKeyEncoding, len(b)-n)
+	}
+	return k, nil
+}
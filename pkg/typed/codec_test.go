@@ -0,0 +1,97 @@
+package typed
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"testing"
+	"time"
+
+	"pgregory.net/rapid"
+)
+
+// checkKeyCodec checks that a codec round-trips keys and that the byte
+// order of two encodings matches compare
+func checkKeyCodec[K any](t *testing.T, codec KeyCodec[K], gen *rapid.Generator[K], compare func(a, b K) int) {
+	t.Helper()
+	rapid.Check(t, func(rt *rapid.T) {
+		a, b := gen.Draw(rt, "a"), gen.Draw(rt, "b")
+		encA, encB := codec.AppendKey(nil, a), codec.AppendKey(nil, b)
+
+		decoded, err := decodeKey(codec, encA)
+		if err != nil {
+			rt.Fatalf("decodeKey failed: %v", err)
+		}
+		if compare(decoded, a) != 0 {
+			rt.Fatalf("round trip of %v returned %v", a, decoded)
+		}
+		if got, want := bytes.Compare(encA, encB), compare(a, b); got != want {
+			rt.Fatalf("encodings of %v and %v compare %d, keys compare %d", a, b, got, want)
+		}
+	})
+}
+
+// genString draws strings rich in zero bytes and shared prefixes
+func genString() *rapid.Generator[string] {
+	return rapid.StringOfN(rapid.SampledFrom([]rune{0, 1, 'a', 'b', 0xff}), 0, 6, -1)
+}
+
+// TestProperty_KeyCodecsPreserveOrder checks every key codec
+func TestProperty_KeyCodecsPreserveOrder(t *testing.T) {
+	t.Run("uint64", func(t *testing.T) {
+		checkKeyCodec(t, Uint64Key(), rapid.Uint64(), cmp.Compare[uint64])
+	})
+	t.Run("uint32", func(t *testing.T) {
+		checkKeyCodec(t, Uint32Key(), rapid.Uint32(), cmp.Compare[uint32])
+	})
+	t.Run("int64", func(t *testing.T) {
+		checkKeyCodec(t, Int64Key(), rapid.Int64(), cmp.Compare[int64])
+	})
+	t.Run("int32", func(t *testing.T) {
+		checkKeyCodec(t, Int32Key(), rapid.Int32(), cmp.Compare[int32])
+	})
+	t.Run("string", func(t *testing.T) {
+		checkKeyCodec(t, StringKey(), genString(), cmp.Compare[string])
+	})
+	t.Run("bytes", func(t *testing.T) {
+		checkKeyCodec(t, BytesKey(), rapid.SliceOfN(rapid.SampledFrom([]byte{0, 1, 0xff}), 0, 6), bytes.Compare)
+	})
+	t.Run("time", func(t *testing.T) {
+		gen := rapid.Custom(func(rt *rapid.T) time.Time {
+			return time.Unix(rapid.Int64Range(-1<<40, 1<<40).Draw(rt, "sec"), rapid.Int64Range(0, 999999999).Draw(rt, "nsec")).UTC()
+		})
+		checkKeyCodec(t, TimeKey(), gen, func(a, b time.Time) int { return a.Compare(b) })
+	})
+	t.Run("tuple", func(t *testing.T) {
+		gen := rapid.Custom(func(rt *rapid.T) Tuple3[string, int64, string] {
+			return Tuple3[string, int64, string]{
+				genString().Draw(rt, "first"),
+				rapid.Int64Range(-2, 2).Draw(rt, "second"),
+				genString().Draw(rt, "third"),
+			}
+		})
+		compare := func(a, b Tuple3[string, int64, string]) int {
+			return cmp.Or(cmp.Compare(a.First, b.First), cmp.Compare(a.Second, b.Second), cmp.Compare(a.Third, b.Third))
+		}
+		checkKeyCodec(t, Tuple3Key(StringKey(), Int64Key(), StringKey()), gen, compare)
+	})
+}
+
+// TestKeyCodecs_RejectInvalidEncodings tests truncated, badly escaped and
+// over-long encodings
+func TestKeyCodecs_RejectInvalidEncodings(t *testing.T) {
+	errs := make(map[string]error)
+	_, errs["truncated uint64"] = decodeKey(Uint64Key(), []byte{1, 2, 3})
+	_, errs["unterminated string"] = decodeKey(StringKey(), []byte("abc"))
+	_, errs["string ending in 0x00"] = decodeKey(StringKey(), []byte{'a', 0x00})
+	_, errs["bad escape"] = decodeKey(StringKey(), []byte{'a', 0x00, 0x02})
+	_, errs["trailing bytes"] = decodeKey(Int32Key(), []byte{0, 0, 0, 0, 0})
+	_, errs["nanoseconds out of range"] = decodeKey(TimeKey(), append(Int64Key().AppendKey(nil, 0), 0xff, 0xff, 0xff, 0xff))
+	_, errs["missing tuple part"] = decodeKey(Tuple2Key(StringKey(), Uint32Key()), StringKey().AppendKey(nil, "a"))
+
+	for name, err := range errs {
+		if !errors.Is(err, ErrInvalidKeyEncoding) {
+			t.Errorf("%s: got %v, expected ErrInvalidKeyEncoding", name, err)
+		}
+	}
+}
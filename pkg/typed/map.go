@@ -0,0 +1,139 @@
+// Package typed provides typed views of a store's keys, with keys and
+// values encoded by pluggable codecs.
+package typed
+
+import (
+	"bytes"
+	"fmt"
+
+	"microprolly/pkg/store"
+	"microprolly/pkg/tree"
+	"microprolly/pkg/types"
+)
+
+// Map is a typed view of the keys of a Store under a prefix. Each key is
+// the prefix followed by the key codec's encoding, so Scan returns keys in
+// the natural order of K. Reads and writes go through the store's working
+// state and are committed with it.
+type Map[K, V any] struct {
+	store  *store.Store
+	prefix []byte
+	keys   KeyCodec[K]
+	values ValueCodec[V]
+}
+
+// NewMap returns a Map over the keys of s under prefix. Maps of different
+// types must use prefixes neither of which is a prefix of the other.
+func NewMap[K, V any](s *store.Store, prefix []byte, keys KeyCodec[K], values ValueCodec[V]) *Map[K, V] {
+	return &Map[K, V]{
+		store:  s,
+		prefix: append([]byte{}, prefix...),
+		keys:   keys,
+		values: values,
+	}
+}
+
+// Change is one difference between two versions of a Map. Old is the zero
+// value for added keys and New for deleted keys.
+type Change[K, V any] struct {
+	Kind tree.DiffKind
+	Key  K
+	Old  V
+	New  V
+}
+
+// Put stores a value under k
+func (m *Map[K, V]) Put(k K, v V) error {
+	value, err := m.values.Encode(v)
+	if err != nil {
+		return err
+	}
+	return m.store.Put(m.storeKey(k), value)
+}
+
+// Get returns the value under k, or store.ErrKeyNotFound
+func (m *Map[K, V]) Get(k K) (V, error) {
+	data, err := m.store.Get(m.storeKey(k))
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return m.values.Decode(data)
+}
+
+// Delete removes k, returning store.ErrKeyNotFound if it is missing
+func (m *Map[K, V]) Delete(k K) error {
+	return m.store.Delete(m.storeKey(k))
+}
+
+// Clear removes every key of the map
+func (m *Map[K, V]) Clear() error {
+	return m.store.DeletePrefix(m.prefix)
+}
+
+// Scan calls fn for each entry in key order, stopping at the first error
+// fn returns
+func (m *Map[K, V]) Scan(fn func(k K, v V) error) error {
+	return m.store.ScanPrefix(m.prefix, m.decodeEach(fn))
+}
+
+// ScanRange calls fn for each entry with start <= key < end in key order
+func (m *Map[K, V]) ScanRange(start, end K, fn func(k K, v V) error) error {
+	return m.store.Scan(m.storeKey(start), m.storeKey(end), m.decodeEach(fn))
+}
+
+// Diff returns the changes to the map between two commits in key order,
+// with old and new values decoded. Only the subtrees holding the map's
+// keys are compared.
+func (m *Map[K, V]) Diff(hashA, hashB types.Hash) ([]Change[K, V], error) {
+	var changes []Change[K, V]
+	err := m.store.DiffStream(hashA, hashB, tree.DiffOptions{Prefix: m.prefix}, func(entry tree.DiffEntry) error {
+		change := Change[K, V]{Kind: entry.Kind}
+		var err error
+		if change.Key, err = m.decodeStoreKey(entry.Key); err != nil {
+			return err
+		}
+		if entry.Kind != tree.DiffAdded {
+			if change.Old, err = m.values.Decode(entry.OldValue); err != nil {
+				return fmt.Errorf("key %x: %w", entry.Key, err)
+			}
+		}
+		if entry.Kind != tree.DiffDeleted {
+			if change.New, err = m.values.Decode(entry.NewValue); err != nil {
+				return fmt.Errorf("key %x: %w", entry.Key, err)
+			}
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	return changes, err
+}
+
+// storeKey returns the store key of k
+func (m *Map[K, V]) storeKey(k K) []byte {
+	return m.keys.AppendKey(append([]byte{}, m.prefix...), k)
+}
+
+// decodeStoreKey decodes the key of a store key under the prefix
+func (m *Map[K, V]) decodeStoreKey(key []byte) (K, error) {
+	if !bytes.HasPrefix(key, m.prefix) {
+		var zero K
+		return zero, fmt.Errorf("%w: key %x is outside the map", ErrInvalidKeyEncoding, key)
+	}
+	return decodeKey(m.keys, key[len(m.prefix):])
+}
+
+// decodeEach adapts fn to the raw pairs of a store scan
+func (m *Map[K, V]) decodeEach(fn func(k K, v V) error) func(key, value []byte) error {
+	return func(key, value []byte) error {
+		k, err := m.decodeStoreKey(key)
+		if err != nil {
+			return err
+		}
+		v, err := m.values.Decode(value)
+		if err != nil {
+			return fmt.Errorf("key %x: %w", key, err)
+		}
+		return fn(k, v)
+	}
+}
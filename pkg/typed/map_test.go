@@ -0,0 +1,216 @@
+package typed
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"microprolly/pkg/store"
+	"microprolly/pkg/tree"
+
+	"pgregory.net/rapid"
+)
+
+// variant is a sample value type
+type variant struct {
+	Ref   string
+	Alt   string
+	Depth int
+}
+
+// TestMap_PutGetDelete tests the basic operations with each value codec,
+// and that maps under different prefixes do not see each other's keys
+func TestMap_PutGetDelete(t *testing.T) {
+	s := store.NewInMemory()
+	defer s.Close()
+
+	byJSON := NewMap(s, []byte("json:"), StringKey(), JSON[variant]())
+	byGob := NewMap(s, []byte("gob:"), StringKey(), Gob[variant]())
+	raw := NewMap(s, []byte("raw:"), StringKey(), Raw())
+
+	v := variant{Ref: "A", Alt: "G", Depth: 31}
+	for _, m := range []*Map[string, variant]{byJSON, byGob} {
+		if err := m.Put("rs123", v); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		got, err := m.Get("rs123")
+		if err != nil || got != v {
+			t.Errorf("Get(rs123) = %+v, %v; expected %+v", got, err, v)
+		}
+	}
+	if err := raw.Put("rs123", []byte{0, 1, 2}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got, err := raw.Get("rs123"); err != nil || string(got) != "\x00\x01\x02" {
+		t.Errorf("raw Get(rs123) = %v, %v", got, err)
+	}
+
+	if err := byJSON.Delete("rs123"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := byJSON.Get("rs123"); !errors.Is(err, store.ErrKeyNotFound) {
+		t.Errorf("Get after Delete returned %v, expected ErrKeyNotFound", err)
+	}
+	if _, err := byGob.Get("rs123"); err != nil {
+		t.Errorf("Delete in one map removed a key of another: %v", err)
+	}
+}
+
+// TestMap_ScanOrder tests that Scan and ScanRange follow the order of the
+// keys, not of their text, including negative numbers and tuples
+func TestMap_ScanOrder(t *testing.T) {
+	s := store.NewInMemory()
+	defer s.Close()
+
+	ints := NewMap(s, []byte("i:"), Int64Key(), JSON[int64]())
+	for _, k := range []int64{10, -3, 2, -100, 0, 1 << 40} {
+		if err := ints.Put(k, k*2); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	var got []int64
+	err := ints.Scan(func(k, v int64) error {
+		if v != k*2 {
+			t.Errorf("value of %d is %d", k, v)
+		}
+		got = append(got, k)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if fmt.Sprint(got) != "[-100 -3 0 2 10 1099511627776]" {
+		t.Errorf("Scan order = %v", got)
+	}
+
+	type pos = Tuple2[string, uint32]
+	positions := NewMap(s, []byte("p:"), Tuple2Key(StringKey(), Uint32Key()), Raw())
+	for _, k := range []pos{{"chr10", 5}, {"chr1", 200}, {"chr1", 30}, {"chr2", 1}} {
+		if err := positions.Put(k, nil); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	var keys []pos
+	err = positions.ScanRange(pos{"chr1", 0}, pos{"chr2", 0}, func(k pos, _ []byte) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanRange failed: %v", err)
+	}
+	if fmt.Sprint(keys) != "[{chr1 30} {chr1 200} {chr10 5}]" {
+		t.Errorf("ScanRange = %v", keys)
+	}
+}
+
+// TestMap_Diff tests that Diff decodes keys and both values, and ignores
+// keys outside the map
+func TestMap_Diff(t *testing.T) {
+	s := store.NewInMemory()
+	defer s.Close()
+	events := NewMap(s, []byte("events:"), TimeKey(), JSON[string]())
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 500; i++ {
+		if err := events.Put(t0.Add(time.Duration(i)*time.Second), fmt.Sprintf("event %d", i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	base, err := s.Commit("events")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	if err := events.Put(t0.Add(10*time.Second), "edited"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := events.Delete(t0); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := events.Put(t0.Add(-time.Hour), "earlier"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Put([]byte("other"), []byte("not an event")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	head, err := s.Commit("edits")
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	changes, err := events.Diff(base, head)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %d", len(changes))
+	}
+	added, deleted, modified := changes[0], changes[1], changes[2]
+	if added.Kind != tree.DiffAdded || !added.Key.Equal(t0.Add(-time.Hour)) || added.New != "earlier" || added.Old != "" {
+		t.Errorf("unexpected first change %+v", added)
+	}
+	if deleted.Kind != tree.DiffDeleted || !deleted.Key.Equal(t0) || deleted.Old != "event 0" || deleted.New != "" {
+		t.Errorf("unexpected second change %+v", deleted)
+	}
+	if modified.Kind != tree.DiffModified || modified.Old != "event 10" || modified.New != "edited" {
+		t.Errorf("unexpected third change %+v", modified)
+	}
+}
+
+// TestProperty_MapMatchesModel checks a map against a Go map after random
+// puts, deletes and clears
+func TestProperty_MapMatchesModel(t *testing.T) {
+	rapid.Check(t, func(rt *rapid.T) {
+		s := store.NewInMemory()
+		defer s.Close()
+		m := NewMap(s, []byte("m"), Int32Key(), Gob[string]())
+		other := NewMap(s, []byte("n"), Int32Key(), Gob[string]())
+		model := make(map[int32]string)
+
+		ops := rapid.IntRange(0, 100).Draw(rt, "ops")
+		for i := 0; i < ops; i++ {
+			k := rapid.Int32Range(-20, 20).Draw(rt, "key")
+			switch rapid.IntRange(0, 9).Draw(rt, "op") {
+			case 0:
+				if err := m.Clear(); err != nil {
+					rt.Fatalf("Clear failed: %v", err)
+				}
+				clear(model)
+			case 1, 2, 3:
+				err := m.Delete(k)
+				if _, ok := model[k]; ok != (err == nil) {
+					rt.Fatalf("Delete(%d) returned %v", k, err)
+				}
+				delete(model, k)
+			default:
+				v := rapid.String().Draw(rt, "value")
+				if err := m.Put(k, v); err != nil {
+					rt.Fatalf("Put failed: %v", err)
+				}
+				if err := other.Put(k, v); err != nil {
+					rt.Fatalf("Put failed: %v", err)
+				}
+				model[k] = v
+			}
+		}
+
+		last, n := int32(-1<<31), 0
+		err := m.Scan(func(k int32, v string) error {
+			if n > 0 && k <= last {
+				rt.Fatalf("Scan returned %d after %d", k, last)
+			}
+			if model[k] != v {
+				rt.Fatalf("Scan returned %q for %d, expected %q", v, k, model[k])
+			}
+			last, n = k, n+1
+			return nil
+		})
+		if err != nil {
+			rt.Fatalf("Scan failed: %v", err)
+		}
+		if n != len(model) {
+			rt.Fatalf("Scan returned %d keys, expected %d", n, len(model))
+		}
+	})
+}
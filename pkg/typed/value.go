@@ -0,0 +1,67 @@
+package typed
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// ValueCodec encodes values of type V
+type ValueCodec[V any] interface {
+	Encode(v V) ([]byte, error)
+	Decode(data []byte) (V, error)
+}
+
+// JSON encodes values with encoding/json
+func JSON[V any]() ValueCodec[V] {
+	return jsonValue[V]{}
+}
+
+type jsonValue[V any] struct{}
+
+func (jsonValue[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonValue[V]) Decode(data []byte) (V, error) {
+	var v V
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// Gob encodes values with encoding/gob. Each value carries its own type
+// description, so values can be decoded one at a time.
+func Gob[V any]() ValueCodec[V] {
+	return gobValue[V]{}
+}
+
+type gobValue[V any] struct{}
+
+func (gobValue[V]) Encode(v V) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobValue[V]) Decode(data []byte) (V, error) {
+	var v V
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// Raw stores byte slice values as they are
+func Raw() ValueCodec[[]byte] {
+	return rawValue{}
+}
+
+type rawValue struct{}
+
+func (rawValue) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (rawValue) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
@@ -3,6 +3,7 @@ package types
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"time"
 )
 
 // SerializerFunc is a function type for serializing nodes
@@ -29,6 +30,10 @@ func HashFromBytes(data []byte) Hash {
 type KVPair struct {
 	Key   []byte
 	Value []byte
+	// ValueRef marks Value as an encoded reference to an out-of-line value
+	// blob instead of the value itself. Such pairs only appear inside trees;
+	// the traverser resolves them before returning values.
+	ValueRef bool
 }
 
 // Node represents a node in the Prolly Tree
@@ -103,12 +108,68 @@ func (n *InternalNode) Serialize() ([]byte, error) {
 type ChildRef struct {
 	Key  []byte
 	Hash Hash
+	// Count is the number of keys in the child's subtree, or zero in nodes
+	// written before subtree counts were recorded
+	Count uint64
+}
+
+// Signature identifies who made a change and when
+type Signature struct {
+	Name  string
+	Email string
+	// When has nanosecond precision and keeps its zone offset
+	When time.Time
+}
+
+// IsZero reports whether the signature is empty
+func (s Signature) IsZero() bool {
+	return s.Name == "" && s.Email == "" && s.When.IsZero()
 }
 
 // Commit represents a snapshot of the database
 type Commit struct {
-	RootHash  Hash   `json:"root_hash"`
-	Message   string `json:"message"`
-	Parent    Hash   `json:"parent"`
-	Timestamp int64  `json:"timestamp"`
+	RootHash Hash   `json:"root_hash"`
+	Message  string `json:"message"`
+	Parent   Hash   `json:"parent"`
+	// Timestamp is the commit time in Unix seconds
+	Timestamp int64 `json:"timestamp"`
+	// Author made the change and Committer recorded it. Both are zero in
+	// commits written before they were recorded.
+	Author    Signature         `json:"author"`
+	Committer Signature         `json:"committer"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	// Tables is the root of the table map, a tree from table name to the
+	// root of that table's tree. It is zero when the commit has no tables.
+	Tables Hash `json:"tables,omitempty"`
+	// Sig is set on signed commits
+	Sig *CommitSignature `json:"sig,omitempty"`
+}
+
+// CommitSignature is an ed25519 signature over the canonical encoding of a
+// commit without its Sig
+type CommitSignature struct {
+	// KeyID identifies the public key that verifies Value
+	KeyID string
+	Value []byte
+}
+
+// Tag names a commit. It is stored as an object of its own, which the tag
+// reference points to, so it records who tagged the commit and why.
+type Tag struct {
+	Name    string    `json:"name"`
+	Commit  Hash      `json:"commit"`
+	Message string    `json:"message"`
+	Tagger  Signature `json:"tagger"`
+	// Sig is set on signed tags. It covers the tag's encoding without Sig,
+	// like a commit signature.
+	Sig *CommitSignature `json:"sig,omitempty"`
+}
+
+// Time returns the commit time: the committer time, which has nanosecond
+// precision, or Timestamp for commits that predate it
+func (c *Commit) Time() time.Time {
+	if !c.Committer.When.IsZero() {
+		return c.Committer.When
+	}
+	return time.Unix(c.Timestamp, 0)
 }